@@ -0,0 +1,303 @@
+package gitbot
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cosminilie/gitbot/audit"
+	"github.com/cosminilie/gitbot/logging"
+	"github.com/cosminilie/gitbot/plugins"
+	"github.com/go-kit/kit/log"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+const dropRightsPlugin = "drop_rights"
+
+//AccessEntry is the access level of a member of a configured group or project
+type AccessEntry struct {
+	Instance string `json:"instance"`
+	//Kind is "group" for the members of a group and "project" for the members added to a project directly
+	Kind        string `json:"kind"`
+	Group       string `json:"group"`
+	Project     string `json:"project,omitempty"`
+	Member      string `json:"member"`
+	AccessLevel string `json:"access_level"`
+	//Downgraded is the last time drop_rights lowered the member, from DowngradedFrom
+	Downgraded     *time.Time `json:"downgraded,omitempty"`
+	DowngradedFrom string     `json:"downgraded_from,omitempty"`
+	//GrantedUntil is set while the member is elevated by an access grant
+	GrantedUntil *time.Time `json:"granted_until,omitempty"`
+	//Violation explains why the access level breaks the drop_rights policy of the group right now
+	Violation string `json:"violation,omitempty"`
+}
+
+//AccessReport lists who has which access to the configured groups and projects
+type AccessReport struct {
+	Generated time.Time     `json:"generated"`
+	Entries   []AccessEntry `json:"entries"`
+	//Errors are the groups and projects whose members could not be listed
+	Errors []string `json:"errors,omitempty"`
+}
+
+//AccessSource is a GitLab instance to report on
+type AccessSource struct {
+	Instance Instance
+	Client   plugins.GitLabClient
+	//Grants are the access grants of the running bot, or the ones it saved next to the audit log for the report
+	//command. The members elevated by a grant are not reported as violations. It may be nil.
+	Grants *plugins.Grants
+}
+
+//AccessReporter builds access reports from the membership APIs of the instances and the downgrades recorded in the
+//audit trail
+type AccessReporter struct {
+	Logger  log.Logger
+	Sources []AccessSource
+	//AuditFile is the audit log the downgrades are read from. The report has no downgrades when it is empty.
+	AuditFile string
+}
+
+//Report reports on the instance, or on every instance when instance is empty. The configured repos are expanded
+//like the bot does, so the groups and projects are the ones the plugins run on.
+func (ar *AccessReporter) Report(instance string) (AccessReport, error) {
+	rep := AccessReport{Generated: time.Now().UTC(), Entries: []AccessEntry{}}
+	downgrades, err := readDowngrades(ar.AuditFile)
+	if err != nil {
+		return rep, err
+	}
+	for _, src := range ar.Sources {
+		if instance != "" && src.Instance.Name != instance {
+			continue
+		}
+		reportInstance(ar.Logger, src, downgrades, &rep)
+	}
+	return rep, nil
+}
+
+//ServeHTTP serves the report as JSON, or as CSV with ?format=csv. ?instance= restricts it to one instance.
+func (ar *AccessReporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "405 Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rep, err := ar.Report(r.URL.Query().Get("instance"))
+	if err != nil {
+		http.Error(w, "500 Internal Server Error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.URL.Query().Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="access.csv"`)
+		WriteAccessCSV(w, rep)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	WriteAccessJSON(w, rep)
+}
+
+//WriteAccessJSON writes the report as indented JSON
+func WriteAccessJSON(w io.Writer, rep AccessReport) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(rep)
+}
+
+//WriteAccessCSV writes the entries of the report as CSV with a header line
+func WriteAccessCSV(w io.Writer, rep AccessReport) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"instance", "kind", "group", "project", "member", "access_level", "downgraded", "downgraded_from", "granted_until", "violation"})
+	for _, e := range rep.Entries {
+		cw.Write([]string{e.Instance, e.Kind, e.Group, e.Project, e.Member, e.AccessLevel, formatTime(e.Downgraded), e.DowngradedFrom, formatTime(e.GrantedUntil), e.Violation})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+//downgrade is the last downgrade of a member recorded in the audit trail
+type downgrade struct {
+	at   time.Time
+	from int
+}
+
+//downgradeKey identifies a member of a group, or of a project when project is set
+type downgradeKey struct {
+	group, project, member string
+}
+
+//readDowngrades returns the last successful downgrade by drop_rights of each member
+func readDowngrades(file string) (map[downgradeKey]downgrade, error) {
+	downgrades := make(map[downgradeKey]downgrade)
+	if file == "" {
+		return downgrades, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	err = audit.Read(f, func(r audit.Record) error {
+		if r.Plugin != dropRightsPlugin || r.Result != "ok" {
+			return nil
+		}
+		var k downgradeKey
+		switch r.Action {
+		case audit.ActionUpdateGroupMember:
+			k = downgradeKey{group: strings.ToLower(r.Group), member: strings.ToLower(r.Member)}
+		case audit.ActionUpdateProjectMember:
+			k = downgradeKey{project: strings.ToLower(r.Project), member: strings.ToLower(r.Member)}
+		default:
+			return nil
+		}
+		downgrades[k] = downgrade{at: r.Time, from: r.OldAccessLevel}
+		return nil
+	})
+	return downgrades, err
+}
+
+//reportInstance adds the members of the groups and projects of an instance to the report
+func reportInstance(logger log.Logger, src AccessSource, downgrades map[downgradeKey]downgrade, rep *AccessReport) {
+	logger = log.NewContext(logger).With("instance", src.Instance.Name)
+	cl := src.Client
+	projects, groups, err := expandRepos(logger, cl, src.Instance.Repos, src.Instance.DefaultApprovers)
+	if err != nil {
+		rep.Errors = append(rep.Errors, src.Instance.Name+": "+err.Error())
+	}
+	now := time.Now()
+
+	//the policies of the groups drop_rights runs on
+	sweeps := make(map[string]*plugins.Sweep)
+	policies := make(map[string]plugins.DropRightsPolicy)
+	for _, g := range groups {
+		if !hasPlugin(g, dropRightsPlugin) {
+			continue
+		}
+		sw, err := plugins.NewSweep(cl, g.DropRights)
+		if err != nil {
+			rep.Errors = append(rep.Errors, g.Name+": "+err.Error())
+			continue
+		}
+		sweeps[strings.ToLower(g.Name)] = sw
+		policies[strings.ToLower(g.Name)] = g.DropRights
+	}
+
+	for _, g := range groups {
+		sw := sweeps[strings.ToLower(g.Name)]
+		//grants are kept by the ID of their group
+		gid := 0
+		if src.Grants != nil {
+			if grp, _, err := cl.GetGroup(g.Name); err == nil {
+				gid = grp.ID
+			}
+		}
+		err := plugins.ForEachGroupMember(cl, g.Name, func(m *gitlab.GroupMember) error {
+			e := AccessEntry{
+				Instance:    src.Instance.Name,
+				Kind:        "group",
+				Group:       g.Name,
+				Member:      m.Username,
+				AccessLevel: plugins.AccessLevelName(m.AccessLevel),
+			}
+			setDowngrade(&e, downgrades[downgradeKey{group: strings.ToLower(g.Name), member: strings.ToLower(m.Username)}])
+			grant, granted := src.Grants.Active(gid, m.Username, now)
+			if granted {
+				expires := grant.Expires
+				e.GrantedUntil = &expires
+			}
+			if sw != nil && sw.Downgrades(m.Username, m.AccessLevel) && !(granted && m.AccessLevel <= grant.Level) {
+				e.Violation = "above max-level " + plugins.AccessLevelName(sw.Max)
+			}
+			rep.Entries = append(rep.Entries, e)
+			return nil
+		})
+		if err != nil {
+			logging.Warn(logger).Log(
+				"Func", "AccessReport",
+				"Group", g.Name,
+				"Error", err,
+			)
+			rep.Errors = append(rep.Errors, g.Name+": "+err.Error())
+		}
+	}
+
+	for _, p := range projects {
+		group := p.Name
+		if i := strings.LastIndex(group, "/"); i >= 0 {
+			group = group[:i]
+		}
+		//project members are only swept when the policy of their group says so
+		sw := sweeps[strings.ToLower(group)]
+		if !policies[strings.ToLower(group)].Projects {
+			sw = nil
+		}
+		err := plugins.ForEachProjectMember(cl, p.Name, func(m *gitlab.ProjectMember) error {
+			e := AccessEntry{
+				Instance:    src.Instance.Name,
+				Kind:        "project",
+				Group:       group,
+				Project:     p.Name,
+				Member:      m.Username,
+				AccessLevel: plugins.AccessLevelName(m.AccessLevel),
+			}
+			setDowngrade(&e, downgrades[downgradeKey{project: strings.ToLower(p.Name), member: strings.ToLower(m.Username)}])
+			if sw != nil && sw.Downgrades(m.Username, m.AccessLevel) {
+				e.Violation = "above max-level " + plugins.AccessLevelName(sw.Max)
+			}
+			rep.Entries = append(rep.Entries, e)
+			return nil
+		})
+		if err != nil {
+			logging.Warn(logger).Log(
+				"Func", "AccessReport",
+				"Project", p.Name,
+				"Error", err,
+			)
+			rep.Errors = append(rep.Errors, p.Name+": "+err.Error())
+		}
+	}
+
+	sort.SliceStable(rep.Entries, func(i, k int) bool {
+		a, b := rep.Entries[i], rep.Entries[k]
+		if a.Instance != b.Instance {
+			return a.Instance < b.Instance
+		}
+		if a.Group != b.Group {
+			return a.Group < b.Group
+		}
+		if a.Project != b.Project {
+			return a.Project < b.Project
+		}
+		return a.Member < b.Member
+	})
+}
+
+func setDowngrade(e *AccessEntry, d downgrade) {
+	if d.at.IsZero() {
+		return
+	}
+	at := d.at
+	e.Downgraded = &at
+	e.DowngradedFrom = plugins.AccessLevelName(gitlab.AccessLevelValue(d.from))
+}
+
+func hasPlugin(r plugins.Repo, plugin string) bool {
+	for _, p := range r.Plugins {
+		if p == plugin {
+			return true
+		}
+	}
+	return false
+}
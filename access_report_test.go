@@ -0,0 +1,113 @@
+package gitbot
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cosminilie/gitbot/audit"
+	"github.com/cosminilie/gitbot/gitlabfake"
+	"github.com/cosminilie/gitbot/plugins"
+	"github.com/go-kit/kit/log"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+func TestAccessReport(t *testing.T) {
+	gl := gitlabfake.New()
+	g := gl.AddGroup("tools")
+	gl.AddGroupMember(g.ID, "alice", gitlab.MasterPermissions)
+	gl.AddGroupMember(g.ID, "bob", gitlab.ReporterPermissions)
+	gl.AddGroupMember(g.ID, "carol", gitlab.DeveloperPermissions)
+	gl.AddGroupMember(g.ID, "dave", gitlab.MasterPermissions)
+	p := gl.AddProject("tools/api")
+	gl.AddProjectMember(p.ID, "erin", gitlab.MasterPermissions)
+
+	dir, err := ioutil.TempDir("", "report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "audit.jsonl")
+	al, err := audit.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downgraded := time.Date(2017, 7, 3, 2, 0, 0, 0, time.UTC)
+	al.Append(audit.Record{Time: downgraded, Action: audit.ActionUpdateGroupMember, Plugin: "drop_rights", Group: "tools", Member: "bob", OldAccessLevel: 40, NewAccessLevel: 20, Result: "ok"})
+	al.Append(audit.Record{Action: audit.ActionMerge, Plugin: "lgtm", Project: "tools/api", Result: "ok"})
+	al.Close()
+
+	//the bot saved a grant next to the audit log, the report reads it back
+	saved, err := plugins.OpenGrants(GrantsFile(file, DefaultInstance))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved.Approve(plugins.AccessGrant{GroupID: g.ID, Group: "tools", User: "dave", Level: gitlab.MasterPermissions, Expires: time.Now().Add(time.Hour)})
+	grants, err := plugins.OpenGrants(GrantsFile(file, DefaultInstance))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reporter := &AccessReporter{
+		Logger:    log.NewNopLogger(),
+		AuditFile: file,
+		Sources: []AccessSource{{
+			Instance: Instance{
+				Name: DefaultInstance,
+				Repos: []plugins.Repo{{
+					Name:       "tools",
+					Plugins:    []string{"drop_rights"},
+					DropRights: plugins.DropRightsPolicy{MaxLevel: "developer", Projects: true},
+				}},
+			},
+			Client: gl,
+			Grants: grants,
+		}},
+	}
+	rep, err := reporter.Report("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Errors) > 0 {
+		t.Fatalf("got errors %v", rep.Errors)
+	}
+
+	got := make(map[string]AccessEntry)
+	for _, e := range rep.Entries {
+		got[e.Member] = e
+	}
+	if len(got) != 5 {
+		t.Fatalf("got %+v, want the 4 group members and the project member", rep.Entries)
+	}
+	if e := got["alice"]; e.Violation == "" || e.AccessLevel != "maintainer" {
+		t.Errorf("got %+v, want alice to violate the policy", e)
+	}
+	if e := got["bob"]; e.Violation != "" || e.Downgraded == nil || !e.Downgraded.Equal(downgraded) || e.DowngradedFrom != "maintainer" {
+		t.Errorf("got %+v, want bob's downgrade", e)
+	}
+	if e := got["carol"]; e.Violation != "" || e.Downgraded != nil {
+		t.Errorf("got %+v, want carol to comply", e)
+	}
+	if e := got["dave"]; e.Violation != "" || e.GrantedUntil == nil {
+		t.Errorf("got %+v, want dave's grant to cover the access", e)
+	}
+	if e := got["erin"]; e.Kind != "project" || e.Project != "tools/api" || e.Violation == "" {
+		t.Errorf("got %+v, want erin to violate the policy on the project", e)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteAccessCSV(&buf, rep); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 6 || rows[0][4] != "member" || rows[2][4] != "bob" || rows[2][6] != "2017-07-03T02:00:00Z" {
+		t.Errorf("got CSV %v", rows)
+	}
+}
@@ -0,0 +1,23 @@
+package gitbot
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/cosminilie/gitbot/plugins"
+	"github.com/go-kit/kit/log"
+)
+
+//QueueFile returns the file the merge queues of an instance are saved to, next to the audit log
+func QueueFile(auditFile, instance string) string {
+	return filepath.Join(filepath.Dir(auditFile), "queue-"+instance+".json")
+}
+
+//advanceQueues moves every merge queue forward, catching up with the rebases and pipelines no event reported. The
+//queues have their own locks, the other plugins are not held up meanwhile.
+func advanceQueues(s *basicService) error {
+	logger := log.NewContext(s.logger).With("Plugin", plugins.MergeQueuePlugin)
+	return s.runPlugin(s.ctx, logger, plugins.MergeQueuePlugin, func(ctx context.Context, pc *plugins.PluginClient) error {
+		return pc.Queue.AdvanceAll(ctx, pc.Logger, pc.GitLabClient, pc.Audit)
+	})
+}
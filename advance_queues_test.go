@@ -0,0 +1,30 @@
+package gitbot
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cosminilie/gitbot/gitlabfake"
+	"github.com/cosminilie/gitbot/plugins"
+	"github.com/go-kit/kit/log"
+)
+
+func TestAdvanceQueues(t *testing.T) {
+	gl := gitlabfake.New()
+	p := gl.AddProject("tools/api")
+	mr, _ := gl.AddMergeRequest(p.ID, "one", "master", "one")
+	gl.SetDiverged(p.ID, mr.IID, 2)
+
+	//the project has no CI, no event follows the rebase
+	queue := plugins.NewMergeQueue()
+	queue.Enqueue(plugins.QueueEntry{Project: "tools/api", ProjectID: p.ID, MergeRequest: mr.IID, SourceBranch: "one", TargetBranch: "master"})
+	svc := NewBasicService(context.Background(), log.NewNopLogger(), gl, nil, nil, queue, Instance{Name: DefaultInstance})
+	for i := 0; i < 2; i++ {
+		if err := advanceQueues(svc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if gl.MergeRequest(p.ID, mr.IID).State != "merged" || len(queue.Entries()) != 0 {
+		t.Error("got the rebased merge request not merged on the schedule")
+	}
+}
@@ -0,0 +1,48 @@
+package gitbot
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+//APIVersion is the GitLab API version spoken by the bot and its plugins
+const APIVersion = "v4"
+
+//ServerVersion is the answer of the GitLab version endpoint
+//https://docs.gitlab.com/ce/api/version.html
+type ServerVersion struct {
+	Version  string `json:"version"`
+	Revision string `json:"revision"`
+}
+
+//CheckAPIVersion makes sure the git-api-URL of an instance points at the API version the bot speaks and that the
+//GitLab server behind it serves that version. cl must use the instance git-api-URL as base URL.
+func CheckAPIVersion(cl *gitlab.Client, inst Instance) (*ServerVersion, error) {
+	u, err := url.Parse(inst.GitURL)
+	if err != nil {
+		return nil, fmt.Errorf("instance %s: invalid git-api-URL %q: %s", inst.Name, inst.GitURL, err)
+	}
+	want := "/api/" + APIVersion
+	path := strings.TrimSuffix(u.Path, "/")
+	if !strings.HasSuffix(path, want) {
+		u.Path = strings.TrimSuffix(strings.TrimSuffix(path, "/api/v3"), want) + want + "/"
+		return nil, fmt.Errorf("instance %s: git-api-URL %s does not point at the GitLab API %s, use %s", inst.Name, inst.GitURL, APIVersion, u)
+	}
+
+	req, err := cl.NewRequest("GET", "version", nil)
+	if err != nil {
+		return nil, fmt.Errorf("instance %s: %s", inst.Name, err)
+	}
+	v := new(ServerVersion)
+	if _, err := cl.Do(req, v); err != nil {
+		if er, ok := err.(*gitlab.ErrorResponse); ok && er.Response.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("instance %s: GitLab at %s does not serve the API %s, GitLab 9.0 or newer is required", inst.Name, inst.GitURL, APIVersion)
+		}
+		return nil, fmt.Errorf("instance %s: failed to query the GitLab version: %s", inst.Name, err)
+	}
+	return v, nil
+}
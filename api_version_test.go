@@ -0,0 +1,48 @@
+package gitbot
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+func TestCheckAPIVersion(t *testing.T) {
+	gs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v4/version" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"version":"9.5.0","revision":"abcdef"}`)
+	}))
+	defer gs.Close()
+
+	tests := []struct {
+		gitURL  string
+		version string
+		err     string
+	}{
+		{gitURL: gs.URL + "/api/v4/", version: "9.5.0"},
+		{gitURL: gs.URL + "/api/v3/", err: "use " + gs.URL + "/api/v4/"},
+		{gitURL: gs.URL + "/gitlab/api/v4/", err: "GitLab 9.0 or newer is required"},
+	}
+
+	for _, tt := range tests {
+		cl := gitlab.NewClient(nil, "token")
+		cl.SetBaseURL(tt.gitURL)
+
+		v, err := CheckAPIVersion(cl, Instance{Name: DefaultInstance, GitURL: tt.gitURL})
+		switch {
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: got error %v, want it to contain %q", tt.gitURL, err, tt.err)
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: unexpected error %s", tt.gitURL, err)
+		case tt.err == "" && v.Version != tt.version:
+			t.Errorf("%s: got version %s, want %s", tt.gitURL, v.Version, tt.version)
+		}
+	}
+}
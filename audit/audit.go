@@ -0,0 +1,290 @@
+//Package audit keeps a tamper-evident trail of the changes made by the bot.
+//Records are appended to a JSONL file where each record carries the hash of the previous one, so editing or
+//removing a record breaks the chain from that point on.
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	//ActionMerge is recorded when a merge request is accepted
+	ActionMerge = "AcceptMergeRequest"
+	//ActionUpdateGroupMember is recorded when the access level of a group member is changed
+	ActionUpdateGroupMember = "UpdateGroupMember"
+	//ActionUpdateProjectMember is recorded when the access level of a project member is changed
+	ActionUpdateProjectMember = "UpdateProjectMember"
+	//ActionGrantAccess is recorded when a member is temporarily elevated by an approved access request
+	ActionGrantAccess = "GrantAccess"
+	//ActionRevokeAccess is recorded when an access grant expires and the member is lowered again
+	ActionRevokeAccess = "RevokeAccess"
+	//ActionProtectBranch is recorded when a branch protection that was missing or changed is applied again
+	ActionProtectBranch = "ProtectBranch"
+	//ActionDirectPush, ActionForcePush and ActionDeleteBranch are recorded when push_audit flags a push
+	ActionDirectPush   = "DirectPush"
+	ActionForcePush    = "ForcePush"
+	ActionDeleteBranch = "DeleteBranch"
+)
+
+//Anchor identifies a record known to belong to an audit log, e.g. the head published by the export endpoint. The
+//chain alone cannot tell that records were cut off the end of a log, checking the log still reaches an anchor can.
+type Anchor struct {
+	Seq int64
+	//Hash is the hash of the record Seq. When Seq is 0 the log must hold a record with this hash.
+	Hash string
+}
+
+//Record is a single entry in the audit trail
+type Record struct {
+	Seq    int64     `json:"seq"`
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Plugin string    `json:"plugin"`
+	//Actor is the user whose action triggered the change. Approvers are the approvers configured for the repo when a
+	//merge was allowed, or the approver of an access grant.
+	Actor     string   `json:"actor"`
+	Approvers []string `json:"approvers,omitempty"`
+
+	Project      string `json:"project,omitempty"`
+	MergeRequest int    `json:"merge_request,omitempty"`
+	CommitSHA    string `json:"commit_sha,omitempty"`
+	Branch       string `json:"branch,omitempty"`
+
+	Group          string `json:"group,omitempty"`
+	Member         string `json:"member,omitempty"`
+	OldAccessLevel int    `json:"old_access_level,omitempty"`
+	NewAccessLevel int    `json:"new_access_level,omitempty"`
+	//Reason and Expires are set on access grants, Reason also describes the drift of a protected branch
+	Reason  string     `json:"reason,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"`
+
+	//Event describes what triggered the change, e.g. the URL of the approving comment
+	Event  string `json:"event"`
+	Result string `json:"result"`
+
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+}
+
+//Log is an append only, hash chained audit log. A nil *Log discards every record.
+type Log struct {
+	mut  sync.Mutex
+	file *os.File
+	seq  int64
+	last string
+}
+
+//Open opens or creates the audit log at path. The existing chain is verified so new records are never appended to a broken log.
+func Open(path string) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log %s: %s", path, err)
+	}
+	last, err := Verify(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("audit log %s failed verification: %s", path, err)
+	}
+	l := &Log{file: f}
+	if last != nil {
+		l.seq = last.Seq
+		l.last = last.Hash
+	}
+	return l, nil
+}
+
+//Append chains r to the log and writes it to disk
+func (l *Log) Append(r Record) error {
+	if l == nil {
+		return nil
+	}
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+	r.Time = r.Time.UTC()
+	r.Seq = l.seq + 1
+	r.PrevHash = l.last
+	h, err := hash(r)
+	if err != nil {
+		return err
+	}
+	r.Hash = h
+
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	l.seq = r.Seq
+	l.last = r.Hash
+	return nil
+}
+
+//Head returns the anchor of the last record of the log, the zero Anchor for an empty log
+func (l *Log) Head() Anchor {
+	if l == nil {
+		return Anchor{}
+	}
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	return Anchor{Seq: l.seq, Hash: l.last}
+}
+
+//Export writes the raw audit log to w
+func (l *Log) Export(w io.Writer) error {
+	if l == nil {
+		return nil
+	}
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	f, err := os.Open(l.file.Name())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+//ServeHTTP exports the audit log as JSONL. The X-Audit-Seq and X-Audit-Hash headers hold the head of the log, keeping
+//them somewhere else lets "gitbot audit verify" tell when records were later removed from the end of the log.
+func (l *Log) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "405 Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if l == nil {
+		http.Error(w, "404 Not Found: audit log is disabled", http.StatusNotFound)
+		return
+	}
+	head := l.Head()
+	w.Header().Set("X-Audit-Seq", strconv.FormatInt(head.Seq, 10))
+	w.Header().Set("X-Audit-Hash", head.Hash)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+	l.Export(w)
+}
+
+//Close closes the audit log
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	return l.file.Close()
+}
+
+//Verify checks the hash chain of an audit log and returns its last record, or nil for an empty log
+func Verify(r io.Reader) (*Record, error) {
+	return verify(r, func(Record) error { return nil })
+}
+
+//VerifyAnchored checks the hash chain of an audit log like Verify and that the log still holds the anchored record
+func VerifyAnchored(r io.Reader, a Anchor) (*Record, error) {
+	found := false
+	last, err := verify(r, func(rec Record) error {
+		switch {
+		case a.Seq != 0 && rec.Seq == a.Seq:
+			if a.Hash != "" && rec.Hash != a.Hash {
+				return fmt.Errorf("record %d does not match the anchor hash %s", rec.Seq, a.Hash)
+			}
+			found = true
+		case a.Seq == 0 && rec.Hash == a.Hash:
+			found = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		var seq int64
+		if last != nil {
+			seq = last.Seq
+		}
+		if a.Seq != 0 {
+			return nil, fmt.Errorf("the log ends at record %d before the anchored record %d, records were removed from its end", seq, a.Seq)
+		}
+		return nil, fmt.Errorf("no record of the log, which ends at record %d, has the anchor hash %s", seq, a.Hash)
+	}
+	return last, nil
+}
+
+//verify checks the hash chain of an audit log, calling fn with each record once it is verified
+func verify(r io.Reader, fn func(Record) error) (*Record, error) {
+	var last *Record
+	err := Read(r, func(rec Record) error {
+		prevHash, prevSeq := "", int64(0)
+		if last != nil {
+			prevHash, prevSeq = last.Hash, last.Seq
+		}
+		if rec.Seq != prevSeq+1 {
+			return fmt.Errorf("got sequence %d, want %d", rec.Seq, prevSeq+1)
+		}
+		if rec.PrevHash != prevHash {
+			return fmt.Errorf("record %d does not chain to the previous record", rec.Seq)
+		}
+		h, err := hash(rec)
+		if err != nil {
+			return err
+		}
+		if rec.Hash != h {
+			return fmt.Errorf("record %d has been modified", rec.Seq)
+		}
+		last = &rec
+		return fn(rec)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return last, nil
+}
+
+//Read calls fn with each record of an audit log, in order. The chain is not verified, see Verify.
+func Read(r io.Reader, fn func(Record) error) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for sc.Scan() {
+		line++
+		var rec Record
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return fmt.Errorf("line %d: %s", line, err)
+		}
+		if err := fn(rec); err != nil {
+			return fmt.Errorf("line %d: %s", line, err)
+		}
+	}
+	return sc.Err()
+}
+
+//hash returns the hash of a record, computed over its JSON encoding without the Hash field
+func hash(r Record) (string, error) {
+	r.Hash = ""
+	b, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,107 @@
+package audit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLogChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitbot-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.jsonl")
+
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Append(Record{Action: ActionMerge, Plugin: "lgtm", Actor: "user5", Project: "tools/a", MergeRequest: 1, Result: "ok"}); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	//reopening continues the chain
+	l, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Append(Record{Action: ActionUpdateGroupMember, Plugin: "drop_rights", Group: "tools", Member: "user8", OldAccessLevel: 30, NewAccessLevel: 20, Result: "ok"}); err != nil {
+		t.Fatal(err)
+	}
+	var exported bytes.Buffer
+	if err := l.Export(&exported); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	last, err := Verify(bytes.NewReader(exported.Bytes()))
+	if err != nil {
+		t.Fatalf("valid log failed verification: %s", err)
+	}
+	if last == nil || last.Seq != 2 {
+		t.Fatalf("got last record %+v, want sequence 2", last)
+	}
+
+	tampered := bytes.Replace(exported.Bytes(), []byte(`"member":"user8"`), []byte(`"member":"user9"`), 1)
+	if _, err := Verify(bytes.NewReader(tampered)); err == nil {
+		t.Error("modified record passed verification")
+	}
+
+	lines := bytes.SplitAfter(exported.Bytes(), []byte("\n"))
+	if _, err := Verify(bytes.NewReader(lines[1])); err == nil {
+		t.Error("log with a removed record passed verification")
+	}
+
+	//cutting the last record off still chains, only the anchor published with the export tells
+	head := Anchor{Seq: last.Seq, Hash: last.Hash}
+	if _, err := Verify(bytes.NewReader(lines[0])); err != nil {
+		t.Fatalf("truncated log failed the chain verification: %s", err)
+	}
+	if _, err := VerifyAnchored(bytes.NewReader(lines[0]), head); err == nil {
+		t.Error("log with its last record removed passed verification against its head")
+	}
+	if _, err := VerifyAnchored(bytes.NewReader(lines[0]), Anchor{Hash: head.Hash}); err == nil {
+		t.Error("log with its last record removed passed verification against the hash of its head")
+	}
+	if _, err := VerifyAnchored(bytes.NewReader(exported.Bytes()), Anchor{Seq: 1, Hash: head.Hash}); err == nil {
+		t.Error("log passed verification against an anchor with the hash of another record")
+	}
+	if _, err := VerifyAnchored(bytes.NewReader(exported.Bytes()), head); err != nil {
+		t.Errorf("valid log failed verification against its head: %s", err)
+	}
+}
+
+func TestExportHead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitbot-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := Open(filepath.Join(dir, "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for i := 0; i < 3; i++ {
+		if err := l.Append(Record{Action: ActionMerge, Plugin: "lgtm", Actor: "user5", Result: "ok"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	l.ServeHTTP(w, httptest.NewRequest("GET", "/debug/audit", nil))
+	last, err := VerifyAnchored(w.Body, Anchor{Hash: w.Header().Get("X-Audit-Hash")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq := w.Header().Get("X-Audit-Seq"); seq != "3" || last.Seq != 3 {
+		t.Errorf("got head %s and last record %d, want 3", seq, last.Seq)
+	}
+}
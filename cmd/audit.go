@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/cosminilie/gitbot/audit"
+)
+
+//runAudit implements the "gitbot audit verify" command. It checks the hash chain of an audit log and, when given the
+//expected head of the log, that no record was removed from its end.
+func runAudit(args []string, defaultFile string) int {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	file := fs.String("file", defaultFile, "Audit log to verify")
+	seq := fs.Int64("expect-seq", 0, "Sequence of a record the log must hold, e.g. the X-Audit-Seq header of an earlier export")
+	hash := fs.String("expect-hash", "", "Hash the record -expect-seq must have, or of any record of the log without -expect-seq, e.g. the X-Audit-Hash header of an earlier export")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s audit verify [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 || args[0] != "verify" {
+		fs.Usage()
+		return 2
+	}
+	fs.Parse(args[1:])
+
+	if *file == "" {
+		fmt.Println("No audit log given, use -file or -audit.file")
+		return 2
+	}
+	f, err := os.Open(*file)
+	if err != nil {
+		fmt.Printf("Error opening audit log %s. Failed with: %s\n", *file, err)
+		return 1
+	}
+	defer f.Close()
+
+	var last *audit.Record
+	if *seq != 0 || *hash != "" {
+		last, err = audit.VerifyAnchored(f, audit.Anchor{Seq: *seq, Hash: *hash})
+	} else {
+		last, err = audit.Verify(f)
+	}
+	if err != nil {
+		fmt.Printf("Audit log %s is NOT valid: %s\n", *file, err)
+		return 1
+	}
+	if last == nil {
+		fmt.Printf("Audit log %s is empty\n", *file)
+		return 0
+	}
+	fmt.Printf("Audit log %s is valid: %d records, last hash %s\n", *file, last.Seq, last.Hash)
+	return 0
+}
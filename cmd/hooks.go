@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/cosminilie/gitbot"
+)
+
+//runHooks implements the "gitbot hooks cleanup" command. It removes the hooks pointing at the bot, e.g. before
+//uninstalling it or after changing the hook strategy.
+func runHooks(args []string, configFile string) int {
+	fs := flag.NewFlagSet("hooks", flag.ExitOnError)
+	var (
+		instance = fs.String("instance", "", "Only clean up the hooks of this GitLab instance")
+		dryRun   = fs.Bool("dry-run", false, "Log the hooks that would be removed without removing them")
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-config file] hooks cleanup [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 || args[0] != "cleanup" {
+		fs.Usage()
+		return 2
+	}
+	fs.Parse(args[1:])
+
+	instances, err := loadConfig(configFile)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	logger := log.NewLogfmtLogger(os.Stdout)
+	status := 0
+	for _, inst := range instances {
+		if *instance != "" && inst.Name != *instance {
+			continue
+		}
+		_, gcl, err := newClient(inst)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		n, err := gitbot.CleanupHooks(log.NewContext(logger).With("instance", inst.Name), gcl, inst, *dryRun)
+		if err != nil {
+			fmt.Printf("Failed to clean up the hooks of GitLab instance %q: %s\n", inst.Name, err)
+			status = 1
+		}
+		fmt.Printf("Removed %d hooks from GitLab instance %q\n", n, inst.Name)
+	}
+	return status
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"expvar"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -16,10 +19,17 @@ import (
 	gitlab "github.com/xanzy/go-gitlab"
 
 	"github.com/cosminilie/gitbot"
+	"github.com/cosminilie/gitbot/audit"
+	"github.com/cosminilie/gitbot/logging"
+	"github.com/cosminilie/gitbot/schedule"
 
 	"github.com/cosminilie/gitbot/plugins"
+	_ "github.com/cosminilie/gitbot/plugins/access"
 	_ "github.com/cosminilie/gitbot/plugins/droprights"
 	_ "github.com/cosminilie/gitbot/plugins/lgtm"
+	_ "github.com/cosminilie/gitbot/plugins/policy"
+	_ "github.com/cosminilie/gitbot/plugins/protectbranches"
+	_ "github.com/cosminilie/gitbot/plugins/pushaudit"
 )
 
 var (
@@ -32,20 +42,104 @@ var (
 	buildDate    = "BuildDate not set"
 )
 
-//Config struct in loading HCL configuration
+//cancelGrace is the time given on exit to the cancelled plugins to return before the stores are closed
+const cancelGrace = 5 * time.Second
+
+//Config struct in loading HCL configuration. The top level token, git-api-URL, default-approvers and repos
+//configure the "default" GitLab instance, additional instances are configured with gitlab blocks.
 type Config struct {
-	Token            string         `hcl:"token"`
-	GitURL           string         `hcl:"git-api-URL"`
-	DefaultApprovers []string       `hcl:"default-approvers"`
-	Repos            []plugins.Repo `hcl:"repo,expand"`
+	Token            string                  `hcl:"token"`
+	GitURL           string                  `hcl:"git-api-URL"`
+	DefaultApprovers []string                `hcl:"default-approvers"`
+	RateLimit        plugins.RateLimit       `hcl:"rate-limit"`
+	HookStrategy     string                  `hcl:"hook-strategy"`
+	Hook             gitbot.HookConfig       `hcl:"hook"`
+	PluginTimeout    string                  `hcl:"plugin-timeout"`
+	PluginTimeouts   map[string]string       `hcl:"plugin-timeouts"`
+	Schedules        []gitbot.ScheduleConfig `hcl:"schedule,expand"`
+	Repos            []plugins.Repo          `hcl:"repo,expand"`
+	Instances        []gitbot.Instance       `hcl:"gitlab,expand"`
+}
+
+//instances returns every configured GitLab instance
+func (c *Config) instances() ([]gitbot.Instance, error) {
+	var insts []gitbot.Instance
+	if c.GitURL != "" || len(c.Repos) > 0 {
+		insts = append(insts, gitbot.Instance{
+			Name:             gitbot.DefaultInstance,
+			Token:            c.Token,
+			GitURL:           c.GitURL,
+			DefaultApprovers: c.DefaultApprovers,
+			RateLimit:        c.RateLimit,
+			HookStrategy:     c.HookStrategy,
+			Hook:             c.Hook,
+			PluginTimeout:    c.PluginTimeout,
+			PluginTimeouts:   c.PluginTimeouts,
+			Schedules:        c.Schedules,
+			Repos:            c.Repos,
+		})
+	}
+	insts = append(insts, c.Instances...)
+
+	if len(insts) == 0 {
+		return nil, errors.New("no GitLab instance configured")
+	}
+	names := make(map[string]bool)
+	paths := make(map[string]bool)
+	for _, i := range insts {
+		if names[i.Name] {
+			return nil, fmt.Errorf("GitLab instance %q is configured more than once", i.Name)
+		}
+		if paths[i.Path()] {
+			return nil, fmt.Errorf("hook path %s of GitLab instance %q is already used", i.Path(), i.Name)
+		}
+		if i.GitURL == "" {
+			return nil, fmt.Errorf("GitLab instance %q has no git-api-URL", i.Name)
+		}
+		switch i.Strategy() {
+		case gitbot.HookStrategyProject, gitbot.HookStrategyGroup, gitbot.HookStrategySystem:
+		default:
+			return nil, fmt.Errorf("GitLab instance %q has an unknown hook-strategy %q", i.Name, i.HookStrategy)
+		}
+		if _, err := i.Timeouts(); err != nil {
+			return nil, fmt.Errorf("GitLab instance %q has an %s", i.Name, err)
+		}
+		if _, err := i.JobSchedules(); err != nil {
+			return nil, fmt.Errorf("GitLab instance %q has an invalid schedule: %s", i.Name, err)
+		}
+		for _, r := range i.Repos {
+			if _, _, err := r.DropRights.Levels(); err != nil {
+				return nil, fmt.Errorf("repo %q of GitLab instance %q has an invalid drop_rights policy: %s", r.Name, i.Name, err)
+			}
+			for _, b := range r.ProtectedBranches {
+				if _, _, err := b.Levels(); err != nil {
+					return nil, fmt.Errorf("repo %q of GitLab instance %q has an %s", r.Name, i.Name, err)
+				}
+			}
+			if err := r.Policy.Validate(); err != nil {
+				return nil, fmt.Errorf("repo %q of GitLab instance %q has an invalid policy: %s", r.Name, i.Name, err)
+			}
+		}
+		names[i.Name] = true
+		paths[i.Path()] = true
+	}
+	return insts, nil
 }
 
 func main() {
 
 	var (
-		debugAddr   = flag.String("debug.addr", ":9090", "Debug and metrics listen address")
-		showVersion = flag.Bool("version", false, "Display build version")
-		configFile  = flag.String("config", "/etc/githook.conf", "GitLab Hook config file")
+		debugAddr    = flag.String("debug.addr", ":9090", "Debug and metrics listen address")
+		showVersion  = flag.Bool("version", false, "Display build version")
+		configFile   = flag.String("config", "/etc/githook.conf", "GitLab Hook config file")
+		captureDir   = flag.String("capture.dir", "", "Directory used to record received webhooks. Capture is disabled when empty")
+		captureSize  = flag.Int64("capture.max-size", 100, "Size in MB after which the capture log is rotated")
+		captureKeep  = flag.Int("capture.max-files", 5, "Number of rotated capture logs to keep")
+		auditFile    = flag.String("audit.file", "", "Append only audit log of merges and permission changes. Auditing is disabled when empty")
+		hooksCleanup = flag.Bool("hooks.cleanup-on-exit", false, "Remove the hooks pointing at the bot when it stops")
+		logLevel     = flag.String("log.level", "info", "Minimum level of the logged records: debug, info, warn or error")
+		logFormat    = flag.String("log.format", logging.FormatLogfmt, "Format of the logged records: logfmt or json")
+		drainTimeout = flag.Duration("shutdown.drain-timeout", 30*time.Second, "Time given on exit to the webhooks and scheduled handlers being run to complete before their plugins are cancelled")
 	)
 	flag.Parse()
 
@@ -54,95 +148,283 @@ func main() {
 		os.Exit(0)
 	}
 
+	switch flag.Arg(0) {
+	case "replay":
+		os.Exit(runReplay(flag.Args()[1:]))
+	case "audit":
+		os.Exit(runAudit(flag.Args()[1:], *auditFile))
+	case "report":
+		os.Exit(runReport(flag.Args()[1:], *configFile, *auditFile))
+	case "hooks":
+		os.Exit(runHooks(flag.Args()[1:], *configFile))
+	}
+
 	// Logging domain.
 	var logger log.Logger
 	{
-		logger = log.NewLogfmtLogger(os.Stdout)
-		logger = log.NewContext(logger).With("ts", log.DefaultTimestampUTC)
-		logger = log.NewContext(logger).With("caller", log.DefaultCaller)
+		level, err := logging.ParseLevel(*logLevel)
+		if err == nil {
+			logger, err = logging.New(os.Stdout, *logFormat, level)
+		}
+		if err != nil {
+			fmt.Printf("Invalid logging configuration: %s\n", err)
+			os.Exit(1)
+		}
 	}
 	logger.Log("msg", "hello")
-	defer logger.Log("msg", "goodbye")
 
-	//global error chan
-	errc := make(chan error)
+	//global error chan, buffered for the interrupt handler and the two listeners
+	errc := make(chan error, 3)
+
+	//ctx is cancelled on exit once the webhooks being handled were drained, it cancels the plugins still running
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	// Interrupt handler.
 	go func() {
 		c := make(chan os.Signal, 1)
 		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 		errc <- fmt.Errorf("%s", <-c)
+		//a second signal does not wait for the shutdown
+		logging.Error(logger).Log("msg", "Exiting without shutdown", "signal", <-c)
+		os.Exit(1)
 	}()
 
 	// Business domain.
 
 	//create config object
-	content, err := ioutil.ReadFile(*configFile)
+	instances, err := loadConfig(*configFile)
 	if err != nil {
-		fmt.Printf("Error loading configuration file %s. Failed with: %s\n", *configFile, err)
+		logging.Error(logger).Log("msg", "Failed to load configuration", "err", err)
 		os.Exit(1)
-
 	}
-	conf := &Config{}
-	hclParseTree, err := hcl.ParseBytes(content)
-	if err != nil {
-		fmt.Printf("Failed to parse configuration data: %s\n", err)
-		os.Exit(1)
+
+	//open audit log
+	var auditLog *audit.Log
+	if *auditFile != "" {
+		auditLog, err = audit.Open(*auditFile)
+		if err != nil {
+			logging.Error(logger).Log("msg", "Failed to open audit log", "err", err)
+			os.Exit(1)
+		}
 	}
-	if err := hcl.DecodeObject(&conf, hclParseTree); err != nil {
-		fmt.Printf("Failed to decode configuration data: %s\n", err)
-		os.Exit(1)
 
+	var recorder *gitbot.Recorder
+	if *captureDir != "" {
+		recorder, err = gitbot.NewRecorder(*captureDir, *captureSize*1024*1024, *captureKeep)
+		if err != nil {
+			logging.Error(logger).Log("msg", "Failed to setup webhook capture", "err", err)
+			os.Exit(1)
+		}
 	}
 
-	//fmt.Println("Config file is: ", *configFile)
+	//business domain
+	httplogger := log.NewContext(logger).With("transport", "HTTP")
+	router := gitbot.NewRouter(httplogger, recorder)
+	hookMux := http.NewServeMux()
+	hookMux.Handle("/hook", router)
 
-	//create gilabclient
-	var client *gitlab.Client
-	httpclient := &http.Client{
-		Timeout: 10 * time.Second,
+	clients := make(map[string]plugins.GitLabClient)
+	var servers []*gitbot.Server
+	var services []gitbot.Service
+	schedulers := make(map[string]*schedule.Scheduler)
+	reporter := &gitbot.AccessReporter{
+		Logger:    log.NewContext(logger).With("Func", "AccessReport"),
+		AuditFile: *auditFile,
 	}
+	for _, inst := range instances {
+		//create gilabclient
+		client, gcl, err := newClient(inst)
+		if err != nil {
+			logging.Error(logger).Log("instance", inst.Name, "err", err)
+			os.Exit(1)
+		}
+		clients[inst.Name] = gcl
 
-	client = gitlab.NewClient(httpclient, conf.Token)
-	client.SetBaseURL(conf.GitURL)
+		//refuse to start against a server that does not speak the API version of the bot
+		version, err := gitbot.CheckAPIVersion(client, inst)
+		if err != nil {
+			logging.Error(logger).Log("instance", inst.Name, "msg", "Unsupported GitLab API", "err", err)
+			os.Exit(1)
+		}
+		logger.Log("instance", inst.Name, "gitlab", version.Version, "api", gitbot.APIVersion)
 
-	//create service
-	var service gitbot.Service
-	svclogger := log.NewContext(logger).With("service", "basicservice")
-	service = gitbot.NewBasicService(svclogger, client, conf.Repos, conf.DefaultApprovers)
-	go func() {
-		for e := range service.GetErrors() {
-			errc <- e
+		//create service
+		var service gitbot.Service
+		svclogger := log.NewContext(logger).With("service", "basicservice", "instance", inst.Name)
+		//grants are saved next to the audit log so that they still expire to the previous level after a restart
+		var grants *plugins.Grants
+		if *auditFile != "" {
+			grants, err = plugins.OpenGrants(gitbot.GrantsFile(*auditFile, inst.Name))
+			if err != nil {
+				logging.Error(logger).Log("instance", inst.Name, "msg", "Failed to open access grants", "err", err)
+				os.Exit(1)
+			}
 		}
-	}()
+		//so are the merge queues, the approved merge requests are merged after a restart without a new /lgtm
+		var queue *plugins.MergeQueue
+		if *auditFile != "" {
+			queue, err = plugins.OpenMergeQueue(gitbot.QueueFile(*auditFile, inst.Name))
+			if err != nil {
+				logging.Error(logger).Log("instance", inst.Name, "msg", "Failed to open merge queues", "err", err)
+				os.Exit(1)
+			}
+		}
+		basic := gitbot.NewBasicService(ctx, svclogger, gcl, auditLog, grants, queue, inst)
+		schedulers[inst.Name] = basic.Scheduler()
+		reporter.Sources = append(reporter.Sources, gitbot.AccessSource{Instance: inst, Client: gcl, Grants: basic.Plugins.Grants})
+		service = basic
+		services = append(services, service)
+		go func(name string) {
+			//startup errors such as a configured group that cannot be expanded stop the bot, plugin and schedule
+			//errors are only logged by the service
+			for e := range service.GetErrors() {
+				if e != nil {
+					errc <- fmt.Errorf("instance %s: %s", name, e)
+				}
+			}
+		}(inst.Name)
 
-	//business domain
-	httplogger := log.NewContext(logger).With("transport", "HTTP")
-	httpserver := &gitbot.Server{
-		Logger:  httplogger,
-		Service: service,
+		httpserver := &gitbot.Server{
+			Logger:   log.NewContext(httplogger).With("instance", inst.Name),
+			Service:  service,
+			Instance: inst.Name,
+			Recorder: recorder,
+			Token:    inst.Hook.Token,
+			Context:  ctx,
+		}
+		servers = append(servers, httpserver)
+		router.Add(inst.Host(), httpserver)
+		if inst.Path() != "/hook" {
+			hookMux.Handle(inst.Path(), httpserver)
+		}
+		logger.Log("instance", inst.Name, "host", inst.Host(), "hook", inst.Path())
 	}
 
 	// Debug listener.
+	m := http.NewServeMux()
+	debugServer := &http.Server{Addr: *debugAddr, Handler: m}
 	go func() {
-		m := http.NewServeMux()
 		m.Handle("/debug/pprof/", http.HandlerFunc(pprof.Index))
 		m.Handle("/debug/pprof/cmdline", http.HandlerFunc(pprof.Cmdline))
 		m.Handle("/debug/pprof/profile", http.HandlerFunc(pprof.Profile))
 		m.Handle("/debug/pprof/symbol", http.HandlerFunc(pprof.Symbol))
 		m.Handle("/debug/pprof/trace", http.HandlerFunc(pprof.Trace))
+		m.Handle("/debug/deliveries", router.DeliveriesHandler())
+		m.Handle("/debug/deliveries/", router.DeliveriesHandler())
+		m.Handle("/debug/audit", auditLog)
+		m.Handle("/debug/vars", expvar.Handler())
+		m.Handle("/debug/schedules", schedule.Handler(schedulers))
+		m.Handle("/debug/report/access", reporter)
 		logger.Log("addr", *debugAddr)
-		errc <- http.ListenAndServe(*debugAddr, m)
-
+		if err := debugServer.ListenAndServe(); err != http.ErrServerClosed {
+			errc <- err
+		}
 	}()
 
 	// HTTP transport.
+	hookServer := &http.Server{Addr: ":9091", Handler: hookMux}
 	go func() {
 		logger.Log("addr", ":9091")
 
-		m := http.NewServeMux()
-		m.Handle("/hook", httpserver)
-		errc <- http.ListenAndServe(":9091", m)
+		if err := hookServer.ListenAndServe(); err != http.ErrServerClosed {
+			errc <- err
+		}
 	}()
-	fmt.Println(<-errc)
+	logger.Log("exit", <-errc)
+
+	//stop accepting webhooks, let the webhooks being handled and the scheduled handlers complete, then cancel the
+	//plugins that are still running and give them a moment to return
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), *drainTimeout)
+	if err := hookServer.Shutdown(drainCtx); err != nil {
+		logging.Warn(logger).Log("msg", "Closing the webhook connections still open", "err", err)
+		hookServer.Close()
+	}
+	if !drain(logger, drainCtx, servers, services) {
+		logging.Warn(logger).Log("msg", "Cancelling the plugins still running", "timeout", *drainTimeout)
+	}
+	drainCancel()
+	cancel()
+	graceCtx, graceCancel := context.WithTimeout(context.Background(), cancelGrace)
+	if !drain(logger, graceCtx, servers, services) {
+		logging.Error(logger).Log("msg", "Plugins did not return once cancelled")
+	}
+	graceCancel()
+	debugServer.Close()
+
+	if *hooksCleanup {
+		for _, inst := range instances {
+			n, err := gitbot.CleanupHooks(logger, clients[inst.Name], inst, false)
+			if err != nil {
+				logging.Error(logger).Log("instance", inst.Name, "hooks_removed", n, "err", err)
+				continue
+			}
+			logger.Log("instance", inst.Name, "hooks_removed", n)
+		}
+	}
+
+	//flush the stores and the log
+	if err := recorder.Close(); err != nil {
+		logging.Error(logger).Log("msg", "Failed to close the webhook capture", "err", err)
+	}
+	if err := auditLog.Close(); err != nil {
+		logging.Error(logger).Log("msg", "Failed to close the audit log", "err", err)
+	}
+	logger.Log("msg", "goodbye")
+	os.Stdout.Sync()
+}
+
+//drain waits until ctx is done for the webhooks being handled by the servers and the scheduled handlers of the
+//services. It reports whether everything completed.
+func drain(logger log.Logger, ctx context.Context, servers []*gitbot.Server, services []gitbot.Service) bool {
+	ok := true
+	for _, s := range servers {
+		if err := s.Drain(ctx); err != nil {
+			logging.Warn(logger).Log("instance", s.Instance, "msg", "Webhooks still being handled", "err", err)
+			ok = false
+		}
+	}
+	for _, svc := range services {
+		if err := svc.Shutdown(ctx); err != nil {
+			logging.Warn(logger).Log("msg", "Scheduled handlers still running", "err", err)
+			ok = false
+		}
+	}
+	return ok
+}
+
+//loadConfig reads the configuration file and returns the GitLab instances it configures
+func loadConfig(configFile string) ([]gitbot.Instance, error) {
+	content, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading configuration file %s. Failed with: %s", configFile, err)
+	}
+	conf := &Config{}
+	hclParseTree, err := hcl.ParseBytes(content)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse configuration data: %s", err)
+	}
+	if err := hcl.DecodeObject(&conf, hclParseTree); err != nil {
+		return nil, fmt.Errorf("Failed to decode configuration data: %s", err)
+	}
+	instances, err := conf.instances()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid configuration: %s", err)
+	}
+	return instances, nil
+}
+
+//newClient creates the GitLab client of an instance and the rate limited client used by the bot
+func newClient(inst gitbot.Instance) (*gitlab.Client, plugins.GitLabClient, error) {
+	httpclient := &http.Client{
+		Timeout: 10 * time.Second,
+	}
+	client := gitlab.NewClient(httpclient, inst.Token)
+	client.SetBaseURL(inst.GitURL)
+
+	gcl, err := plugins.NewRateLimitedClient(client, inst.RateLimit)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid rate-limit for GitLab instance %q: %s", inst.Name, err)
+	}
+	return client, gcl, nil
 }
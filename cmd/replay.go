@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/cosminilie/gitbot"
+)
+
+//runReplay implements the "gitbot replay <file>" command. It re-delivers a captured webhook payload to a running bot.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	var (
+		hookURL   = fs.String("url", "http://localhost:9091/hook", "Hook URL of the running bot")
+		eventType = fs.String("event", "", "X-Gitlab-Event header to send. Derived from the payload object_kind when empty")
+		token     = fs.String("token", "", "X-Gitlab-Token header to send, the token of the hook block of the instance")
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s replay [flags] <file>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	payload, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Printf("Error loading payload file %s. Failed with: %s\n", fs.Arg(0), err)
+		return 1
+	}
+	if err := gitbot.Replay(*hookURL, *eventType, *token, payload); err != nil {
+		fmt.Printf("Failed to replay %s: %s\n", fs.Arg(0), err)
+		return 1
+	}
+	fmt.Printf("Replayed %s to %s\n", fs.Arg(0), *hookURL)
+	return 0
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/cosminilie/gitbot"
+	"github.com/cosminilie/gitbot/plugins"
+)
+
+//runReport implements the "gitbot report access" command. It prints who has which access to the configured groups
+//and projects, who was downgraded by drop_rights and who breaks the policy right now.
+func runReport(args []string, configFile, auditFile string) int {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	var (
+		instance = fs.String("instance", "", "Only report on this GitLab instance")
+		format   = fs.String("format", "json", "Format of the report: json or csv")
+		file     = fs.String("audit", auditFile, "Audit log the downgrades are read from, the access grants are read next to it")
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-config file] report access [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 || args[0] != "access" {
+		fs.Usage()
+		return 2
+	}
+	fs.Parse(args[1:])
+	if *format != "json" && *format != "csv" {
+		fs.Usage()
+		return 2
+	}
+
+	instances, err := loadConfig(configFile)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	reporter := &gitbot.AccessReporter{
+		//the report goes to stdout
+		Logger:    log.NewNopLogger(),
+		AuditFile: *file,
+	}
+	for _, inst := range instances {
+		_, gcl, err := newClient(inst)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		//the grants saved by the bot keep the members it elevated from showing up as violations
+		var grants *plugins.Grants
+		if *file != "" {
+			grants, err = plugins.OpenGrants(gitbot.GrantsFile(*file, inst.Name))
+			if err != nil {
+				fmt.Println(err)
+				return 1
+			}
+		}
+		reporter.Sources = append(reporter.Sources, gitbot.AccessSource{Instance: inst, Client: gcl, Grants: grants})
+	}
+	rep, err := reporter.Report(*instance)
+	if err != nil {
+		fmt.Printf("Failed to build the access report: %s\n", err)
+		return 1
+	}
+
+	if *format == "csv" {
+		err = gitbot.WriteAccessCSV(os.Stdout, rep)
+	} else {
+		err = gitbot.WriteAccessJSON(os.Stdout, rep)
+	}
+	if err != nil {
+		return 1
+	}
+	for _, e := range rep.Errors {
+		fmt.Fprintln(os.Stderr, e)
+	}
+	if len(rep.Errors) > 0 {
+		return 1
+	}
+	return 0
+}
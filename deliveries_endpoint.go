@@ -0,0 +1,121 @@
+package gitbot
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const deliveriesPath = "/debug/deliveries"
+
+//DeliveriesHandler returns a handler to browse and re-deliver the deliveries captured by the router Recorder. It serves:
+//
+//	GET  /debug/deliveries?limit=N          recent deliveries without payloads, newest first
+//	GET  /debug/deliveries/<id>             a single delivery including headers and payload
+//	POST /debug/deliveries/<id>/redeliver   dispatch the recorded payload again
+//
+//Re-delivering runs every plugin again, a /lgtm merges, so it requires the X-Gitlab-Token header to hold the hook
+//token of the instance the delivery was received from. Instances without a hook token cannot re-deliver.
+func (rt *Router) DeliveriesHandler() http.Handler {
+	return http.HandlerFunc(rt.serveDeliveries)
+}
+
+func (rt *Router) serveDeliveries(w http.ResponseWriter, r *http.Request) {
+	if rt.Recorder == nil {
+		http.Error(w, "404 Not Found: capture is disabled", http.StatusNotFound)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, deliveriesPath), "/"), "/")
+	switch {
+	case parts[0] == "" && r.Method == http.MethodGet:
+		rt.listDeliveries(w, r)
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		d, err := rt.Recorder.Delivery(parts[0])
+		if err != nil {
+			http.Error(w, "404 Not Found: "+err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, d)
+	case len(parts) == 2 && parts[1] == "redeliver" && r.Method == http.MethodPost:
+		rt.redeliver(w, r, parts[0])
+	default:
+		http.Error(w, "405 Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (rt *Router) listDeliveries(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			http.Error(w, "400 Bad Request: invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	ds, err := rt.Recorder.Deliveries()
+	if err != nil {
+		http.Error(w, "500 Internal Server Error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(ds) > limit {
+		ds = ds[:limit]
+	}
+	//keep the listing small, payloads are available per delivery
+	summaries := make([]Delivery, 0, len(ds))
+	for _, d := range ds {
+		summaries = append(summaries, Delivery{
+			ID:           d.ID,
+			Instance:     d.Instance,
+			Time:         d.Time,
+			EventType:    d.EventType,
+			RedeliveryOf: d.RedeliveryOf,
+			Outcomes:     d.Outcomes,
+		})
+	}
+	writeJSON(w, summaries)
+}
+
+func (rt *Router) redeliver(w http.ResponseWriter, r *http.Request, id string) {
+	d, err := rt.Recorder.Delivery(id)
+	if err != nil {
+		http.Error(w, "404 Not Found: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	s := rt.server(d.Instance)
+	if s == nil {
+		http.Error(w, "404 Not Found: No GitLab instance named "+d.Instance, http.StatusNotFound)
+		return
+	}
+	if s.Token == "" {
+		http.Error(w, "403 Forbidden: No hook token is configured for "+d.Instance, http.StatusForbidden)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Gitlab-Token")), []byte(s.Token)) != 1 {
+		http.Error(w, "401 Unauthorized: Invalid X-Gitlab-Token Header", http.StatusUnauthorized)
+		return
+	}
+	if !s.track() {
+		http.Error(w, "503 Service Unavailable: Shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.inflight.Done()
+
+	newID, err := s.demuxEvent(d.EventType, d.Headers, d.Payload, d.ID)
+	if err != nil {
+		http.Error(w, "500 Internal Server Error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]string{"id": newID, "redelivery_of": d.ID})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -0,0 +1,77 @@
+package gitbot
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestRedeliver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitbot-deliveries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r, err := NewRecorder(dir, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	logger := log.NewNopLogger()
+	svc := &recordingService{}
+	s := &Server{Service: svc, Logger: logger, Instance: "company", Recorder: r, Token: "s3cr3t"}
+	rt := NewRouter(logger, r)
+	rt.Add("gitlab.company.net", s)
+	debug := httptest.NewServer(rt.DeliveriesHandler())
+	defer debug.Close()
+
+	payload, err := ioutil.ReadFile(filepath.Join("testdata", "note_merge_request_comment.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := r.Record("company", "Note Hook", http.Header{}, payload, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	redeliver := func(token string) int {
+		req, err := http.NewRequest("POST", debug.URL+deliveriesPath+"/"+id+"/redeliver", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("X-Gitlab-Token", token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := redeliver(""); code != http.StatusUnauthorized {
+		t.Errorf("got %d re-delivering without a token, want 401", code)
+	}
+	if code := redeliver("guess"); code != http.StatusUnauthorized {
+		t.Errorf("got %d re-delivering with a wrong token, want 401", code)
+	}
+	if code := redeliver("s3cr3t"); code != http.StatusOK {
+		t.Errorf("got %d re-delivering with the hook token, want 200", code)
+	}
+	s.inflight.Wait()
+	if svc.Events() != 1 {
+		t.Errorf("got %d events dispatched, want 1", svc.Events())
+	}
+
+	//instances without a hook token cannot re-deliver at all
+	s.Token = ""
+	if code := redeliver(""); code != http.StatusForbidden {
+		t.Errorf("got %d re-delivering on an instance without a hook token, want 403", code)
+	}
+}
@@ -0,0 +1,52 @@
+package gitbot
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/cosminilie/gitbot/plugins"
+	"github.com/go-kit/kit/log"
+)
+
+//GrantsFile returns the file the access grants of an instance are saved to, next to the audit log
+func GrantsFile(auditFile, instance string) string {
+	return filepath.Join(filepath.Dir(auditFile), "grants-"+instance+".json")
+}
+
+//expireGrants drops the access requests that were not approved in time and lowers the members whose access grant
+//expired back to the level they had before it, on every group whether drop_rights runs on it or not. A group that
+//fails does not stop the others.
+func expireGrants(s *basicService) error {
+	errs := groupErrors{}
+	expired, err := s.Plugins.Grants.PruneRequests(time.Now())
+	for _, g := range expired {
+		s.logger.Log(
+			"Repo", g.Group,
+			"Plugin", "expire_grants",
+			"Action", "DropRequest",
+			"Username", g.User,
+			"Requested", g.RequestedAt,
+		)
+	}
+	if err != nil {
+		errs["requests"] = err
+	}
+	for _, gid := range s.Plugins.Grants.ExpiredGroups(time.Now()) {
+		logger := log.NewContext(s.logger).With("GroupID", gid, "Plugin", "expire_grants")
+		err := s.runPlugin(s.ctx, logger, "expire_grants", func(ctx context.Context, pc *plugins.PluginClient) error {
+			pc.Pmut.Lock()
+			defer pc.Pmut.Unlock()
+
+			return plugins.RevokeExpired(ctx, pc.Logger, pc.GitLabClient, pc.Audit, pc.Grants, "expire_grants", gid, time.Now())
+		})
+		if err != nil {
+			errs[fmt.Sprint(gid)] = err
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
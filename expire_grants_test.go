@@ -0,0 +1,54 @@
+package gitbot
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cosminilie/gitbot/gitlabfake"
+	"github.com/cosminilie/gitbot/plugins"
+	"github.com/go-kit/kit/log"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+func TestExpireGrants(t *testing.T) {
+	gl := gitlabfake.New()
+	//neither group runs drop_rights
+	g := gl.AddGroup("tools")
+	sub := gl.AddGroup("tools/infra")
+	gl.AddGroupMember(g.ID, "alice", gitlab.MasterPermissions)
+	gl.AddGroupMember(sub.ID, "bob", gitlab.MasterPermissions)
+	p := gl.AddProject("tools/infra/api")
+	issue, _ := gl.AddIssue(p.ID, "access requests")
+
+	grants := plugins.NewGrants()
+	for gid, u := range map[int]string{g.ID: "alice", sub.ID: "bob"} {
+		grants.Approve(plugins.AccessGrant{
+			GroupID:       gid,
+			User:          u,
+			Level:         gitlab.MasterPermissions,
+			ProjectID:     p.ID,
+			NoteableType:  "Issue",
+			NoteableIID:   issue.IID,
+			PreviousLevel: gitlab.DeveloperPermissions,
+			Approver:      "carol",
+			Expires:       time.Now().Add(-time.Minute),
+		})
+	}
+	//a request nobody approved in time
+	grants.Request(plugins.AccessGrant{GroupID: g.ID, User: "dave", Level: gitlab.MasterPermissions, Duration: time.Hour, ProjectID: p.ID,
+		NoteableType: "Issue", NoteableIID: issue.IID, RequestedAt: time.Now().Add(-2 * time.Hour)})
+	svc := NewBasicService(context.Background(), log.NewNopLogger(), gl, nil, grants, nil, Instance{Name: DefaultInstance})
+	if err := expireGrants(svc); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, gid := range []int{g.ID, sub.ID} {
+		if m := gl.Members(gid)[0]; m.AccessLevel != gitlab.DeveloperPermissions {
+			t.Errorf("got %s at %s, want developer", m.Username, plugins.AccessLevelName(m.AccessLevel))
+		}
+	}
+	if pending, active := grants.List(); len(pending) != 0 || len(active) != 0 {
+		t.Errorf("got pending grants %+v, active grants %+v", pending, active)
+	}
+}
@@ -25,7 +25,7 @@ Source2:	gitbot
 %build
 mkdir -p /tmp/gopath/{src,bin}/github.com/cosminilie
 cp -r $CI_PROJECT_DIR  $GOPATH/src/github.com/cosminilie
-go build -o /tmp/bin/%{name} -ldflags "-X main.majorVersion=${GIT_MAJOR_VERSION} -X main.minorVersion=${GIT_MINOR_VERSION} -X main.gitVersion=${COMMIT_HASH} -X main.buildDate=${BUILD_DATE}" $GOPATH/src/github.com/cosminilie/gitbot/cmd/main.go
+go build -o /tmp/bin/%{name} -ldflags "-X main.majorVersion=${GIT_MAJOR_VERSION} -X main.minorVersion=${GIT_MINOR_VERSION} -X main.gitVersion=${COMMIT_HASH} -X main.buildDate=${BUILD_DATE}" github.com/cosminilie/gitbot/cmd
 
 %install
 cp  -r $CI_PROJECT_DIR/build/* %{_sourcedir}
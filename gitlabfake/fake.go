@@ -0,0 +1,1407 @@
+//Package gitlabfake provides an in memory GitLab that implements plugins.GitLabClient.
+//It keeps just enough state (projects, groups, members, merge requests, notes and hooks) to exercise the bot and its plugins without a server.
+package gitlabfake
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cosminilie/gitbot/plugins"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+var _ plugins.GitLabClient = (*GitLab)(nil)
+
+//GitLab is an in memory fake of the GitLab API. It is safe for concurrent use.
+type GitLab struct {
+	mut      sync.Mutex
+	nextID   int
+	projects map[int]*gitlab.Project
+	groups   map[int]*plugins.Group
+	members  map[int][]*gitlab.GroupMember
+	//projectMembers are the members added to a project directly
+	projectMembers map[int][]*gitlab.ProjectMember
+	mrs            map[int][]*plugins.MergeRequest
+	notes          map[int]map[int][]*gitlab.Note
+	issues         map[int][]*gitlab.Issue
+	issueNotes     map[int]map[int][]*gitlab.Note
+	protected      map[int][]*plugins.ProtectedBranch
+	//commits holds the parents of each commit of a project
+	commits map[int]map[string][]string
+	//mrCommits holds the commits of each merge request of a project, newest first like GitLab lists them
+	mrCommits map[int]map[int][]*gitlab.Commit
+	//statuses holds the statuses of the jobs and external checks of each commit of a project
+	statuses map[int]map[string][]*gitlab.CommitStatus
+	//jobs holds the jobs of each pipeline
+	jobs  map[int][]*plugins.Job
+	hooks map[int][]*gitlab.ProjectHook
+	//groupHooks and systemHooks are only available on GitLab EE and to administrators
+	groupHooks  map[int][]*gitlab.ProjectHook
+	systemHooks []*gitlab.ProjectHook
+	//hookTokens holds the secret token of each hook, GitLab never returns it
+	hookTokens map[int]string
+	//user is the user the token belongs to
+	user *gitlab.User
+}
+
+//New returns an empty fake GitLab
+func New() *GitLab {
+	return &GitLab{
+		projects:       make(map[int]*gitlab.Project),
+		groups:         make(map[int]*plugins.Group),
+		members:        make(map[int][]*gitlab.GroupMember),
+		projectMembers: make(map[int][]*gitlab.ProjectMember),
+		mrs:            make(map[int][]*plugins.MergeRequest),
+		notes:          make(map[int]map[int][]*gitlab.Note),
+		issues:         make(map[int][]*gitlab.Issue),
+		issueNotes:     make(map[int]map[int][]*gitlab.Note),
+		protected:      make(map[int][]*plugins.ProtectedBranch),
+		commits:        make(map[int]map[string][]string),
+		statuses:       make(map[int]map[string][]*gitlab.CommitStatus),
+		jobs:           make(map[int][]*plugins.Job),
+		mrCommits:      make(map[int]map[int][]*gitlab.Commit),
+		hooks:          make(map[int][]*gitlab.ProjectHook),
+		groupHooks:     make(map[int][]*gitlab.ProjectHook),
+		hookTokens:     make(map[int]string),
+	}
+}
+
+//AddGroup creates a group identified by its full path, e.g. "platform/infra". If the parent path matches an
+//existing group the new group is one of its subgroups.
+func (f *GitLab) AddGroup(path string) *gitlab.Group {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	parent, name := "", path
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		parent, name = path[:i], path[i+1:]
+	}
+	g := &plugins.Group{
+		Group: gitlab.Group{
+			ID:   f.id(),
+			Name: name,
+			Path: name,
+		},
+		FullPath: path,
+	}
+	if p := f.group(parent); p != nil {
+		g.ParentID = p.ID
+	}
+	f.groups[g.ID] = g
+	return &g.Group
+}
+
+//AddProject creates a project with the given path, e.g. "group/name". If the namespace matches an existing group the project is listed as part of that group.
+func (f *GitLab) AddProject(path string) *gitlab.Project {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	namespace, name := "", path
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		namespace, name = path[:i], path[i+1:]
+	}
+	p := &gitlab.Project{
+		ID:                f.id(),
+		Name:              name,
+		Path:              name,
+		PathWithNamespace: path,
+		NameWithNamespace: strings.Replace(path, "/", " / ", -1),
+		DefaultBranch:     "master",
+		Namespace: &gitlab.ProjectNamespace{
+			Name: namespace,
+			Path: namespace,
+		},
+	}
+	if g := f.group(namespace); g != nil {
+		p.Namespace.ID = g.ID
+	}
+	f.projects[p.ID] = p
+	return p
+}
+
+//ArchiveProject marks a project as archived
+func (f *GitLab) ArchiveProject(pid interface{}) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	if p := f.project(pid); p != nil {
+		p.Archived = true
+	}
+}
+
+//RemoveProject deletes a project with its merge requests, issues and hooks
+func (f *GitLab) RemoveProject(pid interface{}) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	if p := f.project(pid); p != nil {
+		delete(f.projects, p.ID)
+		delete(f.mrs, p.ID)
+		delete(f.notes, p.ID)
+		delete(f.issues, p.ID)
+		delete(f.issueNotes, p.ID)
+		delete(f.protected, p.ID)
+		delete(f.commits, p.ID)
+		delete(f.hooks, p.ID)
+		delete(f.projectMembers, p.ID)
+	}
+}
+
+//AddGroupMember adds a user with the given access level to a group
+func (f *GitLab) AddGroupMember(gid interface{}, username string, level gitlab.AccessLevelValue) (*gitlab.GroupMember, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	g := f.group(gid)
+	if g == nil {
+		return nil, notFound("POST", fmt.Sprintf("groups/%v/members", gid))
+	}
+	m := &gitlab.GroupMember{
+		ID:          f.id(),
+		Username:    username,
+		Name:        username,
+		State:       "active",
+		AccessLevel: level,
+	}
+	f.members[g.ID] = append(f.members[g.ID], m)
+	return m, nil
+}
+
+//AddProjectMember adds a user with the given access level to a project
+func (f *GitLab) AddProjectMember(pid interface{}, username string, level gitlab.AccessLevelValue) (*gitlab.ProjectMember, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	p := f.project(pid)
+	if p == nil {
+		return nil, notFound("POST", fmt.Sprintf("projects/%v/members", pid))
+	}
+	m := &gitlab.ProjectMember{
+		ID:          f.id(),
+		Username:    username,
+		Name:        username,
+		State:       "active",
+		AccessLevel: level,
+	}
+	f.projectMembers[p.ID] = append(f.projectMembers[p.ID], m)
+	return m, nil
+}
+
+//SetCurrentUser sets the user the token of the bot belongs to. It defaults to "gitbot".
+func (f *GitLab) SetCurrentUser(username string) *gitlab.User {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	f.user = &gitlab.User{ID: f.id(), Username: username, Name: username, State: "active"}
+	return f.user
+}
+
+//AddMergeRequest opens a merge request on a project
+func (f *GitLab) AddMergeRequest(pid interface{}, source, target, title string) (*gitlab.MergeRequest, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	p := f.project(pid)
+	if p == nil {
+		return nil, notFound("POST", fmt.Sprintf("projects/%v/merge_requests", pid))
+	}
+	mr := &plugins.MergeRequest{
+		MergeRequest: gitlab.MergeRequest{
+			ID:              f.id(),
+			IID:             len(f.mrs[p.ID]) + 1,
+			ProjectID:       p.ID,
+			Title:           title,
+			State:           "opened",
+			SourceBranch:    source,
+			TargetBranch:    target,
+			SourceProjectID: p.ID,
+			TargetProjectID: p.ID,
+			MergeStatus:     "can_be_merged",
+		},
+	}
+	mr.SHA = fmt.Sprintf("%s-%d", source, mr.ID)
+	f.mrs[p.ID] = append(f.mrs[p.ID], mr)
+	return &mr.MergeRequest, nil
+}
+
+//SetPipeline sets the status of the head pipeline of a merge request, creating a pipeline for its SHA when the
+//head pipeline belongs to an older SHA
+func (f *GitLab) SetPipeline(pid interface{}, mergeRequest int, status string) (*plugins.Pipeline, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	path := fmt.Sprintf("projects/%v/merge_requests/%d/pipelines", pid, mergeRequest)
+	p := f.project(pid)
+	if p == nil {
+		return nil, notFound("POST", path)
+	}
+	mr := f.mergeRequest(p.ID, mergeRequest)
+	if mr == nil {
+		return nil, notFound("POST", path)
+	}
+	if mr.HeadPipeline == nil || mr.HeadPipeline.SHA != mr.SHA {
+		mr.HeadPipeline = &plugins.Pipeline{ID: f.id(), SHA: mr.SHA, Ref: mr.SourceBranch}
+	}
+	mr.HeadPipeline.Status = status
+	//like GitLab a merge request set to merge when the pipeline succeeds is merged or left alone once it finished
+	if mr.MergeWhenBuildSucceeds {
+		switch status {
+		case "success":
+			f.merge(p.ID, mr)
+		case "failed", "canceled", "skipped":
+			mr.MergeWhenBuildSucceeds = false
+		}
+	}
+	pl := *mr.HeadPipeline
+	return &pl, nil
+}
+
+//AddPipelineJob adds a job to the head pipeline of a merge request, which must exist, or sets the status of the job
+//of the same name. Like GitLab the job is also listed in the statuses of the commit of the pipeline.
+func (f *GitLab) AddPipelineJob(pid interface{}, mergeRequest int, name, status string) error {
+	f.mut.Lock()
+	path := fmt.Sprintf("projects/%v/merge_requests/%d/pipelines", pid, mergeRequest)
+	p := f.project(pid)
+	if p == nil {
+		f.mut.Unlock()
+		return notFound("POST", path)
+	}
+	mr := f.mergeRequest(p.ID, mergeRequest)
+	if mr == nil || mr.HeadPipeline == nil {
+		f.mut.Unlock()
+		return notFound("POST", path)
+	}
+	pl := mr.HeadPipeline
+	found := false
+	for _, j := range f.jobs[pl.ID] {
+		if j.Name == name {
+			j.Status, found = status, true
+		}
+	}
+	if !found {
+		f.jobs[pl.ID] = append(f.jobs[pl.ID], &plugins.Job{ID: f.id(), Name: name, Status: status})
+	}
+	sha := pl.SHA
+	f.mut.Unlock()
+
+	return f.AddCommitStatus(pid, sha, name, status)
+}
+
+//ListPipelineJobs implements plugins.GitLabClient
+func (f *GitLab) ListPipelineJobs(pid interface{}, pipeline int, opt *gitlab.ListOptions) ([]*plugins.Job, *gitlab.Response, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	p := f.project(pid)
+	if p == nil {
+		return nil, nil, notFound("GET", fmt.Sprintf("projects/%v/pipelines/%d/jobs", pid, pipeline))
+	}
+	js := f.jobs[pipeline]
+	start, end, resp := page(len(js), opt)
+	var out []*plugins.Job
+	for _, j := range js[start:end] {
+		c := *j
+		out = append(out, &c)
+	}
+	return out, resp, nil
+}
+
+//AddMergeRequestCommit pushes a commit with message to the source branch of a merge request, it becomes the last
+//commit of the merge request
+func (f *GitLab) AddMergeRequestCommit(pid interface{}, mergeRequest int, message string) (*gitlab.Commit, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	path := fmt.Sprintf("projects/%v/merge_requests/%d/commits", pid, mergeRequest)
+	p := f.project(pid)
+	if p == nil {
+		return nil, notFound("POST", path)
+	}
+	mr := f.mergeRequest(p.ID, mergeRequest)
+	if mr == nil {
+		return nil, notFound("POST", path)
+	}
+	title := message
+	if i := strings.Index(message, "\n"); i >= 0 {
+		title = message[:i]
+	}
+	c := &gitlab.Commit{ID: fmt.Sprintf("%s-%d", mr.SourceBranch, f.id()), Title: title, Message: message}
+	if f.mrCommits[p.ID] == nil {
+		f.mrCommits[p.ID] = make(map[int][]*gitlab.Commit)
+	}
+	f.mrCommits[p.ID][mergeRequest] = append([]*gitlab.Commit{c}, f.mrCommits[p.ID][mergeRequest]...)
+	mr.SHA = c.ID
+	cc := *c
+	return &cc, nil
+}
+
+//SetDiverged sets the number of commits of the target branch missing from the source branch of a merge request
+func (f *GitLab) SetDiverged(pid interface{}, mergeRequest int, commits int) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	if p := f.project(pid); p != nil {
+		if mr := f.mergeRequest(p.ID, mergeRequest); mr != nil {
+			mr.DivergedCommitsCount = commits
+		}
+	}
+}
+
+//AddIssue opens an issue on a project
+func (f *GitLab) AddIssue(pid interface{}, title string) (*gitlab.Issue, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	return f.addIssue(pid, &gitlab.CreateIssueOptions{Title: &title})
+}
+
+//Issues returns the issues of a project
+func (f *GitLab) Issues(pid interface{}) []*gitlab.Issue {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	p := f.project(pid)
+	if p == nil {
+		return nil
+	}
+	return append([]*gitlab.Issue(nil), f.issues[p.ID]...)
+}
+
+//ProtectedBranches returns the protected branches of a project
+func (f *GitLab) ProtectedBranches(pid interface{}) []*plugins.ProtectedBranch {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	p := f.project(pid)
+	if p == nil {
+		return nil
+	}
+	return append([]*plugins.ProtectedBranch(nil), f.protected[p.ID]...)
+}
+
+//MergeRequest returns the current state of a merge request
+func (f *GitLab) MergeRequest(pid interface{}, mergeRequest int) *gitlab.MergeRequest {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	p := f.project(pid)
+	if p == nil {
+		return nil
+	}
+	if mr := f.mergeRequest(p.ID, mergeRequest); mr != nil {
+		return &mr.MergeRequest
+	}
+	return nil
+}
+
+//Notes returns the notes created on a merge request
+func (f *GitLab) Notes(pid interface{}, mergeRequest int) []*gitlab.Note {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	p := f.project(pid)
+	if p == nil {
+		return nil
+	}
+	return append([]*gitlab.Note(nil), f.notes[p.ID][mergeRequest]...)
+}
+
+//IssueNotes returns the notes created on an issue
+func (f *GitLab) IssueNotes(pid interface{}, issue int) []*gitlab.Note {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	p := f.project(pid)
+	if p == nil {
+		return nil
+	}
+	return append([]*gitlab.Note(nil), f.issueNotes[p.ID][issue]...)
+}
+
+//Hooks returns the hooks registered on a project
+func (f *GitLab) Hooks(pid interface{}) []*gitlab.ProjectHook {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	p := f.project(pid)
+	if p == nil {
+		return nil
+	}
+	return append([]*gitlab.ProjectHook(nil), f.hooks[p.ID]...)
+}
+
+//GroupHooks returns the hooks registered on a group
+func (f *GitLab) GroupHooks(gid interface{}) []*gitlab.ProjectHook {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	g := f.group(gid)
+	if g == nil {
+		return nil
+	}
+	return append([]*gitlab.ProjectHook(nil), f.groupHooks[g.ID]...)
+}
+
+//HookToken returns the secret token of a hook
+func (f *GitLab) HookToken(hook int) string {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	return f.hookTokens[hook]
+}
+
+//SystemHooks returns the system hooks
+func (f *GitLab) SystemHooks() []*gitlab.ProjectHook {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	return append([]*gitlab.ProjectHook(nil), f.systemHooks...)
+}
+
+//Members returns the members of a group
+func (f *GitLab) Members(gid interface{}) []*gitlab.GroupMember {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	g := f.group(gid)
+	if g == nil {
+		return nil
+	}
+	return append([]*gitlab.GroupMember(nil), f.members[g.ID]...)
+}
+
+//ProjectMembers returns the members of a project
+func (f *GitLab) ProjectMembers(pid interface{}) []*gitlab.ProjectMember {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	p := f.project(pid)
+	if p == nil {
+		return nil
+	}
+	return append([]*gitlab.ProjectMember(nil), f.projectMembers[p.ID]...)
+}
+
+//CreateMergeRequestNote implements plugins.GitLabClient
+func (f *GitLab) CreateMergeRequestNote(pid interface{}, mergeRequest int, opt *gitlab.CreateMergeRequestNoteOptions) (*gitlab.Note, *gitlab.Response, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	p := f.project(pid)
+	if p == nil || f.mergeRequest(p.ID, mergeRequest) == nil {
+		return nil, nil, notFound("POST", fmt.Sprintf("projects/%v/merge_requests/%d/notes", pid, mergeRequest))
+	}
+	n := &gitlab.Note{ID: f.id()}
+	if opt != nil && opt.Body != nil {
+		n.Body = *opt.Body
+	}
+	if f.notes[p.ID] == nil {
+		f.notes[p.ID] = make(map[int][]*gitlab.Note)
+	}
+	f.notes[p.ID][mergeRequest] = append(f.notes[p.ID][mergeRequest], n)
+	return n, nil, nil
+}
+
+//CreateIssueNote implements plugins.GitLabClient
+func (f *GitLab) CreateIssueNote(pid interface{}, issue int, opt *gitlab.CreateIssueNoteOptions) (*gitlab.Note, *gitlab.Response, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	p := f.project(pid)
+	if p == nil || f.issue(p.ID, issue) == nil {
+		return nil, nil, notFound("POST", fmt.Sprintf("projects/%v/issues/%d/notes", pid, issue))
+	}
+	n := &gitlab.Note{ID: f.id()}
+	if opt != nil && opt.Body != nil {
+		n.Body = *opt.Body
+	}
+	if f.issueNotes[p.ID] == nil {
+		f.issueNotes[p.ID] = make(map[int][]*gitlab.Note)
+	}
+	f.issueNotes[p.ID][issue] = append(f.issueNotes[p.ID][issue], n)
+	return n, nil, nil
+}
+
+//AddCommit adds a commit with its parents to the repository of a project
+func (f *GitLab) AddCommit(pid interface{}, sha string, parents ...string) error {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	p := f.project(pid)
+	if p == nil {
+		return notFound("POST", fmt.Sprintf("projects/%v/repository/commits", pid))
+	}
+	if f.commits[p.ID] == nil {
+		f.commits[p.ID] = make(map[string][]string)
+	}
+	f.commits[p.ID][sha] = parents
+	return nil
+}
+
+//AddCommitStatus sets the status of a job or external check of a commit, replacing the previous status of the
+//same name
+func (f *GitLab) AddCommitStatus(pid interface{}, sha, name, status string) error {
+	_, _, err := f.SetCommitStatus(pid, sha, &gitlab.SetCommitStatusOptions{State: gitlab.BuildState(status), Name: &name})
+	return err
+}
+
+//SetCommitStatus implements plugins.GitLabClient. Like GitLab the status replaces the previous status of the same
+//name.
+func (f *GitLab) SetCommitStatus(pid interface{}, sha string, opt *gitlab.SetCommitStatusOptions) (*gitlab.CommitStatus, *gitlab.Response, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	path := fmt.Sprintf("projects/%v/statuses/%s", pid, sha)
+	p := f.project(pid)
+	if p == nil {
+		return nil, nil, notFound("POST", path)
+	}
+	if opt == nil || opt.State == "" {
+		return nil, nil, errorResponse("POST", path, http.StatusBadRequest, "state is missing")
+	}
+	cs := &gitlab.CommitStatus{ID: f.id(), SHA: sha, Name: "default", Status: string(opt.State)}
+	if opt.Name != nil {
+		cs.Name = *opt.Name
+	}
+	if opt.Ref != nil {
+		cs.Ref = *opt.Ref
+	}
+	if opt.Description != nil {
+		cs.Description = *opt.Description
+	}
+	if f.statuses[p.ID] == nil {
+		f.statuses[p.ID] = make(map[string][]*gitlab.CommitStatus)
+	}
+	c := *cs
+	for i, o := range f.statuses[p.ID][sha] {
+		if o.Name == cs.Name {
+			f.statuses[p.ID][sha][i] = cs
+			return &c, nil, nil
+		}
+	}
+	f.statuses[p.ID][sha] = append(f.statuses[p.ID][sha], cs)
+	return &c, nil, nil
+}
+
+//ListCommitStatuses implements plugins.GitLabClient
+func (f *GitLab) ListCommitStatuses(pid interface{}, sha string, opt *gitlab.ListOptions) ([]*gitlab.CommitStatus, *gitlab.Response, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	p := f.project(pid)
+	if p == nil {
+		return nil, nil, notFound("GET", fmt.Sprintf("projects/%v/repository/commits/%s/statuses", pid, sha))
+	}
+	cs := f.statuses[p.ID][sha]
+	start, end, resp := page(len(cs), opt)
+	var out []*gitlab.CommitStatus
+	for _, s := range cs[start:end] {
+		c := *s
+		out = append(out, &c)
+	}
+	return out, resp, nil
+}
+
+//Compare implements plugins.GitLabClient. Like GitLab it lists the commits reachable from To that are not reachable
+//from From, without diffs.
+func (f *GitLab) Compare(pid interface{}, opt *gitlab.CompareOptions) (*gitlab.Compare, *gitlab.Response, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	path := fmt.Sprintf("projects/%v/repository/compare", pid)
+	p := f.project(pid)
+	if p == nil || opt == nil || opt.From == nil || opt.To == nil {
+		return nil, nil, notFound("GET", path)
+	}
+	commits := f.commits[p.ID]
+	if _, ok := commits[*opt.From]; !ok {
+		return nil, nil, notFound("GET", path)
+	}
+	if _, ok := commits[*opt.To]; !ok {
+		return nil, nil, notFound("GET", path)
+	}
+	from := ancestors(commits, *opt.From)
+	cmp := &gitlab.Compare{CompareSameRef: *opt.From == *opt.To}
+	for sha := range ancestors(commits, *opt.To) {
+		if !from[sha] {
+			cmp.Commits = append(cmp.Commits, &gitlab.Commit{ID: sha})
+		}
+	}
+	sort.Slice(cmp.Commits, func(i, k int) bool { return cmp.Commits[i].ID < cmp.Commits[k].ID })
+	return cmp, nil, nil
+}
+
+//ancestors returns the commit and all its ancestors
+func ancestors(commits map[string][]string, sha string) map[string]bool {
+	seen := map[string]bool{}
+	todo := []string{sha}
+	for len(todo) > 0 {
+		c := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		if seen[c] {
+			continue
+		}
+		seen[c] = true
+		todo = append(todo, commits[c]...)
+	}
+	return seen
+}
+
+//CreateIssue implements plugins.GitLabClient
+func (f *GitLab) CreateIssue(pid interface{}, opt *gitlab.CreateIssueOptions) (*gitlab.Issue, *gitlab.Response, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	i, err := f.addIssue(pid, opt)
+	return i, nil, err
+}
+
+//ListProtectedBranches implements plugins.GitLabClient
+func (f *GitLab) ListProtectedBranches(pid interface{}, opt *gitlab.ListOptions) ([]*plugins.ProtectedBranch, *gitlab.Response, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	p := f.project(pid)
+	if p == nil {
+		return nil, nil, notFound("GET", fmt.Sprintf("projects/%v/protected_branches", pid))
+	}
+	start, end, resp := page(len(f.protected[p.ID]), opt)
+	return append([]*plugins.ProtectedBranch(nil), f.protected[p.ID][start:end]...), resp, nil
+}
+
+//ProtectBranch implements plugins.GitLabClient. Like GitLab it refuses to protect a branch twice.
+func (f *GitLab) ProtectBranch(pid interface{}, opt *plugins.ProtectBranchOptions) (*plugins.ProtectedBranch, *gitlab.Response, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	path := fmt.Sprintf("projects/%v/protected_branches", pid)
+	p := f.project(pid)
+	if p == nil {
+		return nil, nil, notFound("POST", path)
+	}
+	if opt == nil || opt.Name == nil {
+		return nil, nil, errorResponse("POST", path, http.StatusBadRequest, "name is missing")
+	}
+	for _, b := range f.protected[p.ID] {
+		if b.Name == *opt.Name {
+			return nil, nil, errorResponse("POST", path, http.StatusConflict, "Protected branch already exists")
+		}
+	}
+	//GitLab defaults to maintainers
+	push, merge := gitlab.MasterPermissions, gitlab.MasterPermissions
+	if opt.PushAccessLevel != nil {
+		push = *opt.PushAccessLevel
+	}
+	if opt.MergeAccessLevel != nil {
+		merge = *opt.MergeAccessLevel
+	}
+	b := &plugins.ProtectedBranch{
+		Name:              *opt.Name,
+		PushAccessLevels:  []plugins.BranchAccessDescription{{AccessLevel: push}},
+		MergeAccessLevels: []plugins.BranchAccessDescription{{AccessLevel: merge}},
+	}
+	f.protected[p.ID] = append(f.protected[p.ID], b)
+	return b, nil, nil
+}
+
+//UnprotectBranch implements plugins.GitLabClient
+func (f *GitLab) UnprotectBranch(pid interface{}, name string) (*gitlab.Response, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	path := fmt.Sprintf("projects/%v/protected_branches/%s", pid, name)
+	p := f.project(pid)
+	if p == nil {
+		return nil, notFound("DELETE", path)
+	}
+	for i, b := range f.protected[p.ID] {
+		if b.Name == name {
+			f.protected[p.ID] = append(f.protected[p.ID][:i], f.protected[p.ID][i+1:]...)
+			return nil, nil
+		}
+	}
+	return nil, notFound("DELETE", path)
+}
+
+//AcceptMergeRequest implements plugins.GitLabClient. Like GitLab a merge request set to merge when the pipeline
+//succeeds waits for its running pipeline.
+func (f *GitLab) AcceptMergeRequest(pid interface{}, mergeRequest int, opt *plugins.AcceptMergeRequestOptions) (*gitlab.MergeRequest, *gitlab.Response, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	path := fmt.Sprintf("projects/%v/merge_requests/%d/merge", pid, mergeRequest)
+	p := f.project(pid)
+	if p == nil {
+		return nil, nil, notFound("PUT", path)
+	}
+	mr := f.mergeRequest(p.ID, mergeRequest)
+	if mr == nil {
+		return nil, nil, notFound("PUT", path)
+	}
+	if mr.State != "opened" || mr.MergeStatus == "cannot_be_merged" {
+		return nil, nil, errorResponse("PUT", path, http.StatusMethodNotAllowed, "Method Not Allowed")
+	}
+	if opt != nil && opt.SHA != nil && *opt.SHA != mr.SHA {
+		return nil, nil, errorResponse("PUT", path, http.StatusConflict, "SHA does not match HEAD of source branch")
+	}
+	if opt != nil && opt.ShouldRemoveSourceBranch != nil {
+		mr.SouldRemoveSourceBranch = *opt.ShouldRemoveSourceBranch
+	}
+	if opt != nil && opt.MergeWhenPipelineSucceeds != nil && *opt.MergeWhenPipelineSucceeds &&
+		mr.HeadPipeline != nil && mr.HeadPipeline.Status != "success" {
+		mr.MergeWhenBuildSucceeds = true
+		return &mr.MergeRequest, nil, nil
+	}
+	f.merge(p.ID, mr)
+	return &mr.MergeRequest, nil, nil
+}
+
+//merge merges a merge request of a project
+func (f *GitLab) merge(pid int, mr *plugins.MergeRequest) {
+	mr.State = "merged"
+	mr.MergeWhenBuildSucceeds = false
+	//the other merge requests of the target branch are now behind it
+	for _, o := range f.mrs[pid] {
+		if o != mr && o.State == "opened" && o.TargetBranch == mr.TargetBranch {
+			o.DivergedCommitsCount++
+		}
+	}
+}
+
+//UpdateMergeRequest implements plugins.GitLabClient
+func (f *GitLab) UpdateMergeRequest(pid interface{}, mergeRequest int, opt *plugins.UpdateMergeRequestOptions) (*gitlab.MergeRequest, *gitlab.Response, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	path := fmt.Sprintf("projects/%v/merge_requests/%d", pid, mergeRequest)
+	p := f.project(pid)
+	if p == nil {
+		return nil, nil, notFound("PUT", path)
+	}
+	mr := f.mergeRequest(p.ID, mergeRequest)
+	if mr == nil {
+		return nil, nil, notFound("PUT", path)
+	}
+	if opt != nil && opt.Labels != nil {
+		mr.Labels = nil
+		for _, l := range strings.Split(*opt.Labels, ",") {
+			if l = strings.TrimSpace(l); l != "" {
+				mr.Labels = append(mr.Labels, l)
+			}
+		}
+	}
+	c := mr.MergeRequest
+	return &c, nil, nil
+}
+
+//ListMergeRequestCommits implements plugins.GitLabClient
+func (f *GitLab) ListMergeRequestCommits(pid interface{}, mergeRequest int, opt *gitlab.ListOptions) ([]*gitlab.Commit, *gitlab.Response, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	path := fmt.Sprintf("projects/%v/merge_requests/%d/commits", pid, mergeRequest)
+	p := f.project(pid)
+	if p == nil || f.mergeRequest(p.ID, mergeRequest) == nil {
+		return nil, nil, notFound("GET", path)
+	}
+	cs := f.mrCommits[p.ID][mergeRequest]
+	start, end, resp := page(len(cs), opt)
+	var out []*gitlab.Commit
+	for _, c := range cs[start:end] {
+		cc := *c
+		out = append(out, &cc)
+	}
+	return out, resp, nil
+}
+
+//GetMergeRequest implements plugins.GitLabClient
+func (f *GitLab) GetMergeRequest(pid interface{}, mergeRequest int) (*plugins.MergeRequest, *gitlab.Response, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	path := fmt.Sprintf("projects/%v/merge_requests/%d", pid, mergeRequest)
+	p := f.project(pid)
+	if p == nil {
+		return nil, nil, notFound("GET", path)
+	}
+	mr := f.mergeRequest(p.ID, mergeRequest)
+	if mr == nil {
+		return nil, nil, notFound("GET", path)
+	}
+	c := *mr
+	if mr.HeadPipeline != nil {
+		pl := *mr.HeadPipeline
+		c.HeadPipeline = &pl
+	}
+	return &c, nil, nil
+}
+
+//RebaseMergeRequest implements plugins.GitLabClient. The rebase completes at once and pushes a new SHA to the
+//source branch, which has no pipeline yet.
+func (f *GitLab) RebaseMergeRequest(pid interface{}, mergeRequest int) (*gitlab.Response, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	path := fmt.Sprintf("projects/%v/merge_requests/%d/rebase", pid, mergeRequest)
+	p := f.project(pid)
+	if p == nil {
+		return nil, notFound("PUT", path)
+	}
+	mr := f.mergeRequest(p.ID, mergeRequest)
+	if mr == nil {
+		return nil, notFound("PUT", path)
+	}
+	if mr.State != "opened" {
+		return nil, errorResponse("PUT", path, http.StatusForbidden, "403 Forbidden")
+	}
+	if mr.MergeStatus == "cannot_be_merged" {
+		return nil, errorResponse("PUT", path, http.StatusConflict, "Rebase failed. Please rebase locally")
+	}
+	if mr.DivergedCommitsCount > 0 {
+		mr.DivergedCommitsCount = 0
+		mr.SHA = fmt.Sprintf("%s-%d", mr.SourceBranch, f.id())
+	}
+	return nil, nil
+}
+
+//ListGroups implements plugins.GitLabClient
+func (f *GitLab) ListGroups(opt *gitlab.ListGroupsOptions) ([]*gitlab.Group, *gitlab.Response, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	var gs []*gitlab.Group
+	for _, id := range f.groupIDs() {
+		g := f.groups[id]
+		if opt != nil && opt.Search != nil && !strings.Contains(g.Name, *opt.Search) {
+			continue
+		}
+		gs = append(gs, &g.Group)
+	}
+	var lo *gitlab.ListOptions
+	if opt != nil {
+		lo = &opt.ListOptions
+	}
+	start, end, resp := page(len(gs), lo)
+	return gs[start:end], resp, nil
+}
+
+//GetGroup implements plugins.GitLabClient
+func (f *GitLab) GetGroup(gid interface{}) (*plugins.Group, *gitlab.Response, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	g := f.group(gid)
+	if g == nil {
+		return nil, nil, notFound("GET", fmt.Sprintf("groups/%v", gid))
+	}
+	c := *g
+	return &c, nil, nil
+}
+
+//ListGroupMembers implements plugins.GitLabClient
+func (f *GitLab) ListGroupMembers(gid interface{}, opt *gitlab.ListOptions) ([]*gitlab.GroupMember, *gitlab.Response, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	g := f.group(gid)
+	if g == nil {
+		return nil, nil, notFound("GET", fmt.Sprintf("groups/%v/members", gid))
+	}
+	start, end, resp := page(len(f.members[g.ID]), opt)
+	return append([]*gitlab.GroupMember(nil), f.members[g.ID][start:end]...), resp, nil
+}
+
+//UpdateGroupMember implements plugins.GitLabClient
+func (f *GitLab) UpdateGroupMember(gid interface{}, user int, opt *gitlab.UpdateGroupMemberOptions) (*gitlab.GroupMember, *gitlab.Response, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	path := fmt.Sprintf("groups/%v/members/%d", gid, user)
+	g := f.group(gid)
+	if g == nil {
+		return nil, nil, notFound("PUT", path)
+	}
+	for _, m := range f.members[g.ID] {
+		if m.ID == user {
+			if opt != nil && opt.AccessLevel != nil {
+				m.AccessLevel = *opt.AccessLevel
+			}
+			return m, nil, nil
+		}
+	}
+	return nil, nil, notFound("PUT", path)
+}
+
+//ListGroupProjects implements plugins.GitLabClient
+func (f *GitLab) ListGroupProjects(gid interface{}, opt *gitlab.ListOptions) ([]*gitlab.Project, *gitlab.Response, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	g := f.group(gid)
+	if g == nil {
+		return nil, nil, notFound("GET", fmt.Sprintf("groups/%v/projects", gid))
+	}
+	var ps []*gitlab.Project
+	for _, id := range f.projectIDs() {
+		if p := f.projects[id]; p.Namespace != nil && p.Namespace.ID == g.ID {
+			ps = append(ps, p)
+		}
+	}
+	start, end, resp := page(len(ps), opt)
+	return ps[start:end], resp, nil
+}
+
+//ListSubgroups implements plugins.GitLabClient
+func (f *GitLab) ListSubgroups(gid interface{}, opt *gitlab.ListOptions) ([]*plugins.Group, *gitlab.Response, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	g := f.group(gid)
+	if g == nil {
+		return nil, nil, notFound("GET", fmt.Sprintf("groups/%v/subgroups", gid))
+	}
+	var gs []*plugins.Group
+	for _, id := range f.groupIDs() {
+		if sg := f.groups[id]; sg.ParentID == g.ID {
+			gs = append(gs, sg)
+		}
+	}
+	start, end, resp := page(len(gs), opt)
+	return gs[start:end], resp, nil
+}
+
+//GetProject implements plugins.GitLabClient
+func (f *GitLab) GetProject(pid interface{}) (*gitlab.Project, *gitlab.Response, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	p := f.project(pid)
+	if p == nil {
+		return nil, nil, notFound("GET", fmt.Sprintf("projects/%v", pid))
+	}
+	return p, nil, nil
+}
+
+//ListProjectMembers implements plugins.GitLabClient
+func (f *GitLab) ListProjectMembers(pid interface{}, opt *gitlab.ListProjectMembersOptions) ([]*gitlab.ProjectMember, *gitlab.Response, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	p := f.project(pid)
+	if p == nil {
+		return nil, nil, notFound("GET", fmt.Sprintf("projects/%v/members", pid))
+	}
+	var lo *gitlab.ListOptions
+	if opt != nil {
+		lo = &opt.ListOptions
+	}
+	start, end, resp := page(len(f.projectMembers[p.ID]), lo)
+	return append([]*gitlab.ProjectMember(nil), f.projectMembers[p.ID][start:end]...), resp, nil
+}
+
+//EditProjectMember implements plugins.GitLabClient
+func (f *GitLab) EditProjectMember(pid interface{}, user int, opt *gitlab.EditProjectMemberOptions) (*gitlab.ProjectMember, *gitlab.Response, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	path := fmt.Sprintf("projects/%v/members/%d", pid, user)
+	p := f.project(pid)
+	if p == nil {
+		return nil, nil, notFound("PUT", path)
+	}
+	for _, m := range f.projectMembers[p.ID] {
+		if m.ID == user {
+			if opt != nil && opt.AccessLevel != nil {
+				m.AccessLevel = *opt.AccessLevel
+			}
+			return m, nil, nil
+		}
+	}
+	return nil, nil, notFound("PUT", path)
+}
+
+//CurrentUser implements plugins.GitLabClient
+func (f *GitLab) CurrentUser() (*gitlab.User, *gitlab.Response, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	if f.user == nil {
+		f.user = &gitlab.User{ID: f.id(), Username: "gitbot", Name: "gitbot", State: "active"}
+	}
+	u := *f.user
+	return &u, nil, nil
+}
+
+//ListProjectHooks implements plugins.GitLabClient
+func (f *GitLab) ListProjectHooks(pid interface{}, opt *gitlab.ListProjectHooksOptions) ([]*gitlab.ProjectHook, *gitlab.Response, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	p := f.project(pid)
+	if p == nil {
+		return nil, nil, notFound("GET", fmt.Sprintf("projects/%v/hooks", pid))
+	}
+	var lo *gitlab.ListOptions
+	if opt != nil {
+		lo = &opt.ListOptions
+	}
+	start, end, resp := page(len(f.hooks[p.ID]), lo)
+	return append([]*gitlab.ProjectHook(nil), f.hooks[p.ID][start:end]...), resp, nil
+}
+
+//AddProjectHook implements plugins.GitLabClient
+func (f *GitLab) AddProjectHook(pid interface{}, opt *plugins.HookOptions) (*gitlab.ProjectHook, *gitlab.Response, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	p := f.project(pid)
+	if p == nil {
+		return nil, nil, notFound("POST", fmt.Sprintf("projects/%v/hooks", pid))
+	}
+	h := f.newHook(opt)
+	h.ProjectID = p.ID
+	f.hooks[p.ID] = append(f.hooks[p.ID], h)
+	return h, nil, nil
+}
+
+//EditProjectHook implements plugins.GitLabClient
+func (f *GitLab) EditProjectHook(pid interface{}, hook int, opt *plugins.HookOptions) (*gitlab.ProjectHook, *gitlab.Response, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	p := f.project(pid)
+	if p == nil || findHook(f.hooks[p.ID], hook) == nil {
+		return nil, nil, notFound("PUT", fmt.Sprintf("projects/%v/hooks/%d", pid, hook))
+	}
+	h := findHook(f.hooks[p.ID], hook)
+	f.setHook(h, opt)
+	return h, nil, nil
+}
+
+//DeleteProjectHook implements plugins.GitLabClient
+func (f *GitLab) DeleteProjectHook(pid interface{}, hook int) (*gitlab.Response, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	p := f.project(pid)
+	if p == nil {
+		return nil, notFound("DELETE", fmt.Sprintf("projects/%v/hooks/%d", pid, hook))
+	}
+	f.hooks[p.ID] = deleteHook(f.hooks[p.ID], hook)
+	return nil, nil
+}
+
+//ListGroupHooks implements plugins.GitLabClient
+func (f *GitLab) ListGroupHooks(gid interface{}, opt *gitlab.ListOptions) ([]*gitlab.ProjectHook, *gitlab.Response, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	g := f.group(gid)
+	if g == nil {
+		return nil, nil, notFound("GET", fmt.Sprintf("groups/%v/hooks", gid))
+	}
+	start, end, resp := page(len(f.groupHooks[g.ID]), opt)
+	return append([]*gitlab.ProjectHook(nil), f.groupHooks[g.ID][start:end]...), resp, nil
+}
+
+//AddGroupHook implements plugins.GitLabClient
+func (f *GitLab) AddGroupHook(gid interface{}, opt *plugins.HookOptions) (*gitlab.ProjectHook, *gitlab.Response, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	g := f.group(gid)
+	if g == nil {
+		return nil, nil, notFound("POST", fmt.Sprintf("groups/%v/hooks", gid))
+	}
+	h := f.newHook(opt)
+	f.groupHooks[g.ID] = append(f.groupHooks[g.ID], h)
+	return h, nil, nil
+}
+
+//EditGroupHook implements plugins.GitLabClient
+func (f *GitLab) EditGroupHook(gid interface{}, hook int, opt *plugins.HookOptions) (*gitlab.ProjectHook, *gitlab.Response, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	g := f.group(gid)
+	if g == nil || findHook(f.groupHooks[g.ID], hook) == nil {
+		return nil, nil, notFound("PUT", fmt.Sprintf("groups/%v/hooks/%d", gid, hook))
+	}
+	h := findHook(f.groupHooks[g.ID], hook)
+	f.setHook(h, opt)
+	return h, nil, nil
+}
+
+//DeleteGroupHook implements plugins.GitLabClient
+func (f *GitLab) DeleteGroupHook(gid interface{}, hook int) (*gitlab.Response, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	g := f.group(gid)
+	if g == nil {
+		return nil, notFound("DELETE", fmt.Sprintf("groups/%v/hooks/%d", gid, hook))
+	}
+	f.groupHooks[g.ID] = deleteHook(f.groupHooks[g.ID], hook)
+	return nil, nil
+}
+
+//ListSystemHooks implements plugins.GitLabClient
+func (f *GitLab) ListSystemHooks(opt *gitlab.ListOptions) ([]*gitlab.ProjectHook, *gitlab.Response, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	start, end, resp := page(len(f.systemHooks), opt)
+	return append([]*gitlab.ProjectHook(nil), f.systemHooks[start:end]...), resp, nil
+}
+
+//AddSystemHook implements plugins.GitLabClient
+func (f *GitLab) AddSystemHook(opt *plugins.HookOptions) (*gitlab.ProjectHook, *gitlab.Response, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	h := f.newHook(opt)
+	f.systemHooks = append(f.systemHooks, h)
+	return h, nil, nil
+}
+
+//DeleteSystemHook implements plugins.GitLabClient
+func (f *GitLab) DeleteSystemHook(hook int) (*gitlab.Response, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	f.systemHooks = deleteHook(f.systemHooks, hook)
+	return nil, nil
+}
+
+//newHook builds a hook from its options. Callers must hold f.mut
+func (f *GitLab) newHook(opt *plugins.HookOptions) *gitlab.ProjectHook {
+	h := &gitlab.ProjectHook{ID: f.id()}
+	f.setHook(h, opt)
+	return h
+}
+
+//setHook applies the options that are set to a hook. Callers must hold f.mut
+func (f *GitLab) setHook(h *gitlab.ProjectHook, opt *plugins.HookOptions) {
+	if opt == nil {
+		return
+	}
+	for _, o := range []struct {
+		v   *bool
+		dst *bool
+	}{
+		{opt.PushEvents, &h.PushEvents},
+		{opt.TagPushEvents, &h.TagPushEvents},
+		{opt.MergeRequestsEvents, &h.MergeRequestsEvents},
+		{opt.NoteEvents, &h.NoteEvents},
+		{opt.PipelineEvents, &h.PipelineEvents},
+		{opt.EnableSSLVerification, &h.EnableSSLVerification},
+	} {
+		if o.v != nil {
+			*o.dst = *o.v
+		}
+	}
+	if opt.URL != nil {
+		h.URL = *opt.URL
+	}
+	if opt.Token != nil {
+		f.hookTokens[h.ID] = *opt.Token
+	}
+}
+
+//findHook returns the hook with the given ID from hs
+func findHook(hs []*gitlab.ProjectHook, hook int) *gitlab.ProjectHook {
+	for _, h := range hs {
+		if h.ID == hook {
+			return h
+		}
+	}
+	return nil
+}
+
+//deleteHook removes the hook with the given ID from hs
+func deleteHook(hs []*gitlab.ProjectHook, hook int) []*gitlab.ProjectHook {
+	kept := hs[:0]
+	for _, h := range hs {
+		if h.ID != hook {
+			kept = append(kept, h)
+		}
+	}
+	return kept
+}
+
+//id returns the next free ID. Callers must hold f.mut
+func (f *GitLab) id() int {
+	f.nextID++
+	return f.nextID
+}
+
+//project looks up a project by ID or path. Callers must hold f.mut
+func (f *GitLab) project(pid interface{}) *gitlab.Project {
+	switch v := pid.(type) {
+	case int:
+		return f.projects[v]
+	case string:
+		if id, err := strconv.Atoi(v); err == nil {
+			return f.projects[id]
+		}
+		if u, err := url.QueryUnescape(v); err == nil {
+			v = u
+		}
+		for _, p := range f.projects {
+			if strings.EqualFold(p.PathWithNamespace, v) {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+//group looks up a group by ID or full path. Callers must hold f.mut
+func (f *GitLab) group(gid interface{}) *plugins.Group {
+	switch v := gid.(type) {
+	case int:
+		return f.groups[v]
+	case string:
+		if id, err := strconv.Atoi(v); err == nil {
+			return f.groups[id]
+		}
+		for _, g := range f.groups {
+			if strings.EqualFold(g.FullPath, v) {
+				return g
+			}
+		}
+	}
+	return nil
+}
+
+//mergeRequest looks up a merge request by its IID within the project. Callers must hold f.mut
+func (f *GitLab) mergeRequest(project, mergeRequest int) *plugins.MergeRequest {
+	for _, mr := range f.mrs[project] {
+		if mr.IID == mergeRequest {
+			return mr
+		}
+	}
+	return nil
+}
+
+//addIssue opens an issue. Callers must hold f.mut
+func (f *GitLab) addIssue(pid interface{}, opt *gitlab.CreateIssueOptions) (*gitlab.Issue, error) {
+	p := f.project(pid)
+	if p == nil {
+		return nil, notFound("POST", fmt.Sprintf("projects/%v/issues", pid))
+	}
+	i := &gitlab.Issue{
+		ID:        f.id(),
+		IID:       len(f.issues[p.ID]) + 1,
+		ProjectID: p.ID,
+		State:     "opened",
+	}
+	if opt != nil {
+		if opt.Title != nil {
+			i.Title = *opt.Title
+		}
+		if opt.Description != nil {
+			i.Description = *opt.Description
+		}
+		i.Labels = opt.Labels
+	}
+	f.issues[p.ID] = append(f.issues[p.ID], i)
+	return i, nil
+}
+
+//issue looks up an issue by its IID within the project. Callers must hold f.mut
+func (f *GitLab) issue(project, issue int) *gitlab.Issue {
+	for _, i := range f.issues[project] {
+		if i.IID == issue {
+			return i
+		}
+	}
+	return nil
+}
+
+//groupIDs returns the group IDs in ascending order so listings are stable. Callers must hold f.mut
+func (f *GitLab) groupIDs() []int {
+	ids := make([]int, 0, len(f.groups))
+	for id := range f.groups {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+//projectIDs returns the project IDs in ascending order so listings are stable. Callers must hold f.mut
+func (f *GitLab) projectIDs() []int {
+	ids := make([]int, 0, len(f.projects))
+	for id := range f.projects {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+//page returns the bounds of the requested page of a listing of n items and a response with the pagination values
+//set like GitLab does, 20 items per page by default
+func page(n int, opt *gitlab.ListOptions) (int, int, *gitlab.Response) {
+	p, perPage := 1, 20
+	if opt != nil && opt.Page > 0 {
+		p = opt.Page
+	}
+	if opt != nil && opt.PerPage > 0 {
+		perPage = opt.PerPage
+	}
+	resp := &gitlab.Response{FirstPage: 1, LastPage: (n + perPage - 1) / perPage}
+	if resp.LastPage == 0 {
+		resp.LastPage = 1
+	}
+	if p < resp.LastPage {
+		resp.NextPage = p + 1
+	}
+	if p > 1 {
+		resp.PrevPage = p - 1
+	}
+
+	start, end := (p-1)*perPage, p*perPage
+	if start > n {
+		start = n
+	}
+	if end > n {
+		end = n
+	}
+	return start, end, resp
+}
+
+//notFound builds the error go-gitlab returns for a 404
+func notFound(method, path string) error {
+	return errorResponse(method, path, http.StatusNotFound, "404 Not Found")
+}
+
+//errorResponse builds a *gitlab.ErrorResponse as if it was returned by the API
+func errorResponse(method, path string, code int, msg string) error {
+	u := &url.URL{Scheme: "http", Host: "gitlab.fake", Opaque: "/api/v4/" + path}
+	return &gitlab.ErrorResponse{
+		Response: &http.Response{
+			StatusCode: code,
+			Request:    &http.Request{Method: method, URL: u},
+		},
+		Message: msg,
+	}
+}
+
+func str(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func boolean(b *bool) bool {
+	if b == nil {
+		return false
+	}
+	return *b
+}
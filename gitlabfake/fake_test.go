@@ -0,0 +1,138 @@
+package gitlabfake
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/cosminilie/gitbot/plugins"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+func TestPage(t *testing.T) {
+	cases := []struct {
+		n          int
+		opt        *gitlab.ListOptions
+		start, end int
+		next, last int
+	}{
+		{n: 0, start: 0, end: 0, next: 0, last: 1},
+		{n: 45, start: 0, end: 20, next: 2, last: 3},
+		{n: 45, opt: &gitlab.ListOptions{Page: 3}, start: 40, end: 45, next: 0, last: 3},
+		{n: 45, opt: &gitlab.ListOptions{Page: 2, PerPage: 10}, start: 10, end: 20, next: 3, last: 5},
+		{n: 5, opt: &gitlab.ListOptions{Page: 4}, start: 5, end: 5, next: 0, last: 1},
+	}
+	for _, c := range cases {
+		start, end, resp := page(c.n, c.opt)
+		if start != c.start || end != c.end || resp.NextPage != c.next || resp.LastPage != c.last {
+			t.Errorf("page(%d, %+v) = %d, %d, next %d, last %d, want %d, %d, next %d, last %d",
+				c.n, c.opt, start, end, resp.NextPage, resp.LastPage, c.start, c.end, c.next, c.last)
+		}
+	}
+}
+
+func TestMemberLevels(t *testing.T) {
+	f := New()
+	g := f.AddGroup("platform")
+	p := f.AddProject("platform/api")
+	for i := 0; i < 25; i++ {
+		if _, err := f.AddGroupMember(g.ID, fmt.Sprintf("user%d", i), gitlab.DeveloperPermissions); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pm, err := f.AddProjectMember(p.ID, "alice", gitlab.ReporterPermissions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, resp, err := f.ListGroupMembers("platform", nil)
+	if err != nil || len(first) != 20 || resp.NextPage != 2 {
+		t.Fatalf("got %d members, next page %v, %v, want the first 20 members", len(first), resp, err)
+	}
+	second, _, _ := f.ListGroupMembers(g.ID, &gitlab.ListOptions{Page: 2})
+	if len(second) != 5 || second[0].Username != "user20" {
+		t.Errorf("got %+v on the second page", second)
+	}
+
+	if _, _, err := f.UpdateGroupMember(g.ID, first[3].ID, &gitlab.UpdateGroupMemberOptions{AccessLevel: gitlab.AccessLevel(gitlab.MasterPermissions)}); err != nil {
+		t.Fatal(err)
+	}
+	if m := f.Members(g.ID)[3]; m.AccessLevel != gitlab.MasterPermissions {
+		t.Errorf("got level %d, want master", m.AccessLevel)
+	}
+	if _, _, err := f.UpdateGroupMember(g.ID, pm.ID, &gitlab.UpdateGroupMemberOptions{AccessLevel: gitlab.AccessLevel(gitlab.GuestPermissions)}); !isStatus(err, http.StatusNotFound) {
+		t.Errorf("got %v updating a user who is not a member of the group, want a 404", err)
+	}
+
+	if _, _, err := f.EditProjectMember("platform/api", pm.ID, &gitlab.EditProjectMemberOptions{AccessLevel: gitlab.AccessLevel(gitlab.DeveloperPermissions)}); err != nil {
+		t.Fatal(err)
+	}
+	if ms, _, _ := f.ListProjectMembers(p.ID, nil); len(ms) != 1 || ms[0].AccessLevel != gitlab.DeveloperPermissions {
+		t.Errorf("got project members %+v", ms)
+	}
+}
+
+func TestMergeRequestStates(t *testing.T) {
+	f := New()
+	p := f.AddProject("tools/api")
+	state := func(iid int) *plugins.MergeRequest {
+		mr, _, err := f.GetMergeRequest(p.ID, iid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mr
+	}
+
+	//a stale SHA is refused, the current one merges
+	mr, _ := f.AddMergeRequest(p.ID, "feature", "master", "feature")
+	if _, _, err := f.AcceptMergeRequest(p.ID, mr.IID, &plugins.AcceptMergeRequestOptions{SHA: gitlab.String("stale")}); !isStatus(err, http.StatusConflict) {
+		t.Errorf("got %v, want a 409 for a stale SHA", err)
+	}
+	other, _ := f.AddMergeRequest(p.ID, "other", "master", "other")
+	if _, _, err := f.AcceptMergeRequest(p.ID, mr.IID, &plugins.AcceptMergeRequestOptions{SHA: gitlab.String(state(mr.IID).SHA)}); err != nil {
+		t.Fatal(err)
+	}
+	if state(mr.IID).State != "merged" {
+		t.Errorf("got state %q, want merged", state(mr.IID).State)
+	}
+	if _, _, err := f.AcceptMergeRequest(p.ID, mr.IID, nil); !isStatus(err, http.StatusMethodNotAllowed) {
+		t.Errorf("got %v merging a merged merge request, want a 405", err)
+	}
+
+	//the other merge request of the target branch is now behind, a rebase brings it up to date with a new SHA
+	behind := state(other.IID)
+	if behind.DivergedCommitsCount != 1 {
+		t.Errorf("got %d diverged commits, want 1", behind.DivergedCommitsCount)
+	}
+	if _, err := f.RebaseMergeRequest(p.ID, other.IID); err != nil {
+		t.Fatal(err)
+	}
+	if rebased := state(other.IID); rebased.DivergedCommitsCount != 0 || rebased.SHA == behind.SHA {
+		t.Errorf("got %+v after the rebase", rebased)
+	}
+
+	//merge when the pipeline succeeds waits for the running pipeline
+	f.SetPipeline(p.ID, other.IID, "running")
+	if _, _, err := f.AcceptMergeRequest(p.ID, other.IID, &plugins.AcceptMergeRequestOptions{MergeWhenPipelineSucceeds: gitlab.Bool(true)}); err != nil {
+		t.Fatal(err)
+	}
+	if mr := state(other.IID); mr.State != "opened" || !mr.MergeWhenBuildSucceeds {
+		t.Errorf("got %+v, want the merge request waiting for its pipeline", mr)
+	}
+	f.SetPipeline(p.ID, other.IID, "success")
+	if mr := state(other.IID); mr.State != "merged" || mr.MergeWhenBuildSucceeds {
+		t.Errorf("got %+v, want the merge request merged once the pipeline succeeded", mr)
+	}
+
+	if _, err := f.RebaseMergeRequest(p.ID, other.IID); !isStatus(err, http.StatusForbidden) {
+		t.Errorf("got %v rebasing a merged merge request, want a 403", err)
+	}
+	if _, _, err := f.GetMergeRequest(p.ID, 42); !isStatus(err, http.StatusNotFound) {
+		t.Errorf("got %v for a missing merge request, want a 404", err)
+	}
+}
+
+func isStatus(err error, code int) bool {
+	er, ok := err.(*gitlab.ErrorResponse)
+	return ok && er.Response.StatusCode == code
+}
@@ -1,5 +1,10 @@
 package gitlabhook
 
+import (
+	"encoding/json"
+	"strings"
+)
+
 //MergeRequestCommentEvent contains information needed to unmarshal the post from a "comment on merge request" gitlab hook
 //https://docs.gitlab.com/ce/web_hooks/web_hooks.html#comment-on-merge-request
 type MergeRequestCommentEvent struct {
@@ -10,9 +15,119 @@ type MergeRequestCommentEvent struct {
 	ObjectAttributes ObjectAttributes `json:"object_attributes,omitempty"`
 	Repository       Repository       `json:"repository,omitempty"`
 	MergeRequest     MergeRequest     `json:"merge_request"`
+	//Issue is set instead of MergeRequest when the comment was made on an issue
+	Issue Issue `json:"issue"`
 	//	Assignee         User             `json:"asignee"`
 }
 
+//MergeRequestEvent contains information needed to unmarshal the post from a "merge request" gitlab hook
+//https://docs.gitlab.com/ce/user/project/integrations/webhooks.html#merge-request-events
+type MergeRequestEvent struct {
+	ObjectKind       string       `json:"object_kind,omitempty"`
+	User             User         `json:"user,omitempty"`
+	Project          Project      `json:"project,omitempty"`
+	ObjectAttributes MergeRequest `json:"object_attributes,omitempty"`
+	Repository       Repository   `json:"repository,omitempty"`
+	Assignee         User         `json:"assignee,omitempty"`
+}
+
+//PushEvent contains information needed to unmarshal the post from a "push" gitlab hook
+//https://docs.gitlab.com/ce/user/project/integrations/webhooks.html#push-events
+type PushEvent struct {
+	ObjectKind   string     `json:"object_kind,omitempty"`
+	Before       string     `json:"before"`
+	After        string     `json:"after"`
+	Ref          string     `json:"ref"`
+	CheckoutSHA  string     `json:"checkout_sha"`
+	UserID       int        `json:"user_id"`
+	UserName     string     `json:"user_name"`
+	UserUsername string     `json:"user_username,omitempty"`
+	UserEmail    string     `json:"user_email,omitempty"`
+	ProjectID    int        `json:"project_id"`
+	Project      Project    `json:"project,omitempty"`
+	Commits      []Commit   `json:"commits"`
+	TotalCommits int        `json:"total_commits_count"`
+	Repository   Repository `json:"repository,omitempty"`
+}
+
+//BlankSHA is the before SHA of a push creating a branch and the after SHA of a push deleting it
+const BlankSHA = "0000000000000000000000000000000000000000"
+
+//Branch returns the branch pushed to, or "" when the ref is not a branch
+func (e PushEvent) Branch() string {
+	if !strings.HasPrefix(e.Ref, "refs/heads/") {
+		return ""
+	}
+	return strings.TrimPrefix(e.Ref, "refs/heads/")
+}
+
+//Created reports whether the push created the branch
+func (e PushEvent) Created() bool {
+	return e.Before == BlankSHA
+}
+
+//Deleted reports whether the push deleted the branch
+func (e PushEvent) Deleted() bool {
+	return e.After == BlankSHA
+}
+
+//PipelineEvent contains information needed to unmarshal the post from a "pipeline" gitlab hook
+//https://docs.gitlab.com/ce/user/project/integrations/webhooks.html#pipeline-events
+type PipelineEvent struct {
+	ObjectKind       string             `json:"object_kind,omitempty"`
+	ObjectAttributes PipelineAttributes `json:"object_attributes"`
+	User             User               `json:"user,omitempty"`
+	Project          Project            `json:"project,omitempty"`
+	Commit           Commit             `json:"commit"`
+	Builds           []Build            `json:"builds"`
+}
+
+//PipelineAttributes are the attributes of the pipeline of a pipeline event
+type PipelineAttributes struct {
+	ID         int      `json:"id"`
+	Ref        string   `json:"ref"`
+	Tag        bool     `json:"tag"`
+	SHA        string   `json:"sha"`
+	BeforeSHA  string   `json:"before_sha"`
+	Status     string   `json:"status"`
+	Stages     []string `json:"stages"`
+	CreatedAt  string   `json:"created_at"`
+	FinishedAt string   `json:"finished_at"`
+	Duration   int      `json:"duration"`
+}
+
+//Finished reports whether the pipeline stopped running
+func (a PipelineAttributes) Finished() bool {
+	switch a.Status {
+	case "success", "failed", "canceled", "skipped":
+		return true
+	}
+	return false
+}
+
+//Build is a job of a pipeline event
+type Build struct {
+	ID           int    `json:"id"`
+	Stage        string `json:"stage"`
+	Name         string `json:"name"`
+	Status       string `json:"status"`
+	When         string `json:"when"`
+	Manual       bool   `json:"manual"`
+	AllowFailure bool   `json:"allow_failure"`
+}
+
+//Commit is a commit of a push or pipeline event
+type Commit struct {
+	ID        string `json:"id"`
+	Message   string `json:"message"`
+	Timestamp string `json:"timestamp"`
+	URL       string `json:"url"`
+	Author    struct {
+		Name  string `json:"name"`
+		Email string `json:"email"`
+	} `json:"author,omitempty"`
+}
+
 type User struct {
 	Name      string `json:"name,omitempty"`
 	Username  string `json:"username,omitempty"`
@@ -20,6 +135,7 @@ type User struct {
 }
 
 type Project struct {
+	ID                int    `json:"id,omitempty"`
 	Name              string `json:"name"`
 	Description       string `json:"description"`
 	WebURL            string `json:"web_url,omitempty"`
@@ -37,27 +153,26 @@ type Project struct {
 }
 
 type ObjectAttributes struct {
-	ID                   int    `json:"id,omitempty"`
-	Note                 string `json:"note"`
-	NoteableType         string `json:"noteable_type,omitempty"`
-	AuthorID             int    `json:"author_id,omitempty"`
-	CreatedAT            string `json:"created_at,omitempty"`
-	UpdatedAt            string `json:"updated_at,omitempty"`
-	ProjectID            int    `json:"project_id,omitempty"`
-	LineCode             string `json:"line_code"`
-	CommitID             string `json:"commit_id"`
-	NoteableId           int    `json:"noteable_id"`
-	System               bool   `json:"system"`
-	StDIff               string `json:"st_diff"`
-	UpdatedByID          string `json:"updated_by_id"`
-	Type                 string `json:"type"`
-	Position             string `json:"position"`
-	OriginalPosition     string `json:"original_position"`
-	ResolvedAt           string `json:"resolved_at"`
-	ResolvedById         string `json:"resolved_by_id"`
-	DiscussionId         string `json:"discussion_id"`
-	OriginalDiscussionID string `json:"original_discussion_id"`
-	URL                  string `json:"url"`
+	ID                   int             `json:"id,omitempty"`
+	Note                 string          `json:"note"`
+	NoteableType         string          `json:"noteable_type,omitempty"`
+	AuthorID             int             `json:"author_id,omitempty"`
+	CreatedAT            string          `json:"created_at,omitempty"`
+	UpdatedAt            string          `json:"updated_at,omitempty"`
+	ProjectID            int             `json:"project_id,omitempty"`
+	LineCode             string          `json:"line_code"`
+	CommitID             string          `json:"commit_id"`
+	NoteableId           int             `json:"noteable_id"`
+	System               bool            `json:"system"`
+	UpdatedByID          int             `json:"updated_by_id"`
+	Type                 string          `json:"type"`
+	Position             json.RawMessage `json:"position,omitempty"`
+	OriginalPosition     json.RawMessage `json:"original_position,omitempty"`
+	ResolvedAt           string          `json:"resolved_at"`
+	ResolvedById         int             `json:"resolved_by_id"`
+	DiscussionId         string          `json:"discussion_id"`
+	OriginalDiscussionID string          `json:"original_discussion_id"`
+	URL                  string          `json:"url"`
 }
 
 type Repository struct {
@@ -68,38 +183,50 @@ type Repository struct {
 }
 
 type MergeRequest struct {
-	ID              int    `json:"id"`
-	TargetBranch    string `json:"target_branch"`
-	SourceBranch    string `json:"source_branch"`
-	SourceProjectID int    `json:"source_project_id"`
-	AuthorID        int    `json:"author_id"`
-	AssigneeID      int    `json:"assignee_id"`
-	Title           string `json:"title"`
-	CreatedAt       string `json:"created_at"`
-	UpdatedAt       string `json:"updated_at"`
-	MilestoneID     int    `json:"milestone_id"`
-	State           string `json:"state"`
-	MergeStatus     string `json:"merge_status"`
-	TargetProjectID int    `json:"target_project_id"`
-	IID             int    `json:"iid"`
-	Description     string `json:"description,omitempty"`
-	Position        int    `json:"position"`
-	LockedAt        string `json:"locked_at,omitempty"`
-	UpdatedByID     int    `json:"updated_by_id"`
-	MergeError      string `json:"merge_error"`
-	MergeParams     struct {
-		ForceRemoveSourceBranch string `json:"force_remove_source_branch"`
-	} `json:"merge_params"`
-	MergeWhenBuildSucceeds   bool       `json:"merge_when_build_succeeds"`
-	MergeUserID              int        `json:"merge_user_id,omitempty"`
-	MergeCommitSha           string     `json:"merge_commit_sha,omitempty"`
-	DeletedAt                string     `json:"deleted_at,omitempty"`
-	InProgressMergeCommitSha string     `json:"in_progress_merge_commit_sha,omitempty"`
-	LockVersion              int        `json:"lock_version,omitempty"`
-	Source                   Source     `json:"source"`
-	Target                   Target     `json:"target"`
-	LastCommit               LastCommit `json:"last_commit"`
-	WorkInProgress           bool       `json:"work_in_progress"`
+	ID                        int                    `json:"id"`
+	TargetBranch              string                 `json:"target_branch"`
+	SourceBranch              string                 `json:"source_branch"`
+	SourceProjectID           int                    `json:"source_project_id"`
+	AuthorID                  int                    `json:"author_id"`
+	AssigneeID                int                    `json:"assignee_id"`
+	Title                     string                 `json:"title"`
+	CreatedAt                 string                 `json:"created_at"`
+	UpdatedAt                 string                 `json:"updated_at"`
+	MilestoneID               int                    `json:"milestone_id"`
+	State                     string                 `json:"state"`
+	MergeStatus               string                 `json:"merge_status"`
+	TargetProjectID           int                    `json:"target_project_id"`
+	IID                       int                    `json:"iid"`
+	Description               string                 `json:"description,omitempty"`
+	LockedAt                  string                 `json:"locked_at,omitempty"`
+	UpdatedByID               int                    `json:"updated_by_id"`
+	MergeError                string                 `json:"merge_error"`
+	MergeParams               map[string]interface{} `json:"merge_params"` //value types differ between GitLab releases
+	MergeWhenPipelineSucceeds bool                   `json:"merge_when_pipeline_succeeds"`
+	HeadPipelineID            int                    `json:"head_pipeline_id,omitempty"`
+	MergeUserID               int                    `json:"merge_user_id,omitempty"`
+	MergeCommitSha            string                 `json:"merge_commit_sha,omitempty"`
+	DeletedAt                 string                 `json:"deleted_at,omitempty"`
+	InProgressMergeCommitSha  string                 `json:"in_progress_merge_commit_sha,omitempty"`
+	LockVersion               int                    `json:"lock_version,omitempty"`
+	Source                    Source                 `json:"source"`
+	Target                    Target                 `json:"target"`
+	LastCommit                LastCommit             `json:"last_commit"`
+	WorkInProgress            bool                   `json:"work_in_progress"`
+	URL                       string                 `json:"url,omitempty"`
+	Action                    string                 `json:"action,omitempty"`
+}
+
+//Issue is the issue a comment was made on
+type Issue struct {
+	ID          int    `json:"id"`
+	IID         int    `json:"iid"`
+	ProjectID   int    `json:"project_id"`
+	AuthorID    int    `json:"author_id"`
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	State       string `json:"state"`
+	URL         string `json:"url,omitempty"`
 }
 
 type Source struct {
@@ -0,0 +1,43 @@
+package gitlabhook
+
+import "encoding/json"
+
+//SystemHookEvent contains the fields of a "system hook" payload needed to dispatch it. Push, tag push and merge
+//request payloads are the same as the ones of project webhooks.
+//https://docs.gitlab.com/ce/system_hooks/system_hooks.html
+type SystemHookEvent struct {
+	ObjectKind string `json:"object_kind,omitempty"`
+	//EventName is set on the events only sent to system hooks, e.g. project_create or user_add_to_team
+	EventName         string  `json:"event_name,omitempty"`
+	PathWithNamespace string  `json:"path_with_namespace,omitempty"`
+	Project           Project `json:"project,omitempty"`
+}
+
+//DecodeSystemHook decodes the payload of a "System Hook" delivery
+func DecodeSystemHook(payload []byte) (SystemHookEvent, error) {
+	var e SystemHookEvent
+	err := json.Unmarshal(payload, &e)
+	return e, err
+}
+
+//EventType returns the X-Gitlab-Event header a project webhook sends with the same payload, or "" when the event
+//is only sent to system hooks
+func (e SystemHookEvent) EventType() string {
+	switch e.ObjectKind {
+	case "push":
+		return "Push Hook"
+	case "tag_push":
+		return "Tag Push Hook"
+	case "merge_request":
+		return "Merge Request Hook"
+	}
+	return ""
+}
+
+//ProjectPath returns the path of the project the event belongs to
+func (e SystemHookEvent) ProjectPath() string {
+	if e.Project.PathWithNamespace != "" {
+		return e.Project.PathWithNamespace
+	}
+	return e.PathWithNamespace
+}
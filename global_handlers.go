@@ -1,10 +1,14 @@
 package gitbot
 
 import (
+	"context"
 	"fmt"
+	"sort"
 	"strings"
 
+	"github.com/cosminilie/gitbot/logging"
 	"github.com/cosminilie/gitbot/plugins"
+	"github.com/go-kit/kit/log"
 )
 
 func setupGroupHandlers(svc *basicService, reposChan chan plugins.Repo) {
@@ -14,30 +18,56 @@ func setupGroupHandlers(svc *basicService, reposChan chan plugins.Repo) {
 		s = strings.TrimSuffix(s, "/")
 
 		//Add repos to top level repos list
-		svc.Plugins.GroupRepos[s] = r
+		r.Name = s
+		svc.Plugins.AddGroupRepo(r)
 
 	}
 }
 
-//globalHandlers loads all global handlers for gitlab groups
-func groupHandlers(s *basicService) error {
-	for _, tpr := range s.Plugins.GroupRepos {
-
-		for _, h := range s.Plugins.GroupHandlers(tpr.Name) {
-			s.logger.Log(
-				"handler", "groupHandlers",
-				"ProjectName", tpr.Name,
-				"Plugin", fmt.Sprintf("%T", h),
+//groupPluginHandler runs a group plugin on every group it is enabled on. A group the plugin fails on does not stop
+//the others, the errors are returned together.
+func groupPluginHandler(plugin string) recuringHandlers {
+	return func(s *basicService) error {
+		errs := groupErrors{}
+		for _, name := range s.Plugins.GroupRepoNames() {
+			h, ok := s.Plugins.Handlers(plugins.GroupEvent, name)[plugin]
+			if !ok {
+				continue
+			}
+			logger := log.NewContext(s.logger).With("Group", name, "Plugin", plugin)
+			logging.Debug(logger).Log(
+				"handler", "groupPluginHandler",
 			)
 
-			pc := &s.Plugins.PluginClient
-			if err := h(pc, tpr.Name); err != nil {
-				fmt.Println("Error handling groupHandlers ", err)
-				return err
+			if err := s.runPlugin(s.ctx, logger, plugin, func(ctx context.Context, pc *plugins.PluginClient) error {
+				return h(ctx, pc, name)
+			}); err != nil {
+				logging.Error(logger).Log(
+					"handler", "groupPluginHandler",
+					"Error", err,
+				)
+				errs[name] = err
 			}
 		}
-
+		if len(errs) > 0 {
+			return errs
+		}
+		return nil
 	}
+}
+
+//groupErrors holds the errors of a group plugin keyed by group
+type groupErrors map[string]error
 
-	return nil
+func (e groupErrors) Error() string {
+	var groups []string
+	for g := range e {
+		groups = append(groups, g)
+	}
+	sort.Strings(groups)
+	msgs := make([]string, 0, len(groups))
+	for _, g := range groups {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", g, e[g]))
+	}
+	return fmt.Sprintf("failed on %d groups: %s", len(e), strings.Join(msgs, "; "))
 }
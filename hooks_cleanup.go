@@ -0,0 +1,80 @@
+package gitbot
+
+import (
+	"github.com/cosminilie/gitbot/logging"
+	"github.com/cosminilie/gitbot/plugins"
+	"github.com/go-kit/kit/log"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+//CleanupHooks removes the hooks pointing at the bot from the projects matched by the repos of an instance, including
+//the other projects of their groups, and from the group or system hooks of its hook strategy. It returns the number
+//of hooks removed, or that would be removed when dryRun is set.
+func CleanupHooks(logger log.Logger, gc plugins.GitLabClient, inst Instance, dryRun bool) (int, error) {
+	hr := hookReconciler{
+		logger:   log.NewContext(logger).With("Func", "CleanupHooks"),
+		instance: inst.Name,
+		url:      hookURL(logger, inst.Hook, inst.Path()),
+		dryRun:   dryRun,
+	}
+
+	var (
+		paths []string
+		seen  = make(map[string]bool)
+	)
+	addPath := func(p string) {
+		if !seen[p] {
+			seen[p] = true
+			paths = append(paths, p)
+		}
+	}
+	for _, r := range inst.Repos {
+		p := parseRepoPattern(r)
+		switch {
+		case p.exact():
+			addPath(p.base)
+		case p.base != "":
+			err := walkGroup(gc, p.base, true, func(group string, pr *gitlab.Project) {
+				if pr != nil {
+					addPath(pr.PathWithNamespace)
+				}
+			})
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	var targets []hookTarget
+	for _, p := range paths {
+		t, err := projectHookTarget(gc, p)
+		if err != nil {
+			//deleted projects took their hooks with them
+			logging.Warn(logger).Log(
+				"Func", "CleanupHooks",
+				"Project", p,
+				"Error", err,
+			)
+			continue
+		}
+		targets = append(targets, t)
+	}
+	switch inst.Strategy() {
+	case HookStrategyGroup:
+		for _, g := range hookGroups(inst.Repos) {
+			targets = append(targets, groupHookTarget(gc, g))
+		}
+	case HookStrategySystem:
+		targets = append(targets, systemHookTarget(gc))
+	}
+
+	removed := 0
+	for _, t := range targets {
+		n, err := hr.reconcile(t, nil)
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
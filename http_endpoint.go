@@ -5,14 +5,17 @@ inspired by https://github.com/kubernetes/test-infra/blob/master/prow/cmd/hook/s
 */
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sync"
 
 	"github.com/cosminilie/gitbot/gitlabhook"
+	"github.com/cosminilie/gitbot/logging"
 	"github.com/go-kit/kit/log"
-	gitlab "github.com/xanzy/go-gitlab"
 )
 
 // Server implements http.Handler. It validates incoming GitLab webhooks and
@@ -20,6 +23,56 @@ import (
 type Server struct {
 	Service Service
 	Logger  log.Logger
+	//Instance is the name of the GitLab instance the server receives webhooks from
+	Instance string
+	//Recorder captures every delivery when set
+	Recorder *Recorder
+	//Token is the secret token of the hooks, webhooks with another X-Gitlab-Token header are refused when set
+	Token string
+	//Context is the parent of the contexts the events are handled with, cancelling it cancels the running plugins.
+	//Defaults to context.Background().
+	Context context.Context
+
+	mut      sync.Mutex
+	draining bool
+	inflight sync.WaitGroup
+}
+
+//Drain refuses new webhooks and waits for the events being handled. It returns ctx.Err() when ctx is done first.
+func (s *Server) Drain(ctx context.Context) error {
+	s.mut.Lock()
+	s.draining = true
+	s.mut.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//track counts a new event being handled. It returns false once the server drains.
+func (s *Server) track() bool {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.draining {
+		return false
+	}
+	s.inflight.Add(1)
+	return true
+}
+
+func (s *Server) context() context.Context {
+	if s.Context == nil {
+		return context.Background()
+	}
+	return s.Context
 }
 
 // ServeHTTP validates an incoming webhook and invokes the service handler for them.
@@ -31,6 +84,15 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "405 Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	if s.Token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Gitlab-Token")), []byte(s.Token)) != 1 {
+		http.Error(w, "401 Unauthorized: Invalid X-Gitlab-Token Header", http.StatusUnauthorized)
+		return
+	}
+	if !s.track() {
+		http.Error(w, "503 Service Unavailable: Shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.inflight.Done()
 	eventType := r.Header.Get("X-Gitlab-Event")
 	if eventType == "" {
 		http.Error(w, "400 Bad Request: Missing X-Gitlab-Event Header", http.StatusBadRequest)
@@ -45,9 +107,9 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	fmt.Fprint(w, "Event received. Have a nice day.")
 
-	err = s.demuxEvent(eventType, payload)
+	_, err = s.demuxEvent(eventType, r.Header, payload, "")
 	if err != nil {
-		s.Logger.Log(
+		logging.Error(s.Logger).Log(
 			"Caller", "ServeHTTP",
 			"Action", "demuxEvent",
 			"eventType", eventType,
@@ -57,31 +119,115 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func (s *Server) demuxEvent(eventType string, payload []byte) error {
+//demuxEvent records the delivery and dispatches it to the service. It returns the delivery ID.
+func (s *Server) demuxEvent(eventType string, header http.Header, payload []byte, redeliveryOf string) (string, error) {
+	id, err := s.Recorder.Record(s.Instance, eventType, header, payload, redeliveryOf)
+	if err != nil {
+		logging.Error(s.Logger).Log(
+			"Caller", "demuxEvent",
+			"Action", "Record",
+			"eventType", eventType,
+			"Error", err,
+		)
+	}
+	logger := log.NewContext(s.Logger).With("Delivery", id)
+
+	return id, s.dispatch(logger, id, eventType, payload)
+}
+
+//dispatch decodes the payload of an event and hands it to the service
+func (s *Server) dispatch(logger log.Logger, id string, eventType string, payload []byte) error {
 	switch eventType {
+	case "System Hook":
+		e, err := gitlabhook.DecodeSystemHook(payload)
+		if err != nil {
+			return fmt.Errorf("failed to Unmarshal System Hook with :%s raw body:%s", err, string(payload))
+		}
+		//system hooks deliver the events of every project of the instance, only the ones of our repos are handled
+		inner, project := e.EventType(), e.ProjectPath()
+		if inner == "" || !s.handlesRepo(project) {
+			logger.Log(
+				"Caller", "dispatch",
+				"EventType", eventType,
+				"ObjectKind", e.ObjectKind,
+				"EventName", e.EventName,
+				"Project", project,
+				"Result", "Ignored",
+			)
+			s.recordOutcomes(logger, id, nil)
+			return nil
+		}
+		return s.dispatch(log.NewContext(logger).With("SystemHook", inner), id, inner, payload)
 	case "Merge Request Hook":
-		var req gitlab.MergeEvent
+		var req gitlabhook.MergeRequestEvent
 		if err := json.Unmarshal(payload, &req); err != nil {
 			return fmt.Errorf("failed to Unmarshal Merge Event with :%s raw body:%s", err, string(payload))
 
 		}
-		go s.Service.GitHook(s.Logger, req)
+		s.goHandle(logger, id, req)
+	case "Push Hook":
+		var req gitlabhook.PushEvent
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return fmt.Errorf("failed to Unmarshal Push Event with :%s raw body:%s", err, string(payload))
+		}
+		s.goHandle(logger, id, req)
+	case "Pipeline Hook":
+		var req gitlabhook.PipelineEvent
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return fmt.Errorf("failed to Unmarshal Pipeline Event with :%s raw body:%s", err, string(payload))
+		}
+		s.goHandle(logger, id, req)
 	case "Note Hook":
 		var req gitlabhook.MergeRequestCommentEvent
 		if err := json.Unmarshal(payload, &req); err != nil {
 			return fmt.Errorf("Failed to Unmarshal MergeComment Event with :%s raw body:%s", err, string(payload))
 		}
 
-		go s.Service.GitHook(s.Logger, req)
+		s.goHandle(logger, id, req)
 	default:
-		s.Logger.Log(
-			"Caller", "demuxEvent",
+		logger.Log(
+			"Caller", "dispatch",
 			"EventType", eventType,
 			"Result", "Unknow Event",
 			//"Payload", string(payload),
 		)
-
+		s.recordOutcomes(logger, id, nil)
 	}
-
 	return nil
 }
+
+//repoFilter is implemented by services that know which repos they handle
+type repoFilter interface {
+	HandlesRepo(repo string) bool
+}
+
+//handlesRepo reports whether the service handles the repo, services that don't know accept every repo
+func (s *Server) handlesRepo(repo string) bool {
+	f, ok := s.Service.(repoFilter)
+	return !ok || f.HandlesRepo(repo)
+}
+
+//goHandle handles an event in the background, Drain waits for it
+func (s *Server) goHandle(logger log.Logger, id string, data interface{}) {
+	s.inflight.Add(1)
+	go func() {
+		defer s.inflight.Done()
+		s.handle(logger, id, data)
+	}()
+}
+
+//handle runs the service handlers for an event and records their outcome
+func (s *Server) handle(logger log.Logger, id string, data interface{}) {
+	outcomes := s.Service.GitHook(s.context(), logger, data)
+	s.recordOutcomes(logger, id, outcomes)
+}
+
+func (s *Server) recordOutcomes(logger log.Logger, id string, outcomes []Outcome) {
+	if err := s.Recorder.RecordOutcomes(id, outcomes); err != nil {
+		logging.Error(logger).Log(
+			"Caller", "recordOutcomes",
+			"Action", "RecordOutcomes",
+			"Error", err,
+		)
+	}
+}
@@ -0,0 +1,316 @@
+package gitbot
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cosminilie/gitbot/plugins"
+	_ "github.com/cosminilie/gitbot/plugins/lgtm"
+	_ "github.com/cosminilie/gitbot/plugins/policy"
+	_ "github.com/cosminilie/gitbot/plugins/pushaudit"
+	"github.com/go-kit/kit/log"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+//gitlabServer is a stand-in for the GitLab API which records every call it receives
+type gitlabServer struct {
+	*httptest.Server
+	mut   sync.Mutex
+	calls []string
+}
+
+func newGitLabServer() *gitlabServer {
+	gs := &gitlabServer{}
+	gs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gs.mut.Lock()
+		gs.calls = append(gs.calls, r.Method+" "+r.URL.Path)
+		gs.mut.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/notes"):
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"id":1}`)
+		case r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, "/merge"):
+			fmt.Fprint(w, `{"id":7,"iid":1,"state":"merged"}`)
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/commits"):
+			fmt.Fprint(w, `[]`)
+		default:
+			fmt.Fprint(w, `{}`)
+		}
+	}))
+	return gs
+}
+
+//Calls returns the API calls received so far as "METHOD path"
+func (gs *gitlabServer) Calls() []string {
+	gs.mut.Lock()
+	defer gs.mut.Unlock()
+	return append([]string(nil), gs.calls...)
+}
+
+//harness wires a Server and a basicService to a stand-in GitLab
+type harness struct {
+	gitlab *gitlabServer
+	hook   *httptest.Server
+	svc    *basicService
+}
+
+func newHarness(t *testing.T, repos []plugins.Repo, defaultApprovers []string) *harness {
+	gs := newGitLabServer()
+	cl := gitlab.NewClient(nil, "token")
+	cl.SetBaseURL(gs.URL + "/api/v4/")
+
+	logger := log.NewNopLogger()
+	svc := NewBasicService(context.Background(), logger, plugins.NewGitLabClient(cl), nil, nil, nil, Instance{
+		Name:             DefaultInstance,
+		GitURL:           gs.URL + "/api/v4/",
+		Repos:            repos,
+		DefaultApprovers: defaultApprovers,
+	})
+	hook := httptest.NewServer(&Server{Service: svc, Logger: logger})
+
+	//wait for the service to finish loading repos in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for _, r := range repos {
+		for len(svc.Plugins.Handlers(plugins.MergeCommentEvent, r.Name)) == 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for repo %s to be loaded", r.Name)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	return &harness{gitlab: gs, hook: hook, svc: svc}
+}
+
+func (h *harness) Close() {
+	h.hook.Close()
+	h.gitlab.Close()
+}
+
+//deliver replays a fixture from testdata against the hook endpoint
+func (h *harness) deliver(t *testing.T, fixture string) {
+	payload, err := ioutil.ReadFile(filepath.Join("testdata", fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Replay(h.hook.URL, "", "", payload); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//waitForCalls waits until the stand-in GitLab has received want calls. Plugins run asynchronously so the calls are
+//collected for a short while longer to catch unexpected extra calls.
+func (h *harness) waitForCalls(want int) []string {
+	deadline := time.Now().Add(5 * time.Second)
+	for len(h.gitlab.Calls()) < want && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	return h.gitlab.Calls()
+}
+
+func TestWebhookFixtures(t *testing.T) {
+	repos := []plugins.Repo{
+		{Name: "monitoring_group/test1", Plugins: []string{"lgtm"}, Approvers: []string{"user5"}},
+	}
+
+	tests := []struct {
+		fixture string
+		calls   []string
+	}{
+		{
+			fixture: "note_merge_request_lgtm.json",
+			calls: []string{
+				"GET /api/v4/projects/5/merge_requests/1",
+				"POST /api/v4/projects/5/merge_requests/1/notes",
+				"PUT /api/v4/projects/5/merge_requests/1/merge",
+			},
+		},
+		{
+			fixture: "note_merge_request_lgtm_author.json",
+			calls: []string{
+				"POST /api/v4/projects/5/merge_requests/1/notes",
+			},
+		},
+		{fixture: "note_merge_request_comment.json"},
+		{fixture: "merge_request.json"},
+		{fixture: "push.json"},
+		{fixture: "pipeline.json"},
+	}
+
+	for _, tt := range tests {
+		h := newHarness(t, repos, nil)
+		h.deliver(t, tt.fixture)
+		calls := h.waitForCalls(len(tt.calls))
+		h.Close()
+
+		if len(calls) == 0 && len(tt.calls) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(calls, tt.calls) {
+			t.Errorf("%s: got API calls %q, want %q", tt.fixture, calls, tt.calls)
+		}
+	}
+}
+
+func TestPushFixture(t *testing.T) {
+	repos := []plugins.Repo{
+		{Name: "monitoring_group/test1", Plugins: []string{"lgtm", "push_audit"}},
+	}
+	h := newHarness(t, repos, nil)
+	defer h.Close()
+
+	//a push to a feature branch is only checked for being protected
+	h.deliver(t, "push.json")
+	want := []string{"GET /api/v4/projects/5/protected_branches"}
+	if calls := h.waitForCalls(len(want)); !reflect.DeepEqual(calls, want) {
+		t.Errorf("got API calls %q, want %q", calls, want)
+	}
+}
+
+func TestMergeRequestFixture(t *testing.T) {
+	repos := []plugins.Repo{
+		{Name: "monitoring_group/test1", Plugins: []string{"lgtm", "policy"}, Policy: plugins.ChangePolicy{Title: `^JIRA-[0-9]+ `, Commit: `^feat: `}},
+	}
+	h := newHarness(t, repos, nil)
+	defer h.Close()
+
+	//the title has no ticket reference, the last commit is marked as breaking the policy
+	h.deliver(t, "merge_request.json")
+	want := []string{
+		"GET /api/v4/projects/5/merge_requests/1/commits",
+		"POST /api/v4/projects/5/statuses/da1560886d4f094c3e6c9ef40349f7d38b5d27d7",
+	}
+	if calls := h.waitForCalls(len(want)); !reflect.DeepEqual(calls, want) {
+		t.Errorf("got API calls %q, want %q", calls, want)
+	}
+}
+
+func TestServeHTTPRejectsInvalidRequests(t *testing.T) {
+	s := &Server{Logger: log.NewNopLogger()}
+
+	tests := []struct {
+		method    string
+		eventType string
+		code      int
+	}{
+		{method: http.MethodGet, eventType: "Note Hook", code: http.StatusMethodNotAllowed},
+		{method: http.MethodPost, eventType: "", code: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/hook", strings.NewReader("{}"))
+		if tt.eventType != "" {
+			req.Header.Set("X-Gitlab-Event", tt.eventType)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		if w.Code != tt.code {
+			t.Errorf("%s with event %q: got status %d, want %d", tt.method, tt.eventType, w.Code, tt.code)
+		}
+	}
+}
+
+func TestEventType(t *testing.T) {
+	tests := map[string]string{
+		"note_merge_request_lgtm.json": "Note Hook",
+		"merge_request.json":           "Merge Request Hook",
+		"push.json":                    "Push Hook",
+		"pipeline.json":                "Pipeline Hook",
+	}
+
+	for fixture, want := range tests {
+		payload, err := ioutil.ReadFile(filepath.Join("testdata", fixture))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := EventType(payload)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", fixture, err)
+		}
+		if got != want {
+			t.Errorf("%s: got event type %q, want %q", fixture, got, want)
+		}
+	}
+}
+
+func TestServerChecksHookToken(t *testing.T) {
+	svc := &recordingService{}
+	hook := httptest.NewServer(&Server{Service: svc, Logger: log.NewNopLogger(), Token: "secret"})
+	defer hook.Close()
+
+	payload, err := ioutil.ReadFile(filepath.Join("testdata", "note_merge_request_comment.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Replay(hook.URL, "", "wrong", payload); err == nil {
+		t.Error("webhook with the wrong token was accepted")
+	}
+	if err := Replay(hook.URL, "", "secret", payload); err != nil {
+		t.Error(err)
+	}
+}
+
+//blockingService handles events until it is released or the event context is done
+type blockingService struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (bs *blockingService) GitHook(ctx context.Context, logger log.Logger, data interface{}) []Outcome {
+	bs.started <- struct{}{}
+	select {
+	case <-bs.release:
+	case <-ctx.Done():
+	}
+	return nil
+}
+
+func (bs *blockingService) GetErrors() chan error {
+	return nil
+}
+
+func (bs *blockingService) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+func TestServerDrain(t *testing.T) {
+	svc := &blockingService{started: make(chan struct{}, 1), release: make(chan struct{})}
+	s := &Server{Service: svc, Logger: log.NewNopLogger()}
+	hook := httptest.NewServer(s)
+	defer hook.Close()
+
+	payload, err := ioutil.ReadFile(filepath.Join("testdata", "note_merge_request_comment.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Replay(hook.URL, "", "", payload); err != nil {
+		t.Fatal(err)
+	}
+	<-svc.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.Drain(ctx); err != context.DeadlineExceeded {
+		t.Errorf("got %v while the event is handled, want %v", err, context.DeadlineExceeded)
+	}
+	if err := Replay(hook.URL, "", "", payload); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("got %v for a webhook received while draining, want a 503", err)
+	}
+
+	close(svc.release)
+	if err := s.Drain(context.Background()); err != nil {
+		t.Errorf("got %v once the event was handled, want nil", err)
+	}
+}
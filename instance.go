@@ -0,0 +1,202 @@
+package gitbot
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cosminilie/gitbot/plugins"
+	"github.com/cosminilie/gitbot/schedule"
+)
+
+const (
+	//DefaultInstance is the name of the instance configured by the top level token and git-api-URL settings
+	DefaultInstance = "default"
+	defaultHookPath = "/hook"
+	//DefaultPluginTimeout bounds the handling of an event or a group by a plugin without a timeout in the configuration
+	DefaultPluginTimeout = 2 * time.Minute
+	//DefaultScheduleInterval is how often the recurring handlers without a schedule in the configuration run
+	DefaultScheduleInterval = time.Minute
+)
+
+//Hook strategies, they decide which hooks the bot registers to receive the events of its repos
+const (
+	//HookStrategyProject registers a hook on every project
+	HookStrategyProject = "project"
+	//HookStrategyGroup registers a single hook on each configured group, it needs GitLab EE. Projects outside the
+	//configured groups get a project hook.
+	HookStrategyGroup = "group"
+	//HookStrategySystem registers an instance wide system hook, it needs an administrator token. System hooks do not
+	//deliver comments so the projects with comment plugins also get a project hook for comments only.
+	HookStrategySystem = "system"
+)
+
+//Instance struct in loading HCL configuration. It holds the settings of a GitLab instance served by the bot
+type Instance struct {
+	Name             string   `hcl:",key"`
+	Token            string   `hcl:"token"`
+	GitURL           string   `hcl:"git-api-URL"`
+	DefaultApprovers []string `hcl:"default-approvers"`
+	//HookPath is the path webhooks for this instance are received on. Defaults to /hook/<name>.
+	HookPath string `hcl:"hook-path"`
+	//HookStrategy is one of project, group or system. Defaults to project.
+	HookStrategy string `hcl:"hook-strategy"`
+	//Hook configures the hooks the bot registers on GitLab
+	Hook HookConfig `hcl:"hook"`
+	//RateLimit throttles and retries the API calls made to this instance
+	RateLimit plugins.RateLimit `hcl:"rate-limit"`
+	//PluginTimeout bounds the handling of an event or a group by a plugin, e.g. "30s". Defaults to DefaultPluginTimeout.
+	PluginTimeout string `hcl:"plugin-timeout"`
+	//PluginTimeouts overrides PluginTimeout for the named plugins
+	PluginTimeouts map[string]string `hcl:"plugin-timeouts"`
+	//Schedules set when the recurring handlers and the group plugins run
+	Schedules []ScheduleConfig `hcl:"schedule,expand"`
+	Repos     []plugins.Repo   `hcl:"repo,expand"`
+}
+
+//ScheduleConfig struct in loading HCL configuration. It sets when a recurring handler (refresh_repos, hooks,
+//expire_grants or merge_queue) or a group plugin (e.g. drop_rights) runs, either on an interval or on a cron expression.
+type ScheduleConfig struct {
+	Name string `hcl:",key"`
+	//Interval between the runs, e.g. "10m"
+	Interval string `hcl:"interval"`
+	//Cron expression, e.g. "0 2 * * *", see schedule.Parse
+	Cron string `hcl:"cron"`
+	//Jitter delays each run by a random duration up to it, e.g. "30s"
+	Jitter string `hcl:"jitter"`
+}
+
+//JobSchedule is when a recurring handler or a group plugin runs
+type JobSchedule struct {
+	Schedule schedule.Schedule
+	Jitter   time.Duration
+}
+
+//PluginTimeouts holds how long each plugin may take to handle an event or a group
+type PluginTimeouts struct {
+	Default time.Duration
+	Plugins map[string]time.Duration
+}
+
+//For returns the timeout of a plugin
+func (t PluginTimeouts) For(plugin string) time.Duration {
+	if d, ok := t.Plugins[plugin]; ok {
+		return d
+	}
+	return t.Default
+}
+
+//HookConfig struct in loading HCL configuration. It describes the hooks the bot registers on GitLab
+type HookConfig struct {
+	//URL GitLab delivers events to. Defaults to http://<ip>:9091<hook-path>.
+	URL string `hcl:"url"`
+	//Token is sent by GitLab in the X-Gitlab-Token header, webhooks without it are refused
+	Token string `hcl:"token"`
+	//SSLVerify makes GitLab verify the certificate of URL
+	SSLVerify bool `hcl:"ssl-verify"`
+}
+
+//Path returns the hook path of the instance
+func (i Instance) Path() string {
+	switch {
+	case i.HookPath != "":
+		return "/" + strings.TrimPrefix(i.HookPath, "/")
+	case i.Name == DefaultInstance:
+		return defaultHookPath
+	default:
+		return defaultHookPath + "/" + i.Name
+	}
+}
+
+//Strategy returns the hook strategy of the instance
+func (i Instance) Strategy() string {
+	if i.HookStrategy == "" {
+		return HookStrategyProject
+	}
+	return i.HookStrategy
+}
+
+//Timeouts parses the plugin timeouts of the instance
+func (i Instance) Timeouts() (PluginTimeouts, error) {
+	t := PluginTimeouts{Default: DefaultPluginTimeout, Plugins: make(map[string]time.Duration)}
+	if i.PluginTimeout != "" {
+		d, err := time.ParseDuration(i.PluginTimeout)
+		if err != nil || d <= 0 {
+			return t, fmt.Errorf("invalid plugin-timeout %q", i.PluginTimeout)
+		}
+		t.Default = d
+	}
+	for plugin, v := range i.PluginTimeouts {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return t, fmt.Errorf("invalid timeout %q of plugin %s", v, plugin)
+		}
+		t.Plugins[plugin] = d
+	}
+	return t, nil
+}
+
+//JobSchedules parses the schedules of the instance, keyed by recurring handler or group plugin name. The recurring
+//handlers and group plugins without a schedule run every DefaultScheduleInterval.
+func (i Instance) JobSchedules() (map[string]JobSchedule, error) {
+	known := map[string]bool{}
+	for name := range recurring {
+		known[name] = true
+	}
+	for _, name := range plugins.GroupHandlerNames() {
+		known[name] = true
+	}
+
+	js := make(map[string]JobSchedule)
+	for _, sc := range i.Schedules {
+		if !known[sc.Name] {
+			return nil, fmt.Errorf("schedule of unknown handler %q", sc.Name)
+		}
+		if _, ok := js[sc.Name]; ok {
+			return nil, fmt.Errorf("handler %q is scheduled more than once", sc.Name)
+		}
+		var j JobSchedule
+		switch {
+		case sc.Cron != "" && sc.Interval != "":
+			return nil, fmt.Errorf("schedule %q has both an interval and a cron expression", sc.Name)
+		case sc.Cron != "":
+			sched, err := schedule.Parse(sc.Cron)
+			if err != nil {
+				return nil, fmt.Errorf("schedule %q: %s", sc.Name, err)
+			}
+			j.Schedule = sched
+		case sc.Interval != "":
+			d, err := time.ParseDuration(sc.Interval)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("schedule %q has an invalid interval %q", sc.Name, sc.Interval)
+			}
+			j.Schedule = schedule.Every(d)
+		default:
+			j.Schedule = schedule.Every(DefaultScheduleInterval)
+		}
+		if sc.Jitter != "" {
+			d, err := time.ParseDuration(sc.Jitter)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("schedule %q has an invalid jitter %q", sc.Name, sc.Jitter)
+			}
+			j.Jitter = d
+		}
+		js[sc.Name] = j
+	}
+	for name := range known {
+		if _, ok := js[name]; !ok {
+			js[name] = JobSchedule{Schedule: schedule.Every(DefaultScheduleInterval)}
+		}
+	}
+	return js, nil
+}
+
+//Host returns the host of the instance, taken from its API URL. Webhooks are matched to an instance by the host of their project web_url.
+func (i Instance) Host() string {
+	u, err := url.Parse(i.GitURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Host)
+}
@@ -0,0 +1,114 @@
+//Package logging adds levels to go-kit loggers. Records are given a level by the loggers returned from Debug, Info,
+//Warn and Error, the logger returned by NewFilter drops the records below a threshold.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+)
+
+//Level is the severity of a log record
+type Level int
+
+//Levels from the most to the least verbose
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+//Key is the key the level of a record is logged under
+const Key = "level"
+
+//Formats of the records written by New
+const (
+	FormatLogfmt = "logfmt"
+	FormatJSON   = "json"
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("Level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+//ParseLevel returns the level named s
+func ParseLevel(s string) (Level, error) {
+	for l, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(l), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q, use one of %s", s, strings.Join(levelNames, ", "))
+}
+
+//Debug returns a logger logging its records at the debug level
+func Debug(logger log.Logger) log.Logger {
+	return log.NewContext(logger).WithPrefix(Key, LevelDebug)
+}
+
+//Info returns a logger logging its records at the info level
+func Info(logger log.Logger) log.Logger {
+	return log.NewContext(logger).WithPrefix(Key, LevelInfo)
+}
+
+//Warn returns a logger logging its records at the warn level
+func Warn(logger log.Logger) log.Logger {
+	return log.NewContext(logger).WithPrefix(Key, LevelWarn)
+}
+
+//Error returns a logger logging its records at the error level
+func Error(logger log.Logger) log.Logger {
+	return log.NewContext(logger).WithPrefix(Key, LevelError)
+}
+
+//filter drops the records below its threshold
+type filter struct {
+	next      log.Logger
+	threshold Level
+}
+
+//NewFilter returns a logger passing the records at or above threshold to next. Records without a level are logged
+//at the info level.
+func NewFilter(next log.Logger, threshold Level) log.Logger {
+	return &filter{next: next, threshold: threshold}
+}
+
+func (f *filter) Log(keyvals ...interface{}) error {
+	l := LevelInfo
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if lv, ok := keyvals[i+1].(Level); ok && keyvals[i] == Key {
+			l = lv
+			break
+		}
+	}
+	if l < f.threshold {
+		return nil
+	}
+	return f.next.Log(keyvals...)
+}
+
+//New returns the logger of the bot writing records at or above threshold to w in the logfmt or json format. Each
+//record carries its time and caller.
+func New(w io.Writer, format string, threshold Level) (log.Logger, error) {
+	var logger log.Logger
+	switch format {
+	case FormatLogfmt, "":
+		logger = log.NewLogfmtLogger(log.NewSyncWriter(w))
+	case FormatJSON:
+		logger = log.NewJSONLogger(log.NewSyncWriter(w))
+	default:
+		return nil, fmt.Errorf("unknown log format %q, use %s or %s", format, FormatLogfmt, FormatJSON)
+	}
+	//the filter goes first, the caller is taken from the outermost context
+	logger = NewFilter(logger, threshold)
+	logger = log.NewContext(logger).With("ts", log.DefaultTimestampUTC, "caller", log.DefaultCaller)
+	return logger, nil
+}
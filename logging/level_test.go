@@ -0,0 +1,51 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestFilter(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewFilter(log.NewLogfmtLogger(&buf), LevelWarn)
+	ctx := log.NewContext(logger).With("plugin", "lgtm")
+
+	Debug(ctx).Log("msg", "debug")
+	Info(ctx).Log("msg", "info")
+	ctx.Log("msg", "no level")
+	Warn(ctx).Log("msg", "warn")
+	Error(ctx).Log("msg", "error")
+
+	want := "level=warn plugin=lgtm msg=warn\nlevel=error plugin=lgtm msg=error\n"
+	if buf.String() != want {
+		t.Errorf("got\n%swant\n%s", buf.String(), want)
+	}
+}
+
+func TestNewJSON(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, FormatJSON, LevelDebug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Debug(log.NewContext(logger).With("Repo", "platform/api")).Log("msg", "hello")
+
+	var rec map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("%s is not JSON: %s", buf.String(), err)
+	}
+	if rec["level"] != "debug" || rec["Repo"] != "platform/api" || !strings.HasPrefix(rec["caller"].(string), "level_test.go:") {
+		t.Errorf("got record %v", rec)
+	}
+
+	if _, err := New(&buf, "xml", LevelInfo); err == nil {
+		t.Error("unknown format accepted")
+	}
+	if l, err := ParseLevel("WARN"); err != nil || l != LevelWarn {
+		t.Errorf("got level %s and error %v, want warn", l, err)
+	}
+}
@@ -0,0 +1,332 @@
+package access
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/cosminilie/gitbot/audit"
+	"github.com/cosminilie/gitbot/gitlabhook"
+	"github.com/cosminilie/gitbot/logging"
+	"github.com/cosminilie/gitbot/plugins"
+	"github.com/go-kit/kit/log"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+const (
+	pluginName = "access"
+	//MaxDuration is the longest access that can be requested
+	MaxDuration = 24 * time.Hour
+)
+
+var (
+	requestRe = regexp.MustCompile(`(?mi)^/request-access[ \t]+(\S+)[ \t]+(\S+)[ \t]+(\S.*?)\r?$`)
+	approveRe = regexp.MustCompile(`(?mi)^/approve(?:[ \t]+@?(\S+))?[ \t]*\r?$`)
+)
+
+func init() {
+	plugins.RegisterMergeCommentEventHandler(pluginName, handleComment)
+}
+
+//AccessError is an error struct which implements the error interface
+type AccessError struct {
+	Repo      string
+	Group     string
+	User      string
+	Action    string
+	Condition string
+	Result    error
+}
+
+func (e AccessError) Error() string {
+	return fmt.Sprintf("AccessError:\nRepo:%s,\nGroup:%s,\nUser:%s,\nAction:%s,\nCondition:%s,\nResult:%s,\n", e.Repo, e.Group, e.User, e.Action, e.Condition, e.Result)
+}
+
+//handleComment handles the comments made on the issues and merge requests of a project. The access is granted on
+//the group of the project and approved by the approvers of that group, or of the project when the group is not
+//configured on its own.
+func handleComment(ctx context.Context, pc *plugins.PluginClient, ic gitlabhook.MergeRequestCommentEvent) error {
+	pc.Pmut.Lock()
+	defer pc.Pmut.Unlock()
+
+	project := ic.Project.PathWithNamespace
+	group := projectGroup(project)
+	approvers := pc.Repos[project].Approvers
+	if g, ok := pc.GroupRepos[group]; ok && len(g.Approvers) > 0 {
+		approvers = g.Approvers
+	}
+	if !requestRe.MatchString(ic.ObjectAttributes.Note) && !approveRe.MatchString(ic.ObjectAttributes.Note) {
+		return nil
+	}
+	//grants are kept by the ID of the group so that they survive renaming it
+	gid, err := pc.Groups.ID(pc.GitLabClient, group)
+	if err != nil {
+		return AccessError{
+			Repo:   project,
+			Group:  group,
+			User:   ic.User.Username,
+			Action: "ResolveGroup",
+			Result: err,
+		}
+	}
+	return handle(pc.Logger, pc.GitLabClient, pc.Audit, pc.Grants, ic, group, gid, approvers, time.Now())
+}
+
+func handle(logger log.Logger, cl plugins.GitLabClient, al *audit.Log, grants *plugins.Grants, ic gitlabhook.MergeRequestCommentEvent, group string, gid int, approvers []string, now time.Time) error {
+	var iid int
+	switch ic.ObjectAttributes.NoteableType {
+	case "Issue":
+		iid = ic.Issue.IID
+	case "MergeRequest":
+		iid = ic.MergeRequest.IID
+	default:
+		//comments on commits and snippets
+		return nil
+	}
+	c := &comment{
+		logger: logger,
+		cl:     cl,
+		ic:     ic,
+		iid:    iid,
+		group:  group,
+		gid:    gid,
+	}
+
+	if m := requestRe.FindStringSubmatch(ic.ObjectAttributes.Note); m != nil {
+		return c.request(grants, approvers, m[1], m[2], m[3], now)
+	}
+	if m := approveRe.FindStringSubmatch(ic.ObjectAttributes.Note); m != nil {
+		return c.approve(al, grants, approvers, m[1], now)
+	}
+	logging.Debug(logger).Log(
+		"Plugin", pluginName,
+		"Action", "Ignore",
+		"Condition", "!request&&!approve",
+	)
+	return nil
+}
+
+//comment is an access command found in a comment
+type comment struct {
+	logger log.Logger
+	cl     plugins.GitLabClient
+	ic     gitlabhook.MergeRequestCommentEvent
+	iid    int
+	group  string
+	gid    int
+}
+
+//request records a pending grant and tells who can approve it
+func (c *comment) request(grants *plugins.Grants, approvers []string, levelName, duration, reason string, now time.Time) error {
+	level, err := plugins.ParseAccessLevel(levelName)
+	if err != nil || level < gitlab.DeveloperPermissions || level >= gitlab.OwnerPermission {
+		return c.reply("Access plugin -> Only developer or maintainer access can be requested", "InvalidLevel")
+	}
+	d, err := time.ParseDuration(duration)
+	if err != nil || d <= 0 || d > MaxDuration {
+		return c.reply(fmt.Sprintf("Access plugin -> The duration must be at most %s, e.g. 2h", MaxDuration), "InvalidDuration")
+	}
+	if len(approvers) == 0 {
+		return c.reply(fmt.Sprintf("Access plugin -> Nobody can approve access to %s, the group has no approvers", c.group), "NoApprovers")
+	}
+
+	err = grants.Request(plugins.AccessGrant{
+		GroupID:      c.gid,
+		Group:        c.group,
+		User:         c.ic.User.Username,
+		Level:        level,
+		Reason:       strings.TrimSpace(reason),
+		Duration:     d,
+		Project:      c.ic.Project.PathWithNamespace,
+		ProjectID:    c.ic.ProjectID,
+		NoteableType: c.ic.ObjectAttributes.NoteableType,
+		NoteableIID:  c.iid,
+		RequestedAt:  now,
+	})
+	if err != nil {
+		return AccessError{
+			Repo:   c.ic.Project.PathWithNamespace,
+			Group:  c.group,
+			User:   c.ic.User.Username,
+			Action: "SaveGrants",
+			Result: err,
+		}
+	}
+	c.logger.Log(
+		"Plugin", pluginName,
+		"Action", "RequestAccess",
+		"Group", c.group,
+		"Username", c.ic.User.Username,
+		"AccessLevel", plugins.AccessLevelName(level),
+		"Duration", d,
+	)
+	return c.reply(fmt.Sprintf("Access plugin -> Requested %s access to %s for %s. Waiting for `/approve @%s` from one of %s",
+		plugins.AccessLevelName(level), c.group, d, c.ic.User.Username, strings.Join(approvers, ", ")), "RequestAccess")
+}
+
+//approve elevates the member of a pending request and records the grant. The requester is named with `/approve @user`,
+//it may only be left out when a single request is pending so that nobody else's request gets approved by mistake.
+func (c *comment) approve(al *audit.Log, grants *plugins.Grants, approvers []string, requester string, now time.Time) error {
+	var g plugins.AccessGrant
+	pending := grants.Pending(c.ic.ProjectID, c.ic.ObjectAttributes.NoteableType, c.iid, now)
+	switch {
+	case len(pending) == 0:
+		return c.reply("Access plugin -> There is no pending access request to approve", "NoPendingRequest")
+	case requester == "" && len(pending) > 1:
+		users := make([]string, 0, len(pending))
+		for _, p := range pending {
+			users = append(users, "@"+p.User)
+		}
+		return c.reply(fmt.Sprintf("Access plugin -> Several access requests are pending, approve one of %s with `/approve @user`", strings.Join(users, ", ")), "SeveralPendingRequests")
+	case requester == "":
+		g = pending[0]
+	default:
+		found := false
+		for _, p := range pending {
+			if strings.EqualFold(p.User, requester) {
+				g, found = p, true
+			}
+		}
+		if !found {
+			return c.reply(fmt.Sprintf("Access plugin -> There is no pending access request of %s to approve", requester), "NoPendingRequest")
+		}
+	}
+	approver := c.ic.User.Username
+	switch {
+	case !inList(approver, approvers):
+		return c.reply("Access plugin -> You can't approve access unless you are in the list of Approvers", "!isApprover")
+	case strings.EqualFold(approver, g.User):
+		return c.reply("Access plugin -> You can't approve your own access request", "isRequester")
+	}
+
+	var member *gitlab.GroupMember
+	err := plugins.ForEachGroupMember(c.cl, c.gid, func(m *gitlab.GroupMember) error {
+		if strings.EqualFold(m.Username, g.User) {
+			member = m
+		}
+		return nil
+	})
+	if err != nil {
+		return AccessError{
+			Repo:   g.Project,
+			Group:  c.group,
+			User:   g.User,
+			Action: "ListGroupMembers",
+			Result: err,
+		}
+	}
+	if member == nil {
+		return c.reply(fmt.Sprintf("Access plugin -> %s is not a member of %s", g.User, c.group), "!isMember")
+	}
+	//an elevated member may ask again to extend or change the grant
+	if _, elevated := grants.Active(c.gid, g.User, now); member.AccessLevel >= g.Level && !elevated {
+		return c.reply(fmt.Sprintf("Access plugin -> %s already has %s access to %s", g.User, plugins.AccessLevelName(member.AccessLevel), c.group), "hasLevel")
+	}
+
+	g.PreviousLevel = member.AccessLevel
+	g.Approver = approver
+	g.Expires = now.Add(g.Duration)
+
+	c.logger.Log(
+		"Plugin", pluginName,
+		"Action", "UpdateGroupMember",
+		"Group", c.group,
+		"Username", g.User,
+		"AccessLevel", plugins.AccessLevelName(g.Level),
+		"Approver", approver,
+	)
+	_, _, err = c.cl.UpdateGroupMember(c.gid, member.ID, &gitlab.UpdateGroupMemberOptions{AccessLevel: gitlab.AccessLevel(g.Level)})
+	if auditErr := al.Append(grantRecord(c.ic, g, member.AccessLevel, err)); auditErr != nil {
+		return AccessError{
+			Repo:   g.Project,
+			Group:  c.group,
+			User:   g.User,
+			Action: "Audit",
+			Result: auditErr,
+		}
+	}
+	if err != nil {
+		return AccessError{
+			Repo:   g.Project,
+			Group:  c.group,
+			User:   g.User,
+			Action: "UpdateGroupMember",
+			Result: err,
+		}
+	}
+	g, err = grants.Approve(g)
+	if err != nil {
+		return AccessError{
+			Repo:   g.Project,
+			Group:  c.group,
+			User:   g.User,
+			Action: "SaveGrants",
+			Result: err,
+		}
+	}
+
+	return c.reply(fmt.Sprintf("Access plugin -> Granted %s access to %s to @%s until %s",
+		plugins.AccessLevelName(g.Level), c.group, g.User, g.Expires.UTC().Format(time.RFC3339)), "GrantAccess")
+}
+
+//reply comments on the issue or merge request of the command
+func (c *comment) reply(msg, condition string) error {
+	if err := plugins.CreateNote(c.cl, c.ic.ProjectID, c.ic.ObjectAttributes.NoteableType, c.iid, plugins.FormatResponse(c.ic, msg)); err != nil {
+		return AccessError{
+			Repo:      c.ic.Project.PathWithNamespace,
+			Group:     c.group,
+			User:      c.ic.User.Username,
+			Action:    "CreateNote",
+			Condition: condition,
+			Result:    err,
+		}
+	}
+	return nil
+}
+
+//projectGroup returns the full path of the group of a project
+func projectGroup(project string) string {
+	if i := strings.LastIndex(project, "/"); i >= 0 {
+		return project[:i]
+	}
+	return project
+}
+
+func inList(a string, list []string) bool {
+	for _, b := range list {
+		if strings.EqualFold(b, a) {
+			return true
+		}
+	}
+	return false
+}
+
+//grantRecord builds the audit record for an approved access request
+func grantRecord(ic gitlabhook.MergeRequestCommentEvent, g plugins.AccessGrant, old gitlab.AccessLevelValue, err error) audit.Record {
+	result := "ok"
+	if err != nil {
+		result = err.Error()
+	}
+	event := ic.ObjectAttributes.URL
+	if event == "" {
+		event = fmt.Sprintf("note %d", ic.ObjectAttributes.ID)
+	}
+	expires := g.Expires
+	return audit.Record{
+		Action:         audit.ActionGrantAccess,
+		Plugin:         pluginName,
+		Actor:          g.Approver,
+		Approvers:      []string{g.Approver},
+		Project:        g.Project,
+		Group:          g.Group,
+		Member:         g.User,
+		OldAccessLevel: int(old),
+		NewAccessLevel: int(g.Level),
+		Reason:         g.Reason,
+		Expires:        &expires,
+		Event:          event,
+		Result:         result,
+	}
+}
@@ -0,0 +1,119 @@
+package access
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cosminilie/gitbot/gitlabfake"
+	"github.com/cosminilie/gitbot/gitlabhook"
+	"github.com/cosminilie/gitbot/plugins"
+	"github.com/go-kit/kit/log"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+func TestRequestAndApprove(t *testing.T) {
+	gl := gitlabfake.New()
+	g := gl.AddGroup("tools")
+	gl.AddGroupMember(g.ID, "alice", gitlab.ReporterPermissions)
+	gl.AddGroupMember(g.ID, "mallory", gitlab.ReporterPermissions)
+	p := gl.AddProject("tools/access")
+	issue, err := gl.AddIssue(p.ID, "access requests")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	grants := plugins.NewGrants()
+	approvers := []string{"bob"}
+	now := time.Date(2017, 7, 3, 10, 0, 0, 0, time.UTC)
+	comment := func(user, note string) {
+		ic := gitlabhook.MergeRequestCommentEvent{
+			ProjectID: p.ID,
+			User:      gitlabhook.User{Username: user, Name: user},
+			Project:   gitlabhook.Project{PathWithNamespace: p.PathWithNamespace},
+			ObjectAttributes: gitlabhook.ObjectAttributes{
+				Note:         note,
+				NoteableType: "Issue",
+			},
+			Issue: gitlabhook.Issue{IID: issue.IID},
+		}
+		if err := handle(log.NewNopLogger(), gl, nil, grants, ic, "tools", g.ID, approvers, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lastNote := func() string {
+		notes := gl.IssueNotes(p.ID, issue.IID)
+		if len(notes) == 0 {
+			return ""
+		}
+		return notes[len(notes)-1].Body
+	}
+	level := func() gitlab.AccessLevelValue {
+		return gl.Members(g.ID)[0].AccessLevel
+	}
+	pending := func() []string {
+		var users []string
+		for _, p := range grants.Pending(p.ID, "Issue", issue.IID, now) {
+			users = append(users, p.User)
+		}
+		return users
+	}
+
+	comment("alice", "/request-access owner 2h fix the build")
+	if !strings.Contains(lastNote(), "Only developer or maintainer") {
+		t.Errorf("got %q, want owner access to be refused", lastNote())
+	}
+	comment("alice", "/request-access developer 48h fix the build")
+	if !strings.Contains(lastNote(), "at most") {
+		t.Errorf("got %q, want the duration to be refused", lastNote())
+	}
+
+	comment("alice", "/request-access developer 2h fix the build")
+	if users := pending(); len(users) != 1 || users[0] != "alice" {
+		t.Fatalf("got pending requests of %v, want alice's", users)
+	}
+	comment("alice", "/approve")
+	comment("carol", "/approve")
+	if level() != gitlab.ReporterPermissions {
+		t.Fatalf("got alice at %s before an approver approved", plugins.AccessLevelName(level()))
+	}
+
+	//another commenter does not replace alice's request, the approver has to name the requester
+	comment("mallory", "/request-access maintainer 2h fix the build")
+	if users := pending(); len(users) != 2 {
+		t.Fatalf("got pending requests of %v, want alice's and mallory's", users)
+	}
+	comment("bob", "/approve")
+	if !strings.Contains(lastNote(), "Several access requests are pending") || level() != gitlab.ReporterPermissions {
+		t.Fatalf("got %q, want the approver asked to name the requester", lastNote())
+	}
+	comment("bob", "/approve @carol")
+	if !strings.Contains(lastNote(), "no pending access request of carol") {
+		t.Errorf("got %q, want no request of carol to approve", lastNote())
+	}
+
+	comment("bob", "/approve @alice")
+	if level() != gitlab.DeveloperPermissions {
+		t.Fatalf("got alice at %s, want developer", plugins.AccessLevelName(level()))
+	}
+	a, ok := grants.Active(g.ID, "alice", now)
+	if !ok || a.Approver != "bob" || a.PreviousLevel != gitlab.ReporterPermissions || !a.Expires.Equal(now.Add(2*time.Hour)) || a.Reason != "fix the build" {
+		t.Errorf("got grant %+v", a)
+	}
+	if _, ok := grants.Active(g.ID, "alice", now.Add(2*time.Hour)); ok {
+		t.Error("the grant is active after it expired")
+	}
+	if users := pending(); len(users) != 1 || users[0] != "mallory" {
+		t.Errorf("got pending requests of %v, want only mallory's left", users)
+	}
+	if m := gl.Members(g.ID)[1]; m.AccessLevel != gitlab.ReporterPermissions {
+		t.Errorf("got mallory at %s, want reporter", plugins.AccessLevelName(m.AccessLevel))
+	}
+	if !strings.Contains(lastNote(), "Granted developer access to tools") {
+		t.Errorf("got %q, want the grant to be announced", lastNote())
+	}
+	comment("bob", "/approve @alice")
+	if !strings.Contains(lastNote(), "no pending access request") {
+		t.Errorf("got %q, want nothing left to approve", lastNote())
+	}
+}
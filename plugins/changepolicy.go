@@ -0,0 +1,118 @@
+package plugins
+
+import (
+	"fmt"
+	"regexp"
+
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+//PolicyPlugin is the name of the plugin checking merge requests against the change control policy of their repo.
+//lgtm refuses to merge the merge requests breaking the policy of the repos it is enabled on.
+const PolicyPlugin = "policy"
+
+//DefaultPolicyStatus is the name of the commit status set by the policy plugin when the policy sets none
+const DefaultPolicyStatus = "policy"
+
+//mergeCommitRe matches the merge commits GitLab and git create, they are not held to the commit policy
+var mergeCommitRe = regexp.MustCompile(`^Merge (branch|remote-tracking branch) '`)
+
+//ChangePolicy struct in loading HCL configuration. It sets the regular expressions the title, the description and the
+//commit messages of the merge requests of a repo must match, e.g. a ticket reference such as JIRA-123 in the title
+//and conventional commit messages.
+type ChangePolicy struct {
+	Title string `hcl:"title"`
+	//DescriptionSections must each match a line of the description, e.g. "^## Testing"
+	DescriptionSections []string `hcl:"description-sections"`
+	//Commit must match the message of every commit of the merge request except merge commits
+	Commit string `hcl:"commit"`
+	//Status is the name of the commit status set on the last commit. Defaults to DefaultPolicyStatus.
+	Status string `hcl:"status"`
+	//Label is added to the merge requests breaking the policy and removed once they comply. None when empty.
+	Label string `hcl:"label"`
+}
+
+//Validate checks the regular expressions of the policy
+func (p ChangePolicy) Validate() error {
+	_, err := p.compile()
+	return err
+}
+
+//StatusName returns the name of the commit status of the policy
+func (p ChangePolicy) StatusName() string {
+	if p.Status == "" {
+		return DefaultPolicyStatus
+	}
+	return p.Status
+}
+
+type compiledPolicy struct {
+	title    *regexp.Regexp
+	sections []*regexp.Regexp
+	commit   *regexp.Regexp
+}
+
+func (p ChangePolicy) compile() (*compiledPolicy, error) {
+	var (
+		c   compiledPolicy
+		err error
+	)
+	if p.Title != "" {
+		if c.title, err = regexp.Compile(p.Title); err != nil {
+			return nil, fmt.Errorf("invalid title: %s", err)
+		}
+	}
+	for _, s := range p.DescriptionSections {
+		re, err := regexp.Compile("(?m)" + s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid description section %q: %s", s, err)
+		}
+		c.sections = append(c.sections, re)
+	}
+	if p.Commit != "" {
+		if c.commit, err = regexp.Compile(p.Commit); err != nil {
+			return nil, fmt.Errorf("invalid commit: %s", err)
+		}
+	}
+	return &c, nil
+}
+
+//CheckPolicy returns the violations of the policy by a merge request, none when it complies. The commits of the
+//merge request are only listed when the policy has a commit expression.
+func CheckPolicy(gc GitLabClient, pid interface{}, mergeRequest int, title, description string, policy ChangePolicy) ([]string, error) {
+	c, err := policy.compile()
+	if err != nil {
+		return nil, err
+	}
+	var violations []string
+	if c.title != nil && !c.title.MatchString(title) {
+		violations = append(violations, fmt.Sprintf("the title does not match `%s`", policy.Title))
+	}
+	for i, re := range c.sections {
+		if !re.MatchString(description) {
+			violations = append(violations, fmt.Sprintf("the description has no section matching `%s`", policy.DescriptionSections[i]))
+		}
+	}
+	if c.commit == nil {
+		return violations, nil
+	}
+	err = ForEachMergeRequestCommit(gc, pid, mergeRequest, func(commit *gitlab.Commit) error {
+		msg := commit.Message
+		if msg == "" {
+			msg = commit.Title
+		}
+		if mergeCommitRe.MatchString(msg) || c.commit.MatchString(msg) {
+			return nil
+		}
+		violations = append(violations, fmt.Sprintf("the message of commit %s does not match `%s`", shortSHA(commit.ID), policy.Commit))
+		return nil
+	})
+	return violations, err
+}
+
+func shortSHA(sha string) string {
+	if len(sha) > 8 {
+		return sha[:8]
+	}
+	return sha
+}
@@ -0,0 +1,49 @@
+package plugins_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cosminilie/gitbot/gitlabfake"
+	"github.com/cosminilie/gitbot/plugins"
+)
+
+func TestCheckPolicy(t *testing.T) {
+	gl := gitlabfake.New()
+	p := gl.AddProject("tools/api")
+	mr, _ := gl.AddMergeRequest(p.ID, "alert", "master", "JIRA-123 Add disk alert")
+	gl.AddMergeRequestCommit(p.ID, mr.IID, "feat(alerts): add disk usage alert")
+	gl.AddMergeRequestCommit(p.ID, mr.IID, "Merge branch 'master' into alert")
+	bad, _ := gl.AddMergeRequestCommit(p.ID, mr.IID, "wip\n\nfix later")
+	policy := plugins.ChangePolicy{
+		Title:               `^[A-Z]+-[0-9]+ `,
+		DescriptionSections: []string{`^## Summary`, `^## Testing`},
+		Commit:              `^(feat|fix|docs|chore|refactor|test)(\(.+\))?!?: .+`,
+	}
+
+	violations, err := plugins.CheckPolicy(gl, p.ID, mr.IID, "Add disk alert", "## Summary\nAdds an alert", policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"the title does not match `^[A-Z]+-[0-9]+ `",
+		"the description has no section matching `^## Testing`",
+		"the message of commit " + bad.ID + " does not match `" + policy.Commit + "`",
+	}
+	if strings.Join(violations, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got violations %q, want %q", violations, want)
+	}
+
+	gl.AddMergeRequestCommit(p.ID, mr.IID, "fix: drop the wip commit")
+	violations, err = plugins.CheckPolicy(gl, p.ID, mr.IID, "JIRA-123 Add disk alert", "## Summary\nAdds an alert\n\n## Testing\nmake test", plugins.ChangePolicy{Title: policy.Title, DescriptionSections: policy.DescriptionSections})
+	if err != nil || len(violations) != 0 {
+		t.Errorf("got %q, %v, want a compliant merge request", violations, err)
+	}
+
+	if err := (plugins.ChangePolicy{Commit: "("}).Validate(); err == nil {
+		t.Error("got an invalid commit expression accepted")
+	}
+	if name := (plugins.ChangePolicy{}).StatusName(); name != plugins.DefaultPolicyStatus {
+		t.Errorf("got status %q", name)
+	}
+}
@@ -0,0 +1,127 @@
+package plugins
+
+import (
+	"fmt"
+	"strings"
+
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+//Checks is the state of the pipeline and of the required checks of the last commit of a merge request
+type Checks struct {
+	SHA string
+	//Pipeline is the head pipeline of the merge request, nil when no pipeline ran
+	Pipeline *Pipeline
+	//Failed and Pending are the required checks that did not pass and the ones that did not finish yet
+	Failed  []*gitlab.CommitStatus
+	Pending []*gitlab.CommitStatus
+	//Missing are the required checks that did not run on the commit
+	Missing []string
+	//Jobs are the names of the jobs of Pipeline. They are only listed when a required check is pending.
+	Jobs []string
+}
+
+//CheckCommit looks up the statuses of the required jobs and external checks of a commit. pipeline is the head
+//pipeline of the merge request of the commit, when it has one. A pipeline of an older commit is ignored.
+func CheckCommit(gc GitLabClient, pid interface{}, sha string, pipeline *Pipeline, required []string) (Checks, error) {
+	if pipeline != nil && pipeline.SHA != sha {
+		pipeline = nil
+	}
+	c := Checks{SHA: sha, Pipeline: pipeline}
+	if len(required) == 0 {
+		return c, nil
+	}
+	statuses := make(map[string]*gitlab.CommitStatus)
+	err := ForEachCommitStatus(gc, pid, sha, func(s *gitlab.CommitStatus) error {
+		statuses[s.Name] = s
+		return nil
+	})
+	if err != nil {
+		return c, err
+	}
+	for _, name := range required {
+		s, ok := statuses[name]
+		switch {
+		case !ok:
+			c.Missing = append(c.Missing, name)
+		case s.Status == "success":
+		case failedStatus(s.Status) || s.Status == "manual":
+			c.Failed = append(c.Failed, s)
+		default:
+			c.Pending = append(c.Pending, s)
+		}
+	}
+	if pipeline == nil || len(c.Pending) == 0 {
+		return c, nil
+	}
+	err = ForEachPipelineJob(gc, pid, pipeline.ID, func(j *Job) error {
+		c.Jobs = append(c.Jobs, j.Name)
+		return nil
+	})
+	return c, err
+}
+
+//Blocked reports whether the commit must not be merged: its pipeline or a required check failed, or a required
+//check did not run
+func (c Checks) Blocked() bool {
+	return c.Pipeline != nil && failedStatus(c.Pipeline.Status) || len(c.Failed) > 0 || len(c.Missing) > 0
+}
+
+//Green reports whether the pipeline, when there is one, and every required check passed
+func (c Checks) Green() bool {
+	return (c.Pipeline == nil || c.Pipeline.Status == "success") && len(c.Failed)+len(c.Pending)+len(c.Missing) == 0
+}
+
+//PendingOutsidePipeline reports whether a required check that did not finish is not a job of the pipeline, such as an
+//external check. GitLab only waits for the pipeline before merging a merge request set to merge when it succeeds.
+func (c Checks) PendingOutsidePipeline() bool {
+	jobs := make(map[string]bool, len(c.Jobs))
+	for _, j := range c.Jobs {
+		jobs[j] = true
+	}
+	for _, s := range c.Pending {
+		if c.Pipeline == nil || !jobs[s.Name] {
+			return true
+		}
+	}
+	return false
+}
+
+//Explain describes what keeps the commit from being merged, e.g. "pipeline #12 failed, required check `lint` is missing"
+func (c Checks) Explain() string {
+	var why []string
+	if c.Pipeline != nil && c.Pipeline.Status != "success" {
+		why = append(why, fmt.Sprintf("pipeline #%d %s", c.Pipeline.ID, describeStatus(c.Pipeline.Status)))
+	}
+	for _, s := range c.Failed {
+		why = append(why, fmt.Sprintf("required check `%s` %s", s.Name, describeStatus(s.Status)))
+	}
+	for _, name := range c.Missing {
+		why = append(why, fmt.Sprintf("required check `%s` is missing", name))
+	}
+	for _, s := range c.Pending {
+		why = append(why, fmt.Sprintf("required check `%s` %s", s.Name, describeStatus(s.Status)))
+	}
+	return strings.Join(why, ", ")
+}
+
+//failedStatus reports whether a job or pipeline ended without passing
+func failedStatus(status string) bool {
+	switch status {
+	case "failed", "canceled", "skipped":
+		return true
+	}
+	return false
+}
+
+func describeStatus(status string) string {
+	switch status {
+	case "failed":
+		return "failed"
+	case "canceled", "skipped":
+		return "was " + status
+	case "manual":
+		return "was not run"
+	}
+	return "is " + status
+}
@@ -0,0 +1,69 @@
+package plugins_test
+
+import (
+	"testing"
+
+	"github.com/cosminilie/gitbot/gitlabfake"
+	"github.com/cosminilie/gitbot/plugins"
+)
+
+func TestCheckCommit(t *testing.T) {
+	gl := gitlabfake.New()
+	p := gl.AddProject("tools/api")
+	required := []string{"unit", "lint", "security"}
+	for _, s := range []struct{ name, status string }{{"unit", "success"}, {"lint", "running"}, {"docs", "failed"}} {
+		gl.AddCommitStatus(p.ID, "abc", s.name, s.status)
+	}
+
+	tests := []struct {
+		name     string
+		pipeline *plugins.Pipeline
+		statuses map[string]string
+		blocked  bool
+		green    bool
+		explain  string
+	}{
+		{
+			name:    "missing",
+			blocked: true,
+			explain: "required check `security` is missing, required check `lint` is running",
+		},
+		{
+			name:     "failed",
+			pipeline: &plugins.Pipeline{ID: 12, SHA: "abc", Status: "failed"},
+			statuses: map[string]string{"security": "canceled"},
+			blocked:  true,
+			explain:  "pipeline #12 failed, required check `security` was canceled, required check `lint` is running",
+		},
+		{
+			name:     "pending",
+			pipeline: &plugins.Pipeline{ID: 12, SHA: "abc", Status: "running"},
+			statuses: map[string]string{"security": "success"},
+			explain:  "pipeline #12 is running, required check `lint` is running",
+		},
+		{
+			name:     "green with a pipeline of an older commit",
+			pipeline: &plugins.Pipeline{ID: 11, SHA: "old", Status: "failed"},
+			statuses: map[string]string{"lint": "success"},
+			green:    true,
+		},
+	}
+	for _, tt := range tests {
+		for name, status := range tt.statuses {
+			gl.AddCommitStatus(p.ID, "abc", name, status)
+		}
+		c, err := plugins.CheckCommit(gl, p.ID, "abc", tt.pipeline, required)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if c.Blocked() != tt.blocked || c.Green() != tt.green || c.Explain() != tt.explain {
+			t.Errorf("%s: got blocked %v, green %v, %q", tt.name, c.Blocked(), c.Green(), c.Explain())
+		}
+	}
+
+	//without required checks only the pipeline counts
+	c, err := plugins.CheckCommit(gl, p.ID, "def", nil, nil)
+	if err != nil || !c.Green() || c.Blocked() {
+		t.Errorf("got %+v, %v, want a commit without pipeline green", c, err)
+	}
+}
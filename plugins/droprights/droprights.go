@@ -1,10 +1,12 @@
 package droprights
 
 import (
+	"context"
 	"fmt"
-	"os"
-	"strings"
+	"time"
 
+	"github.com/cosminilie/gitbot/audit"
+	"github.com/cosminilie/gitbot/logging"
 	"github.com/cosminilie/gitbot/plugins"
 	"github.com/go-kit/kit/log"
 	gitlab "github.com/xanzy/go-gitlab"
@@ -14,10 +16,6 @@ const (
 	pluginName = "drop_rights"
 )
 
-var (
-	groupList []*gitlab.Group
-)
-
 func init() {
 	plugins.RegisterGroupHandler(pluginName, dropRights)
 }
@@ -36,51 +34,58 @@ func (e DropRightsError) Error() string {
 	return fmt.Sprintf("DropRightsError:\nRepo:%s,\nGroup:%s,\nUser:%s,\nAction:%s,\nCondition:%s,\nResult:%s,\n", e.Repo, e.Group, e.User, e.Action, e.Condition, e.Result)
 }
 
-func dropRights(pc *plugins.PluginClient, ic string) error {
-	//logging
-	var logger log.Logger
-	{
-		logger = log.NewLogfmtLogger(os.Stdout)
-		logger = log.NewContext(logger).With("ts", log.DefaultTimestampUTC)
-		logger = log.NewContext(logger).With("caller", log.DefaultCaller)
-		logger = log.NewContext(logger).With("plugin", "drop_rights")
-	}
+func dropRights(ctx context.Context, pc *plugins.PluginClient, ic string) error {
 	pc.Pmut.Lock()
 	defer pc.Pmut.Unlock()
 
-	return handle(logger, pc.GitLabClient, ic)
+	//the config names groups by their full path, GitLab needs the ID of the group to update its members
+	gid, err := pc.Groups.ID(pc.GitLabClient, ic)
+	if err != nil {
+		return DropRightsError{
+			Group:  ic,
+			Action: "ResolveGroup",
+			Result: err,
+		}
+	}
+	return handle(ctx, pc.Logger, pc.GitLabClient, pc.Audit, pc.Grants, ic, gid, pc.GroupRepos[ic].DropRights)
 
 }
 
-func handle(logger log.Logger, cl *gitlab.Client, mr string) error {
-	logger.Log(
+func handle(ctx context.Context, logger log.Logger, cl plugins.GitLabClient, al *audit.Log, grants *plugins.Grants, mr string, gid int, policy plugins.DropRightsPolicy) error {
+	logging.Debug(logger).Log(
 		"Repo", mr,
 		"Plugin", pluginName,
 	)
-	upgradeGroupMemberOpts := &gitlab.UpdateGroupMemberOptions{
-		AccessLevel: gitlab.AccessLevel(gitlab.ReporterPermissions),
-	}
-
-	//get group ID
-	listGroupOpts := &gitlab.ListGroupsOptions{
-		Search: gitlab.String(""),
-	}
-
-	groups, _, err := cl.Groups.ListGroups(listGroupOpts)
+	sw, err := plugins.NewSweep(cl, policy)
 	if err != nil {
 		myErr := DropRightsError{
 			Repo:      "",
 			Group:     mr,
 			User:      "",
-			Action:    "ListGroups",
+			Action:    "Policy",
 			Condition: "",
 			Result:    err,
 		}
 		return myErr
 	}
-	groupList = append(groupList, groups...)
+	now := time.Now()
+	//expired grants are revoked before the sweep so that their members go back to their previous level, not the target
+	if err := plugins.RevokeExpired(ctx, logger, cl, al, grants, pluginName, gid, now); err != nil {
+		return DropRightsError{
+			Group:  mr,
+			Action: "RevokeAccess",
+			Result: err,
+		}
+	}
+	upgradeGroupMemberOpts := &gitlab.UpdateGroupMemberOptions{
+		AccessLevel: gitlab.AccessLevel(sw.Target),
+	}
 
-	groupMembers, _, err := cl.Groups.ListGroupMembers(mr)
+	var groupMembers []*gitlab.GroupMember
+	err = plugins.ForEachGroupMember(cl, mr, func(m *gitlab.GroupMember) error {
+		groupMembers = append(groupMembers, m)
+		return nil
+	})
 	if err != nil {
 		myErr := DropRightsError{
 			Repo:      "",
@@ -95,39 +100,73 @@ func handle(logger log.Logger, cl *gitlab.Client, mr string) error {
 	}
 
 	for _, m := range groupMembers {
-		if m.AccessLevel >= gitlab.DeveloperPermissions {
-			if id := groupID(mr); id != 0 {
-				logger.Log(
-					"Repo", mr,
-					"Plugin", pluginName,
-					"Action", "UpdateGroupMember",
-					"Username", m.Username,
-				)
-				_, _, err := cl.Groups.UpdateGroupMember(id, m.ID, upgradeGroupMemberOpts)
-				if err != nil {
-					myErr := DropRightsError{
-						Repo:      "",
-						Group:     mr,
-						User:      m.Username,
-						Action:    "UpdateGroupMembership",
-						Condition: "",
-						Result:    err,
-					}
-					return myErr
-				}
-
+		//stop before the next member when the plugin timed out or the bot stops
+		if err := ctx.Err(); err != nil {
+			return DropRightsError{
+				Group:  mr,
+				User:   m.Username,
+				Action: "UpdateGroupMembership",
+				Result: err,
 			}
-
+		}
+		if granted(logger, grants, gid, m, now) {
+			continue
+		}
+		if !downgrades(logger, sw, m.Username, m.AccessLevel) {
+			continue
+		}
+		logger.Log(
+			"Repo", mr,
+			"Plugin", pluginName,
+			"Action", "UpdateGroupMember",
+			"Username", m.Username,
+		)
+		_, _, err := cl.UpdateGroupMember(gid, m.ID, upgradeGroupMemberOpts)
+		if auditErr := al.Append(memberRecord(mr, m, *upgradeGroupMemberOpts.AccessLevel, err)); auditErr != nil {
+			myErr := DropRightsError{
+				Repo:      "",
+				Group:     mr,
+				User:      m.Username,
+				Action:    "Audit",
+				Condition: "",
+				Result:    auditErr,
+			}
+			return myErr
+		}
+		if err != nil {
+			myErr := DropRightsError{
+				Repo:      "",
+				Group:     mr,
+				User:      m.Username,
+				Action:    "UpdateGroupMembership",
+				Condition: "",
+				Result:    err,
+			}
+			return myErr
 		}
 	}
 
+	if policy.Projects {
+		return sweepProjects(ctx, logger, cl, al, mr, sw)
+	}
 	return nil
 }
-func groupID(name string) int {
-	for _, g := range groupList {
-		if strings.EqualFold(g.Name, name) {
-			return g.ID
-		}
+
+//memberRecord builds the audit record for a group member access level change
+func memberRecord(group string, m *gitlab.GroupMember, level gitlab.AccessLevelValue, err error) audit.Record {
+	result := "ok"
+	if err != nil {
+		result = err.Error()
+	}
+	return audit.Record{
+		Action:         audit.ActionUpdateGroupMember,
+		Plugin:         pluginName,
+		Actor:          pluginName,
+		Group:          group,
+		Member:         m.Username,
+		OldAccessLevel: int(m.AccessLevel),
+		NewAccessLevel: int(level),
+		Event:          "schedule",
+		Result:         result,
 	}
-	return 0
 }
@@ -0,0 +1,185 @@
+package droprights
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cosminilie/gitbot/gitlabfake"
+	"github.com/cosminilie/gitbot/plugins"
+	"github.com/go-kit/kit/log"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+func TestPolicy(t *testing.T) {
+	gl := gitlabfake.New()
+	gl.SetCurrentUser("gitbot")
+	g := gl.AddGroup("tools")
+	admins := gl.AddGroup("admins")
+	gl.AddGroupMember(admins.ID, "eve", gitlab.OwnerPermission)
+	members := map[string]gitlab.AccessLevelValue{
+		"alice":  gitlab.DeveloperPermissions,
+		"bob":    gitlab.MasterPermissions,
+		"carol":  gitlab.OwnerPermission,
+		"dave":   gitlab.MasterPermissions,
+		"eve":    gitlab.MasterPermissions,
+		"gitbot": gitlab.MasterPermissions,
+		"frank":  gitlab.ReporterPermissions,
+	}
+	for u, l := range members {
+		if _, err := gl.AddGroupMember(g.ID, u, l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := gl.AddProject("tools/api")
+	gl.AddProjectMember(p.ID, "gina", gitlab.MasterPermissions)
+	gl.AddProjectMember(p.ID, "hank", gitlab.DeveloperPermissions)
+
+	policy := plugins.DropRightsPolicy{
+		TargetLevel:  "reporter",
+		MaxLevel:     "developer",
+		ExemptUsers:  []string{"dave"},
+		ExemptGroups: []string{"admins"},
+		Projects:     true,
+	}
+	pc := &plugins.PluginClient{
+		GitLabClient: gl,
+		GroupRepos:   map[string]plugins.Repo{"tools": {Name: "tools", Plugins: []string{pluginName}, DropRights: policy}},
+		Pmut:         &sync.Mutex{},
+		Logger:       log.NewNopLogger(),
+	}
+	if err := dropRights(context.Background(), pc, "tools"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]gitlab.AccessLevelValue{
+		"alice":  gitlab.DeveloperPermissions,
+		"bob":    gitlab.ReporterPermissions,
+		"carol":  gitlab.OwnerPermission,
+		"dave":   gitlab.MasterPermissions,
+		"eve":    gitlab.MasterPermissions,
+		"gitbot": gitlab.MasterPermissions,
+		"frank":  gitlab.ReporterPermissions,
+	}
+	for _, m := range gl.Members(g.ID) {
+		if m.AccessLevel != want[m.Username] {
+			t.Errorf("got %s at %s, want %s", m.Username, plugins.AccessLevelName(m.AccessLevel), plugins.AccessLevelName(want[m.Username]))
+		}
+	}
+	for _, m := range gl.ProjectMembers(p.ID) {
+		if m.Username == "gina" && m.AccessLevel != gitlab.ReporterPermissions || m.Username == "hank" && m.AccessLevel != gitlab.DeveloperPermissions {
+			t.Errorf("got project member %s at %s", m.Username, plugins.AccessLevelName(m.AccessLevel))
+		}
+	}
+
+	//owners are only downgraded when the policy includes them
+	policy.IncludeOwners = true
+	pc.GroupRepos["tools"] = plugins.Repo{Name: "tools", DropRights: policy}
+	if err := dropRights(context.Background(), pc, "tools"); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range gl.Members(g.ID) {
+		if m.Username == "carol" && m.AccessLevel != gitlab.ReporterPermissions {
+			t.Errorf("got owner carol at %s, want reporter", plugins.AccessLevelName(m.AccessLevel))
+		}
+	}
+
+	pc.GroupRepos["tools"] = plugins.Repo{Name: "tools", DropRights: plugins.DropRightsPolicy{TargetLevel: "maintainer", MaxLevel: "developer"}}
+	if err := dropRights(context.Background(), pc, "tools"); err == nil {
+		t.Error("a target level above the maximum level was accepted")
+	}
+}
+
+func TestGrants(t *testing.T) {
+	gl := gitlabfake.New()
+	g := gl.AddGroup("tools")
+	gl.AddGroupMember(g.ID, "alice", gitlab.MasterPermissions)
+	gl.AddGroupMember(g.ID, "bob", gitlab.MasterPermissions)
+	p := gl.AddProject("tools/access")
+	issue, _ := gl.AddIssue(p.ID, "access requests")
+
+	grants := plugins.NewGrants()
+	for _, u := range []string{"alice", "bob"} {
+		grants.Approve(plugins.AccessGrant{
+			GroupID:       g.ID,
+			Group:         "tools",
+			User:          u,
+			Level:         gitlab.MasterPermissions,
+			ProjectID:     p.ID,
+			NoteableType:  "Issue",
+			NoteableIID:   issue.IID,
+			PreviousLevel: gitlab.DeveloperPermissions,
+			Approver:      "carol",
+			Expires:       time.Now().Add(time.Hour),
+		})
+	}
+	//bob's grant expired, the group was renamed since
+	grants.Approve(plugins.AccessGrant{
+		GroupID:       g.ID,
+		Group:         "tools-legacy",
+		User:          "bob",
+		Level:         gitlab.MasterPermissions,
+		ProjectID:     p.ID,
+		NoteableType:  "Issue",
+		NoteableIID:   issue.IID,
+		PreviousLevel: gitlab.DeveloperPermissions,
+		Approver:      "carol",
+		Expires:       time.Now().Add(-time.Minute),
+	})
+
+	pc := &plugins.PluginClient{
+		GitLabClient: gl,
+		GroupRepos:   map[string]plugins.Repo{"tools": {Name: "tools", DropRights: plugins.DropRightsPolicy{MaxLevel: "developer"}}},
+		Grants:       grants,
+		Pmut:         &sync.Mutex{},
+		Logger:       log.NewNopLogger(),
+	}
+	if err := dropRights(context.Background(), pc, "tools"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]gitlab.AccessLevelValue{
+		"alice": gitlab.MasterPermissions,
+		//lowered back to the level bob had before the grant
+		"bob": gitlab.DeveloperPermissions,
+	}
+	for _, m := range gl.Members(g.ID) {
+		if m.AccessLevel != want[m.Username] {
+			t.Errorf("got %s at %s, want %s", m.Username, plugins.AccessLevelName(m.AccessLevel), plugins.AccessLevelName(want[m.Username]))
+		}
+	}
+	if _, active := grants.List(); len(active) != 1 || active[0].User != "alice" {
+		t.Errorf("got active grants %+v, want only alice's", active)
+	}
+	if notes := gl.IssueNotes(p.ID, issue.IID); len(notes) != 1 || !strings.Contains(notes[0].Body, "@bob") {
+		t.Errorf("got notes %+v, want bob to be told the access expired", notes)
+	}
+}
+
+func TestNestedGroup(t *testing.T) {
+	gl := gitlabfake.New()
+	gl.AddGroup("platform")
+	g := gl.AddGroup("platform/infra")
+	gl.AddGroupMember(g.ID, "alice", gitlab.MasterPermissions)
+
+	pc := &plugins.PluginClient{
+		GitLabClient: gl,
+		GroupRepos:   map[string]plugins.Repo{"platform/infra": {Name: "platform/infra"}},
+		Groups:       plugins.NewGroupCache(time.Minute),
+		Pmut:         &sync.Mutex{},
+		Logger:       log.NewNopLogger(),
+	}
+	if err := dropRights(context.Background(), pc, "platform/infra"); err != nil {
+		t.Fatal(err)
+	}
+	if m := gl.Members(g.ID)[0]; m.AccessLevel != gitlab.ReporterPermissions {
+		t.Errorf("got alice at %s, want reporter", plugins.AccessLevelName(m.AccessLevel))
+	}
+
+	err := dropRights(context.Background(), pc, "platform/missing")
+	if err == nil || !strings.Contains(err.Error(), `group "platform/missing" not found`) {
+		t.Errorf("got %v, want the group to be reported as not found", err)
+	}
+}
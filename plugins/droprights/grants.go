@@ -0,0 +1,26 @@
+package droprights
+
+import (
+	"time"
+
+	"github.com/cosminilie/gitbot/logging"
+	"github.com/cosminilie/gitbot/plugins"
+	"github.com/go-kit/kit/log"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+//granted reports whether the access level of a group member is covered by an access grant that has not expired
+func granted(logger log.Logger, grants *plugins.Grants, gid int, m *gitlab.GroupMember, now time.Time) bool {
+	g, ok := grants.Active(gid, m.Username, now)
+	if !ok || m.AccessLevel > g.Level {
+		return false
+	}
+	logging.Debug(logger).Log(
+		"Plugin", pluginName,
+		"Action", "Granted",
+		"Username", m.Username,
+		"AccessLevel", plugins.AccessLevelName(m.AccessLevel),
+		"Expires", g.Expires,
+	)
+	return true
+}
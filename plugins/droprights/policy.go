@@ -0,0 +1,124 @@
+package droprights
+
+import (
+	"context"
+
+	"github.com/cosminilie/gitbot/audit"
+	"github.com/cosminilie/gitbot/logging"
+	"github.com/cosminilie/gitbot/plugins"
+	"github.com/go-kit/kit/log"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+//downgrades reports whether the sweep lowers a member with the access level, logging the members above the maximum
+//level that are left alone because they are exempt
+func downgrades(logger log.Logger, sw *plugins.Sweep, username string, level gitlab.AccessLevelValue) bool {
+	if sw.Downgrades(username, level) {
+		return true
+	}
+	if level > sw.Max {
+		logging.Debug(logger).Log(
+			"Plugin", pluginName,
+			"Action", "Exempt",
+			"Username", username,
+			"AccessLevel", plugins.AccessLevelName(level),
+		)
+	}
+	return false
+}
+
+//sweepProjects downgrades the members added directly to the projects of the group
+func sweepProjects(ctx context.Context, logger log.Logger, cl plugins.GitLabClient, al *audit.Log, group string, sw *plugins.Sweep) error {
+	var projects []*gitlab.Project
+	err := plugins.ForEachGroupProject(cl, group, func(p *gitlab.Project) error {
+		projects = append(projects, p)
+		return nil
+	})
+	if err != nil {
+		return DropRightsError{
+			Group:  group,
+			Action: "ListGroupProjects",
+			Result: err,
+		}
+	}
+
+	opts := &gitlab.EditProjectMemberOptions{
+		AccessLevel: gitlab.AccessLevel(sw.Target),
+	}
+	for _, p := range projects {
+		var members []*gitlab.ProjectMember
+		err := plugins.ForEachProjectMember(cl, p.ID, func(m *gitlab.ProjectMember) error {
+			members = append(members, m)
+			return nil
+		})
+		if err != nil {
+			return DropRightsError{
+				Repo:   p.PathWithNamespace,
+				Group:  group,
+				Action: "ListProjectMembers",
+				Result: err,
+			}
+		}
+
+		for _, m := range members {
+			if err := ctx.Err(); err != nil {
+				return DropRightsError{
+					Repo:   p.PathWithNamespace,
+					Group:  group,
+					User:   m.Username,
+					Action: "EditProjectMember",
+					Result: err,
+				}
+			}
+			if !downgrades(logger, sw, m.Username, m.AccessLevel) {
+				continue
+			}
+			logger.Log(
+				"Repo", p.PathWithNamespace,
+				"Plugin", pluginName,
+				"Action", "EditProjectMember",
+				"Username", m.Username,
+			)
+			_, _, err := cl.EditProjectMember(p.ID, m.ID, opts)
+			if auditErr := al.Append(projectMemberRecord(group, p.PathWithNamespace, m, sw.Target, err)); auditErr != nil {
+				return DropRightsError{
+					Repo:   p.PathWithNamespace,
+					Group:  group,
+					User:   m.Username,
+					Action: "Audit",
+					Result: auditErr,
+				}
+			}
+			if err != nil {
+				return DropRightsError{
+					Repo:   p.PathWithNamespace,
+					Group:  group,
+					User:   m.Username,
+					Action: "EditProjectMember",
+					Result: err,
+				}
+			}
+		}
+	}
+	return nil
+}
+
+//projectMemberRecord builds the audit record for a project member access level change
+func projectMemberRecord(group, project string, m *gitlab.ProjectMember, level gitlab.AccessLevelValue, err error) audit.Record {
+	result := "ok"
+	if err != nil {
+		result = err.Error()
+	}
+	return audit.Record{
+		Action:         audit.ActionUpdateProjectMember,
+		Plugin:         pluginName,
+		Actor:          pluginName,
+		Project:        project,
+		Group:          group,
+		Member:         m.Username,
+		OldAccessLevel: int(m.AccessLevel),
+		NewAccessLevel: int(level),
+		Event:          "schedule",
+		Result:         result,
+	}
+}
@@ -0,0 +1,7 @@
+package plugins
+
+//the merge queue handlers are tested from plugins_test, gitlabfake imports this package
+var (
+	QueueComment  = (*MergeQueue).comment
+	QueuePipeline = (*MergeQueue).pipeline
+)
@@ -0,0 +1,548 @@
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+// GitLabClient is the subset of the GitLab API used by the bot and its plugins.
+// It is satisfied by the client returned from NewGitLabClient and by the in memory
+// fake in the gitlabfake package.
+type GitLabClient interface {
+	// Notes
+	CreateMergeRequestNote(pid interface{}, mergeRequest int, opt *gitlab.CreateMergeRequestNoteOptions) (*gitlab.Note, *gitlab.Response, error)
+	CreateIssueNote(pid interface{}, issue int, opt *gitlab.CreateIssueNoteOptions) (*gitlab.Note, *gitlab.Response, error)
+
+	// Merge requests. mergeRequest is the IID of the merge request within its project
+	AcceptMergeRequest(pid interface{}, mergeRequest int, opt *AcceptMergeRequestOptions) (*gitlab.MergeRequest, *gitlab.Response, error)
+	GetMergeRequest(pid interface{}, mergeRequest int) (*MergeRequest, *gitlab.Response, error)
+	//RebaseMergeRequest starts rebasing the source branch onto the target branch, GitLab rebases in the background
+	RebaseMergeRequest(pid interface{}, mergeRequest int) (*gitlab.Response, error)
+	UpdateMergeRequest(pid interface{}, mergeRequest int, opt *UpdateMergeRequestOptions) (*gitlab.MergeRequest, *gitlab.Response, error)
+	ListMergeRequestCommits(pid interface{}, mergeRequest int, opt *gitlab.ListOptions) ([]*gitlab.Commit, *gitlab.Response, error)
+
+	// Groups
+	ListGroups(opt *gitlab.ListGroupsOptions) ([]*gitlab.Group, *gitlab.Response, error)
+	GetGroup(gid interface{}) (*Group, *gitlab.Response, error)
+	ListGroupMembers(gid interface{}, opt *gitlab.ListOptions) ([]*gitlab.GroupMember, *gitlab.Response, error)
+	UpdateGroupMember(gid interface{}, user int, opt *gitlab.UpdateGroupMemberOptions) (*gitlab.GroupMember, *gitlab.Response, error)
+	ListGroupProjects(gid interface{}, opt *gitlab.ListOptions) ([]*gitlab.Project, *gitlab.Response, error)
+	ListSubgroups(gid interface{}, opt *gitlab.ListOptions) ([]*Group, *gitlab.Response, error)
+
+	// Projects
+	GetProject(pid interface{}) (*gitlab.Project, *gitlab.Response, error)
+
+	// Repository
+	Compare(pid interface{}, opt *gitlab.CompareOptions) (*gitlab.Compare, *gitlab.Response, error)
+	//ListCommitStatuses lists the latest status of each job and external check of a commit
+	ListCommitStatuses(pid interface{}, sha string, opt *gitlab.ListOptions) ([]*gitlab.CommitStatus, *gitlab.Response, error)
+	SetCommitStatus(pid interface{}, sha string, opt *gitlab.SetCommitStatusOptions) (*gitlab.CommitStatus, *gitlab.Response, error)
+	//ListPipelineJobs lists the jobs of a pipeline, external checks are not jobs
+	ListPipelineJobs(pid interface{}, pipeline int, opt *gitlab.ListOptions) ([]*Job, *gitlab.Response, error)
+
+	// Issues
+	CreateIssue(pid interface{}, opt *gitlab.CreateIssueOptions) (*gitlab.Issue, *gitlab.Response, error)
+
+	// Protected branches of the v4 API, name may be a wildcard such as release/*
+	ListProtectedBranches(pid interface{}, opt *gitlab.ListOptions) ([]*ProtectedBranch, *gitlab.Response, error)
+	ProtectBranch(pid interface{}, opt *ProtectBranchOptions) (*ProtectedBranch, *gitlab.Response, error)
+	UnprotectBranch(pid interface{}, name string) (*gitlab.Response, error)
+
+	// Project members, the members inherited from the groups of the project are not listed
+	ListProjectMembers(pid interface{}, opt *gitlab.ListProjectMembersOptions) ([]*gitlab.ProjectMember, *gitlab.Response, error)
+	EditProjectMember(pid interface{}, user int, opt *gitlab.EditProjectMemberOptions) (*gitlab.ProjectMember, *gitlab.Response, error)
+
+	// Users
+	CurrentUser() (*gitlab.User, *gitlab.Response, error)
+
+	// Project hooks
+	ListProjectHooks(pid interface{}, opt *gitlab.ListProjectHooksOptions) ([]*gitlab.ProjectHook, *gitlab.Response, error)
+	AddProjectHook(pid interface{}, opt *HookOptions) (*gitlab.ProjectHook, *gitlab.Response, error)
+	EditProjectHook(pid interface{}, hook int, opt *HookOptions) (*gitlab.ProjectHook, *gitlab.Response, error)
+	DeleteProjectHook(pid interface{}, hook int) (*gitlab.Response, error)
+
+	// Group hooks, GitLab EE only. They share the fields of project hooks.
+	ListGroupHooks(gid interface{}, opt *gitlab.ListOptions) ([]*gitlab.ProjectHook, *gitlab.Response, error)
+	AddGroupHook(gid interface{}, opt *HookOptions) (*gitlab.ProjectHook, *gitlab.Response, error)
+	EditGroupHook(gid interface{}, hook int, opt *HookOptions) (*gitlab.ProjectHook, *gitlab.Response, error)
+	DeleteGroupHook(gid interface{}, hook int) (*gitlab.Response, error)
+
+	// System hooks, the token must belong to an administrator. The project hook fields a system hook does not
+	// support are ignored by GitLab. System hooks cannot be edited.
+	ListSystemHooks(opt *gitlab.ListOptions) ([]*gitlab.ProjectHook, *gitlab.Response, error)
+	AddSystemHook(opt *HookOptions) (*gitlab.ProjectHook, *gitlab.Response, error)
+	DeleteSystemHook(hook int) (*gitlab.Response, error)
+}
+
+//AcceptMergeRequestOptions represents the available AcceptMergeRequest() options of the v4 API.
+//https://docs.gitlab.com/ce/api/merge_requests.html#accept-mr
+type AcceptMergeRequestOptions struct {
+	MergeCommitMessage        *string `url:"merge_commit_message,omitempty" json:"merge_commit_message,omitempty"`
+	ShouldRemoveSourceBranch  *bool   `url:"should_remove_source_branch,omitempty" json:"should_remove_source_branch,omitempty"`
+	MergeWhenPipelineSucceeds *bool   `url:"merge_when_pipeline_succeeds,omitempty" json:"merge_when_pipeline_succeeds,omitempty"`
+	SHA                       *string `url:"sha,omitempty" json:"sha,omitempty"`
+}
+
+//UpdateMergeRequestOptions represents the UpdateMergeRequest() options of the v4 API the bot uses.
+//https://docs.gitlab.com/ce/api/merge_requests.html#update-mr
+type UpdateMergeRequestOptions struct {
+	//Labels replaces the labels of the merge request with a comma separated list, an empty list removes them all
+	Labels *string `url:"labels,omitempty" json:"labels,omitempty"`
+}
+
+//MergeRequest is a merge request as returned by the v4 API, with the fields go-gitlab does not know about
+//https://docs.gitlab.com/ce/api/merge_requests.html#get-single-mr
+type MergeRequest struct {
+	gitlab.MergeRequest
+	SHA          string    `json:"sha"`
+	HeadPipeline *Pipeline `json:"head_pipeline"`
+	//DivergedCommitsCount is the number of commits of the target branch missing from the source branch
+	DivergedCommitsCount int  `json:"diverged_commits_count"`
+	RebaseInProgress     bool `json:"rebase_in_progress"`
+}
+
+//Pipeline is a pipeline of the v4 API
+type Pipeline struct {
+	ID     int    `json:"id"`
+	SHA    string `json:"sha"`
+	Ref    string `json:"ref"`
+	Status string `json:"status"`
+}
+
+//Job is a job of a pipeline of the v4 API, go-gitlab does not know about jobs
+//https://docs.gitlab.com/ce/api/jobs.html#list-pipeline-jobs
+type Job struct {
+	ID     int    `json:"id"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+//ProtectedBranch is a protected branch or wildcard of the v4 API
+//https://docs.gitlab.com/ce/api/protected_branches.html
+type ProtectedBranch struct {
+	Name              string                    `json:"name"`
+	PushAccessLevels  []BranchAccessDescription `json:"push_access_levels"`
+	MergeAccessLevels []BranchAccessDescription `json:"merge_access_levels"`
+}
+
+//BranchAccessDescription is an access level allowed to push or merge to a protected branch
+type BranchAccessDescription struct {
+	AccessLevel            gitlab.AccessLevelValue `json:"access_level"`
+	AccessLevelDescription string                  `json:"access_level_description"`
+}
+
+//ProtectBranchOptions represents the options of a protected branch of the v4 API
+type ProtectBranchOptions struct {
+	Name             *string                  `url:"name,omitempty" json:"name,omitempty"`
+	PushAccessLevel  *gitlab.AccessLevelValue `url:"push_access_level,omitempty" json:"push_access_level,omitempty"`
+	MergeAccessLevel *gitlab.AccessLevelValue `url:"merge_access_level,omitempty" json:"merge_access_level,omitempty"`
+}
+
+//HookOptions represents the options of a project, group or system hook in the v4 API. go-gitlab does not know
+//about the secret token sent in the X-Gitlab-Token header.
+//https://docs.gitlab.com/ce/api/projects.html#add-project-hook
+type HookOptions struct {
+	URL                   *string `url:"url,omitempty" json:"url,omitempty"`
+	Token                 *string `url:"token,omitempty" json:"token,omitempty"`
+	PushEvents            *bool   `url:"push_events,omitempty" json:"push_events,omitempty"`
+	TagPushEvents         *bool   `url:"tag_push_events,omitempty" json:"tag_push_events,omitempty"`
+	MergeRequestsEvents   *bool   `url:"merge_requests_events,omitempty" json:"merge_requests_events,omitempty"`
+	NoteEvents            *bool   `url:"note_events,omitempty" json:"note_events,omitempty"`
+	PipelineEvents        *bool   `url:"pipeline_events,omitempty" json:"pipeline_events,omitempty"`
+	EnableSSLVerification *bool   `url:"enable_ssl_verification,omitempty" json:"enable_ssl_verification,omitempty"`
+}
+
+//Group is a group as returned by the v4 API. go-gitlab does not know about nested groups.
+type Group struct {
+	gitlab.Group
+	FullPath string `json:"full_path"`
+	ParentID int    `json:"parent_id"`
+}
+
+//NewGitLabClient wraps a go-gitlab client so it can be used as a GitLabClient
+func NewGitLabClient(cl *gitlab.Client) GitLabClient {
+	return &gitLabClient{cl: cl}
+}
+
+//gitLabClient makes every call through send with the request building of go-gitlab. go-gitlab services are not used
+//as they do not take a context and most of them still target the v3 API.
+type gitLabClient struct {
+	cl *gitlab.Client
+	//ctx cancels the requests and the waits of the client
+	ctx context.Context
+	//retry limits and retries the requests, nil when the client is not rate limited
+	retry *retrier
+}
+
+//WithContext returns a copy of the client whose requests are cancelled when ctx is done. The copy shares the rate
+//limiter of c.
+func (c *gitLabClient) WithContext(ctx context.Context) GitLabClient {
+	cc := *c
+	cc.ctx = ctx
+	return &cc
+}
+
+func (c *gitLabClient) CreateMergeRequestNote(pid interface{}, mergeRequest int, opt *gitlab.CreateMergeRequestNoteOptions) (*gitlab.Note, *gitlab.Response, error) {
+	n := new(gitlab.Note)
+	resp, err := c.sendID("POST", pid, "projects/%s/merge_requests/"+strconv.Itoa(mergeRequest)+"/notes", opt, n)
+	if err != nil {
+		return nil, resp, err
+	}
+	return n, resp, nil
+}
+
+//CreateIssueNote takes the IID of the issue, the path is the same in v3 and v4
+func (c *gitLabClient) CreateIssueNote(pid interface{}, issue int, opt *gitlab.CreateIssueNoteOptions) (*gitlab.Note, *gitlab.Response, error) {
+	n := new(gitlab.Note)
+	resp, err := c.sendID("POST", pid, "projects/%s/issues/"+strconv.Itoa(issue)+"/notes", opt, n)
+	if err != nil {
+		return nil, resp, err
+	}
+	return n, resp, nil
+}
+
+//AcceptMergeRequest uses the v4 endpoint. go-gitlab still targets v3 which used the merge request ID and a different path.
+func (c *gitLabClient) AcceptMergeRequest(pid interface{}, mergeRequest int, opt *AcceptMergeRequestOptions) (*gitlab.MergeRequest, *gitlab.Response, error) {
+	m := new(gitlab.MergeRequest)
+	resp, err := c.sendID("PUT", pid, "projects/%s/merge_requests/"+strconv.Itoa(mergeRequest)+"/merge", opt, m)
+	if err != nil {
+		return nil, resp, err
+	}
+	return m, resp, err
+}
+
+func (c *gitLabClient) ListGroups(opt *gitlab.ListGroupsOptions) ([]*gitlab.Group, *gitlab.Response, error) {
+	var gs []*gitlab.Group
+	resp, err := c.send("GET", "groups", opt, &gs)
+	return gs, resp, err
+}
+
+//GetGroup is implemented here because go-gitlab does not escape the full path of nested groups
+func (c *gitLabClient) GetGroup(gid interface{}) (*Group, *gitlab.Response, error) {
+	sid, err := parseID(gid)
+	if err != nil {
+		return nil, nil, err
+	}
+	g := new(Group)
+	resp, err := c.send("GET", fmt.Sprintf("groups/%s", url.QueryEscape(sid)), nil, g)
+	if err != nil {
+		return nil, resp, err
+	}
+	return g, resp, nil
+}
+
+//ListGroupMembers is implemented here because go-gitlab does not support pagination options for it
+func (c *gitLabClient) ListGroupMembers(gid interface{}, opt *gitlab.ListOptions) ([]*gitlab.GroupMember, *gitlab.Response, error) {
+	var ms []*gitlab.GroupMember
+	resp, err := c.list(gid, "groups/%s/members", opt, &ms)
+	return ms, resp, err
+}
+
+func (c *gitLabClient) UpdateGroupMember(gid interface{}, user int, opt *gitlab.UpdateGroupMemberOptions) (*gitlab.GroupMember, *gitlab.Response, error) {
+	m := new(gitlab.GroupMember)
+	resp, err := c.sendID("PUT", gid, "groups/%s/members/"+strconv.Itoa(user), opt, m)
+	if err != nil {
+		return nil, resp, err
+	}
+	return m, resp, nil
+}
+
+//ListGroupProjects is implemented here because go-gitlab does not support pagination options for it
+func (c *gitLabClient) ListGroupProjects(gid interface{}, opt *gitlab.ListOptions) ([]*gitlab.Project, *gitlab.Response, error) {
+	var ps []*gitlab.Project
+	resp, err := c.list(gid, "groups/%s/projects", opt, &ps)
+	return ps, resp, err
+}
+
+//ListSubgroups lists the direct subgroups of a group, available since GitLab 10.3
+func (c *gitLabClient) ListSubgroups(gid interface{}, opt *gitlab.ListOptions) ([]*Group, *gitlab.Response, error) {
+	var gs []*Group
+	resp, err := c.list(gid, "groups/%s/subgroups", opt, &gs)
+	return gs, resp, err
+}
+
+func (c *gitLabClient) GetProject(pid interface{}) (*gitlab.Project, *gitlab.Response, error) {
+	p := new(gitlab.Project)
+	resp, err := c.sendID("GET", pid, "projects/%s", nil, p)
+	if err != nil {
+		return nil, resp, err
+	}
+	return p, resp, nil
+}
+
+func (c *gitLabClient) Compare(pid interface{}, opt *gitlab.CompareOptions) (*gitlab.Compare, *gitlab.Response, error) {
+	cmp := new(gitlab.Compare)
+	resp, err := c.sendID("GET", pid, "projects/%s/repository/compare", opt, cmp)
+	if err != nil {
+		return nil, resp, err
+	}
+	return cmp, resp, nil
+}
+
+//ListCommitStatuses is implemented here because go-gitlab does not page through the statuses
+func (c *gitLabClient) ListCommitStatuses(pid interface{}, sha string, opt *gitlab.ListOptions) ([]*gitlab.CommitStatus, *gitlab.Response, error) {
+	var cs []*gitlab.CommitStatus
+	resp, err := c.sendID("GET", pid, "projects/%s/repository/commits/"+url.QueryEscape(sha)+"/statuses", opt, &cs)
+	return cs, resp, err
+}
+
+func (c *gitLabClient) SetCommitStatus(pid interface{}, sha string, opt *gitlab.SetCommitStatusOptions) (*gitlab.CommitStatus, *gitlab.Response, error) {
+	cs := new(gitlab.CommitStatus)
+	resp, err := c.sendID("POST", pid, "projects/%s/statuses/"+url.QueryEscape(sha), opt, cs)
+	if err != nil {
+		return nil, resp, err
+	}
+	return cs, resp, nil
+}
+
+func (c *gitLabClient) ListPipelineJobs(pid interface{}, pipeline int, opt *gitlab.ListOptions) ([]*Job, *gitlab.Response, error) {
+	var js []*Job
+	resp, err := c.sendID("GET", pid, "projects/%s/pipelines/"+strconv.Itoa(pipeline)+"/jobs", opt, &js)
+	return js, resp, err
+}
+
+func (c *gitLabClient) CreateIssue(pid interface{}, opt *gitlab.CreateIssueOptions) (*gitlab.Issue, *gitlab.Response, error) {
+	i := new(gitlab.Issue)
+	resp, err := c.sendID("POST", pid, "projects/%s/issues", opt, i)
+	if err != nil {
+		return nil, resp, err
+	}
+	return i, resp, nil
+}
+
+//ListProtectedBranches is implemented here because go-gitlab only knows the v3 branch protection
+func (c *gitLabClient) ListProtectedBranches(pid interface{}, opt *gitlab.ListOptions) ([]*ProtectedBranch, *gitlab.Response, error) {
+	var bs []*ProtectedBranch
+	resp, err := c.list(pid, "projects/%s/protected_branches", opt, &bs)
+	return bs, resp, err
+}
+
+func (c *gitLabClient) ProtectBranch(pid interface{}, opt *ProtectBranchOptions) (*ProtectedBranch, *gitlab.Response, error) {
+	project, err := parseID(pid)
+	if err != nil {
+		return nil, nil, err
+	}
+	b := new(ProtectedBranch)
+	resp, err := c.send("POST", fmt.Sprintf("projects/%s/protected_branches", url.QueryEscape(project)), opt, b)
+	if err != nil {
+		return nil, resp, err
+	}
+	return b, resp, nil
+}
+
+func (c *gitLabClient) UnprotectBranch(pid interface{}, name string) (*gitlab.Response, error) {
+	project, err := parseID(pid)
+	if err != nil {
+		return nil, err
+	}
+	return c.send("DELETE", fmt.Sprintf("projects/%s/protected_branches/%s", url.QueryEscape(project), url.QueryEscape(name)), nil, nil)
+}
+
+func (c *gitLabClient) GetMergeRequest(pid interface{}, mergeRequest int) (*MergeRequest, *gitlab.Response, error) {
+	project, err := parseID(pid)
+	if err != nil {
+		return nil, nil, err
+	}
+	opt := struct {
+		IncludeDivergedCommitsCount bool `url:"include_diverged_commits_count"`
+		IncludeRebaseInProgress     bool `url:"include_rebase_in_progress"`
+	}{true, true}
+	mr := new(MergeRequest)
+	resp, err := c.send("GET", fmt.Sprintf("projects/%s/merge_requests/%d", url.QueryEscape(project), mergeRequest), &opt, mr)
+	if err != nil {
+		return nil, resp, err
+	}
+	return mr, resp, nil
+}
+
+func (c *gitLabClient) RebaseMergeRequest(pid interface{}, mergeRequest int) (*gitlab.Response, error) {
+	project, err := parseID(pid)
+	if err != nil {
+		return nil, err
+	}
+	return c.send("PUT", fmt.Sprintf("projects/%s/merge_requests/%d/rebase", url.QueryEscape(project), mergeRequest), nil, nil)
+}
+
+//UpdateMergeRequest is implemented here because go-gitlab does not know about the labels of merge requests
+func (c *gitLabClient) UpdateMergeRequest(pid interface{}, mergeRequest int, opt *UpdateMergeRequestOptions) (*gitlab.MergeRequest, *gitlab.Response, error) {
+	project, err := parseID(pid)
+	if err != nil {
+		return nil, nil, err
+	}
+	mr := new(gitlab.MergeRequest)
+	resp, err := c.send("PUT", fmt.Sprintf("projects/%s/merge_requests/%d", url.QueryEscape(project), mergeRequest), opt, mr)
+	if err != nil {
+		return nil, resp, err
+	}
+	return mr, resp, nil
+}
+
+func (c *gitLabClient) ListMergeRequestCommits(pid interface{}, mergeRequest int, opt *gitlab.ListOptions) ([]*gitlab.Commit, *gitlab.Response, error) {
+	var cs []*gitlab.Commit
+	resp, err := c.list(pid, fmt.Sprintf("projects/%%s/merge_requests/%d/commits", mergeRequest), opt, &cs)
+	return cs, resp, err
+}
+
+func (c *gitLabClient) ListProjectMembers(pid interface{}, opt *gitlab.ListProjectMembersOptions) ([]*gitlab.ProjectMember, *gitlab.Response, error) {
+	var ms []*gitlab.ProjectMember
+	resp, err := c.sendID("GET", pid, "projects/%s/members", opt, &ms)
+	return ms, resp, err
+}
+
+func (c *gitLabClient) EditProjectMember(pid interface{}, user int, opt *gitlab.EditProjectMemberOptions) (*gitlab.ProjectMember, *gitlab.Response, error) {
+	m := new(gitlab.ProjectMember)
+	resp, err := c.sendID("PUT", pid, "projects/%s/members/"+strconv.Itoa(user), opt, m)
+	if err != nil {
+		return nil, resp, err
+	}
+	return m, resp, nil
+}
+
+func (c *gitLabClient) CurrentUser() (*gitlab.User, *gitlab.Response, error) {
+	u := new(gitlab.User)
+	resp, err := c.send("GET", "user", nil, u)
+	if err != nil {
+		return nil, resp, err
+	}
+	return u, resp, nil
+}
+
+func (c *gitLabClient) ListProjectHooks(pid interface{}, opt *gitlab.ListProjectHooksOptions) ([]*gitlab.ProjectHook, *gitlab.Response, error) {
+	var hs []*gitlab.ProjectHook
+	resp, err := c.sendID("GET", pid, "projects/%s/hooks", opt, &hs)
+	return hs, resp, err
+}
+
+func (c *gitLabClient) AddProjectHook(pid interface{}, opt *HookOptions) (*gitlab.ProjectHook, *gitlab.Response, error) {
+	return c.hook("POST", pid, "projects/%s/hooks", opt)
+}
+
+func (c *gitLabClient) EditProjectHook(pid interface{}, hook int, opt *HookOptions) (*gitlab.ProjectHook, *gitlab.Response, error) {
+	return c.hook("PUT", pid, "projects/%s/hooks/"+strconv.Itoa(hook), opt)
+}
+
+func (c *gitLabClient) DeleteProjectHook(pid interface{}, hook int) (*gitlab.Response, error) {
+	return c.sendID("DELETE", pid, "projects/%s/hooks/"+strconv.Itoa(hook), nil, nil)
+}
+
+func (c *gitLabClient) ListGroupHooks(gid interface{}, opt *gitlab.ListOptions) ([]*gitlab.ProjectHook, *gitlab.Response, error) {
+	var hs []*gitlab.ProjectHook
+	resp, err := c.list(gid, "groups/%s/hooks", opt, &hs)
+	return hs, resp, err
+}
+
+func (c *gitLabClient) AddGroupHook(gid interface{}, opt *HookOptions) (*gitlab.ProjectHook, *gitlab.Response, error) {
+	return c.hook("POST", gid, "groups/%s/hooks", opt)
+}
+
+func (c *gitLabClient) EditGroupHook(gid interface{}, hook int, opt *HookOptions) (*gitlab.ProjectHook, *gitlab.Response, error) {
+	return c.hook("PUT", gid, "groups/%s/hooks/"+strconv.Itoa(hook), opt)
+}
+
+func (c *gitLabClient) DeleteGroupHook(gid interface{}, hook int) (*gitlab.Response, error) {
+	group, err := parseID(gid)
+	if err != nil {
+		return nil, err
+	}
+	return c.send("DELETE", fmt.Sprintf("groups/%s/hooks/%d", url.QueryEscape(group), hook), nil, nil)
+}
+
+func (c *gitLabClient) ListSystemHooks(opt *gitlab.ListOptions) ([]*gitlab.ProjectHook, *gitlab.Response, error) {
+	var hs []*gitlab.ProjectHook
+	resp, err := c.send("GET", "hooks", opt, &hs)
+	return hs, resp, err
+}
+
+func (c *gitLabClient) AddSystemHook(opt *HookOptions) (*gitlab.ProjectHook, *gitlab.Response, error) {
+	h := new(gitlab.ProjectHook)
+	resp, err := c.send("POST", "hooks", opt, h)
+	if err != nil {
+		return nil, resp, err
+	}
+	return h, resp, err
+}
+
+func (c *gitLabClient) DeleteSystemHook(hook int) (*gitlab.Response, error) {
+	return c.send("DELETE", fmt.Sprintf("hooks/%d", hook), nil, nil)
+}
+
+//hook creates or edits the hook at path, formatted with the escaped id
+func (c *gitLabClient) hook(method string, id interface{}, path string, opt *HookOptions) (*gitlab.ProjectHook, *gitlab.Response, error) {
+	sid, err := parseID(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	h := new(gitlab.ProjectHook)
+	resp, err := c.send(method, fmt.Sprintf(path, url.QueryEscape(sid)), opt, h)
+	if err != nil {
+		return nil, resp, err
+	}
+	return h, resp, err
+}
+
+//send makes a request with the options opt and decodes the response into v. When the client is rate limited the
+//request waits for the limiter and is retried as long as its method allows it.
+func (c *gitLabClient) send(method, path string, opt interface{}, v interface{}) (*gitlab.Response, error) {
+	call := func() (*gitlab.Response, error) {
+		req, err := c.cl.NewRequest(method, path, opt)
+		if err != nil {
+			return nil, err
+		}
+		if c.ctx != nil {
+			req = req.WithContext(c.ctx)
+		}
+		return c.cl.Do(req, v)
+	}
+	if c.retry == nil {
+		return call()
+	}
+	ctx := c.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return c.retry.do(ctx, idempotent(method, path), call)
+}
+
+//sendID makes a request to path, formatted with the escaped id of a project or group
+func (c *gitLabClient) sendID(method string, id interface{}, path string, opt interface{}, v interface{}) (*gitlab.Response, error) {
+	sid, err := parseID(id)
+	if err != nil {
+		return nil, err
+	}
+	return c.send(method, fmt.Sprintf(path, url.QueryEscape(sid)), opt, v)
+}
+
+//list gets a page of the listing at path, formatted with the escaped id, into v
+func (c *gitLabClient) list(id interface{}, path string, opt *gitlab.ListOptions, v interface{}) (*gitlab.Response, error) {
+	return c.sendID("GET", id, path, opt, v)
+}
+
+//contextClient is implemented by the clients whose calls can be bound to a context
+type contextClient interface {
+	WithContext(ctx context.Context) GitLabClient
+}
+
+//WithContext returns a client making the calls of gc on behalf of ctx: once ctx is done the waits and retries of the
+//calls stop and no new call is made. Clients that know nothing about contexts are returned as is.
+func WithContext(ctx context.Context, gc GitLabClient) GitLabClient {
+	if c, ok := gc.(contextClient); ok {
+		return c.WithContext(ctx)
+	}
+	return gc
+}
+
+//parseID accepts both the numeric ID and the path of a project or group, like go-gitlab does
+func parseID(id interface{}) (string, error) {
+	switch v := id.(type) {
+	case int:
+		return strconv.Itoa(v), nil
+	case string:
+		return v, nil
+	default:
+		return "", fmt.Errorf("invalid ID type %#v, the ID must be an int or a string", id)
+	}
+}
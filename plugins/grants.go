@@ -0,0 +1,381 @@
+package plugins
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosminilie/gitbot/audit"
+	"github.com/cosminilie/gitbot/logging"
+	"github.com/go-kit/kit/log"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+//AccessGrant is a temporary elevation of the access level of a group member requested with the access plugin.
+//It is pending until an approver approves it.
+type AccessGrant struct {
+	//GroupID identifies the group, Group is its full path when the grant was requested and may change
+	GroupID int                     `json:"group_id"`
+	Group   string                  `json:"group"`
+	User    string                  `json:"user"`
+	Level   gitlab.AccessLevelValue `json:"level"`
+	Reason  string                  `json:"reason"`
+	//Duration is how long the grant lasts once approved
+	Duration time.Duration `json:"duration"`
+	//Project, NoteableType and NoteableIID locate the issue or merge request the access was requested on
+	Project      string    `json:"project"`
+	ProjectID    int       `json:"project_id"`
+	NoteableType string    `json:"noteable_type"`
+	NoteableIID  int       `json:"noteable_iid"`
+	RequestedAt  time.Time `json:"requested_at"`
+	//PreviousLevel is the access level restored when the grant expires
+	PreviousLevel gitlab.AccessLevelValue `json:"previous_level,omitempty"`
+	Approver      string                  `json:"approver,omitempty"`
+	Expires       time.Time               `json:"expires,omitempty"`
+}
+
+//Approved reports whether the grant was approved
+func (g AccessGrant) Approved() bool {
+	return g.Approver != ""
+}
+
+//RequestExpired reports whether a pending grant is too old to be approved at now. A request lapses once the access it
+//asked for would have ended had it been approved right away.
+func (g AccessGrant) RequestExpired(now time.Time) bool {
+	return !now.Before(g.RequestedAt.Add(g.Duration))
+}
+
+//Grants holds the pending and approved access grants of an instance. It is safe for concurrent use and a nil
+//*Grants has no grants. Grants opened from a file are saved to it on every change so that they survive a restart,
+//otherwise they are kept in memory only and the drop_rights sweep lowers the elevated members after a restart as if
+//their grant had expired.
+type Grants struct {
+	mut     sync.Mutex
+	path    string
+	pending []AccessGrant
+	active  []AccessGrant
+}
+
+//grantsFile is the content of the file the grants are saved to
+type grantsFile struct {
+	Pending []AccessGrant `json:"pending"`
+	Active  []AccessGrant `json:"active"`
+}
+
+//NewGrants returns an empty set of grants kept in memory
+func NewGrants() *Grants {
+	return &Grants{}
+}
+
+//OpenGrants loads the grants saved to path, which does not have to exist yet. The grants are saved to it again on
+//every change.
+func OpenGrants(path string) (*Grants, error) {
+	gs := &Grants{path: path}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return gs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f grantsFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("invalid grants file %s: %s", path, err)
+	}
+	gs.pending, gs.active = f.Pending, f.Active
+	return gs, nil
+}
+
+//save writes the grants to their file, replacing it at once so that a crash leaves either the old or the new grants
+func (gs *Grants) save() error {
+	if gs.path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(grantsFile{Pending: gs.pending, Active: gs.active}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := gs.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, gs.path)
+}
+
+//Request records a pending grant, replacing the one the same user requested earlier on the same issue or merge
+//request. The requests of other users are kept.
+func (gs *Grants) Request(g AccessGrant) error {
+	gs.mut.Lock()
+	defer gs.mut.Unlock()
+
+	gs.pending = removeGrants(gs.pending, func(p AccessGrant) bool {
+		return sameRequest(p, g)
+	})
+	gs.pending = append(gs.pending, g)
+	return gs.save()
+}
+
+//Pending returns the grants waiting for approval on an issue or merge request at now, one per requester. Expired
+//requests are left out.
+func (gs *Grants) Pending(projectID int, noteableType string, iid int, now time.Time) []AccessGrant {
+	if gs == nil {
+		return nil
+	}
+	gs.mut.Lock()
+	defer gs.mut.Unlock()
+
+	var pending []AccessGrant
+	for _, p := range gs.pending {
+		if sameNoteable(p, AccessGrant{ProjectID: projectID, NoteableType: noteableType, NoteableIID: iid}) && !p.RequestExpired(now) {
+			pending = append(pending, p)
+		}
+	}
+	return pending
+}
+
+//PruneRequests removes the pending grants expired at now and returns them. They are removed even when saving the
+//grants fails.
+func (gs *Grants) PruneRequests(now time.Time) ([]AccessGrant, error) {
+	if gs == nil {
+		return nil, nil
+	}
+	gs.mut.Lock()
+	defer gs.mut.Unlock()
+
+	var expired []AccessGrant
+	gs.pending = removeGrants(gs.pending, func(p AccessGrant) bool {
+		if p.RequestExpired(now) {
+			expired = append(expired, p)
+			return true
+		}
+		return false
+	})
+	if len(expired) == 0 {
+		return nil, nil
+	}
+	return expired, gs.save()
+}
+
+//Approve activates a pending grant. An active grant of the same user on the same group is replaced, keeping the
+//access level the user had before the first one. The grant is active even when saving it fails.
+func (gs *Grants) Approve(g AccessGrant) (AccessGrant, error) {
+	gs.mut.Lock()
+	defer gs.mut.Unlock()
+
+	gs.pending = removeGrants(gs.pending, func(p AccessGrant) bool {
+		return sameRequest(p, g)
+	})
+	for _, a := range gs.active {
+		if sameMember(a, g) {
+			g.PreviousLevel = a.PreviousLevel
+		}
+	}
+	gs.active = removeGrants(gs.active, func(a AccessGrant) bool {
+		return sameMember(a, g)
+	})
+	gs.active = append(gs.active, g)
+	return g, gs.save()
+}
+
+//Active returns the grant of a user on a group that has not expired at now
+func (gs *Grants) Active(group int, user string, now time.Time) (AccessGrant, bool) {
+	if gs == nil {
+		return AccessGrant{}, false
+	}
+	gs.mut.Lock()
+	defer gs.mut.Unlock()
+
+	for _, a := range gs.active {
+		if sameMember(a, AccessGrant{GroupID: group, User: user}) && now.Before(a.Expires) {
+			return a, true
+		}
+	}
+	return AccessGrant{}, false
+}
+
+//Expired returns the grants on a group that expired at now
+func (gs *Grants) Expired(group int, now time.Time) []AccessGrant {
+	if gs == nil {
+		return nil
+	}
+	gs.mut.Lock()
+	defer gs.mut.Unlock()
+
+	var expired []AccessGrant
+	for _, a := range gs.active {
+		if a.GroupID == group && !now.Before(a.Expires) {
+			expired = append(expired, a)
+		}
+	}
+	return expired
+}
+
+//ExpiredGroups returns the IDs of the groups with grants that expired at now
+func (gs *Grants) ExpiredGroups(now time.Time) []int {
+	if gs == nil {
+		return nil
+	}
+	gs.mut.Lock()
+	defer gs.mut.Unlock()
+
+	var groups []int
+	seen := make(map[int]bool)
+	for _, a := range gs.active {
+		if !now.Before(a.Expires) && !seen[a.GroupID] {
+			seen[a.GroupID] = true
+			groups = append(groups, a.GroupID)
+		}
+	}
+	return groups
+}
+
+//Revoke removes the active grant of the user on the group
+func (gs *Grants) Revoke(group int, user string) error {
+	gs.mut.Lock()
+	defer gs.mut.Unlock()
+
+	gs.active = removeGrants(gs.active, func(a AccessGrant) bool {
+		return sameMember(a, AccessGrant{GroupID: group, User: user})
+	})
+	return gs.save()
+}
+
+//List returns the pending and the active grants sorted by group and user
+func (gs *Grants) List() (pending, active []AccessGrant) {
+	if gs == nil {
+		return nil, nil
+	}
+	gs.mut.Lock()
+	defer gs.mut.Unlock()
+
+	pending = append([]AccessGrant(nil), gs.pending...)
+	active = append([]AccessGrant(nil), gs.active...)
+	for _, l := range [][]AccessGrant{pending, active} {
+		l := l
+		sort.Slice(l, func(i, k int) bool {
+			if l[i].Group != l[k].Group {
+				return l[i].Group < l[k].Group
+			}
+			return l[i].User < l[k].User
+		})
+	}
+	return pending, active
+}
+
+func sameNoteable(a, b AccessGrant) bool {
+	return a.ProjectID == b.ProjectID && a.NoteableType == b.NoteableType && a.NoteableIID == b.NoteableIID
+}
+
+func sameRequest(a, b AccessGrant) bool {
+	return sameNoteable(a, b) && strings.EqualFold(a.User, b.User)
+}
+
+func sameMember(a, b AccessGrant) bool {
+	return a.GroupID == b.GroupID && strings.EqualFold(a.User, b.User)
+}
+
+//removeGrants filters out the grants matching fn, in place
+func removeGrants(grants []AccessGrant, fn func(AccessGrant) bool) []AccessGrant {
+	kept := grants[:0]
+	for _, g := range grants {
+		if !fn(g) {
+			kept = append(kept, g)
+		}
+	}
+	return kept
+}
+
+//RevokeExpired lowers the members whose access grant on a group expired back to the level they had before it, records
+//it in the audit log as done by plugin and tells the member on the issue or merge request of the grant. The grants
+//are matched by the ID of the group, they still expire once the group is renamed.
+func RevokeExpired(ctx context.Context, logger log.Logger, cl GitLabClient, al *audit.Log, grants *Grants, plugin string, gid int, now time.Time) error {
+	expired := grants.Expired(gid, now)
+	if len(expired) == 0 {
+		return nil
+	}
+
+	members := make(map[string]*gitlab.GroupMember)
+	err := ForEachGroupMember(cl, gid, func(m *gitlab.GroupMember) error {
+		members[strings.ToLower(m.Username)] = m
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, g := range expired {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		m, ok := members[strings.ToLower(g.User)]
+		//the member left the group or was lowered by someone else in the meantime
+		if !ok || m.AccessLevel <= g.PreviousLevel {
+			if err := grants.Revoke(gid, g.User); err != nil {
+				return err
+			}
+			continue
+		}
+
+		logger.Log(
+			"Repo", g.Group,
+			"Plugin", plugin,
+			"Action", "RevokeAccess",
+			"Username", g.User,
+			"AccessLevel", AccessLevelName(g.PreviousLevel),
+		)
+		_, _, err := cl.UpdateGroupMember(gid, m.ID, &gitlab.UpdateGroupMemberOptions{AccessLevel: gitlab.AccessLevel(g.PreviousLevel)})
+		if auditErr := al.Append(revokeRecord(g, plugin, m.AccessLevel, err)); auditErr != nil {
+			return auditErr
+		}
+		if err != nil {
+			return fmt.Errorf("revoking the access of %s: %s", g.User, err)
+		}
+		if err := grants.Revoke(gid, g.User); err != nil {
+			return err
+		}
+
+		//the access is already revoked, a failed comment is only logged
+		msg := fmt.Sprintf("@%s: The %s access to %s approved by %s expired, it is back to %s.",
+			g.User, AccessLevelName(g.Level), g.Group, g.Approver, AccessLevelName(g.PreviousLevel))
+		if err := CreateNote(cl, g.ProjectID, g.NoteableType, g.NoteableIID, msg); err != nil {
+			logging.Warn(logger).Log(
+				"Repo", g.Project,
+				"Plugin", plugin,
+				"Action", "CreateNote",
+				"Username", g.User,
+				"Error", err,
+			)
+		}
+	}
+	return nil
+}
+
+//revokeRecord builds the audit record for an expired access grant
+func revokeRecord(g AccessGrant, plugin string, level gitlab.AccessLevelValue, err error) audit.Record {
+	result := "ok"
+	if err != nil {
+		result = err.Error()
+	}
+	expires := g.Expires
+	return audit.Record{
+		Action:         audit.ActionRevokeAccess,
+		Plugin:         plugin,
+		Actor:          plugin,
+		Approvers:      []string{g.Approver},
+		Project:        g.Project,
+		Group:          g.Group,
+		Member:         g.User,
+		OldAccessLevel: int(level),
+		NewAccessLevel: int(g.PreviousLevel),
+		Reason:         g.Reason,
+		Expires:        &expires,
+		Event:          "schedule",
+		Result:         result,
+	}
+}
@@ -0,0 +1,68 @@
+package plugins_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cosminilie/gitbot/plugins"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+func TestOpenGrants(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitbot-grants")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "grants.json")
+
+	gs, err := plugins.OpenGrants(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2017, 7, 3, 10, 0, 0, 0, time.UTC)
+	for _, u := range []string{"alice", "bob"} {
+		if err := gs.Request(plugins.AccessGrant{GroupID: 7, Group: "tools", User: u, Level: gitlab.MasterPermissions, Duration: time.Hour, ProjectID: 1, NoteableType: "Issue", NoteableIID: 2, RequestedAt: now}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := gs.Approve(plugins.AccessGrant{GroupID: 7, Group: "tools", User: "alice", Level: gitlab.MasterPermissions, ProjectID: 1, NoteableType: "Issue", NoteableIID: 2,
+		PreviousLevel: gitlab.DeveloperPermissions, Approver: "carol", Expires: now.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	//a restart finds the grants again
+	reopened, err := plugins.OpenGrants(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := reopened.Pending(1, "Issue", 2, now); len(p) != 1 || p[0].User != "bob" {
+		t.Errorf("got pending grants %+v, want bob's", p)
+	}
+	//bob's request lapses once the hour he asked for is over
+	if p := reopened.Pending(1, "Issue", 2, now.Add(time.Hour)); len(p) != 0 {
+		t.Errorf("got pending grants %+v after the request expired", p)
+	}
+	if expired, err := reopened.PruneRequests(now.Add(time.Hour)); err != nil || len(expired) != 1 || expired[0].User != "bob" {
+		t.Errorf("got pruned requests %+v, %v, want bob's", expired, err)
+	}
+	if again, _ := plugins.OpenGrants(path); len(again.Pending(1, "Issue", 2, now)) != 0 {
+		t.Error("got the expired request back after a restart")
+	}
+	if a, ok := reopened.Active(7, "alice", now); !ok || a.PreviousLevel != gitlab.DeveloperPermissions || !a.Expires.Equal(now.Add(time.Hour)) {
+		t.Errorf("got grant %+v, %v, want alice's grant", a, ok)
+	}
+	if groups := reopened.ExpiredGroups(now.Add(time.Hour)); len(groups) != 1 || groups[0] != 7 {
+		t.Errorf("got expired groups %v", groups)
+	}
+
+	if err := reopened.Revoke(7, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := plugins.OpenGrants(path); len(again.Expired(7, now.Add(time.Hour))) != 0 {
+		t.Error("got the revoked grant back after a restart")
+	}
+}
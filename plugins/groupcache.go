@@ -0,0 +1,98 @@
+package plugins
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+//DefaultGroupCacheTTL is how long a resolved group is cached
+const DefaultGroupCacheTTL = 10 * time.Minute
+
+//GroupNotFoundError is returned when no group has the full path, e.g. after a typo in the config or when the
+//token of the bot can't see the group
+type GroupNotFoundError struct {
+	Path string
+}
+
+func (e GroupNotFoundError) Error() string {
+	return fmt.Sprintf("group %q not found, check its full path in the config and the access of the bot to it", e.Path)
+}
+
+//GroupCache resolves the full path of groups to their ID and keeps the result for a while. It is safe for
+//concurrent use and a nil *GroupCache looks the groups up every time.
+type GroupCache struct {
+	ttl    time.Duration
+	now    func() time.Time
+	mut    sync.Mutex
+	groups map[string]cachedGroup
+}
+
+type cachedGroup struct {
+	group   *Group
+	expires time.Time
+}
+
+//NewGroupCache returns an empty cache keeping the groups for ttl
+func NewGroupCache(ttl time.Duration) *GroupCache {
+	return &GroupCache{
+		ttl:    ttl,
+		now:    time.Now,
+		groups: make(map[string]cachedGroup),
+	}
+}
+
+//Group returns the group with the full path, e.g. "platform/infra". Groups that don't exist are not cached so
+//that they are found as soon as they are created.
+func (c *GroupCache) Group(cl GitLabClient, path string) (*Group, error) {
+	key := strings.ToLower(strings.Trim(path, "/"))
+	if c == nil {
+		return getGroup(cl, key)
+	}
+	now := c.now()
+
+	c.mut.Lock()
+	cg, ok := c.groups[key]
+	c.mut.Unlock()
+	if ok && now.Before(cg.expires) {
+		return cg.group, nil
+	}
+
+	g, err := getGroup(cl, key)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.groups[key] = cachedGroup{group: g, expires: now.Add(c.ttl)}
+	//drop the other expired groups so the cache doesn't grow with groups removed from the config
+	for k, v := range c.groups {
+		if !now.Before(v.expires) {
+			delete(c.groups, k)
+		}
+	}
+	return g, nil
+}
+
+//ID returns the ID of the group with the full path
+func (c *GroupCache) ID(cl GitLabClient, path string) (int, error) {
+	g, err := c.Group(cl, path)
+	if err != nil {
+		return 0, err
+	}
+	return g.ID, nil
+}
+
+//getGroup gets a group by its full path, reporting a GroupNotFoundError when GitLab doesn't know it
+func getGroup(cl GitLabClient, path string) (*Group, error) {
+	g, _, err := cl.GetGroup(path)
+	if er, ok := err.(*gitlab.ErrorResponse); ok && er.Response != nil && er.Response.StatusCode == http.StatusNotFound {
+		return nil, GroupNotFoundError{Path: path}
+	}
+	return g, err
+}
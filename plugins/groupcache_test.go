@@ -0,0 +1,65 @@
+package plugins_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cosminilie/gitbot/gitlabfake"
+	"github.com/cosminilie/gitbot/plugins"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+//countingGitLab counts the groups looked up
+type countingGitLab struct {
+	*gitlabfake.GitLab
+	mut     sync.Mutex
+	lookups int
+}
+
+func (c *countingGitLab) GetGroup(gid interface{}) (*plugins.Group, *gitlab.Response, error) {
+	c.mut.Lock()
+	c.lookups++
+	c.mut.Unlock()
+	return c.GitLab.GetGroup(gid)
+}
+
+func TestGroupCache(t *testing.T) {
+	gl := &countingGitLab{GitLab: gitlabfake.New()}
+	gl.AddGroup("platform")
+	infra := gl.AddGroup("platform/infra")
+
+	cache := plugins.NewGroupCache(time.Hour)
+	if _, err := cache.ID(gl, "platform/infra"); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			//the config may use another case or a trailing slash
+			if id, err := cache.ID(gl, "Platform/Infra/"); err != nil || id != infra.ID {
+				t.Errorf("got %d, %v, want %d", id, err, infra.ID)
+			}
+		}()
+	}
+	wg.Wait()
+	if gl.lookups != 1 {
+		t.Errorf("got %d lookups, want the group to be cached", gl.lookups)
+	}
+
+	_, err := cache.ID(gl, "platform/missing")
+	if _, ok := err.(plugins.GroupNotFoundError); !ok {
+		t.Errorf("got %v, want a GroupNotFoundError", err)
+	}
+
+	//nothing is kept without a TTL
+	gl.lookups = 0
+	cache = plugins.NewGroupCache(0)
+	cache.ID(gl, "platform")
+	cache.ID(gl, "platform")
+	if gl.lookups != 2 {
+		t.Errorf("got %d lookups, want 2", gl.lookups)
+	}
+}
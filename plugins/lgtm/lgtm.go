@@ -1,14 +1,16 @@
 package lgtm
 
 import (
+	"context"
 	"fmt"
-	"os"
 	"regexp"
 	"strings"
 
 	"github.com/go-kit/kit/log"
 
+	"github.com/cosminilie/gitbot/audit"
 	"github.com/cosminilie/gitbot/gitlabhook"
+	"github.com/cosminilie/gitbot/logging"
 	"github.com/cosminilie/gitbot/plugins"
 	gitlab "github.com/xanzy/go-gitlab"
 )
@@ -17,12 +19,19 @@ const (
 	pluginName                           = "lgtm"
 	ActionStrCreateMergeRequestNote      = "CreateNote"
 	ActionStrCreateMergeRequest          = "CreateMergeRequest"
+	ActionStrAudit                       = "Audit"
+	ActionStrEnqueue                     = "Enqueue"
+	ActionStrAdvanceMergeQueue           = "AdvanceMergeQueue"
+	ActionStrCheckCommit                 = "CheckCommit"
+	ActionStrCheckPolicy                 = "CheckPolicy"
 	ConditionStrCantBeMerged             = "MergeRequest.MergeStatus=cannot_be_merged"
 	ConditionStrWorkInProgress           = "MergeRequest.WorkInProgress=true"
 	ConditionStrState                    = "MergeRequest.State=closed"
 	ConditionStrAuthorAndWantLGTM        = "isAuthor&&wantLGTM"
 	ConditionsStrIsNotAproverAndWantLGTM = "!isApprover&&wantLGTM"
 	ConditionsStrAllOK                   = "AllOK"
+	ConditionsStrChecksBlocked           = "!Checks.Green"
+	ConditionsStrPolicyViolated          = "Policy.Violations>0"
 )
 
 var (
@@ -47,43 +56,58 @@ func (e LGTMError) Error() string {
 	return fmt.Sprintf("LGTMError:\nRepo:%s,\nGroup:%s,\nUser:%s,\nAction:%s,\nCondition:%s,\nResult:%s,\n", e.Repo, e.Group, e.User, e.Action, e.Condition, e.Result)
 }
 
-func handleMergeRequestCommentHandler(pc *plugins.PluginClient, ic gitlabhook.MergeRequestCommentEvent) error {
-	//logging
-	var logger log.Logger
-	{
-		logger = log.NewLogfmtLogger(os.Stdout)
-		logger = log.NewContext(logger).With("ts", log.DefaultTimestampUTC)
-		logger = log.NewContext(logger).With("caller", log.DefaultCaller)
-		logger = log.NewContext(logger).With("plugin", "lgtm")
-
-	}
+func handleMergeRequestCommentHandler(ctx context.Context, pc *plugins.PluginClient, ic gitlabhook.MergeRequestCommentEvent) error {
+	logger := pc.Logger
+	//the lock only guards the repos, the merge queue has its own locks and may wait for GitLab for a while
 	pc.Pmut.Lock()
-	defer pc.Pmut.Unlock()
-	if p, ok := pc.Repos[ic.Project.PathWithNamespace]; ok {
-		logger.Log(
-			"Func", "handleMergeRequestCommentHandler",
-			"Approvers", strings.Join(p.Approvers, " "),
-			"Name", p.Name,
-			"Plugins", strings.Join(p.Plugins, " "),
-		)
-
-		return handle(logger, pc.GitLabClient, ic, p.Approvers)
+	p, ok := pc.Repos[ic.Project.PathWithNamespace]
+	if !ok {
+		defer pc.Pmut.Unlock()
+		return fmt.Errorf("Could not find any plugin for this repo: %v\n", pc.Repos)
 	}
+	pc.Pmut.Unlock()
 
-	return fmt.Errorf("Could not find any plugin for this repo: %v\n", pc.Repos)
+	logging.Debug(logger).Log(
+		"Func", "handleMergeRequestCommentHandler",
+		"Approvers", strings.Join(p.Approvers, " "),
+		"Name", p.Name,
+		"Plugins", strings.Join(p.Plugins, " "),
+	)
+
+	//with the merge queue approved merge requests are merged one at a time per target branch
+	var queue *plugins.MergeQueue
+	if hasPlugin(p.Plugins, plugins.MergeQueuePlugin) {
+		queue = pc.Queue
+	}
+	//with the policy plugin merge requests breaking the change control policy are not merged
+	var policy *plugins.ChangePolicy
+	if hasPlugin(p.Plugins, plugins.PolicyPlugin) {
+		policy = &p.Policy
+	}
+	return handle(ctx, logger, pc.GitLabClient, pc.Audit, queue, ic, p.Approvers, p.RequiredChecks, policy)
 }
 
-func handle(logger log.Logger, gc *gitlab.Client, ic gitlabhook.MergeRequestCommentEvent, approversList []string) error {
+func handle(ctx context.Context, logger log.Logger, gc plugins.GitLabClient, al *audit.Log, queue *plugins.MergeQueue, ic gitlabhook.MergeRequestCommentEvent, approversList []string, requiredChecks []string, policy *plugins.ChangePolicy) error {
 
 	//hadle
-	logger.Log(
+	logging.Debug(logger).Log(
 		"Func", "handle",
 		"Repo", ic.Project.Name,
 		"Group", ic.Project.Namespace,
 		"Reff", ic.Project.GitHTTPURL,
 	)
+	//comments on issues and commits carry no merge request
+	if t := ic.ObjectAttributes.NoteableType; t != "" && t != "MergeRequest" {
+		logging.Debug(logger).Log(
+			"Func", "handle",
+			"Repo", ic.Project.Name,
+			"NoteableType", t,
+			"Action", "Comment is not on a merge request, skipping",
+		)
+		return nil
+	}
 	if ic.User.Username == "lgtm-bot" {
-		logger.Log(
+		logging.Debug(logger).Log(
 			"Func", "handle",
 			"Repo", ic.Project.Name,
 			"Group", ic.Project.Namespace,
@@ -100,7 +124,7 @@ func handle(logger log.Logger, gc *gitlab.Client, ic gitlabhook.MergeRequestComm
 		gitComment := gitlab.CreateMergeRequestNoteOptions{
 			Body: &response,
 		}
-		_, _, err := gc.Notes.CreateMergeRequestNote(ic.ProjectID, ic.MergeRequest.ID, &gitComment)
+		_, _, err := gc.CreateMergeRequestNote(ic.ProjectID, ic.MergeRequest.IID, &gitComment)
 		if err != nil {
 			myErr := LGTMError{
 				Repo:      ic.Project.Name,
@@ -121,7 +145,7 @@ func handle(logger log.Logger, gc *gitlab.Client, ic gitlabhook.MergeRequestComm
 		gitComment := gitlab.CreateMergeRequestNoteOptions{
 			Body: &response,
 		}
-		_, _, err := gc.Notes.CreateMergeRequestNote(ic.ProjectID, ic.MergeRequest.ID, &gitComment)
+		_, _, err := gc.CreateMergeRequestNote(ic.ProjectID, ic.MergeRequest.IID, &gitComment)
 		if err != nil {
 			myErr := LGTMError{
 				Repo:      ic.Project.Name,
@@ -143,7 +167,7 @@ func handle(logger log.Logger, gc *gitlab.Client, ic gitlabhook.MergeRequestComm
 		gitComment := gitlab.CreateMergeRequestNoteOptions{
 			Body: &response,
 		}
-		_, _, err := gc.Notes.CreateMergeRequestNote(ic.ProjectID, ic.MergeRequest.ID, &gitComment)
+		_, _, err := gc.CreateMergeRequestNote(ic.ProjectID, ic.MergeRequest.IID, &gitComment)
 		if err != nil {
 			myErr := LGTMError{
 				Repo:      ic.Project.Name,
@@ -165,7 +189,7 @@ func handle(logger log.Logger, gc *gitlab.Client, ic gitlabhook.MergeRequestComm
 	if lgtmRe.MatchString(ic.ObjectAttributes.Note) {
 		wantLGTM = true
 	} else {
-		logger.Log(
+		logging.Debug(logger).Log(
 			"Func", "handle",
 			"Repo", ic.Project.Name,
 			"Group", ic.Project.Namespace,
@@ -196,7 +220,7 @@ func handle(logger log.Logger, gc *gitlab.Client, ic gitlabhook.MergeRequestComm
 		gitComment := gitlab.CreateMergeRequestNoteOptions{
 			Body: &response,
 		}
-		_, _, err := gc.Notes.CreateMergeRequestNote(ic.ProjectID, ic.MergeRequest.ID, &gitComment)
+		_, _, err := gc.CreateMergeRequestNote(ic.ProjectID, ic.MergeRequest.IID, &gitComment)
 		if err != nil {
 			myErr := LGTMError{
 				Repo:      ic.Project.Name,
@@ -217,7 +241,7 @@ func handle(logger log.Logger, gc *gitlab.Client, ic gitlabhook.MergeRequestComm
 		gitComment := gitlab.CreateMergeRequestNoteOptions{
 			Body: &response,
 		}
-		_, _, err := gc.Notes.CreateMergeRequestNote(ic.ProjectID, ic.MergeRequest.ID, &gitComment)
+		_, _, err := gc.CreateMergeRequestNote(ic.ProjectID, ic.MergeRequest.IID, &gitComment)
 		if err != nil {
 			myErr := LGTMError{
 				Repo:      ic.Project.Name,
@@ -232,13 +256,32 @@ func handle(logger log.Logger, gc *gitlab.Client, ic gitlabhook.MergeRequestComm
 		}
 		return nil
 
+	} else if violations, err := checkPolicy(gc, ic, policy); err != nil {
+		return err
+	} else if len(violations) > 0 {
+		return refuse(gc, ic, ConditionsStrPolicyViolated, fmt.Sprintf("LGTM plugin -> Can't merge as the merge request breaks the change control policy: %s", strings.Join(violations, ", ")))
+	} else if checks, err := checkMergeRequest(gc, ic, requiredChecks); err != nil {
+		return err
+	} else if checks.Blocked() || !checks.Green() && (checks.Pipeline == nil || checks.PendingOutsidePipeline()) {
+		//GitLab only waits for the pipeline before merging, not for checks outside of it
+		msg := fmt.Sprintf("LGTM plugin -> Can't merge as %s", checks.Explain())
+		if !checks.Blocked() {
+			msg = fmt.Sprintf("LGTM plugin -> Can't merge yet as %s. Comment /lgtm again once it passed", checks.Explain())
+		}
+		return refuse(gc, ic, ConditionsStrChecksBlocked, msg)
+	} else if queue != nil {
+		return enqueue(ctx, logger, gc, al, queue, ic, approversList, requiredChecks, policy)
 	} else {
-		//Add merge request comment
-		response := plugins.FormatResponse(ic, "LGTM plugin -> All OK. Merging ...")
+		//Add merge request comment, a green merge request is merged right away
+		msg := "LGTM plugin -> All OK. Merging ..."
+		if !checks.Green() {
+			msg = fmt.Sprintf("LGTM plugin -> All OK. Merging once pipeline #%d succeeds ...", checks.Pipeline.ID)
+		}
+		response := plugins.FormatResponse(ic, msg)
 		gitComment := gitlab.CreateMergeRequestNoteOptions{
 			Body: &response,
 		}
-		_, _, err := gc.Notes.CreateMergeRequestNote(ic.ProjectID, ic.MergeRequest.ID, &gitComment)
+		_, _, err := gc.CreateMergeRequestNote(ic.ProjectID, ic.MergeRequest.IID, &gitComment)
 		if err != nil {
 			myErr := LGTMError{
 				Repo:      ic.Project.Name,
@@ -253,14 +296,28 @@ func handle(logger log.Logger, gc *gitlab.Client, ic gitlabhook.MergeRequestComm
 		//merge the request
 
 		//Create merge request ops
-		mergeRequestOpts := &gitlab.AcceptMergeRequestOptions{
-			MergeCommitMessage:       gitlab.String(fmt.Sprintf("LGTM Plugin Merged Request based on Aproval from %s\n", ic.User.Username)),
-			ShouldRemoveSourceBranch: gitlab.Bool(true),
-			MergeWhenBuildSucceeds:   gitlab.Bool(true),
+		mergeRequestOpts := &plugins.AcceptMergeRequestOptions{
+			MergeCommitMessage:        gitlab.String(fmt.Sprintf("LGTM Plugin Merged Request based on Aproval from %s\n", ic.User.Username)),
+			ShouldRemoveSourceBranch:  gitlab.Bool(true),
+			MergeWhenPipelineSucceeds: gitlab.Bool(!checks.Green()),
+			//only the checked commit is merged, GitLab refuses once another commit was pushed
+			SHA: gitlab.String(checks.SHA),
 		}
 
 		//Call accept merge request
-		_, _, err = gc.MergeRequests.AcceptMergeRequest(ic.ProjectID, ic.MergeRequest.ID, mergeRequestOpts)
+		_, _, err = gc.AcceptMergeRequest(ic.ProjectID, ic.MergeRequest.IID, mergeRequestOpts)
+		if auditErr := al.Append(mergeRecord(ic, approversList, checks.SHA, err)); auditErr != nil {
+			myErr := LGTMError{
+				Repo:      ic.Project.Name,
+				Group:     ic.Project.Namespace,
+				User:      ic.User.Username,
+				Action:    ActionStrAudit,
+				Condition: ConditionsStrAllOK,
+				Result:    auditErr,
+			}
+
+			return myErr
+		}
 		if err != nil {
 			myErr := LGTMError{
 				Repo:      ic.Project.Name,
@@ -289,6 +346,129 @@ func handle(logger log.Logger, gc *gitlab.Client, ic gitlabhook.MergeRequestComm
 	return nil
 }
 
+//enqueue adds an approved merge request to the merge queue of its target branch and moves the queue forward
+func enqueue(ctx context.Context, logger log.Logger, gc plugins.GitLabClient, al *audit.Log, queue *plugins.MergeQueue, ic gitlabhook.MergeRequestCommentEvent, approversList []string, requiredChecks []string, policy *plugins.ChangePolicy) error {
+	target := ic.MergeRequest.TargetBranch
+	pos, added, err := queue.Enqueue(plugins.QueueEntry{
+		Project:        ic.Project.PathWithNamespace,
+		ProjectID:      ic.ProjectID,
+		MergeRequest:   ic.MergeRequest.IID,
+		SourceBranch:   ic.MergeRequest.SourceBranch,
+		TargetBranch:   target,
+		Approver:       ic.User.Username,
+		Approvers:      approversList,
+		Event:          noteEvent(ic),
+		RequiredChecks: requiredChecks,
+		Policy:         policy,
+	})
+	if err != nil {
+		return LGTMError{
+			Repo:      ic.Project.Name,
+			Group:     ic.Project.Namespace,
+			User:      ic.User.Username,
+			Action:    ActionStrEnqueue,
+			Condition: ConditionsStrAllOK,
+			Result:    err,
+		}
+	}
+	msg := fmt.Sprintf("LGTM plugin -> All OK. Added to the merge queue of `%s` at position %d", target, pos)
+	if !added {
+		msg = fmt.Sprintf("LGTM plugin -> Already in the merge queue of `%s` at position %d", target, pos)
+	}
+	if e, ok := queue.Entry(ic.Project.PathWithNamespace, ic.MergeRequest.IID); ok && e.Held {
+		msg += ", it is held until someone comments /unhold"
+	}
+	response := plugins.FormatResponse(ic, msg)
+	_, _, err = gc.CreateMergeRequestNote(ic.ProjectID, ic.MergeRequest.IID, &gitlab.CreateMergeRequestNoteOptions{Body: &response})
+	if err != nil {
+		return LGTMError{
+			Repo:      ic.Project.Name,
+			Group:     ic.Project.Namespace,
+			User:      ic.User.Username,
+			Action:    ActionStrCreateMergeRequestNote,
+			Condition: ConditionsStrAllOK,
+			Result:    err,
+		}
+	}
+	if err := queue.Advance(ctx, logger, gc, al, ic.Project.PathWithNamespace, target); err != nil {
+		return LGTMError{
+			Repo:      ic.Project.Name,
+			Group:     ic.Project.Namespace,
+			User:      ic.User.Username,
+			Action:    ActionStrAdvanceMergeQueue,
+			Condition: ConditionsStrAllOK,
+			Result:    err,
+		}
+	}
+	return nil
+}
+
+//refuse explains on the merge request why it is not merged
+func refuse(gc plugins.GitLabClient, ic gitlabhook.MergeRequestCommentEvent, condition, msg string) error {
+	response := plugins.FormatResponse(ic, msg)
+	_, _, err := gc.CreateMergeRequestNote(ic.ProjectID, ic.MergeRequest.IID, &gitlab.CreateMergeRequestNoteOptions{Body: &response})
+	if err != nil {
+		return LGTMError{
+			Repo:      ic.Project.Name,
+			Group:     ic.Project.Namespace,
+			User:      ic.User.Username,
+			Action:    ActionStrCreateMergeRequestNote,
+			Condition: condition,
+			Result:    err,
+		}
+	}
+	return nil
+}
+
+//checkPolicy returns the violations of the change control policy by the merge request, none without a policy
+func checkPolicy(gc plugins.GitLabClient, ic gitlabhook.MergeRequestCommentEvent, policy *plugins.ChangePolicy) ([]string, error) {
+	if policy == nil {
+		return nil, nil
+	}
+	violations, err := plugins.CheckPolicy(gc, ic.ProjectID, ic.MergeRequest.IID, ic.MergeRequest.Title, ic.MergeRequest.Description, *policy)
+	if err != nil {
+		return nil, LGTMError{
+			Repo:      ic.Project.Name,
+			Group:     ic.Project.Namespace,
+			User:      ic.User.Username,
+			Action:    ActionStrCheckPolicy,
+			Condition: ConditionsStrAllOK,
+			Result:    err,
+		}
+	}
+	return violations, nil
+}
+
+//checkMergeRequest looks up the pipeline and the required checks of the last commit of the merge request, the
+//checks carry the SHA of the checked commit which is the one to merge
+func checkMergeRequest(gc plugins.GitLabClient, ic gitlabhook.MergeRequestCommentEvent, requiredChecks []string) (plugins.Checks, error) {
+	mr, _, err := gc.GetMergeRequest(ic.ProjectID, ic.MergeRequest.IID)
+	if err == nil {
+		var checks plugins.Checks
+		checks, err = plugins.CheckCommit(gc, ic.ProjectID, mr.SHA, mr.HeadPipeline, requiredChecks)
+		if err == nil {
+			return checks, nil
+		}
+	}
+	return plugins.Checks{}, LGTMError{
+		Repo:      ic.Project.Name,
+		Group:     ic.Project.Namespace,
+		User:      ic.User.Username,
+		Action:    ActionStrCheckCommit,
+		Condition: ConditionsStrAllOK,
+		Result:    err,
+	}
+}
+
+func hasPlugin(plugins []string, plugin string) bool {
+	for _, p := range plugins {
+		if p == plugin {
+			return true
+		}
+	}
+	return false
+}
+
 func userInApproverList(a string, list []string) bool {
 	for _, b := range list {
 		if strings.EqualFold(b, a) {
@@ -297,3 +477,31 @@ func userInApproverList(a string, list []string) bool {
 	}
 	return false
 }
+
+//mergeRecord builds the audit record for an accepted merge request, approvers are the approvers of the repo that
+//allowed the commenter to merge it and sha the commit that was checked and merged
+func mergeRecord(ic gitlabhook.MergeRequestCommentEvent, approvers []string, sha string, err error) audit.Record {
+	result := "ok"
+	if err != nil {
+		result = err.Error()
+	}
+	return audit.Record{
+		Action:       audit.ActionMerge,
+		Plugin:       pluginName,
+		Actor:        ic.User.Username,
+		Approvers:    approvers,
+		Project:      ic.Project.PathWithNamespace,
+		MergeRequest: ic.MergeRequest.IID,
+		CommitSHA:    sha,
+		Event:        noteEvent(ic),
+		Result:       result,
+	}
+}
+
+//noteEvent describes the comment that triggered a change in the audit trail
+func noteEvent(ic gitlabhook.MergeRequestCommentEvent) string {
+	if ic.ObjectAttributes.URL != "" {
+		return ic.ObjectAttributes.URL
+	}
+	return fmt.Sprintf("note %d", ic.ObjectAttributes.ID)
+}
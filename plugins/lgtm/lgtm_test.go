@@ -0,0 +1,173 @@
+package lgtm
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/cosminilie/gitbot/gitlabfake"
+	"github.com/cosminilie/gitbot/gitlabhook"
+	"github.com/cosminilie/gitbot/plugins"
+	"github.com/go-kit/kit/log"
+	"github.com/xanzy/go-gitlab"
+)
+
+func TestRequiredChecks(t *testing.T) {
+	gl := gitlabfake.New()
+	p := gl.AddProject("tools/api")
+	lgtm := func(iid int) {
+		ic := gitlabhook.MergeRequestCommentEvent{
+			ProjectID:        p.ID,
+			Project:          gitlabhook.Project{Name: "api", PathWithNamespace: "tools/api"},
+			ObjectAttributes: gitlabhook.ObjectAttributes{Note: "/lgtm", NoteableType: "MergeRequest", AuthorID: 2},
+			MergeRequest:     gitlabhook.MergeRequest{IID: iid, AuthorID: 1, TargetBranch: "master"},
+			User:             gitlabhook.User{Username: "alice"},
+		}
+		if err := handle(context.Background(), log.NewNopLogger(), gl, nil, nil, ic, []string{"alice"}, []string{"unit"}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sha := func(iid int) string {
+		mr, _, err := gl.GetMergeRequest(p.ID, iid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mr.SHA
+	}
+	lastNote := func(iid int) string {
+		notes := gl.Notes(p.ID, iid)
+		if len(notes) == 0 {
+			return ""
+		}
+		return notes[len(notes)-1].Body
+	}
+
+	//the required check did not run
+	missing, _ := gl.AddMergeRequest(p.ID, "missing", "master", "missing")
+	gl.SetPipeline(p.ID, missing.IID, "success")
+	lgtm(missing.IID)
+	if gl.MergeRequest(p.ID, missing.IID).State != "opened" || !strings.Contains(lastNote(missing.IID), "required check `unit` is missing") {
+		t.Errorf("got %q, want the merge request refused", lastNote(missing.IID))
+	}
+
+	//the required check failed
+	failed, _ := gl.AddMergeRequest(p.ID, "failed", "master", "failed")
+	gl.SetPipeline(p.ID, failed.IID, "running")
+	gl.AddCommitStatus(p.ID, sha(failed.IID), "unit", "failed")
+	lgtm(failed.IID)
+	if gl.MergeRequest(p.ID, failed.IID).State != "opened" || !strings.Contains(lastNote(failed.IID), "required check `unit` failed") {
+		t.Errorf("got %q, want the merge request refused", lastNote(failed.IID))
+	}
+
+	//everything passed, merged right away
+	green, _ := gl.AddMergeRequest(p.ID, "green", "master", "green")
+	gl.SetPipeline(p.ID, green.IID, "success")
+	gl.AddCommitStatus(p.ID, sha(green.IID), "unit", "success")
+	lgtm(green.IID)
+	if mr := gl.MergeRequest(p.ID, green.IID); mr.State != "merged" || mr.MergeWhenBuildSucceeds {
+		t.Errorf("got %+v, want the merge request merged", mr)
+	}
+
+	//still running, merged by GitLab once the pipeline succeeds
+	running, _ := gl.AddMergeRequest(p.ID, "running", "master", "running")
+	gl.SetPipeline(p.ID, running.IID, "running")
+	gl.AddPipelineJob(p.ID, running.IID, "unit", "pending")
+	lgtm(running.IID)
+	if mr := gl.MergeRequest(p.ID, running.IID); mr.State != "opened" || !mr.MergeWhenBuildSucceeds {
+		t.Errorf("got %+v, want the merge request set to merge when the pipeline succeeds", mr)
+	}
+	if !strings.Contains(lastNote(running.IID), "Merging once pipeline") {
+		t.Errorf("got %q", lastNote(running.IID))
+	}
+	gl.SetPipeline(p.ID, running.IID, "success")
+	if gl.MergeRequest(p.ID, running.IID).State != "merged" {
+		t.Error("got the merge request not merged once the pipeline succeeded")
+	}
+
+	//the required check runs outside of the running pipeline, GitLab would merge without waiting for it
+	external, _ := gl.AddMergeRequest(p.ID, "external", "master", "external")
+	gl.SetPipeline(p.ID, external.IID, "running")
+	gl.AddPipelineJob(p.ID, external.IID, "lint", "pending")
+	gl.AddCommitStatus(p.ID, sha(external.IID), "unit", "pending")
+	lgtm(external.IID)
+	if mr := gl.MergeRequest(p.ID, external.IID); mr.State != "opened" || mr.MergeWhenBuildSucceeds || !strings.Contains(lastNote(external.IID), "Can't merge yet") {
+		t.Errorf("got %+v and note %q, want the merge request refused until the check passed", mr, lastNote(external.IID))
+	}
+}
+
+//pushingClient pushes a commit to the merge request once the lgtm plugin announced the merge
+type pushingClient struct {
+	*gitlabfake.GitLab
+}
+
+func (c pushingClient) CreateMergeRequestNote(pid interface{}, mergeRequest int, opt *gitlab.CreateMergeRequestNoteOptions) (*gitlab.Note, *gitlab.Response, error) {
+	n, resp, err := c.GitLab.CreateMergeRequestNote(pid, mergeRequest, opt)
+	if err == nil && strings.Contains(*opt.Body, "All OK") {
+		_, err = c.AddMergeRequestCommit(pid, mergeRequest, "unchecked change")
+	}
+	return n, resp, err
+}
+
+func TestMergeChecked(t *testing.T) {
+	gl := gitlabfake.New()
+	p := gl.AddProject("tools/api")
+	mr, _ := gl.AddMergeRequest(p.ID, "push", "master", "push")
+	ic := gitlabhook.MergeRequestCommentEvent{
+		ProjectID:        p.ID,
+		Project:          gitlabhook.Project{Name: "api", PathWithNamespace: "tools/api"},
+		ObjectAttributes: gitlabhook.ObjectAttributes{Note: "/lgtm", NoteableType: "MergeRequest", AuthorID: 2},
+		MergeRequest:     gitlabhook.MergeRequest{IID: mr.IID, AuthorID: 1, TargetBranch: "master"},
+		User:             gitlabhook.User{Username: "alice"},
+	}
+	if err := handle(context.Background(), log.NewNopLogger(), pushingClient{gl}, nil, nil, ic, []string{"alice"}, nil, nil); err == nil {
+		t.Error("got no error, want the merge of a commit that was pushed after the checks refused")
+	}
+	if gl.MergeRequest(p.ID, mr.IID).State != "opened" {
+		t.Error("got the unchecked commit merged")
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	gl := gitlabfake.New()
+	p := gl.AddProject("tools/api")
+	mr, _ := gl.AddMergeRequest(p.ID, "alert", "master", "Add disk alert")
+	gl.AddMergeRequestCommit(p.ID, mr.IID, "add disk usage alert")
+	policy := &plugins.ChangePolicy{Title: `^JIRA-[0-9]+ `, Commit: `^(feat|fix): `}
+	ic := gitlabhook.MergeRequestCommentEvent{
+		ProjectID:        p.ID,
+		Project:          gitlabhook.Project{Name: "api", PathWithNamespace: "tools/api"},
+		ObjectAttributes: gitlabhook.ObjectAttributes{Note: "/lgtm", NoteableType: "MergeRequest", AuthorID: 2},
+		MergeRequest:     gitlabhook.MergeRequest{IID: mr.IID, AuthorID: 1, Title: "Add disk alert", TargetBranch: "master"},
+		User:             gitlabhook.User{Username: "alice"},
+	}
+	if err := handle(context.Background(), log.NewNopLogger(), gl, nil, nil, ic, []string{"alice"}, nil, policy); err != nil {
+		t.Fatal(err)
+	}
+	notes := gl.Notes(p.ID, mr.IID)
+	if gl.MergeRequest(p.ID, mr.IID).State != "opened" || len(notes) != 1 || !strings.Contains(notes[0].Body, "change control policy: the title does not match") || !strings.Contains(notes[0].Body, "the message of commit") {
+		t.Errorf("got notes %+v, want the merge request refused", notes)
+	}
+
+	//compliant, merged
+	gl.AddMergeRequestCommit(p.ID, mr.IID, "fix: add disk usage alert")
+	policy.Commit = `^(feat|fix|add)\b`
+	ic.MergeRequest.Title = "JIRA-9 Add disk alert"
+	if err := handle(context.Background(), log.NewNopLogger(), gl, nil, nil, ic, []string{"alice"}, nil, policy); err != nil {
+		t.Fatal(err)
+	}
+	if gl.MergeRequest(p.ID, mr.IID).State != "merged" {
+		t.Errorf("got the compliant merge request not merged, notes %+v", gl.Notes(p.ID, mr.IID))
+	}
+}
+
+func TestMergeRecord(t *testing.T) {
+	ic := gitlabhook.MergeRequestCommentEvent{
+		Project:      gitlabhook.Project{PathWithNamespace: "tools/api"},
+		MergeRequest: gitlabhook.MergeRequest{IID: 3},
+		User:         gitlabhook.User{Username: "alice"},
+	}
+	r := mergeRecord(ic, []string{"alice", "bob"}, "abc123", nil)
+	if r.Actor != "alice" || strings.Join(r.Approvers, ",") != "alice,bob" || r.CommitSHA != "abc123" || r.Result != "ok" {
+		t.Errorf("got %+v, want alice merging with the approvers alice and bob", r)
+	}
+}
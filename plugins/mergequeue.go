@@ -0,0 +1,662 @@
+package plugins
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosminilie/gitbot/audit"
+	"github.com/cosminilie/gitbot/gitlabhook"
+	"github.com/cosminilie/gitbot/logging"
+	"github.com/go-kit/kit/log"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+//MergeQueuePlugin is the name of the plugin merging the merge requests approved with lgtm one at a time per target
+//branch. lgtm queues the merge requests instead of merging them when it is enabled on the repo.
+const MergeQueuePlugin = "merge_queue"
+
+var (
+	holdRe   = regexp.MustCompile(`(?mi)^/hold\s*$`)
+	unholdRe = regexp.MustCompile(`(?mi)^/(unhold|hold\s+cancel)\s*$`)
+)
+
+func init() {
+	RegisterMergeCommentEventHandler(MergeQueuePlugin, queueCommentHandler)
+	RegisterPipelineEventHandler(MergeQueuePlugin, queuePipelineHandler)
+}
+
+//MergeQueueError is an error struct which implements the error interface
+type MergeQueueError struct {
+	Repo         string
+	MergeRequest int
+	User         string
+	Action       string
+	Condition    string
+	Result       error
+}
+
+func (e MergeQueueError) Error() string {
+	return fmt.Sprintf("MergeQueueError:\nRepo:%s,\nMergeRequest:%d,\nUser:%s,\nAction:%s,\nCondition:%s,\nResult:%s,\n", e.Repo, e.MergeRequest, e.User, e.Action, e.Condition, e.Result)
+}
+
+//QueueEntry is a merge request waiting in the merge queue of its target branch
+type QueueEntry struct {
+	Project      string `json:"project"`
+	ProjectID    int    `json:"project_id"`
+	MergeRequest int    `json:"merge_request"`
+	SourceBranch string `json:"source_branch"`
+	TargetBranch string `json:"target_branch"`
+	//Approver approved the merge request with lgtm, Event is the URL of the approving comment
+	Approver string `json:"approver"`
+	//Approvers are the approvers of the repo when the merge request was approved
+	Approvers []string  `json:"approvers,omitempty"`
+	Event     string    `json:"event"`
+	Enqueued  time.Time `json:"enqueued"`
+	//Rebased is set once the queue rebased a merge request that ran pipelines, it is then only merged after a pipeline
+	//passed on the rebased commits. Merge requests without any pipeline are taken as projects without CI.
+	Rebased bool `json:"rebased"`
+	Held    bool `json:"held"`
+	//RequiredChecks are the jobs and external checks that must pass before the merge request is merged
+	RequiredChecks []string `json:"required_checks,omitempty"`
+	//Policy is the change control policy the merge request must still comply with when it is merged. None when nil.
+	Policy *ChangePolicy `json:"policy,omitempty"`
+}
+
+type queueKey struct {
+	project, target string
+}
+
+type queuedMR struct {
+	project      string
+	mergeRequest int
+}
+
+//MergeQueue holds a queue of approved merge requests per project and target branch. The first merge request of a
+//queue that is not held is rebased onto its target branch, merged once its pipeline passed and the next one starts.
+//It is safe for concurrent use and does not need PluginClient.Pmut. Queues opened from a file are saved to it on every
+//change so that they survive a restart, otherwise they are kept in memory only and the merge requests have to be
+//approved again after a restart.
+type MergeQueue struct {
+	mut    sync.Mutex
+	path   string
+	queues map[queueKey][]*QueueEntry
+	//holds are the merge requests held with /hold, queued or not
+	holds map[queuedMR]bool
+	//advancing holds a lock per queue, a queue is moved forward by one caller at a time while the GitLab calls of
+	//one queue don't hold up the others
+	advancing map[queueKey]*sync.Mutex
+}
+
+//queueFile is the content of the file the queues are saved to
+type queueFile struct {
+	//Entries are in the order of their queues
+	Entries []QueueEntry `json:"entries"`
+	Holds   []QueueEntry `json:"holds"`
+}
+
+//NewMergeQueue returns empty merge queues kept in memory
+func NewMergeQueue() *MergeQueue {
+	return &MergeQueue{
+		queues:    make(map[queueKey][]*QueueEntry),
+		holds:     make(map[queuedMR]bool),
+		advancing: make(map[queueKey]*sync.Mutex),
+	}
+}
+
+//OpenMergeQueue loads the queues saved to path, which does not have to exist yet. The queues are saved to it again on
+//every change.
+func OpenMergeQueue(path string) (*MergeQueue, error) {
+	q := NewMergeQueue()
+	q.path = path
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f queueFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("invalid merge queue file %s: %s", path, err)
+	}
+	for i := range f.Entries {
+		e := f.Entries[i]
+		k := queueKey{project: strings.ToLower(e.Project), target: e.TargetBranch}
+		q.queues[k] = append(q.queues[k], &e)
+	}
+	for _, h := range f.Holds {
+		q.holds[queuedMR{strings.ToLower(h.Project), h.MergeRequest}] = true
+	}
+	return q, nil
+}
+
+//save writes the queues to their file, replacing it at once. Callers must hold q.mut
+func (q *MergeQueue) save() error {
+	if q.path == "" {
+		return nil
+	}
+	f := queueFile{Entries: q.entries(), Holds: []QueueEntry{}}
+	for h := range q.holds {
+		f.Holds = append(f.Holds, QueueEntry{Project: h.project, MergeRequest: h.mergeRequest})
+	}
+	sort.Slice(f.Holds, func(i, j int) bool {
+		if f.Holds[i].Project != f.Holds[j].Project {
+			return f.Holds[i].Project < f.Holds[j].Project
+		}
+		return f.Holds[i].MergeRequest < f.Holds[j].MergeRequest
+	})
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := q.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path)
+}
+
+//Enqueue adds a merge request at the end of the queue of its target branch. It returns the position of the merge
+//request in the queue, starting at 1, and false when it was queued already. The merge request is queued even when
+//saving the queues fails.
+func (q *MergeQueue) Enqueue(e QueueEntry) (int, bool, error) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	if k, i := q.find(e.Project, e.MergeRequest); i >= 0 {
+		if k.target == e.TargetBranch {
+			return i + 1, false, nil
+		}
+		//the target branch of the merge request changed
+		q.remove(k, i)
+	}
+	k := queueKey{project: strings.ToLower(e.Project), target: e.TargetBranch}
+	if e.Enqueued.IsZero() {
+		e.Enqueued = time.Now()
+	}
+	e.Rebased = false
+	q.queues[k] = append(q.queues[k], &e)
+	return len(q.queues[k]), true, q.save()
+}
+
+//Position returns the position of a merge request in the queue of its target branch, 0 when it is not queued
+func (q *MergeQueue) Position(project string, mergeRequest int) int {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	_, i := q.find(project, mergeRequest)
+	return i + 1
+}
+
+//Entry returns a queued merge request
+func (q *MergeQueue) Entry(project string, mergeRequest int) (QueueEntry, bool) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	k, i := q.find(project, mergeRequest)
+	if i < 0 {
+		return QueueEntry{}, false
+	}
+	return q.entry(q.queues[k][i]), true
+}
+
+//Remove removes a merge request from its queue. The merge request is removed even when saving the queues fails.
+func (q *MergeQueue) Remove(project string, mergeRequest int) (QueueEntry, bool, error) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	k, i := q.find(project, mergeRequest)
+	if i < 0 {
+		return QueueEntry{}, false, nil
+	}
+	e := q.entry(q.queues[k][i])
+	q.remove(k, i)
+	return e, true, q.save()
+}
+
+//Hold holds a merge request: it keeps its place in the queue but is not merged until it is released. Merge requests
+//can be held before they are queued.
+func (q *MergeQueue) Hold(project string, mergeRequest int) error {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	q.holds[queuedMR{strings.ToLower(project), mergeRequest}] = true
+	return q.save()
+}
+
+//Release releases a held merge request. It reports whether the merge request was held.
+func (q *MergeQueue) Release(project string, mergeRequest int) (bool, error) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	k := queuedMR{strings.ToLower(project), mergeRequest}
+	held := q.holds[k]
+	delete(q.holds, k)
+	if !held {
+		return false, nil
+	}
+	return true, q.save()
+}
+
+//Head returns the first merge request of a queue that is not held
+func (q *MergeQueue) Head(project, target string) (QueueEntry, bool) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	for _, e := range q.queues[queueKey{strings.ToLower(project), target}] {
+		if !q.holds[queuedMR{strings.ToLower(e.Project), e.MergeRequest}] {
+			return *e, true
+		}
+	}
+	return QueueEntry{}, false
+}
+
+//Sources returns the queued merge requests of a project whose source branch is branch
+func (q *MergeQueue) Sources(project, branch string) []QueueEntry {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	var es []QueueEntry
+	for k, queue := range q.queues {
+		if k.project != strings.ToLower(project) {
+			continue
+		}
+		for _, e := range queue {
+			if e.SourceBranch == branch {
+				es = append(es, q.entry(e))
+			}
+		}
+	}
+	return es
+}
+
+//Entries returns the queued merge requests sorted by project, target branch and position
+func (q *MergeQueue) Entries() []QueueEntry {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	return q.entries()
+}
+
+//entries returns the queued merge requests sorted by project, target branch and position. Callers must hold q.mut
+func (q *MergeQueue) entries() []QueueEntry {
+	var keys []queueKey
+	for k := range q.queues {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].project != keys[j].project {
+			return keys[i].project < keys[j].project
+		}
+		return keys[i].target < keys[j].target
+	})
+	es := []QueueEntry{}
+	for _, k := range keys {
+		for _, e := range q.queues[k] {
+			es = append(es, q.entry(e))
+		}
+	}
+	return es
+}
+
+func (q *MergeQueue) setRebased(project string, mergeRequest int) error {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	k, i := q.find(project, mergeRequest)
+	if i < 0 {
+		return nil
+	}
+	q.queues[k][i].Rebased = true
+	return q.save()
+}
+
+//find returns the queue and the index of a merge request, -1 when it is not queued. Callers must hold q.mut
+func (q *MergeQueue) find(project string, mergeRequest int) (queueKey, int) {
+	project = strings.ToLower(project)
+	for k, queue := range q.queues {
+		if k.project != project {
+			continue
+		}
+		for i, e := range queue {
+			if e.MergeRequest == mergeRequest {
+				return k, i
+			}
+		}
+	}
+	return queueKey{}, -1
+}
+
+//remove removes the entry at i from a queue. Callers must hold q.mut
+func (q *MergeQueue) remove(k queueKey, i int) {
+	q.queues[k] = append(q.queues[k][:i], q.queues[k][i+1:]...)
+	if len(q.queues[k]) == 0 {
+		delete(q.queues, k)
+	}
+}
+
+//entry returns a copy of a queued merge request. Callers must hold q.mut
+func (q *MergeQueue) entry(e *QueueEntry) QueueEntry {
+	c := *e
+	c.Held = q.holds[queuedMR{strings.ToLower(e.Project), e.MergeRequest}]
+	return c
+}
+
+//AdvanceAll moves every queue forward. It catches up with the rebases and pipelines that no event reports, such as
+//the rebase of a merge request in a project without CI. A queue that fails does not stop the others, the first error
+//is returned. It stops between two queues once ctx is done.
+func (q *MergeQueue) AdvanceAll(ctx context.Context, logger log.Logger, cl GitLabClient, al *audit.Log) error {
+	q.mut.Lock()
+	var keys []QueueEntry
+	for k, queue := range q.queues {
+		if len(queue) > 0 {
+			keys = append(keys, QueueEntry{Project: queue[0].Project, TargetBranch: k.target})
+		}
+	}
+	q.mut.Unlock()
+
+	var first error
+	for _, k := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := q.Advance(ctx, logger, cl, al, k.Project, k.TargetBranch); err != nil {
+			logging.Warn(logger).Log(
+				"Repo", k.Project,
+				"Plugin", MergeQueuePlugin,
+				"Action", "Advance",
+				"Branch", k.TargetBranch,
+				"Error", err,
+			)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+//Advance moves the queue of a target branch forward. The first merge request that is not held is rebased onto the
+//target branch when it is behind it and merged once the pipeline of its last commit passed, then the next one
+//starts. Merge requests that can't be merged leave the queue with a comment. Advance returns when the queue is
+//empty or its head waits for a rebase or a pipeline. It stops between two merge requests once ctx is done.
+func (q *MergeQueue) Advance(ctx context.Context, logger log.Logger, cl GitLabClient, al *audit.Log, project, target string) error {
+	l := q.queueLock(project, target)
+	l.Lock()
+	defer l.Unlock()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		e, ok := q.Head(project, target)
+		if !ok {
+			return nil
+		}
+		next, err := q.step(logger, cl, al, e)
+		if err != nil || !next {
+			return err
+		}
+	}
+}
+
+//queueLock returns the lock moving the queue of a target branch forward
+func (q *MergeQueue) queueLock(project, target string) *sync.Mutex {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	k := queueKey{project: strings.ToLower(project), target: target}
+	l, ok := q.advancing[k]
+	if !ok {
+		l = &sync.Mutex{}
+		q.advancing[k] = l
+	}
+	return l
+}
+
+//refused reports whether GitLab refused a call for good, e.g. because of a conflict, as opposed to failing to answer
+//it. Calls that timed out, were throttled or hit a server error may work the next time.
+func refused(err error) bool {
+	er, ok := err.(*gitlab.ErrorResponse)
+	if !ok || er.Response == nil {
+		return false
+	}
+	code := er.Response.StatusCode
+	return code >= 400 && code < 500 && code != http.StatusRequestTimeout && code != http.StatusTooManyRequests
+}
+
+//step moves the head of a queue forward. It returns true when the merge request left the queue.
+func (q *MergeQueue) step(logger log.Logger, cl GitLabClient, al *audit.Log, e QueueEntry) (bool, error) {
+	mr, _, err := cl.GetMergeRequest(e.ProjectID, e.MergeRequest)
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case mr.State != "opened":
+		//merged or closed by someone else, nobody needs to be told
+		_, _, err := q.Remove(e.Project, e.MergeRequest)
+		return true, err
+	case mr.WorkInProgress:
+		return true, q.drop(logger, cl, e, "it is a work in progress")
+	case mr.MergeStatus == "cannot_be_merged":
+		return true, q.drop(logger, cl, e, fmt.Sprintf("it has conflicts with `%s`", e.TargetBranch))
+	case mr.RebaseInProgress:
+		return false, nil
+	case mr.DivergedCommitsCount > 0:
+		if _, err := cl.RebaseMergeRequest(e.ProjectID, e.MergeRequest); err != nil {
+			//the merge request keeps its place, the next event or merge_queue run tries again
+			if !refused(err) {
+				return false, err
+			}
+			return true, q.drop(logger, cl, e, fmt.Sprintf("rebasing it onto `%s` failed: %s", e.TargetBranch, err))
+		}
+		//without CI no pipeline runs on the rebased commits, the merge request is merged once the rebase is done
+		if mr.HeadPipeline == nil {
+			q.note(logger, cl, e, fmt.Sprintf("Merge queue -> Rebasing onto the latest `%s`, merging once it is rebased.", e.TargetBranch))
+			return false, nil
+		}
+		if err := q.setRebased(e.Project, e.MergeRequest); err != nil {
+			return false, err
+		}
+		q.note(logger, cl, e, fmt.Sprintf("Merge queue -> Rebasing onto the latest `%s`, merging once the pipeline passes.", e.TargetBranch))
+		return false, nil
+	}
+
+	checks, err := CheckCommit(cl, e.ProjectID, mr.SHA, mr.HeadPipeline, e.RequiredChecks)
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case checks.Blocked():
+		return true, q.drop(logger, cl, e, checks.Explain())
+	case checks.Pipeline == nil && e.Rebased:
+		//a rebased merge request waits for the pipeline of its new commits
+		return false, nil
+	case !checks.Green():
+		return false, nil
+	}
+	//commits pushed or the description edited since the approval may break the policy
+	if e.Policy != nil {
+		violations, err := CheckPolicy(cl, e.ProjectID, e.MergeRequest, mr.Title, mr.Description, *e.Policy)
+		if err != nil {
+			return false, err
+		}
+		if len(violations) > 0 {
+			return true, q.drop(logger, cl, e, fmt.Sprintf("it breaks the change control policy: %s", strings.Join(violations, ", ")))
+		}
+	}
+	return true, q.merge(logger, cl, al, e, mr.SHA)
+}
+
+//merge merges the head of a queue at sha and removes it from the queue
+func (q *MergeQueue) merge(logger log.Logger, cl GitLabClient, al *audit.Log, e QueueEntry, sha string) error {
+	logger.Log(
+		"Repo", e.Project,
+		"Plugin", MergeQueuePlugin,
+		"Action", "AcceptMergeRequest",
+		"MergeRequest", e.MergeRequest,
+		"SHA", sha,
+	)
+	_, _, err := cl.AcceptMergeRequest(e.ProjectID, e.MergeRequest, &AcceptMergeRequestOptions{
+		MergeCommitMessage:       gitlab.String(fmt.Sprintf("LGTM Plugin Merged Request based on Aproval from %s\n", e.Approver)),
+		ShouldRemoveSourceBranch: gitlab.Bool(true),
+		SHA:                      gitlab.String(sha),
+	})
+	if auditErr := al.Append(queueMergeRecord(e, sha, err)); auditErr != nil {
+		return auditErr
+	}
+	if err != nil {
+		return q.drop(logger, cl, e, fmt.Sprintf("merging it failed: %s", err))
+	}
+	_, _, err = q.Remove(e.Project, e.MergeRequest)
+	return err
+}
+
+//drop removes a merge request from its queue and says why on the merge request. It returns the error saving the
+//queues.
+func (q *MergeQueue) drop(logger log.Logger, cl GitLabClient, e QueueEntry, why string) error {
+	_, _, err := q.Remove(e.Project, e.MergeRequest)
+	q.note(logger, cl, e, fmt.Sprintf("Merge queue -> Removed from the merge queue of `%s` as %s. Comment /lgtm again once it is fixed.", e.TargetBranch, why))
+	return err
+}
+
+//note comments on a queued merge request. The queue moves on regardless, a failed comment is only logged.
+func (q *MergeQueue) note(logger log.Logger, cl GitLabClient, e QueueEntry, body string) {
+	if e.Approver != "" {
+		body = "@" + e.Approver + ": " + body
+	}
+	if _, _, err := cl.CreateMergeRequestNote(e.ProjectID, e.MergeRequest, &gitlab.CreateMergeRequestNoteOptions{Body: &body}); err != nil {
+		logging.Warn(logger).Log(
+			"Repo", e.Project,
+			"Plugin", MergeQueuePlugin,
+			"Action", "CreateNote",
+			"MergeRequest", e.MergeRequest,
+			"Error", err,
+		)
+	}
+}
+
+//queueMergeRecord builds the audit record for a merge request merged by the queue
+func queueMergeRecord(e QueueEntry, sha string, err error) audit.Record {
+	result := "ok"
+	if err != nil {
+		result = err.Error()
+	}
+	return audit.Record{
+		Action:       audit.ActionMerge,
+		Plugin:       MergeQueuePlugin,
+		Actor:        e.Approver,
+		Approvers:    e.Approvers,
+		Project:      e.Project,
+		MergeRequest: e.MergeRequest,
+		CommitSHA:    sha,
+		Branch:       e.TargetBranch,
+		Event:        e.Event,
+		Result:       result,
+	}
+}
+
+func queueCommentHandler(ctx context.Context, pc *PluginClient, ic gitlabhook.MergeRequestCommentEvent) error {
+	return pc.Queue.comment(ctx, pc.Logger, pc.GitLabClient, pc.Audit, ic)
+}
+
+//comment holds and releases merge requests with /hold and /unhold
+func (q *MergeQueue) comment(ctx context.Context, logger log.Logger, cl GitLabClient, al *audit.Log, ic gitlabhook.MergeRequestCommentEvent) error {
+	if t := ic.ObjectAttributes.NoteableType; t != "" && t != "MergeRequest" {
+		return nil
+	}
+	project, iid := ic.Project.PathWithNamespace, ic.MergeRequest.IID
+	queueErr := func(action string, err error) error {
+		return MergeQueueError{
+			Repo:         project,
+			MergeRequest: iid,
+			User:         ic.User.Username,
+			Action:       action,
+			Result:       err,
+		}
+	}
+	var msg string
+	switch {
+	case unholdRe.MatchString(ic.ObjectAttributes.Note):
+		held, err := q.Release(project, iid)
+		if err != nil {
+			return queueErr("Release", err)
+		}
+		if !held {
+			return nil
+		}
+		msg = "Merge queue -> Released, it is merged once approved and its turn comes"
+	case holdRe.MatchString(ic.ObjectAttributes.Note):
+		if err := q.Hold(project, iid); err != nil {
+			return queueErr("Hold", err)
+		}
+		msg = "Merge queue -> Held, it won't be merged until someone comments /unhold"
+	default:
+		return nil
+	}
+	logger.Log(
+		"Repo", project,
+		"Plugin", MergeQueuePlugin,
+		"MergeRequest", iid,
+		"User", ic.User.Username,
+		"Action", msg,
+	)
+	if pos := q.Position(project, iid); pos > 0 {
+		msg += fmt.Sprintf(". It is at position %d in the merge queue of `%s`", pos, ic.MergeRequest.TargetBranch)
+	}
+	response := FormatResponse(ic, msg)
+	if _, _, err := cl.CreateMergeRequestNote(ic.ProjectID, iid, &gitlab.CreateMergeRequestNoteOptions{Body: &response}); err != nil {
+		return queueErr("CreateNote", err)
+	}
+
+	//a held head lets the next merge request through, a released one may be next
+	if err := q.Advance(ctx, logger, cl, al, project, ic.MergeRequest.TargetBranch); err != nil {
+		return queueErr("Advance", err)
+	}
+	return nil
+}
+
+func queuePipelineHandler(ctx context.Context, pc *PluginClient, pe gitlabhook.PipelineEvent) error {
+	return pc.Queue.pipeline(ctx, pc.Logger, pc.GitLabClient, pc.Audit, pe)
+}
+
+//pipeline moves the queues of the merge requests whose pipeline finished forward
+func (q *MergeQueue) pipeline(ctx context.Context, logger log.Logger, cl GitLabClient, al *audit.Log, pe gitlabhook.PipelineEvent) error {
+	pa := pe.ObjectAttributes
+	if pa.Tag || !pa.Finished() {
+		return nil
+	}
+	project := pe.Project.PathWithNamespace
+	advanced := make(map[string]bool)
+	for _, e := range q.Sources(project, pa.Ref) {
+		if advanced[e.TargetBranch] {
+			continue
+		}
+		advanced[e.TargetBranch] = true
+		logging.Debug(logger).Log(
+			"Repo", project,
+			"Plugin", MergeQueuePlugin,
+			"MergeRequest", e.MergeRequest,
+			"Pipeline", pa.ID,
+			"Status", pa.Status,
+		)
+		if err := q.Advance(ctx, logger, cl, al, project, e.TargetBranch); err != nil {
+			return MergeQueueError{
+				Repo:         project,
+				MergeRequest: e.MergeRequest,
+				Action:       "Advance",
+				Result:       err,
+			}
+		}
+	}
+	return nil
+}
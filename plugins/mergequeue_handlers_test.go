@@ -0,0 +1,81 @@
+package plugins_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/cosminilie/gitbot/gitlabfake"
+	"github.com/cosminilie/gitbot/gitlabhook"
+	"github.com/cosminilie/gitbot/plugins"
+	"github.com/go-kit/kit/log"
+)
+
+func TestHoldAndPipeline(t *testing.T) {
+	gl := gitlabfake.New()
+	p := gl.AddProject("tools/api")
+	first, _ := gl.AddMergeRequest(p.ID, "one", "master", "one")
+	second, _ := gl.AddMergeRequest(p.ID, "two", "master", "two")
+	q := plugins.NewMergeQueue()
+	for _, mr := range []struct {
+		iid    int
+		source string
+	}{{first.IID, "one"}, {second.IID, "two"}} {
+		q.Enqueue(plugins.QueueEntry{Project: "tools/api", ProjectID: p.ID, MergeRequest: mr.iid, SourceBranch: mr.source, TargetBranch: "master"})
+	}
+	gl.SetPipeline(p.ID, first.IID, "running")
+	gl.SetPipeline(p.ID, second.IID, "running")
+
+	comment := func(iid int, note string) {
+		ic := gitlabhook.MergeRequestCommentEvent{
+			ProjectID:        p.ID,
+			Project:          gitlabhook.Project{PathWithNamespace: "tools/api"},
+			ObjectAttributes: gitlabhook.ObjectAttributes{Note: note, NoteableType: "MergeRequest"},
+			MergeRequest:     gitlabhook.MergeRequest{IID: iid, TargetBranch: "master"},
+			User:             gitlabhook.User{Username: "bob"},
+		}
+		if err := plugins.QueueComment(q, context.Background(), log.NewNopLogger(), gl, nil, ic); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pipeline := func(ref, status string) {
+		pe := gitlabhook.PipelineEvent{
+			ObjectAttributes: gitlabhook.PipelineAttributes{Ref: ref, Status: status},
+			Project:          gitlabhook.Project{PathWithNamespace: "tools/api"},
+		}
+		if err := plugins.QueuePipeline(q, context.Background(), log.NewNopLogger(), gl, nil, pe); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	comment(first.IID, "/hold")
+	if notes := gl.Notes(p.ID, first.IID); len(notes) != 1 || !strings.Contains(notes[0].Body, "Held") || !strings.Contains(notes[0].Body, "position 1") {
+		t.Errorf("got notes %+v", notes)
+	}
+	//the pipeline of the held merge request passes, it stays queued
+	gl.SetPipeline(p.ID, first.IID, "success")
+	pipeline("one", "success")
+	if gl.MergeRequest(p.ID, first.IID).State != "opened" {
+		t.Error("got the held merge request merged")
+	}
+
+	gl.SetPipeline(p.ID, second.IID, "success")
+	pipeline("two", "running")
+	if gl.MergeRequest(p.ID, second.IID).State != "opened" {
+		t.Error("got the merge request merged on a running pipeline event")
+	}
+	pipeline("two", "success")
+	if gl.MergeRequest(p.ID, second.IID).State != "merged" {
+		t.Error("got the merge request behind the held one not merged")
+	}
+
+	//released, the first one is now behind master and rebased
+	comment(first.IID, "/unhold")
+	if e, ok := q.Entry("tools/api", first.IID); !ok || !e.Rebased || e.Held {
+		t.Errorf("got %+v, want the released merge request rebased", e)
+	}
+	comment(first.IID, "lgtm otherwise")
+	if notes := gl.Notes(p.ID, first.IID); len(notes) != 3 {
+		t.Errorf("got %d notes, want the hold, the release and the rebase", len(notes))
+	}
+}
@@ -0,0 +1,286 @@
+package plugins_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cosminilie/gitbot/gitlabfake"
+	"github.com/cosminilie/gitbot/plugins"
+	"github.com/go-kit/kit/log"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+func TestMergeQueue(t *testing.T) {
+	gl := gitlabfake.New()
+	p := gl.AddProject("tools/api")
+	var mrs []int
+	for _, b := range []string{"one", "two", "three", "four"} {
+		mr, err := gl.AddMergeRequest(p.ID, b, "master", b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mrs = append(mrs, mr.IID)
+	}
+	q := plugins.NewMergeQueue()
+	enqueue := func(iid int, source string) {
+		if _, _, err := q.Enqueue(plugins.QueueEntry{Project: "tools/api", ProjectID: p.ID, MergeRequest: iid, SourceBranch: source, TargetBranch: "master", Approver: "alice"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	enqueue(mrs[0], "one")
+	enqueue(mrs[1], "two")
+	if pos, added, _ := q.Enqueue(plugins.QueueEntry{Project: "Tools/API", MergeRequest: mrs[1], TargetBranch: "master"}); added || pos != 2 {
+		t.Errorf("got position %d, %v, want the merge request queued once", pos, added)
+	}
+	advance := func() {
+		if err := q.Advance(context.Background(), log.NewNopLogger(), gl, nil, "tools/api", "master"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//the first merge request is up to date and has no pipeline, the second one ran a pipeline and is behind it once it
+	//is merged
+	gl.SetPipeline(p.ID, mrs[1], "success")
+	advance()
+	if gl.MergeRequest(p.ID, mrs[0]).State != "merged" {
+		t.Fatal("got the head of the queue not merged")
+	}
+	if e, ok := q.Head("tools/api", "master"); !ok || e.MergeRequest != mrs[1] || !e.Rebased {
+		t.Fatalf("got head %+v, want the second merge request rebased", e)
+	}
+	if notes := gl.Notes(p.ID, mrs[1]); len(notes) != 1 || !strings.Contains(notes[0].Body, "Rebasing onto the latest `master`") {
+		t.Errorf("got notes %+v", notes)
+	}
+
+	//it waits for the pipeline of the rebased commits, even though the previous one passed
+	advance()
+	if gl.MergeRequest(p.ID, mrs[1]).State != "opened" {
+		t.Fatal("got the merge request merged before a pipeline ran on the rebased commits")
+	}
+	gl.SetPipeline(p.ID, mrs[1], "running")
+	advance()
+	if gl.MergeRequest(p.ID, mrs[1]).State != "opened" || q.Position("tools/api", mrs[1]) != 1 {
+		t.Fatal("got the merge request merged before its pipeline passed")
+	}
+	gl.SetPipeline(p.ID, mrs[1], "success")
+	advance()
+	if gl.MergeRequest(p.ID, mrs[1]).State != "merged" || q.Position("tools/api", mrs[1]) != 0 {
+		t.Fatal("got the merge request not merged after its pipeline passed")
+	}
+
+	//a held merge request keeps its place while the next one goes through, a failed pipeline leaves the queue
+	if err := q.Hold("tools/api", mrs[2]); err != nil {
+		t.Fatal(err)
+	}
+	enqueue(mrs[2], "three")
+	enqueue(mrs[3], "four")
+	gl.SetDiverged(p.ID, mrs[3], 0)
+	gl.SetPipeline(p.ID, mrs[3], "failed")
+	advance()
+	if q.Position("tools/api", mrs[3]) != 0 || gl.MergeRequest(p.ID, mrs[3]).State != "opened" {
+		t.Error("got the merge request with a failed pipeline still queued or merged")
+	}
+	if notes := gl.Notes(p.ID, mrs[3]); len(notes) != 1 || !strings.Contains(notes[0].Body, "failed") {
+		t.Errorf("got notes %+v", notes)
+	}
+	if e, ok := q.Entry("tools/api", mrs[2]); !ok || !e.Held {
+		t.Errorf("got %+v, want the held merge request queued", e)
+	}
+	if held, err := q.Release("tools/api", mrs[2]); err != nil || !held {
+		t.Error("got the merge request not held")
+	}
+	if es := q.Entries(); len(es) != 1 || es[0].MergeRequest != mrs[2] {
+		t.Errorf("got entries %+v", es)
+	}
+}
+
+func TestMergeQueueWithoutCI(t *testing.T) {
+	gl := gitlabfake.New()
+	p := gl.AddProject("tools/api")
+	first, _ := gl.AddMergeRequest(p.ID, "one", "master", "one")
+	second, _ := gl.AddMergeRequest(p.ID, "two", "master", "two")
+	q := plugins.NewMergeQueue()
+	for _, e := range []struct {
+		iid    int
+		source string
+	}{{first.IID, "one"}, {second.IID, "two"}} {
+		q.Enqueue(plugins.QueueEntry{Project: "tools/api", ProjectID: p.ID, MergeRequest: e.iid, SourceBranch: e.source, TargetBranch: "master"})
+	}
+
+	//no pipeline ever runs, the second merge request is merged once it is rebased
+	if err := q.AdvanceAll(context.Background(), log.NewNopLogger(), gl, nil); err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := q.Head("tools/api", "master"); !ok || e.MergeRequest != second.IID || e.Rebased {
+		t.Fatalf("got head %+v, want the second merge request waiting for its rebase only", e)
+	}
+	if notes := gl.Notes(p.ID, second.IID); len(notes) != 1 || !strings.Contains(notes[0].Body, "merging once it is rebased") {
+		t.Errorf("got notes %+v", notes)
+	}
+	if err := q.AdvanceAll(context.Background(), log.NewNopLogger(), gl, nil); err != nil {
+		t.Fatal(err)
+	}
+	if gl.MergeRequest(p.ID, second.IID).State != "merged" || len(q.Entries()) != 0 {
+		t.Error("got the rebased merge request without CI not merged")
+	}
+}
+
+//failingRebase fails the rebases with err
+type failingRebase struct {
+	*gitlabfake.GitLab
+	err error
+}
+
+func (c *failingRebase) RebaseMergeRequest(pid interface{}, mergeRequest int) (*gitlab.Response, error) {
+	return nil, c.err
+}
+
+func TestMergeQueueRebaseError(t *testing.T) {
+	gl := gitlabfake.New()
+	p := gl.AddProject("tools/api")
+	mr, _ := gl.AddMergeRequest(p.ID, "one", "master", "one")
+	gl.SetDiverged(p.ID, mr.IID, 2)
+	q := plugins.NewMergeQueue()
+	q.Enqueue(plugins.QueueEntry{Project: "tools/api", ProjectID: p.ID, MergeRequest: mr.IID, SourceBranch: "one", TargetBranch: "master"})
+
+	//GitLab does not answer, the merge request keeps its place for the next run
+	cl := &failingRebase{GitLab: gl, err: errors.New("connection reset by peer")}
+	if err := q.Advance(context.Background(), log.NewNopLogger(), cl, nil, "tools/api", "master"); err == nil {
+		t.Error("got no error")
+	}
+	if q.Position("tools/api", mr.IID) != 1 || len(gl.Notes(p.ID, mr.IID)) != 0 {
+		t.Fatal("got the merge request dropped on a transient error")
+	}
+
+	//GitLab refuses the rebase
+	cl.err = &gitlab.ErrorResponse{
+		Response: &http.Response{StatusCode: http.StatusForbidden, Request: httptest.NewRequest("PUT", "/api/v4/projects/1/merge_requests/1/rebase", nil)},
+		Message:  "403 Forbidden",
+	}
+	if err := q.Advance(context.Background(), log.NewNopLogger(), cl, nil, "tools/api", "master"); err != nil {
+		t.Fatal(err)
+	}
+	if q.Position("tools/api", mr.IID) != 0 {
+		t.Error("got the merge request still queued after the rebase was refused")
+	}
+	if notes := gl.Notes(p.ID, mr.IID); len(notes) != 1 || !strings.Contains(notes[0].Body, "rebasing it onto `master` failed") {
+		t.Errorf("got notes %+v", notes)
+	}
+
+	//a queue is not moved forward once the handler is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	q.Enqueue(plugins.QueueEntry{Project: "tools/api", ProjectID: p.ID, MergeRequest: mr.IID, SourceBranch: "one", TargetBranch: "master"})
+	if err := q.AdvanceAll(ctx, log.NewNopLogger(), gl, nil); err != context.Canceled {
+		t.Errorf("got %v, want the advance cancelled", err)
+	}
+	if q.Position("tools/api", mr.IID) != 1 {
+		t.Error("got the queue moved forward after the cancellation")
+	}
+}
+
+func TestMergeQueuePolicy(t *testing.T) {
+	gl := gitlabfake.New()
+	p := gl.AddProject("tools/api")
+	mr, _ := gl.AddMergeRequest(p.ID, "one", "master", "JIRA-1 one")
+	gl.AddMergeRequestCommit(p.ID, mr.IID, "feat: one")
+	q := plugins.NewMergeQueue()
+	policy := &plugins.ChangePolicy{Commit: `^(feat|fix): `}
+	q.Enqueue(plugins.QueueEntry{Project: "tools/api", ProjectID: p.ID, MergeRequest: mr.IID, SourceBranch: "one", TargetBranch: "master", Policy: policy})
+	q.Hold("tools/api", mr.IID)
+	if err := q.Advance(context.Background(), log.NewNopLogger(), gl, nil, "tools/api", "master"); err != nil {
+		t.Fatal(err)
+	}
+
+	//a commit breaking the policy is pushed after the approval
+	gl.AddMergeRequestCommit(p.ID, mr.IID, "wip")
+	q.Release("tools/api", mr.IID)
+	if err := q.Advance(context.Background(), log.NewNopLogger(), gl, nil, "tools/api", "master"); err != nil {
+		t.Fatal(err)
+	}
+	if q.Position("tools/api", mr.IID) != 0 || gl.MergeRequest(p.ID, mr.IID).State != "opened" {
+		t.Error("got the merge request breaking the policy still queued or merged")
+	}
+	if notes := gl.Notes(p.ID, mr.IID); len(notes) != 1 || !strings.Contains(notes[0].Body, "change control policy") {
+		t.Errorf("got notes %+v", notes)
+	}
+}
+
+func TestOpenMergeQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitbot-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queue.json")
+
+	q, err := plugins.OpenMergeQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, b := range []string{"one", "two"} {
+		if _, _, err := q.Enqueue(plugins.QueueEntry{Project: "tools/api", ProjectID: 1, MergeRequest: i + 1, SourceBranch: b, TargetBranch: "master", Approver: "alice"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Hold("tools/api", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	//a restart finds the queue in the same order with its holds
+	reopened, err := plugins.OpenMergeQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	es := reopened.Entries()
+	if len(es) != 2 || es[0].MergeRequest != 1 || es[0].Approver != "alice" || es[1].MergeRequest != 2 || !es[1].Held {
+		t.Errorf("got entries %+v", es)
+	}
+
+	if _, removed, err := reopened.Remove("tools/api", 1); err != nil || !removed {
+		t.Fatalf("got %v, %v, want the merge request removed", removed, err)
+	}
+	if again, _ := plugins.OpenMergeQueue(path); reopened.Position("tools/api", 2) != 1 || again.Position("tools/api", 2) != 1 {
+		t.Error("got the removed merge request back after a restart")
+	}
+}
+
+func TestMergeQueueRequiredChecks(t *testing.T) {
+	gl := gitlabfake.New()
+	p := gl.AddProject("tools/api")
+	mr, _ := gl.AddMergeRequest(p.ID, "one", "master", "one")
+	gl.SetPipeline(p.ID, mr.IID, "running")
+	q := plugins.NewMergeQueue()
+	if _, _, err := q.Enqueue(plugins.QueueEntry{Project: "tools/api", ProjectID: p.ID, MergeRequest: mr.IID, SourceBranch: "one", TargetBranch: "master", RequiredChecks: []string{"unit"}}); err != nil {
+		t.Fatal(err)
+	}
+	advance := func() {
+		if err := q.Advance(context.Background(), log.NewNopLogger(), gl, nil, "tools/api", "master"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//the pipeline passed but the required check is still pending
+	got, _, _ := gl.GetMergeRequest(p.ID, mr.IID)
+	gl.AddCommitStatus(p.ID, got.SHA, "unit", "pending")
+	gl.SetPipeline(p.ID, mr.IID, "success")
+	advance()
+	if q.Position("tools/api", mr.IID) != 1 {
+		t.Fatal("got the merge request with a pending required check out of the queue")
+	}
+	gl.AddCommitStatus(p.ID, got.SHA, "unit", "failed")
+	advance()
+	if q.Position("tools/api", mr.IID) != 0 || gl.MergeRequest(p.ID, mr.IID).State != "opened" {
+		t.Error("got the merge request with a failed required check still queued or merged")
+	}
+	if notes := gl.Notes(p.ID, mr.IID); len(notes) != 1 || !strings.Contains(notes[0].Body, "required check `unit` failed") {
+		t.Errorf("got notes %+v", notes)
+	}
+}
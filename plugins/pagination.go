@@ -0,0 +1,234 @@
+package plugins
+
+import (
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+//perPage is the page size requested by the iterators, the maximum GitLab allows
+const perPage = 100
+
+//ForEachGroup calls fn for every group matching opt, following every page of the listing. Iteration stops at the
+//first error returned by fn or by GitLab.
+func ForEachGroup(gc GitLabClient, opt gitlab.ListGroupsOptions, fn func(*gitlab.Group) error) error {
+	return paginate(&opt.ListOptions, func() (*gitlab.Response, error) {
+		gs, resp, err := gc.ListGroups(&opt)
+		if err != nil {
+			return resp, err
+		}
+		for _, g := range gs {
+			if err := fn(g); err != nil {
+				return resp, err
+			}
+		}
+		return resp, nil
+	})
+}
+
+//ForEachGroupMember calls fn for every member of a group, following every page of the listing
+func ForEachGroupMember(gc GitLabClient, gid interface{}, fn func(*gitlab.GroupMember) error) error {
+	var opt gitlab.ListOptions
+	return paginate(&opt, func() (*gitlab.Response, error) {
+		ms, resp, err := gc.ListGroupMembers(gid, &opt)
+		if err != nil {
+			return resp, err
+		}
+		for _, m := range ms {
+			if err := fn(m); err != nil {
+				return resp, err
+			}
+		}
+		return resp, nil
+	})
+}
+
+//ForEachProjectMember calls fn for every member of a project, following every page of the listing
+func ForEachProjectMember(gc GitLabClient, pid interface{}, fn func(*gitlab.ProjectMember) error) error {
+	var opt gitlab.ListProjectMembersOptions
+	return paginate(&opt.ListOptions, func() (*gitlab.Response, error) {
+		ms, resp, err := gc.ListProjectMembers(pid, &opt)
+		if err != nil {
+			return resp, err
+		}
+		for _, m := range ms {
+			if err := fn(m); err != nil {
+				return resp, err
+			}
+		}
+		return resp, nil
+	})
+}
+
+//ForEachGroupProject calls fn for every project of a group, following every page of the listing
+func ForEachGroupProject(gc GitLabClient, gid interface{}, fn func(*gitlab.Project) error) error {
+	var opt gitlab.ListOptions
+	return paginate(&opt, func() (*gitlab.Response, error) {
+		ps, resp, err := gc.ListGroupProjects(gid, &opt)
+		if err != nil {
+			return resp, err
+		}
+		for _, p := range ps {
+			if err := fn(p); err != nil {
+				return resp, err
+			}
+		}
+		return resp, nil
+	})
+}
+
+//ForEachSubgroup calls fn for every direct subgroup of a group, following every page of the listing
+func ForEachSubgroup(gc GitLabClient, gid interface{}, fn func(*Group) error) error {
+	var opt gitlab.ListOptions
+	return paginate(&opt, func() (*gitlab.Response, error) {
+		gs, resp, err := gc.ListSubgroups(gid, &opt)
+		if err != nil {
+			return resp, err
+		}
+		for _, g := range gs {
+			if err := fn(g); err != nil {
+				return resp, err
+			}
+		}
+		return resp, nil
+	})
+}
+
+//ForEachProjectHook calls fn for every hook of a project, following every page of the listing
+func ForEachProjectHook(gc GitLabClient, pid interface{}, fn func(*gitlab.ProjectHook) error) error {
+	var opt gitlab.ListProjectHooksOptions
+	return paginate(&opt.ListOptions, func() (*gitlab.Response, error) {
+		hs, resp, err := gc.ListProjectHooks(pid, &opt)
+		if err != nil {
+			return resp, err
+		}
+		for _, h := range hs {
+			if err := fn(h); err != nil {
+				return resp, err
+			}
+		}
+		return resp, nil
+	})
+}
+
+//ForEachGroupHook calls fn for every hook of a group, following every page of the listing
+func ForEachGroupHook(gc GitLabClient, gid interface{}, fn func(*gitlab.ProjectHook) error) error {
+	var opt gitlab.ListOptions
+	return paginate(&opt, func() (*gitlab.Response, error) {
+		hs, resp, err := gc.ListGroupHooks(gid, &opt)
+		if err != nil {
+			return resp, err
+		}
+		for _, h := range hs {
+			if err := fn(h); err != nil {
+				return resp, err
+			}
+		}
+		return resp, nil
+	})
+}
+
+//ForEachSystemHook calls fn for every system hook, following every page of the listing
+func ForEachSystemHook(gc GitLabClient, fn func(*gitlab.ProjectHook) error) error {
+	var opt gitlab.ListOptions
+	return paginate(&opt, func() (*gitlab.Response, error) {
+		hs, resp, err := gc.ListSystemHooks(&opt)
+		if err != nil {
+			return resp, err
+		}
+		for _, h := range hs {
+			if err := fn(h); err != nil {
+				return resp, err
+			}
+		}
+		return resp, nil
+	})
+}
+
+//paginate requests pages until the response has no next page. opt is updated before each request.
+func paginate(opt *gitlab.ListOptions, page func() (*gitlab.Response, error)) error {
+	if opt.PerPage == 0 {
+		opt.PerPage = perPage
+	}
+	if opt.Page == 0 {
+		opt.Page = 1
+	}
+	for {
+		resp, err := page()
+		if err != nil {
+			return err
+		}
+		//stop when GitLab does not send pagination headers, e.g. for more than 10000 items
+		if resp == nil || resp.NextPage <= opt.Page {
+			return nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+//ForEachProtectedBranch calls fn for every protected branch of a project, following every page of the listing
+func ForEachProtectedBranch(gc GitLabClient, pid interface{}, fn func(*ProtectedBranch) error) error {
+	var opt gitlab.ListOptions
+	return paginate(&opt, func() (*gitlab.Response, error) {
+		bs, resp, err := gc.ListProtectedBranches(pid, &opt)
+		if err != nil {
+			return resp, err
+		}
+		for _, b := range bs {
+			if err := fn(b); err != nil {
+				return resp, err
+			}
+		}
+		return resp, nil
+	})
+}
+
+//ForEachPipelineJob calls fn for every job of a pipeline, following every page of the listing
+func ForEachPipelineJob(gc GitLabClient, pid interface{}, pipeline int, fn func(*Job) error) error {
+	var opt gitlab.ListOptions
+	return paginate(&opt, func() (*gitlab.Response, error) {
+		js, resp, err := gc.ListPipelineJobs(pid, pipeline, &opt)
+		if err != nil {
+			return resp, err
+		}
+		for _, j := range js {
+			if err := fn(j); err != nil {
+				return resp, err
+			}
+		}
+		return resp, nil
+	})
+}
+
+//ForEachCommitStatus calls fn for the latest status of every job and external check of a commit, following every
+//page of the listing
+func ForEachCommitStatus(gc GitLabClient, pid interface{}, sha string, fn func(*gitlab.CommitStatus) error) error {
+	var opt gitlab.ListOptions
+	return paginate(&opt, func() (*gitlab.Response, error) {
+		cs, resp, err := gc.ListCommitStatuses(pid, sha, &opt)
+		if err != nil {
+			return resp, err
+		}
+		for _, s := range cs {
+			if err := fn(s); err != nil {
+				return resp, err
+			}
+		}
+		return resp, nil
+	})
+}
+
+//ForEachMergeRequestCommit calls fn for every commit of a merge request, following every page of the listing
+func ForEachMergeRequestCommit(gc GitLabClient, pid interface{}, mergeRequest int, fn func(*gitlab.Commit) error) error {
+	var opt gitlab.ListOptions
+	return paginate(&opt, func() (*gitlab.Response, error) {
+		cs, resp, err := gc.ListMergeRequestCommits(pid, mergeRequest, &opt)
+		if err != nil {
+			return resp, err
+		}
+		for _, c := range cs {
+			if err := fn(c); err != nil {
+				return resp, err
+			}
+		}
+		return resp, nil
+	})
+}
@@ -0,0 +1,46 @@
+package plugins_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/cosminilie/gitbot/gitlabfake"
+	"github.com/cosminilie/gitbot/plugins"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+func TestIteratorsFollowEveryPage(t *testing.T) {
+	gl := gitlabfake.New()
+	g := gl.AddGroup("platform")
+	for i := 0; i < 130; i++ {
+		if _, err := gl.AddGroupMember(g.ID, fmt.Sprintf("user%d", i), gitlab.DeveloperPermissions); err != nil {
+			t.Fatal(err)
+		}
+		p := gl.AddProject(fmt.Sprintf("platform/service%d", i))
+		gl.AddProjectHook(p.ID, &plugins.HookOptions{URL: gitlab.String("http://bot/hook")})
+	}
+	for i := 0; i < 25; i++ {
+		gl.AddGroup(fmt.Sprintf("team%d", i))
+	}
+
+	var members, projects, groups, hooks int
+	if err := plugins.ForEachGroupMember(gl, "platform", func(*gitlab.GroupMember) error { members++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if err := plugins.ForEachGroupProject(gl, "platform", func(*gitlab.Project) error { projects++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if err := plugins.ForEachGroup(gl, gitlab.ListGroupsOptions{ListOptions: gitlab.ListOptions{PerPage: 10}}, func(*gitlab.Group) error { groups++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if err := plugins.ForEachProjectHook(gl, "platform/service7", func(*gitlab.ProjectHook) error { hooks++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if members != 130 || projects != 130 || groups != 26 || hooks != 1 {
+		t.Errorf("got %d members, %d projects, %d groups and %d hooks, want 130, 130, 26 and 1", members, projects, groups, hooks)
+	}
+
+	if err := plugins.ForEachGroupMember(gl, "missing", func(*gitlab.GroupMember) error { return nil }); err == nil {
+		t.Error("listing the members of a missing group did not fail")
+	}
+}
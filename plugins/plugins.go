@@ -1,64 +1,190 @@
 package plugins
 
 import (
+	"context"
+	"sort"
 	"strings"
 	"sync"
 
+	"github.com/cosminilie/gitbot/audit"
 	"github.com/cosminilie/gitbot/gitlabhook"
+	"github.com/cosminilie/gitbot/logging"
 
 	"github.com/go-kit/kit/log"
-	gitlab "github.com/xanzy/go-gitlab"
 )
 
 var (
-	allPlugins                = map[string]struct{}{}
-	mergeCommentEventHandlers = map[string]MergeCommentEventHandler{}
-	groupHandlers             = map[string]GroupHandler{}
+	allPlugins = map[string]struct{}{}
+	//handlers are the registered handlers keyed by the event they handle and the plugin name
+	handlers = map[EventType]map[string]EventHandler{}
 )
 
+//EventType is the kind of event a handler is registered for
+type EventType string
+
+const (
+	//GroupEvent is the scheduled run of a plugin on a group, the event is the name of the group
+	GroupEvent EventType = "group"
+	//MergeCommentEvent is a comment on a merge request, the event is a gitlabhook.MergeRequestCommentEvent
+	MergeCommentEvent EventType = "merge_comment"
+	//PushEvent is a push to a branch, the event is a gitlabhook.PushEvent
+	PushEvent EventType = "push"
+	//PipelineEvent is a pipeline status change, the event is a gitlabhook.PipelineEvent
+	PipelineEvent EventType = "pipeline"
+	//MergeRequestEvent is a merge request being opened, updated, closed or merged, the event is a
+	//gitlabhook.MergeRequestEvent
+	MergeRequestEvent EventType = "merge_request"
+)
+
+//EventHandler func that handle an event of the type it is registered for. The context is cancelled when the plugin
+//times out or the bot stops.
+type EventHandler func(ctx context.Context, pc *PluginClient, event interface{}) error
+
+//register registers the handler of a plugin for an event type in the global handler register
+func register(t EventType, name string, fn EventHandler) {
+	allPlugins[name] = struct{}{}
+	if handlers[t] == nil {
+		handlers[t] = map[string]EventHandler{}
+	}
+	handlers[t][name] = fn
+}
+
 //Repo struct in loading HCL configuration. Part of the config struct
 type Repo struct {
-	Name      string   `hcl:",key"`
-	Plugins   []string `hcl:"plugins"`
-	Approvers []string `hcl:"approvers"`
+	Name       string           `hcl:",key"`
+	Plugins    []string         `hcl:"plugins"`
+	Approvers  []string         `hcl:"approvers"`
+	DropRights DropRightsPolicy `hcl:"drop_rights"` // policy enforced on the group by the drop_rights plugin
+	//ProtectedBranches are the branches the protect_branches plugin keeps protected on the projects of the group
+	ProtectedBranches []BranchProtection `hcl:"protected_branch,expand"`
+	//RequiredChecks are the jobs and external checks that must pass on the last commit of a merge request for lgtm to merge it
+	RequiredChecks []string `hcl:"required-checks"`
+	//Policy is the change control policy the policy plugin checks the merge requests against
+	Policy ChangePolicy `hcl:"policy"`
 }
 
-type GroupHandler func(*PluginClient, string) error
+//GroupHandler func that handle a group. The context is cancelled when the plugin times out or the bot stops.
+type GroupHandler func(context.Context, *PluginClient, string) error
 
+//RegisterGroupHandler registers GroupHandler in the global handler register
 func RegisterGroupHandler(name string, fn GroupHandler) {
-	allPlugins[name] = struct{}{}
-	groupHandlers[name] = fn
+	register(GroupEvent, name, func(ctx context.Context, pc *PluginClient, event interface{}) error {
+		return fn(ctx, pc, event.(string))
+	})
+}
+
+//GroupHandlerNames returns the names of the plugins with a GroupHandler, sorted
+func GroupHandlerNames() []string {
+	var names []string
+	for name := range handlers[GroupEvent] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
 // PluginClient may be used concurrently, so each entry must be thread-safe.
 type PluginClient struct {
-	GitLabClient *gitlab.Client
+	GitLabClient GitLabClient
 	Repos        map[string]Repo
-	Pmut         sync.Mutex
+	GroupRepos   map[string]Repo
+	Pmut         *sync.Mutex
+	//Audit records the changes made by plugins. It may be nil.
+	Audit *audit.Log
+	//Grants are the temporary access grants of the access plugin, honored by the drop_rights sweep
+	Grants *Grants
+	//Groups resolves the full path of the configured groups to their ID
+	Groups *GroupCache
+	//Queue holds the merge requests queued by lgtm on the repos with the merge_queue plugin. It has its own locks,
+	//don't hold Pmut while moving a queue forward.
+	Queue *MergeQueue
+	//Protected holds the IDs of the projects protect_branches already set up, guarded by Pmut
+	Protected map[int]bool
+	//Logger is tagged with the repo, event and plugin being handled. Use logging.Error and friends to set the level.
+	Logger log.Logger
+}
+
+//WithLogger returns a copy of the client logging to logger. The copy shares the repos and the lock of pc.
+func (pc *PluginClient) WithLogger(logger log.Logger) *PluginClient {
+	c := *pc
+	c.Logger = logger
+	return &c
+}
+
+//WithContext returns a copy of the client whose GitLab calls are made on behalf of ctx, see WithContext.
+func (pc *PluginClient) WithContext(ctx context.Context) *PluginClient {
+	c := *pc
+	c.GitLabClient = WithContext(ctx, pc.GitLabClient)
+	return &c
 }
 
-//MergeCommentEventHandler func that handle merge request comments
-type MergeCommentEventHandler func(*PluginClient, gitlabhook.MergeRequestCommentEvent) error
+//MergeCommentEventHandler func that handle merge request comments. The context is cancelled when the plugin times out
+//or the bot stops.
+type MergeCommentEventHandler func(context.Context, *PluginClient, gitlabhook.MergeRequestCommentEvent) error
 
 //RegisterMergeCommentEventHandler registers MergeCommentEventHandler in the global handler register
 func RegisterMergeCommentEventHandler(name string, fn MergeCommentEventHandler) {
-	allPlugins[name] = struct{}{}
-	mergeCommentEventHandlers[name] = fn
+	register(MergeCommentEvent, name, func(ctx context.Context, pc *PluginClient, event interface{}) error {
+		return fn(ctx, pc, event.(gitlabhook.MergeRequestCommentEvent))
+	})
+}
+
+//PushEventHandler func that handle pushes to branches. The context is cancelled when the plugin times out or the bot
+//stops.
+type PushEventHandler func(context.Context, *PluginClient, gitlabhook.PushEvent) error
+
+//RegisterPushEventHandler registers PushEventHandler in the global handler register
+func RegisterPushEventHandler(name string, fn PushEventHandler) {
+	register(PushEvent, name, func(ctx context.Context, pc *PluginClient, event interface{}) error {
+		return fn(ctx, pc, event.(gitlabhook.PushEvent))
+	})
+}
+
+//PipelineEventHandler func that handle pipeline status changes. The context is cancelled when the plugin times out or
+//the bot stops.
+type PipelineEventHandler func(context.Context, *PluginClient, gitlabhook.PipelineEvent) error
+
+//RegisterPipelineEventHandler registers PipelineEventHandler in the global handler register
+func RegisterPipelineEventHandler(name string, fn PipelineEventHandler) {
+	register(PipelineEvent, name, func(ctx context.Context, pc *PluginClient, event interface{}) error {
+		return fn(ctx, pc, event.(gitlabhook.PipelineEvent))
+	})
+}
+
+//MergeRequestEventHandler func that handle merge requests being opened, updated, closed or merged. The context is
+//cancelled when the plugin times out or the bot stops.
+type MergeRequestEventHandler func(context.Context, *PluginClient, gitlabhook.MergeRequestEvent) error
+
+//RegisterMergeRequestEventHandler registers MergeRequestEventHandler in the global handler register
+func RegisterMergeRequestEventHandler(name string, fn MergeRequestEventHandler) {
+	register(MergeRequestEvent, name, func(ctx context.Context, pc *PluginClient, event interface{}) error {
+		return fn(ctx, pc, event.(gitlabhook.MergeRequestEvent))
+	})
 }
 
 //NewPluginAgent creates a new plugin agent
-func NewPluginAgent(logger log.Logger, gci *gitlab.Client, pluginReposChan chan Repo) *PluginAgent {
+func NewPluginAgent(logger log.Logger, gci GitLabClient, pluginReposChan chan Repo) *PluginAgent {
 	agent := &PluginAgent{}
 	agent.PluginClient.GitLabClient = gci
+	agent.PluginClient.Pmut = &sync.Mutex{}
+	agent.PluginClient.Logger = logger
 	agent.logger = logger
 	agent.PluginClient.Repos = make(map[string]Repo)
+	agent.PluginClient.GroupRepos = make(map[string]Repo)
+	agent.PluginClient.Grants = NewGrants()
+	agent.PluginClient.Groups = NewGroupCache(DefaultGroupCacheTTL)
+	agent.PluginClient.Queue = NewMergeQueue()
+	agent.PluginClient.Protected = make(map[int]bool)
 	agent.Repos = make(map[string]Repo)
 	agent.GroupRepos = make(map[string]Repo)
 
 	go func() {
+		repos := expandRepo(pluginReposChan)
 		agent.mut.Lock()
 		defer agent.mut.Unlock()
-		for k, v := range expandRepo(pluginReposChan) {
+		agent.Pmut.Lock()
+		defer agent.Pmut.Unlock()
+		for k, v := range repos {
 			if _, ok := agent.Repos[k]; !ok {
 				agent.Repos[k] = v
 				agent.PluginClient.Repos[k] = v
@@ -88,56 +214,168 @@ type PluginAgent struct {
 	logger     log.Logger
 }
 
-// GlobalHandlers returns a map of plugin names to apply for all repos without waiting for events.
-func (pa *PluginAgent) GroupHandlers(repo string) map[string]GroupHandler {
+//SetRepos replaces the repos handled by the agent, e.g. after the groups were expanded again. It returns the
+//names of the repos that were added and removed.
+func (pa *PluginAgent) SetRepos(repos []Repo) (added, removed []string) {
 	pa.mut.Lock()
 	defer pa.mut.Unlock()
+	pa.Pmut.Lock()
+	defer pa.Pmut.Unlock()
 
-	hs := map[string]GroupHandler{}
-	for _, p := range pa.getPlugins(repo) {
-		pa.logger.Log(
-			"handler", "GlobalHandlers",
-			"Plugin", p,
-		)
-
-		if h, ok := groupHandlers[p]; ok {
-			pa.logger.Log(
-				"handler", "GlobalHandlers",
-				"Plugin", p,
-				"Action", "AddingHandlerforPlugin",
-			)
-			hs[p] = h
+	m := make(map[string]Repo, len(repos))
+	for _, r := range repos {
+		m[r.Name] = r
+		if _, ok := pa.Repos[r.Name]; !ok {
+			added = append(added, r.Name)
 		}
 	}
+	for name := range pa.Repos {
+		if _, ok := m[name]; !ok {
+			removed = append(removed, name)
+			delete(pa.Repos, name)
+			delete(pa.PluginClient.Repos, name)
+		}
+	}
+	for name, r := range m {
+		pa.Repos[name] = r
+		pa.PluginClient.Repos[name] = r
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
 
-	return hs
+//SetGroupRepos replaces the groups the group handlers run on
+func (pa *PluginAgent) SetGroupRepos(groups []Repo) {
+	pa.mut.Lock()
+	defer pa.mut.Unlock()
+	pa.Pmut.Lock()
+	defer pa.Pmut.Unlock()
+
+	pa.GroupRepos = make(map[string]Repo, len(groups))
+	//the plugin client map is shared with the copies of the client, it is updated in place
+	for name := range pa.PluginClient.GroupRepos {
+		delete(pa.PluginClient.GroupRepos, name)
+	}
+	for _, g := range groups {
+		pa.GroupRepos[g.Name] = g
+		pa.PluginClient.GroupRepos[g.Name] = g
+	}
 }
 
-// StatusEventHandlers returns a map of plugin names to merge request comments handler for the repo.
-func (pa *PluginAgent) MergeCommentEventHandlers(repo string) map[string]MergeCommentEventHandler {
+//AddGroupRepo adds a group the group handlers run on
+func (pa *PluginAgent) AddGroupRepo(group Repo) {
 	pa.mut.Lock()
 	defer pa.mut.Unlock()
+	pa.Pmut.Lock()
+	defer pa.Pmut.Unlock()
 
-	hs := map[string]MergeCommentEventHandler{}
+	pa.GroupRepos[group.Name] = group
+	pa.PluginClient.GroupRepos[group.Name] = group
+}
+
+//RepoNames returns the sorted names of the repos handled by the agent
+func (pa *PluginAgent) RepoNames() []string {
+	pa.mut.Lock()
+	defer pa.mut.Unlock()
+
+	return sortedKeys(pa.Repos)
+}
+
+//HasRepo reports whether the agent handles the repo
+func (pa *PluginAgent) HasRepo(repo string) bool {
+	pa.mut.Lock()
+	defer pa.mut.Unlock()
+
+	_, ok := pa.Repos[repo]
+	return ok
+}
+
+//GroupRepoNames returns the sorted names of the groups the group handlers run on
+func (pa *PluginAgent) GroupRepoNames() []string {
+	pa.mut.Lock()
+	defer pa.mut.Unlock()
+
+	return sortedKeys(pa.GroupRepos)
+}
+
+func sortedKeys(m map[string]Repo) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//Handlers returns a map of plugin names to the handlers of an event type for the repo, or for the group with
+//GroupEvent.
+func (pa *PluginAgent) Handlers(t EventType, repo string) map[string]EventHandler {
+	pa.mut.Lock()
+	defer pa.mut.Unlock()
+
+	hs := map[string]EventHandler{}
 	for _, p := range pa.getPlugins(repo) {
-		pa.logger.Log(
-			"handler", "MergeCommentEventHandlers",
-			"Plugin", p,
-		)
-
-		if h, ok := mergeCommentEventHandlers[p]; ok {
-			pa.logger.Log(
-				"handler", "MergeCommentEventHandlers",
+		if h, ok := handlers[t][p]; ok {
+			logging.Debug(pa.logger).Log(
+				"handler", "Handlers",
+				"Event", t,
 				"Plugin", p,
 				"Action", "AddingHandlerforPlugin",
 			)
 			hs[p] = h
 		}
 	}
-
 	return hs
 }
 
+//HookEvents are the webhook events the plugins of a repo need
+type HookEvents struct {
+	Push          bool
+	TagPush       bool
+	MergeRequests bool
+	Note          bool
+	Pipeline      bool
+}
+
+//Any reports whether at least one event is needed
+func (e HookEvents) Any() bool {
+	return e != HookEvents{}
+}
+
+//Or returns the events needed by either e or o
+func (e HookEvents) Or(o HookEvents) HookEvents {
+	return HookEvents{
+		Push:          e.Push || o.Push,
+		TagPush:       e.TagPush || o.TagPush,
+		MergeRequests: e.MergeRequests || o.MergeRequests,
+		Note:          e.Note || o.Note,
+		Pipeline:      e.Pipeline || o.Pipeline,
+	}
+}
+
+//pluginHookEvents returns the events the handlers registered by a plugin receive
+func pluginHookEvents(plugin string) HookEvents {
+	var e HookEvents
+	_, e.Note = handlers[MergeCommentEvent][plugin]
+	_, e.Push = handlers[PushEvent][plugin]
+	_, e.Pipeline = handlers[PipelineEvent][plugin]
+	_, e.MergeRequests = handlers[MergeRequestEvent][plugin]
+	return e
+}
+
+//HookEvents returns the webhook events needed by the plugins enabled on the repo
+func (pa *PluginAgent) HookEvents(repo string) HookEvents {
+	pa.mut.Lock()
+	defer pa.mut.Unlock()
+
+	var e HookEvents
+	for _, p := range pa.getPlugins(repo) {
+		e = e.Or(pluginHookEvents(p))
+	}
+	return e
+}
+
 // getPlugins returns a list of plugins that are enabled on a given (org, repository).
 func (pa *PluginAgent) getPlugins(repo string) []string {
 	var plugins []string
@@ -147,7 +385,7 @@ func (pa *PluginAgent) getPlugins(repo string) []string {
 	plugins = append(plugins, plugs.Plugins...)
 	plugins = append(plugins, groupPlugs.Plugins...)
 
-	pa.logger.Log(
+	logging.Debug(pa.logger).Log(
 		"plugins", strings.Join(plugins, ", "),
 		"Repo", repo,
 	)
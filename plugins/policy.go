@@ -0,0 +1,177 @@
+package plugins
+
+import (
+	"fmt"
+	"strings"
+
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+//accessLevels maps the names used in the configuration to GitLab access levels
+var accessLevels = map[string]gitlab.AccessLevelValue{
+	"guest":      gitlab.GuestPermissions,
+	"reporter":   gitlab.ReporterPermissions,
+	"developer":  gitlab.DeveloperPermissions,
+	"master":     gitlab.MasterPermissions,
+	"maintainer": gitlab.MasterPermissions,
+	"owner":      gitlab.OwnerPermission,
+}
+
+//ParseAccessLevel returns the access level named guest, reporter, developer, maintainer (or master) or owner
+func ParseAccessLevel(name string) (gitlab.AccessLevelValue, error) {
+	l, ok := accessLevels[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown access level %q", name)
+	}
+	return l, nil
+}
+
+//NoAccess is the access level allowed to push or merge to a protected branch nobody can push or merge to
+const NoAccess gitlab.AccessLevelValue = 0
+
+//AccessLevelName returns the name of an access level
+func AccessLevelName(l gitlab.AccessLevelValue) string {
+	switch l {
+	case NoAccess:
+		return "none"
+	case gitlab.GuestPermissions:
+		return "guest"
+	case gitlab.ReporterPermissions:
+		return "reporter"
+	case gitlab.DeveloperPermissions:
+		return "developer"
+	case gitlab.MasterPermissions:
+		return "maintainer"
+	case gitlab.OwnerPermission:
+		return "owner"
+	}
+	return fmt.Sprintf("level %d", int(l))
+}
+
+//DropRightsPolicy struct in loading HCL configuration. It sets which members of a group the drop_rights plugin
+//downgrades and to which access level.
+type DropRightsPolicy struct {
+	//TargetLevel is the access level given to the members above MaxLevel. Defaults to reporter.
+	TargetLevel string `hcl:"target-level"`
+	//MaxLevel is the highest access level allowed. Defaults to TargetLevel.
+	MaxLevel string `hcl:"max-level"`
+	//ExemptUsers are never downgraded, e.g. bots and break-glass administrators
+	ExemptUsers []string `hcl:"exempt-users"`
+	//ExemptGroups are the full paths of the GitLab groups whose members are never downgraded
+	ExemptGroups []string `hcl:"exempt-groups"`
+	//IncludeOwners also downgrades the owners of the group, they are exempt otherwise
+	IncludeOwners bool `hcl:"include-owners"`
+	//Projects also sweeps the members added directly to the projects of the group
+	Projects bool `hcl:"projects"`
+}
+
+//Levels returns the target and maximum access levels of the policy
+func (p DropRightsPolicy) Levels() (target, max gitlab.AccessLevelValue, err error) {
+	target = gitlab.ReporterPermissions
+	if p.TargetLevel != "" {
+		if target, err = ParseAccessLevel(p.TargetLevel); err != nil {
+			return 0, 0, fmt.Errorf("invalid target-level: %s", err)
+		}
+	}
+	max = target
+	if p.MaxLevel != "" {
+		if max, err = ParseAccessLevel(p.MaxLevel); err != nil {
+			return 0, 0, fmt.Errorf("invalid max-level: %s", err)
+		}
+	}
+	if target > max {
+		return 0, 0, fmt.Errorf("target-level %s is above max-level %s", AccessLevelName(target), AccessLevelName(max))
+	}
+	return target, max, nil
+}
+
+//BranchProtection struct in loading HCL configuration. It sets who the protect_branches plugin lets push and merge to
+//the branches matching its name, e.g. "master" or "release/*".
+type BranchProtection struct {
+	Name string `hcl:",key"`
+	//PushLevel and MergeLevel are none, developer or maintainer. PushLevel defaults to none so that changes go through
+	//merge requests, MergeLevel to maintainer.
+	PushLevel  string `hcl:"push-level"`
+	MergeLevel string `hcl:"merge-level"`
+}
+
+//Levels returns the access levels allowed to push and merge
+func (b BranchProtection) Levels() (push, merge gitlab.AccessLevelValue, err error) {
+	if push, err = branchAccessLevel(b.PushLevel, NoAccess); err != nil {
+		return 0, 0, fmt.Errorf("invalid push-level of branch %q: %s", b.Name, err)
+	}
+	if merge, err = branchAccessLevel(b.MergeLevel, gitlab.MasterPermissions); err != nil {
+		return 0, 0, fmt.Errorf("invalid merge-level of branch %q: %s", b.Name, err)
+	}
+	return push, merge, nil
+}
+
+//branchAccessLevel parses the levels GitLab allows on protected branches, an empty name is the default level
+func branchAccessLevel(name string, def gitlab.AccessLevelValue) (gitlab.AccessLevelValue, error) {
+	switch strings.ToLower(name) {
+	case "":
+		return def, nil
+	case "none", "no one":
+		return NoAccess, nil
+	}
+	l, err := ParseAccessLevel(name)
+	if err != nil {
+		return 0, err
+	}
+	if l != gitlab.DeveloperPermissions && l != gitlab.MasterPermissions {
+		return 0, fmt.Errorf("%s is not allowed on protected branches", name)
+	}
+	return l, nil
+}
+
+//Sweep decides which members a drop_rights policy downgrades
+type Sweep struct {
+	Target, Max   gitlab.AccessLevelValue
+	exempt        map[string]bool
+	includeOwners bool
+}
+
+//NewSweep resolves the levels and the exempt users of a policy. The user of the bot is always exempt.
+func NewSweep(cl GitLabClient, policy DropRightsPolicy) (*Sweep, error) {
+	target, max, err := policy.Levels()
+	if err != nil {
+		return nil, err
+	}
+	sw := &Sweep{
+		Target:        target,
+		Max:           max,
+		exempt:        make(map[string]bool),
+		includeOwners: policy.IncludeOwners,
+	}
+	for _, u := range policy.ExemptUsers {
+		sw.exempt[strings.ToLower(u)] = true
+	}
+
+	bot, _, err := cl.CurrentUser()
+	if err != nil {
+		return nil, err
+	}
+	sw.exempt[strings.ToLower(bot.Username)] = true
+
+	for _, g := range policy.ExemptGroups {
+		err := ForEachGroupMember(cl, g, func(m *gitlab.GroupMember) error {
+			sw.exempt[strings.ToLower(m.Username)] = true
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sw, nil
+}
+
+//Exempt reports whether a member is never downgraded: the exempt users and the owners, unless the policy includes
+//them
+func (sw *Sweep) Exempt(username string, level gitlab.AccessLevelValue) bool {
+	return sw.exempt[strings.ToLower(username)] || (level >= gitlab.OwnerPermission && !sw.includeOwners)
+}
+
+//Downgrades reports whether a member with the access level has to be lowered to the target level
+func (sw *Sweep) Downgrades(username string, level gitlab.AccessLevelValue) bool {
+	return level > sw.Max && !sw.Exempt(username, level)
+}
@@ -0,0 +1,140 @@
+package policy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/cosminilie/gitbot/gitlabhook"
+	"github.com/cosminilie/gitbot/logging"
+	"github.com/cosminilie/gitbot/plugins"
+	"github.com/go-kit/kit/log"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+const (
+	pluginName = plugins.PolicyPlugin
+	//maxDescription is the longest description GitLab accepts on a commit status
+	maxDescription = 255
+)
+
+func init() {
+	plugins.RegisterMergeRequestEventHandler(pluginName, handleMergeRequestEvent)
+}
+
+//PolicyError is an error struct which implements the error interface
+type PolicyError struct {
+	Repo         string
+	MergeRequest int
+	User         string
+	Action       string
+	Condition    string
+	Result       error
+}
+
+func (e PolicyError) Error() string {
+	return fmt.Sprintf("PolicyError:\nRepo:%s,\nMergeRequest:%d,\nUser:%s,\nAction:%s,\nCondition:%s,\nResult:%s,\n", e.Repo, e.MergeRequest, e.User, e.Action, e.Condition, e.Result)
+}
+
+func handleMergeRequestEvent(ctx context.Context, pc *plugins.PluginClient, me gitlabhook.MergeRequestEvent) error {
+	pc.Pmut.Lock()
+	defer pc.Pmut.Unlock()
+
+	r, ok := pc.Repos[me.Project.PathWithNamespace]
+	if !ok {
+		return fmt.Errorf("Could not find any plugin for this repo: %s", me.Project.PathWithNamespace)
+	}
+	return handle(pc.Logger, pc.GitLabClient, me, r.Policy)
+}
+
+//handle checks an open merge request against the policy of its repo and reports the result with a commit status on
+//its last commit and, when the policy has one, a label
+func handle(logger log.Logger, cl plugins.GitLabClient, me gitlabhook.MergeRequestEvent, policy plugins.ChangePolicy) error {
+	mr := me.ObjectAttributes
+	if mr.State != "opened" || mr.LastCommit.ID == "" {
+		return nil
+	}
+	project := me.Project.PathWithNamespace
+	fail := func(action string, err error) error {
+		return PolicyError{
+			Repo:         project,
+			MergeRequest: mr.IID,
+			User:         me.User.Username,
+			Action:       action,
+			Condition:    "MergeRequest.State=opened",
+			Result:       err,
+		}
+	}
+
+	violations, err := plugins.CheckPolicy(cl, me.Project.ID, mr.IID, mr.Title, mr.Description, policy)
+	if err != nil {
+		return fail("CheckPolicy", err)
+	}
+	logging.Debug(logger).Log(
+		"Repo", project,
+		"Plugin", pluginName,
+		"MergeRequest", mr.IID,
+		"SHA", mr.LastCommit.ID,
+		"Violations", strings.Join(violations, "; "),
+	)
+
+	state, description := gitlab.Success, "Complies with the change control policy"
+	if len(violations) > 0 {
+		state, description = gitlab.Failed, truncate(strings.Join(violations, "; "), maxDescription)
+	}
+	_, _, err = cl.SetCommitStatus(me.Project.ID, mr.LastCommit.ID, &gitlab.SetCommitStatusOptions{
+		State:       state,
+		Ref:         gitlab.String(mr.SourceBranch),
+		Name:        gitlab.String(policy.StatusName()),
+		Description: gitlab.String(description),
+	})
+	if err != nil {
+		return fail("SetCommitStatus", err)
+	}
+
+	if policy.Label == "" {
+		return nil
+	}
+	if err := label(cl, me.Project.ID, mr.IID, policy.Label, len(violations) > 0); err != nil {
+		return fail("UpdateMergeRequest", err)
+	}
+	return nil
+}
+
+//label adds the label to a merge request breaking the policy and removes it from one complying with it
+func label(cl plugins.GitLabClient, pid interface{}, iid int, label string, add bool) error {
+	current, _, err := cl.GetMergeRequest(pid, iid)
+	if err != nil {
+		return err
+	}
+	var labels []string
+	has := false
+	for _, l := range current.Labels {
+		if strings.EqualFold(l, label) {
+			has = true
+			continue
+		}
+		labels = append(labels, l)
+	}
+	if has == add {
+		return nil
+	}
+	if add {
+		labels = append(labels, label)
+	}
+	_, _, err = cl.UpdateMergeRequest(pid, iid, &plugins.UpdateMergeRequestOptions{Labels: gitlab.String(strings.Join(labels, ","))})
+	return err
+}
+
+//truncate shortens s to at most n bytes without splitting a character
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	i := n - len("...")
+	for i > 0 && !utf8.RuneStart(s[i]) {
+		i--
+	}
+	return s[:i] + "..."
+}
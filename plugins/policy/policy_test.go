@@ -0,0 +1,80 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cosminilie/gitbot/gitlabfake"
+	"github.com/cosminilie/gitbot/gitlabhook"
+	"github.com/cosminilie/gitbot/plugins"
+	"github.com/go-kit/kit/log"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+func TestPolicy(t *testing.T) {
+	gl := gitlabfake.New()
+	p := gl.AddProject("tools/api")
+	mr, _ := gl.AddMergeRequest(p.ID, "alert", "master", "Add disk alert")
+	commit, _ := gl.AddMergeRequestCommit(p.ID, mr.IID, "feat: add disk usage alert")
+	policy := plugins.ChangePolicy{Title: `^JIRA-[0-9]+ `, Commit: `^(feat|fix): `, Label: "non-compliant"}
+
+	event := func(title, sha string) gitlabhook.MergeRequestEvent {
+		return gitlabhook.MergeRequestEvent{
+			Project: gitlabhook.Project{ID: p.ID, PathWithNamespace: "tools/api"},
+			ObjectAttributes: gitlabhook.MergeRequest{
+				IID:          mr.IID,
+				Title:        title,
+				State:        "opened",
+				SourceBranch: "alert",
+				LastCommit:   gitlabhook.LastCommit{ID: sha},
+			},
+		}
+	}
+	status := func(sha string) *gitlab.CommitStatus {
+		cs, _, err := gl.ListCommitStatuses(p.ID, sha, nil)
+		if err != nil || len(cs) != 1 {
+			t.Fatalf("got statuses %+v, %v", cs, err)
+		}
+		return cs[0]
+	}
+
+	if err := handle(log.NewNopLogger(), gl, event("Add disk alert", commit.ID), policy); err != nil {
+		t.Fatal(err)
+	}
+	if s := status(commit.ID); s.Status != "failed" || s.Name != plugins.DefaultPolicyStatus || !strings.Contains(s.Description, "title") {
+		t.Errorf("got status %+v", s)
+	}
+	if labels := gl.MergeRequest(p.ID, mr.IID).Labels; len(labels) != 1 || labels[0] != "non-compliant" {
+		t.Errorf("got labels %v", labels)
+	}
+
+	//the title is fixed, the label goes away
+	if err := handle(log.NewNopLogger(), gl, event("JIRA-7 Add disk alert", commit.ID), policy); err != nil {
+		t.Fatal(err)
+	}
+	if s := status(commit.ID); s.Status != "success" {
+		t.Errorf("got status %+v", s)
+	}
+	if labels := gl.MergeRequest(p.ID, mr.IID).Labels; len(labels) != 0 {
+		t.Errorf("got labels %v", labels)
+	}
+
+	//closed merge requests are left alone
+	closed := event("Add disk alert", "other")
+	closed.ObjectAttributes.State = "closed"
+	if err := handle(log.NewNopLogger(), gl, closed, policy); err != nil {
+		t.Fatal(err)
+	}
+	if cs, _, _ := gl.ListCommitStatuses(p.ID, "other", nil); len(cs) != 0 {
+		t.Errorf("got statuses %+v on a closed merge request", cs)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	if got := truncate("héllo wörld", 5); got != "h..." {
+		t.Errorf("got %q", got)
+	}
+	if got := truncate("short", 8); got != "short" {
+		t.Errorf("got %q", got)
+	}
+}
@@ -0,0 +1,305 @@
+package protectbranches
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/cosminilie/gitbot/audit"
+	"github.com/cosminilie/gitbot/logging"
+	"github.com/cosminilie/gitbot/plugins"
+	"github.com/go-kit/kit/log"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+const (
+	pluginName = "protect_branches"
+	//driftLabel is set on the issues opened when a protection drifted
+	driftLabel = "protect_branches"
+)
+
+func init() {
+	plugins.RegisterGroupHandler(pluginName, protectBranches)
+}
+
+//ProtectBranchesError is an error struct which implements the error interface
+type ProtectBranchesError struct {
+	Repo      string
+	Group     string
+	Branch    string
+	Action    string
+	Condition string
+	Result    error
+}
+
+func (e ProtectBranchesError) Error() string {
+	return fmt.Sprintf("ProtectBranchesError:\nRepo:%s,\nGroup:%s,\nBranch:%s,\nAction:%s,\nCondition:%s,\nResult:%s,\n", e.Repo, e.Group, e.Branch, e.Action, e.Condition, e.Result)
+}
+
+//protection is a branch pattern with the access levels it must have
+type protection struct {
+	name        string
+	push, merge gitlab.AccessLevelValue
+}
+
+//drift is a protection that was missing or changed on a project and applied again
+type drift struct {
+	protection
+	found *plugins.ProtectedBranch
+}
+
+func (d drift) String() string {
+	want := fmt.Sprintf("push %s, merge %s", plugins.AccessLevelName(d.push), plugins.AccessLevelName(d.merge))
+	if d.found == nil {
+		return fmt.Sprintf("`%s` was not protected, protected it with %s", d.name, want)
+	}
+	return fmt.Sprintf("`%s` was protected with push %s, merge %s, protected it again with %s", d.name,
+		levelNames(d.found.PushAccessLevels), levelNames(d.found.MergeAccessLevels), want)
+}
+
+func protectBranches(ctx context.Context, pc *plugins.PluginClient, ic string) error {
+	pc.Pmut.Lock()
+	defer pc.Pmut.Unlock()
+
+	repo := pc.GroupRepos[ic]
+	return handle(ctx, pc.Logger, pc.GitLabClient, pc.Audit, pc.Protected, ic, repo.ProtectedBranches, repo.Approvers)
+}
+
+//handle protects the branches of the projects of the group. The protections applied on the first run on a project
+//set it up and are only recorded, the ones applied on later runs drifted and are reported. enforced holds the
+//projects already set up, it may be nil when nothing has to be reported.
+func handle(ctx context.Context, logger log.Logger, cl plugins.GitLabClient, al *audit.Log, enforced map[int]bool, group string, branches []plugins.BranchProtection, approvers []string) error {
+	logging.Debug(logger).Log(
+		"Repo", group,
+		"Plugin", pluginName,
+	)
+	protections, err := parseProtections(branches)
+	if err != nil {
+		return ProtectBranchesError{
+			Group:  group,
+			Action: "Config",
+			Result: err,
+		}
+	}
+
+	var projects []*gitlab.Project
+	err = plugins.ForEachGroupProject(cl, group, func(p *gitlab.Project) error {
+		//archived projects are read only, nothing for the bot to do
+		if !p.Archived {
+			projects = append(projects, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return ProtectBranchesError{
+			Group:  group,
+			Action: "ListGroupProjects",
+			Result: err,
+		}
+	}
+
+	for _, p := range projects {
+		//stop before the next project when the plugin timed out or the bot stops
+		if err := ctx.Err(); err != nil {
+			return ProtectBranchesError{
+				Repo:   p.PathWithNamespace,
+				Group:  group,
+				Action: "ProtectBranch",
+				Result: err,
+			}
+		}
+		want := protections
+		if len(want) == 0 {
+			if p.DefaultBranch == "" {
+				continue
+			}
+			//without patterns the default branch is protected with the default levels of a pattern
+			push, merge, _ := plugins.BranchProtection{Name: p.DefaultBranch}.Levels()
+			want = []protection{{name: p.DefaultBranch, push: push, merge: merge}}
+		}
+		drifts, err := protectProject(logger, cl, al, group, p, want)
+		if len(drifts) > 0 && enforced[p.ID] {
+			alert(logger, cl, p, drifts, approvers)
+		}
+		if err != nil {
+			return err
+		}
+		if enforced != nil {
+			enforced[p.ID] = true
+		}
+	}
+	return nil
+}
+
+func parseProtections(branches []plugins.BranchProtection) ([]protection, error) {
+	var protections []protection
+	for _, b := range branches {
+		push, merge, err := b.Levels()
+		if err != nil {
+			return nil, err
+		}
+		protections = append(protections, protection{name: b.Name, push: push, merge: merge})
+	}
+	return protections, nil
+}
+
+//protectProject applies the protections missing or changed on the project and returns the ones it applied
+func protectProject(logger log.Logger, cl plugins.GitLabClient, al *audit.Log, group string, p *gitlab.Project, want []protection) ([]drift, error) {
+	found := make(map[string]*plugins.ProtectedBranch)
+	err := plugins.ForEachProtectedBranch(cl, p.ID, func(b *plugins.ProtectedBranch) error {
+		found[b.Name] = b
+		return nil
+	})
+	if err != nil {
+		return nil, ProtectBranchesError{
+			Repo:   p.PathWithNamespace,
+			Group:  group,
+			Action: "ListProtectedBranches",
+			Result: err,
+		}
+	}
+
+	var drifts []drift
+	for _, w := range want {
+		b := found[w.name]
+		if b != nil && hasLevel(b.PushAccessLevels, w.push) && hasLevel(b.MergeAccessLevels, w.merge) {
+			continue
+		}
+		d := drift{protection: w, found: b}
+		logger.Log(
+			"Repo", p.PathWithNamespace,
+			"Plugin", pluginName,
+			"Action", "ProtectBranch",
+			"Branch", w.name,
+			"Drift", d,
+		)
+		err := protect(cl, p.ID, w, b)
+		if auditErr := al.Append(protectRecord(group, p, d, err)); auditErr != nil {
+			return drifts, ProtectBranchesError{
+				Repo:   p.PathWithNamespace,
+				Group:  group,
+				Branch: w.name,
+				Action: "Audit",
+				Result: auditErr,
+			}
+		}
+		if err != nil {
+			return drifts, ProtectBranchesError{
+				Repo:   p.PathWithNamespace,
+				Group:  group,
+				Branch: w.name,
+				Action: "ProtectBranch",
+				Result: err,
+			}
+		}
+		drifts = append(drifts, d)
+	}
+	return drifts, nil
+}
+
+//protect protects a branch, unprotecting it first when it is protected with other levels since GitLab can't change
+//the levels of a protected branch. The levels found are protected again when the new ones can't be applied, so that
+//a failure does not leave the branch unprotected.
+func protect(cl plugins.GitLabClient, pid int, w protection, found *plugins.ProtectedBranch) error {
+	if found != nil {
+		if _, err := cl.UnprotectBranch(pid, w.name); err != nil {
+			return err
+		}
+	}
+	_, _, err := cl.ProtectBranch(pid, &plugins.ProtectBranchOptions{
+		Name:             gitlab.String(w.name),
+		PushAccessLevel:  gitlab.AccessLevel(w.push),
+		MergeAccessLevel: gitlab.AccessLevel(w.merge),
+	})
+	if err == nil || found == nil {
+		return err
+	}
+	_, _, restoreErr := cl.ProtectBranch(pid, &plugins.ProtectBranchOptions{
+		Name:             gitlab.String(w.name),
+		PushAccessLevel:  gitlab.AccessLevel(firstLevel(found.PushAccessLevels)),
+		MergeAccessLevel: gitlab.AccessLevel(firstLevel(found.MergeAccessLevels)),
+	})
+	if restoreErr != nil {
+		return fmt.Errorf("%s, restoring the previous protection: %s", err, restoreErr)
+	}
+	return err
+}
+
+//firstLevel returns the access level GitLab applies first, nobody when none is allowed
+func firstLevel(levels []plugins.BranchAccessDescription) gitlab.AccessLevelValue {
+	if len(levels) == 0 {
+		return plugins.NoAccess
+	}
+	return levels[0].AccessLevel
+}
+
+//hasLevel reports whether level is the only access level allowed. GitLab lists no access level or a "No one" level
+//when nobody is allowed.
+func hasLevel(levels []plugins.BranchAccessDescription, level gitlab.AccessLevelValue) bool {
+	if len(levels) == 0 {
+		return level == plugins.NoAccess
+	}
+	for _, l := range levels {
+		if l.AccessLevel != level {
+			return false
+		}
+	}
+	return true
+}
+
+func levelNames(levels []plugins.BranchAccessDescription) string {
+	var names []string
+	for _, l := range levels {
+		names = append(names, plugins.AccessLevelName(l.AccessLevel))
+	}
+	if len(names) == 0 {
+		return plugins.AccessLevelName(plugins.NoAccess)
+	}
+	return strings.Join(names, "/")
+}
+
+//alert opens an issue on the project listing the protections applied again, mentioning the approvers. The
+//protections are already applied, a failed issue is only logged.
+func alert(logger log.Logger, cl plugins.GitLabClient, p *gitlab.Project, drifts []drift, approvers []string) {
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "The protected branches of %s drifted from the configuration of the bot:\n\n", p.PathWithNamespace)
+	for _, d := range drifts {
+		fmt.Fprintf(&body, "- %s\n", d)
+	}
+	if len(approvers) > 0 {
+		fmt.Fprintf(&body, "\n/cc @%s", strings.Join(approvers, " @"))
+	}
+	_, _, err := cl.CreateIssue(p.ID, &gitlab.CreateIssueOptions{
+		Title:       gitlab.String(fmt.Sprintf("Protected branches of %s drifted", p.PathWithNamespace)),
+		Description: gitlab.String(body.String()),
+		Labels:      gitlab.Labels{driftLabel},
+	})
+	if err != nil {
+		logging.Warn(logger).Log(
+			"Repo", p.PathWithNamespace,
+			"Plugin", pluginName,
+			"Action", "CreateIssue",
+			"Error", err,
+		)
+	}
+}
+
+//protectRecord builds the audit record for a protection applied again
+func protectRecord(group string, p *gitlab.Project, d drift, err error) audit.Record {
+	result := "ok"
+	if err != nil {
+		result = err.Error()
+	}
+	return audit.Record{
+		Action:  audit.ActionProtectBranch,
+		Plugin:  pluginName,
+		Actor:   pluginName,
+		Project: p.PathWithNamespace,
+		Group:   group,
+		Branch:  d.name,
+		Reason:  d.String(),
+		Event:   "schedule",
+		Result:  result,
+	}
+}
@@ -0,0 +1,149 @@
+package protectbranches
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cosminilie/gitbot/gitlabfake"
+	"github.com/cosminilie/gitbot/plugins"
+	"github.com/go-kit/kit/log"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+func TestProtectBranches(t *testing.T) {
+	gl := gitlabfake.New()
+	gl.AddGroup("tools")
+	api := gl.AddProject("tools/api")
+	web := gl.AddProject("tools/web")
+	old := gl.AddProject("tools/old")
+	gl.ArchiveProject(old.ID)
+
+	//master is already protected as configured on api, release/* was changed by someone
+	gl.ProtectBranch(api.ID, &plugins.ProtectBranchOptions{Name: gitlab.String("master"), PushAccessLevel: gitlab.AccessLevel(plugins.NoAccess)})
+	gl.ProtectBranch(api.ID, &plugins.ProtectBranchOptions{Name: gitlab.String("release/*"), PushAccessLevel: gitlab.AccessLevel(gitlab.DeveloperPermissions)})
+
+	pc := &plugins.PluginClient{
+		GitLabClient: gl,
+		GroupRepos: map[string]plugins.Repo{"tools": {
+			Name:      "tools",
+			Plugins:   []string{pluginName},
+			Approvers: []string{"alice", "bob"},
+			ProtectedBranches: []plugins.BranchProtection{
+				{Name: "master", PushLevel: "none"},
+				{Name: "release/*", PushLevel: "maintainer", MergeLevel: "developer"},
+			},
+		}},
+		Protected: make(map[int]bool),
+		Pmut:      &sync.Mutex{},
+		Logger:    log.NewNopLogger(),
+	}
+	if err := protectBranches(context.Background(), pc, "tools"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []*gitlab.Project{api, web} {
+		got := make(map[string]*plugins.ProtectedBranch)
+		for _, b := range gl.ProtectedBranches(p.ID) {
+			got[b.Name] = b
+		}
+		if b := got["master"]; b == nil || !hasLevel(b.PushAccessLevels, plugins.NoAccess) || !hasLevel(b.MergeAccessLevels, gitlab.MasterPermissions) {
+			t.Errorf("got master %+v on %s", b, p.PathWithNamespace)
+		}
+		if b := got["release/*"]; b == nil || !hasLevel(b.PushAccessLevels, gitlab.MasterPermissions) || !hasLevel(b.MergeAccessLevels, gitlab.DeveloperPermissions) {
+			t.Errorf("got release/* %+v on %s", b, p.PathWithNamespace)
+		}
+	}
+	if len(gl.ProtectedBranches(old.ID)) != 0 {
+		t.Error("got protected branches on the archived project")
+	}
+	//setting up the protections is not a drift
+	if len(gl.Issues(api.ID)) != 0 || len(gl.Issues(web.ID)) != 0 {
+		t.Errorf("got issues %+v, %+v on the first run", gl.Issues(api.ID), gl.Issues(web.ID))
+	}
+
+	//nothing drifted since
+	if err := protectBranches(context.Background(), pc, "tools"); err != nil {
+		t.Fatal(err)
+	}
+	if len(gl.Issues(api.ID)) != 0 || len(gl.Issues(web.ID)) != 0 {
+		t.Error("got an issue without drift")
+	}
+
+	//someone lets developers push to release/*
+	gl.UnprotectBranch(api.ID, "release/*")
+	gl.ProtectBranch(api.ID, &plugins.ProtectBranchOptions{Name: gitlab.String("release/*"), PushAccessLevel: gitlab.AccessLevel(gitlab.DeveloperPermissions)})
+	if err := protectBranches(context.Background(), pc, "tools"); err != nil {
+		t.Fatal(err)
+	}
+	issues := gl.Issues(api.ID)
+	if len(issues) != 1 {
+		t.Fatalf("got %d issues, want the drift of release/* reported", len(issues))
+	}
+	if d := issues[0].Description; !strings.Contains(d, "`release/*` was protected with push developer") || strings.Contains(d, "`master`") || !strings.Contains(d, "@alice @bob") {
+		t.Errorf("got issue %q", d)
+	}
+	if len(issues[0].Labels) != 1 || issues[0].Labels[0] != driftLabel {
+		t.Errorf("got labels %v", issues[0].Labels)
+	}
+
+	//someone unprotects master
+	gl.UnprotectBranch(web.ID, "master")
+	if err := protectBranches(context.Background(), pc, "tools"); err != nil {
+		t.Fatal(err)
+	}
+	if issues := gl.Issues(web.ID); len(issues) != 1 || !strings.Contains(issues[0].Description, "`master` was not protected") {
+		t.Errorf("got issues %+v, want master protected again", issues)
+	}
+}
+
+//refusingClient refuses to protect branches with the push level
+type refusingClient struct {
+	plugins.GitLabClient
+	push gitlab.AccessLevelValue
+}
+
+func (c refusingClient) ProtectBranch(pid interface{}, opt *plugins.ProtectBranchOptions) (*plugins.ProtectedBranch, *gitlab.Response, error) {
+	if *opt.PushAccessLevel == c.push {
+		return nil, nil, errors.New("refused")
+	}
+	return c.GitLabClient.ProtectBranch(pid, opt)
+}
+
+func TestRestoreProtection(t *testing.T) {
+	gl := gitlabfake.New()
+	gl.AddGroup("tools")
+	p := gl.AddProject("tools/api")
+	gl.ProtectBranch(p.ID, &plugins.ProtectBranchOptions{Name: gitlab.String("master"), PushAccessLevel: gitlab.AccessLevel(gitlab.DeveloperPermissions)})
+
+	cl := refusingClient{GitLabClient: gl, push: plugins.NoAccess}
+	err := handle(context.Background(), log.NewNopLogger(), cl, nil, nil, "tools", nil, nil)
+	if e, ok := err.(ProtectBranchesError); !ok || e.Action != "ProtectBranch" {
+		t.Errorf("got %v, want the protection to fail", err)
+	}
+	got := gl.ProtectedBranches(p.ID)
+	if len(got) != 1 || !hasLevel(got[0].PushAccessLevels, gitlab.DeveloperPermissions) || !hasLevel(got[0].MergeAccessLevels, gitlab.MasterPermissions) {
+		t.Errorf("got %+v, want master protected as before", got)
+	}
+}
+
+func TestDefaultBranch(t *testing.T) {
+	gl := gitlabfake.New()
+	gl.AddGroup("tools")
+	p := gl.AddProject("tools/api")
+
+	if err := handle(context.Background(), log.NewNopLogger(), gl, nil, nil, "tools", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	got := gl.ProtectedBranches(p.ID)
+	if len(got) != 1 || got[0].Name != "master" || !hasLevel(got[0].PushAccessLevels, plugins.NoAccess) {
+		t.Errorf("got %+v, want the default branch protected", got)
+	}
+
+	err := handle(context.Background(), log.NewNopLogger(), gl, nil, nil, "tools", []plugins.BranchProtection{{Name: "master", PushLevel: "owner"}}, nil)
+	if e, ok := err.(ProtectBranchesError); !ok || e.Action != "Config" {
+		t.Errorf("got %v, want the owner level refused", err)
+	}
+}
@@ -0,0 +1,278 @@
+package pushaudit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/cosminilie/gitbot/audit"
+	"github.com/cosminilie/gitbot/gitlabhook"
+	"github.com/cosminilie/gitbot/logging"
+	"github.com/cosminilie/gitbot/plugins"
+	"github.com/go-kit/kit/log"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+const (
+	pluginName = "push_audit"
+	//flaggedLabel is set on the issues opened for flagged pushes
+	flaggedLabel = "push_audit"
+)
+
+func init() {
+	plugins.RegisterPushEventHandler(pluginName, handlePushEvent)
+}
+
+//PushAuditError is an error struct which implements the error interface
+type PushAuditError struct {
+	Repo      string
+	Branch    string
+	User      string
+	Action    string
+	Condition string
+	Result    error
+}
+
+func (e PushAuditError) Error() string {
+	return fmt.Sprintf("PushAuditError:\nRepo:%s,\nBranch:%s,\nUser:%s,\nAction:%s,\nCondition:%s,\nResult:%s,\n", e.Repo, e.Branch, e.User, e.Action, e.Condition, e.Result)
+}
+
+//finding is a reason a push was flagged
+type finding struct {
+	action string
+	reason string
+}
+
+func handlePushEvent(ctx context.Context, pc *plugins.PluginClient, pe gitlabhook.PushEvent) error {
+	pc.Pmut.Lock()
+	defer pc.Pmut.Unlock()
+
+	return handle(pc.Logger, pc.GitLabClient, pc.Audit, pe, pc.Repos[pe.Project.PathWithNamespace].Approvers)
+}
+
+func handle(logger log.Logger, cl plugins.GitLabClient, al *audit.Log, pe gitlabhook.PushEvent, approvers []string) error {
+	branch := pe.Branch()
+	if branch == "" {
+		return nil
+	}
+	repo := pe.Project.PathWithNamespace
+	logging.Debug(logger).Log(
+		"Repo", repo,
+		"Plugin", pluginName,
+		"Branch", branch,
+		"Before", pe.Before,
+		"After", pe.After,
+	)
+	findings, err := inspect(cl, pe, branch)
+	if err != nil {
+		return err
+	}
+	if len(findings) == 0 {
+		return nil
+	}
+
+	for _, f := range findings {
+		logger.Log(
+			"Repo", repo,
+			"Plugin", pluginName,
+			"Action", f.action,
+			"Branch", branch,
+			"User", pusher(pe),
+		)
+		if err := al.Append(pushRecord(pe, branch, f)); err != nil {
+			return PushAuditError{
+				Repo:   repo,
+				Branch: branch,
+				User:   pusher(pe),
+				Action: "Audit",
+				Result: err,
+			}
+		}
+	}
+
+	_, _, err = cl.CreateIssue(pe.ProjectID, &gitlab.CreateIssueOptions{
+		Title:       gitlab.String(fmt.Sprintf("Unreviewed push to %s by %s", branch, pusher(pe))),
+		Description: gitlab.String(issueBody(pe, branch, findings, approvers)),
+		Labels:      gitlab.Labels{flaggedLabel},
+	})
+	if err != nil {
+		return PushAuditError{
+			Repo:   repo,
+			Branch: branch,
+			User:   pusher(pe),
+			Action: "CreateIssue",
+			Result: err,
+		}
+	}
+	return nil
+}
+
+//inspect returns why the push is flagged, if it is. Only the pushes to the default and the protected branches by
+//anyone but the bot are flagged, the other branches are free to be rewritten.
+func inspect(cl plugins.GitLabClient, pe gitlabhook.PushEvent, branch string) ([]finding, error) {
+	repo := pe.Project.PathWithNamespace
+	if pe.Deleted() {
+		protected, err := isProtected(cl, pe.ProjectID, branch)
+		if err != nil {
+			return nil, PushAuditError{
+				Repo:   repo,
+				Branch: branch,
+				User:   pusher(pe),
+				Action: "ListProtectedBranches",
+				Result: err,
+			}
+		}
+		if !protected {
+			return nil, nil
+		}
+		return []finding{{
+			action: audit.ActionDeleteBranch,
+			reason: fmt.Sprintf("the protected branch %s was deleted, it pointed at %s", branch, pe.Before),
+		}}, nil
+	}
+	//a new branch has no history to rewrite
+	if pe.Created() {
+		return nil, nil
+	}
+
+	//only the default and the protected branches are under change control
+	defaultBranch, err := projectDefaultBranch(cl, pe)
+	if err != nil {
+		return nil, err
+	}
+	if branch != defaultBranch {
+		protected, err := isProtected(cl, pe.ProjectID, branch)
+		if err != nil {
+			return nil, PushAuditError{
+				Repo:   repo,
+				Branch: branch,
+				User:   pusher(pe),
+				Action: "ListProtectedBranches",
+				Result: err,
+			}
+		}
+		if !protected {
+			return nil, nil
+		}
+	}
+	bot, _, err := cl.CurrentUser()
+	if err != nil {
+		return nil, PushAuditError{
+			Repo:   repo,
+			Branch: branch,
+			User:   pusher(pe),
+			Action: "CurrentUser",
+			Result: err,
+		}
+	}
+	//the merges of the bot are pushed by its own user
+	if pe.UserID == bot.ID {
+		return nil, nil
+	}
+
+	var findings []finding
+	cmp, _, err := cl.Compare(pe.ProjectID, &gitlab.CompareOptions{From: gitlab.String(pe.After), To: gitlab.String(pe.Before)})
+	if err != nil {
+		return nil, PushAuditError{
+			Repo:   repo,
+			Branch: branch,
+			User:   pusher(pe),
+			Action: "Compare",
+			Result: err,
+		}
+	}
+	//before is an ancestor of after unless some of its commits are not reachable from after any more
+	if len(cmp.Commits) > 0 {
+		findings = append(findings, finding{
+			action: audit.ActionForcePush,
+			reason: fmt.Sprintf("%s was force-pushed from %s to %s, %d commits were dropped", branch, pe.Before, pe.After, len(cmp.Commits)),
+		})
+	}
+	if branch == defaultBranch {
+		findings = append(findings, finding{
+			action: audit.ActionDirectPush,
+			reason: fmt.Sprintf("%d commits were pushed to the default branch %s without a merge by the bot", pe.TotalCommits, branch),
+		})
+	}
+	return findings, nil
+}
+
+//projectDefaultBranch returns the default branch of the project pushed to, older GitLab releases don't send it
+func projectDefaultBranch(cl plugins.GitLabClient, pe gitlabhook.PushEvent) (string, error) {
+	if pe.Project.DefaultBranch != "" {
+		return pe.Project.DefaultBranch, nil
+	}
+	p, _, err := cl.GetProject(pe.ProjectID)
+	if err != nil {
+		return "", PushAuditError{
+			Repo:   pe.Project.PathWithNamespace,
+			User:   pusher(pe),
+			Action: "GetProject",
+			Result: err,
+		}
+	}
+	return p.DefaultBranch, nil
+}
+
+//isProtected reports whether the branch matches one of the protected branches of the project. GitLab keeps the
+//protection of a deleted branch.
+func isProtected(cl plugins.GitLabClient, pid int, branch string) (bool, error) {
+	protected := false
+	err := plugins.ForEachProtectedBranch(cl, pid, func(b *plugins.ProtectedBranch) error {
+		if matchBranch(b.Name, branch) {
+			protected = true
+		}
+		return nil
+	})
+	return protected, err
+}
+
+//matchBranch matches a branch against a protected branch name, where * matches any characters including /
+func matchBranch(pattern, branch string) bool {
+	if !strings.Contains(pattern, "*") {
+		return pattern == branch
+	}
+	re := "^" + strings.Replace(regexp.QuoteMeta(pattern), `\*`, ".*", -1) + "$"
+	ok, err := regexp.MatchString(re, branch)
+	return err == nil && ok
+}
+
+func pusher(pe gitlabhook.PushEvent) string {
+	if pe.UserUsername != "" {
+		return pe.UserUsername
+	}
+	return pe.UserName
+}
+
+func issueBody(pe gitlabhook.PushEvent, branch string, findings []finding, approvers []string) string {
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "%s pushed to %s of %s outside of the change control:\n\n", pusher(pe), branch, pe.Project.PathWithNamespace)
+	for _, f := range findings {
+		fmt.Fprintf(&body, "- %s\n", f.reason)
+	}
+	if len(approvers) > 0 {
+		fmt.Fprintf(&body, "\n/cc @%s", strings.Join(approvers, " @"))
+	}
+	return body.String()
+}
+
+//pushRecord builds the audit record of a flagged push
+func pushRecord(pe gitlabhook.PushEvent, branch string, f finding) audit.Record {
+	sha := pe.After
+	if pe.Deleted() {
+		sha = pe.Before
+	}
+	return audit.Record{
+		Action:    f.action,
+		Plugin:    pluginName,
+		Actor:     pusher(pe),
+		Project:   pe.Project.PathWithNamespace,
+		Branch:    branch,
+		CommitSHA: sha,
+		Reason:    f.reason,
+		Event:     "push " + pe.Before + ".." + pe.After,
+		Result:    "flagged",
+	}
+}
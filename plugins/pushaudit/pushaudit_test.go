@@ -0,0 +1,126 @@
+package pushaudit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cosminilie/gitbot/audit"
+	"github.com/cosminilie/gitbot/gitlabfake"
+	"github.com/cosminilie/gitbot/gitlabhook"
+	"github.com/cosminilie/gitbot/plugins"
+	"github.com/go-kit/kit/log"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+func TestPushAudit(t *testing.T) {
+	gl := gitlabfake.New()
+	bot := gl.SetCurrentUser("gitbot")
+	p := gl.AddProject("tools/api")
+	gl.ProtectBranch(p.ID, &plugins.ProtectBranchOptions{Name: gitlab.String("release/*")})
+	//a - b - c on master, d rewrites b
+	gl.AddCommit(p.ID, "a")
+	gl.AddCommit(p.ID, "b", "a")
+	gl.AddCommit(p.ID, "c", "b")
+	gl.AddCommit(p.ID, "d", "a")
+
+	dir, err := ioutil.TempDir("", "pushaudit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	al, err := audit.Open(filepath.Join(dir, "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer al.Close()
+
+	push := func(ref, before, after string, user int) gitlabhook.PushEvent {
+		return gitlabhook.PushEvent{
+			Ref:          ref,
+			Before:       before,
+			After:        after,
+			UserID:       user,
+			UserUsername: "mallory",
+			ProjectID:    p.ID,
+			Project:      gitlabhook.Project{PathWithNamespace: "tools/api", DefaultBranch: "master"},
+			TotalCommits: 1,
+		}
+	}
+	tests := []struct {
+		name string
+		pe   gitlabhook.PushEvent
+		want []string
+	}{
+		{"merge by the bot", push("refs/heads/master", "b", "c", bot.ID), nil},
+		{"feature branch", push("refs/heads/feature", "b", "c", 999), nil},
+		{"new branch", push("refs/heads/feature", gitlabhook.BlankSHA, "c", 999), nil},
+		{"tag", push("refs/tags/v1", "b", "c", 999), nil},
+		{"unprotected branch deleted", push("refs/heads/feature", "c", gitlabhook.BlankSHA, 999), nil},
+		{"direct push", push("refs/heads/master", "b", "c", 999), []string{audit.ActionDirectPush}},
+		{"force push to a feature branch", push("refs/heads/feature", "c", "d", 999), nil},
+		{"force push by the bot", push("refs/heads/master", "c", "d", bot.ID), nil},
+		{"force push to a protected branch", push("refs/heads/release/1.0", "c", "d", 999), []string{audit.ActionForcePush}},
+		{"force push to the default branch", push("refs/heads/master", "c", "d", 999), []string{audit.ActionForcePush, audit.ActionDirectPush}},
+		{"protected branch deleted", push("refs/heads/release/1.0", "c", gitlabhook.BlankSHA, 999), []string{audit.ActionDeleteBranch}},
+	}
+	for _, tt := range tests {
+		issues := len(gl.Issues(p.ID))
+		if err := handle(log.NewNopLogger(), gl, al, tt.pe, []string{"alice"}); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got := gl.Issues(p.ID)[issues:]
+		if len(tt.want) == 0 {
+			if len(got) != 0 {
+				t.Errorf("%s: got issue %q, want none", tt.name, got[0].Description)
+			}
+			continue
+		}
+		if len(got) != 1 {
+			t.Errorf("%s: got %d issues, want 1", tt.name, len(got))
+			continue
+		}
+		if !strings.Contains(got[0].Description, "@alice") || len(got[0].Labels) != 1 || got[0].Labels[0] != flaggedLabel {
+			t.Errorf("%s: got issue %+v", tt.name, got[0])
+		}
+	}
+
+	al.Close()
+	f, err := os.Open(filepath.Join(dir, "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var actions []string
+	audit.Read(f, func(r audit.Record) error {
+		actions = append(actions, r.Action)
+		if r.Actor != "mallory" || r.Project != "tools/api" || r.Branch == "" {
+			t.Errorf("got record %+v", r)
+		}
+		return nil
+	})
+	want := []string{audit.ActionDirectPush, audit.ActionForcePush, audit.ActionForcePush, audit.ActionDirectPush, audit.ActionDeleteBranch}
+	if strings.Join(actions, " ") != strings.Join(want, " ") {
+		t.Errorf("got records %v, want %v", actions, want)
+	}
+}
+
+func TestMatchBranch(t *testing.T) {
+	for _, tt := range []struct {
+		pattern, branch string
+		want            bool
+	}{
+		{"master", "master", true},
+		{"master", "master2", false},
+		{"release/*", "release/1.0", true},
+		{"release/*", "release/1.0/hotfix", true},
+		{"*-stable", "1-0-stable", true},
+		{"release.*", "releaseX1", false},
+	} {
+		if got := matchBranch(tt.pattern, tt.branch); got != tt.want {
+			t.Errorf("matchBranch(%q, %q) = %v, want %v", tt.pattern, tt.branch, got, tt.want)
+		}
+	}
+}
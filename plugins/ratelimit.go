@@ -0,0 +1,243 @@
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+//Defaults used for the RateLimit settings left empty in the configuration
+const (
+	DefaultRequestsPerSecond = 10
+	DefaultBurst             = 10
+	DefaultMaxRetries        = 5
+	DefaultMaxBackoff        = time.Minute
+
+	initialBackoff = 500 * time.Millisecond
+)
+
+//RateLimit struct in loading HCL configuration. It configures the client side rate limiting and retries of the
+//GitLab API calls made for an instance.
+type RateLimit struct {
+	//RequestsPerSecond is the sustained rate of API calls. A negative value disables the client side limit, the
+	//rate limit headers sent by GitLab are still honored.
+	RequestsPerSecond float64 `hcl:"requests-per-second"`
+	//Burst is the number of calls allowed at once before RequestsPerSecond applies
+	Burst int `hcl:"burst"`
+	//MaxRetries is the number of times a throttled or failed call is retried. A negative value disables retries.
+	MaxRetries int `hcl:"max-retries"`
+	//MaxBackoff caps the exponential backoff between retries, e.g. "30s"
+	MaxBackoff string `hcl:"max-backoff"`
+}
+
+//NewRateLimitedClient returns a client for cl whose calls wait for a shared rate limiter and whose throttled or failed
+//calls are retried with exponential backoff. Retry-After and RateLimit-Remaining/RateLimit-Reset response headers
+//pause all calls until GitLab accepts requests again. Calls that are not idempotent are only retried when GitLab
+//throttled them.
+func NewRateLimitedClient(cl *gitlab.Client, rl RateLimit) (GitLabClient, error) {
+	maxBackoff := DefaultMaxBackoff
+	if rl.MaxBackoff != "" {
+		d, err := time.ParseDuration(rl.MaxBackoff)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid max-backoff %q", rl.MaxBackoff)
+		}
+		maxBackoff = d
+	}
+	rps := rl.RequestsPerSecond
+	if rps == 0 {
+		rps = DefaultRequestsPerSecond
+	}
+	burst := rl.Burst
+	if burst <= 0 {
+		burst = DefaultBurst
+	}
+	retries := rl.MaxRetries
+	switch {
+	case retries == 0:
+		retries = DefaultMaxRetries
+	case retries < 0:
+		retries = 0
+	}
+
+	l := &limiter{burst: burst, now: time.Now, sleep: time.Sleep}
+	if rps > 0 {
+		l.interval = time.Duration(float64(time.Second) / rps)
+	}
+	return &gitLabClient{
+		cl: cl,
+		retry: &retrier{
+			limiter:    l,
+			maxRetries: retries,
+			maxBackoff: maxBackoff,
+		},
+	}, nil
+}
+
+//retrier makes the requests of a client through the limiter and retries them
+type retrier struct {
+	limiter    *limiter
+	maxRetries int
+	maxBackoff time.Duration
+}
+
+//idempotent reports whether a request may be repeated without changing its outcome. Merging and rebasing a merge
+//request are PUTs but not idempotent: when the first attempt went through before a 502, the retry fails and the
+//merge request would be reported as not merged.
+func idempotent(method, path string) bool {
+	switch {
+	case method == "POST":
+		return false
+	case method == "PUT" && (strings.HasSuffix(path, "/merge") || strings.HasSuffix(path, "/rebase")):
+		return false
+	}
+	return true
+}
+
+//do runs call until it succeeds, fails permanently, runs out of retries or ctx is done
+func (r *retrier) do(ctx context.Context, idempotent bool, call func() (*gitlab.Response, error)) (*gitlab.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if err := r.sleep(ctx, r.limiter.reserve()); err != nil {
+			return nil, err
+		}
+		resp, err := call()
+		r.limiter.observe(resp)
+		if err == nil || attempt >= r.maxRetries {
+			return resp, err
+		}
+
+		throttled := false
+		if resp != nil && resp.Response != nil {
+			throttled = resp.StatusCode == http.StatusTooManyRequests
+		}
+		if er, ok := err.(*gitlab.ErrorResponse); ok && er.Response != nil {
+			throttled = er.Response.StatusCode == http.StatusTooManyRequests
+			resp = &gitlab.Response{Response: er.Response}
+		}
+		if !throttled && !(idempotent && temporary(resp, err)) {
+			return resp, err
+		}
+
+		//the server told us when to come back, otherwise back off exponentially
+		if resp != nil && resp.Response != nil {
+			if until, ok := retryAfter(resp.Response.Header, r.limiter.now()); ok {
+				r.limiter.pause(until)
+				continue
+			}
+		}
+		if err := r.sleep(ctx, backoff(attempt, r.maxBackoff)); err != nil {
+			return resp, err
+		}
+	}
+}
+
+//sleep waits for d unless ctx is done first
+func (r *retrier) sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil || d <= 0 {
+		return err
+	}
+	slept := make(chan struct{})
+	go func() {
+		r.limiter.sleep(d)
+		close(slept)
+	}()
+	select {
+	case <-slept:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//temporary reports whether a failed call may succeed when retried
+func temporary(resp *gitlab.Response, err error) bool {
+	if resp != nil && resp.Response != nil {
+		switch resp.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+//backoff returns the delay before the retry following attempt, with jitter so that concurrent callers spread out
+func backoff(attempt int, max time.Duration) time.Duration {
+	d := initialBackoff << uint(attempt)
+	if d <= 0 || d > max {
+		d = max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+//retryAfter returns when GitLab accepts calls again based on the Retry-After or RateLimit-Reset headers
+func retryAfter(h http.Header, now time.Time) (time.Time, bool) {
+	if v := h.Get("Retry-After"); v != "" {
+		if s, err := strconv.Atoi(v); err == nil {
+			return now.Add(time.Duration(s) * time.Second), true
+		}
+		if t, err := http.ParseTime(v); err == nil {
+			return t, true
+		}
+	}
+	if v := h.Get("RateLimit-Reset"); v != "" {
+		if s, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return time.Unix(s, 0), true
+		}
+	}
+	return time.Time{}, false
+}
+
+//limiter spaces calls interval apart while allowing bursts of burst calls. It is shared by every caller of a client.
+type limiter struct {
+	mut      sync.Mutex
+	interval time.Duration
+	burst    int
+	//tat is the theoretical arrival time of the next call, see the generic cell rate algorithm
+	tat time.Time
+
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+//reserve books the next call and returns how long the caller has to wait before making it
+func (l *limiter) reserve() time.Duration {
+	l.mut.Lock()
+	now := l.now()
+	at := l.tat.Add(-time.Duration(l.burst-1) * l.interval)
+	if l.tat.Before(now) {
+		l.tat = now
+	}
+	l.tat = l.tat.Add(l.interval)
+	l.mut.Unlock()
+
+	return at.Sub(now)
+}
+
+//pause holds every call until t
+func (l *limiter) pause(t time.Time) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	if t = t.Add(time.Duration(l.burst-1) * l.interval); t.After(l.tat) {
+		l.tat = t
+	}
+}
+
+//observe pauses the limiter when GitLab reports the rate limit was used up
+func (l *limiter) observe(resp *gitlab.Response) {
+	if resp == nil || resp.Response == nil || resp.Header.Get("RateLimit-Remaining") != "0" {
+		return
+	}
+	if until, ok := retryAfter(resp.Header, l.now()); ok {
+		l.pause(until)
+	}
+}
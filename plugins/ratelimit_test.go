@@ -0,0 +1,149 @@
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+//fakeClock replaces time.Now and time.Sleep of a limiter
+type fakeClock struct {
+	mut   sync.Mutex
+	t     time.Time
+	slept []time.Duration
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) sleep(d time.Duration) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.t = c.t.Add(d)
+	c.slept = append(c.slept, d)
+}
+
+func newTestClient(t *testing.T, h http.HandlerFunc, rl RateLimit) (*gitLabClient, *fakeClock, func()) {
+	s := httptest.NewServer(h)
+	cl := gitlab.NewClient(nil, "token")
+	cl.SetBaseURL(s.URL + "/api/v4/")
+
+	gc, err := NewRateLimitedClient(cl, rl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := gc.(*gitLabClient)
+	clock := &fakeClock{t: time.Unix(1500000000, 0)}
+	rc.retry.limiter.now, rc.retry.limiter.sleep = clock.now, clock.sleep
+	return rc, clock, s.Close
+}
+
+func TestRateLimitedClientRetries(t *testing.T) {
+	var calls int
+	rc, clock, done := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch calls {
+		case 1:
+			w.Header().Set("Retry-After", "3")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"id":5}`)
+		}
+	}, RateLimit{RequestsPerSecond: -1})
+	defer done()
+
+	p, _, err := rc.GetProject(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ID != 5 || calls != 3 {
+		t.Errorf("got project %d after %d calls, want project 5 after 3 calls", p.ID, calls)
+	}
+	if len(clock.slept) != 2 || clock.slept[0] != 3*time.Second {
+		t.Errorf("got sleeps %v, want the Retry-After delay of 3s followed by a backoff", clock.slept)
+	}
+
+	//notes are not idempotent, a failed call must not be retried unless GitLab throttled it
+	calls = 1
+	if _, _, err := rc.CreateMergeRequestNote(5, 1, &gitlab.CreateMergeRequestNoteOptions{}); err == nil || calls != 2 {
+		t.Errorf("got error %v after %d calls, want the 503 after a single call", err, calls-1)
+	}
+
+	//neither are merges, a merge that went through before the 503 would fail when retried
+	calls = 1
+	if _, _, err := rc.AcceptMergeRequest(5, 1, &AcceptMergeRequestOptions{}); err == nil || calls != 2 {
+		t.Errorf("got error %v after %d calls, want the 503 after a single call", err, calls-1)
+	}
+	calls = 1
+	if _, err := rc.RebaseMergeRequest(5, 1); err == nil || calls != 2 {
+		t.Errorf("got error %v after %d calls, want the 503 after a single call", err, calls-1)
+	}
+}
+
+func TestRateLimitedClientLimits(t *testing.T) {
+	reset := time.Unix(1500000100, 0)
+	rc, clock, done := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/api/v4/groups" {
+			w.Header().Set("RateLimit-Remaining", "0")
+			w.Header().Set("RateLimit-Reset", fmt.Sprint(reset.Unix()))
+		}
+		fmt.Fprint(w, `[]`)
+	}, RateLimit{RequestsPerSecond: 2, Burst: 2})
+	defer done()
+
+	for i := 0; i < 4; i++ {
+		if _, _, err := rc.ListGroupMembers(1, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := time.Unix(1500000001, 0); !clock.now().Equal(want) {
+		t.Errorf("4 calls at 2 per second with a burst of 2 ended at %s, want %s", clock.now(), want)
+	}
+
+	if _, _, err := rc.ListGroups(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := rc.ListGroups(nil); err != nil {
+		t.Fatal(err)
+	}
+	if clock.now().Before(reset) {
+		t.Errorf("call made at %s before the rate limit reset at %s", clock.now(), reset)
+	}
+}
+
+func TestRateLimitedClientContext(t *testing.T) {
+	var calls int
+	rc, _, done := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":5}`)
+	}, RateLimit{})
+	defer done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cc := WithContext(ctx, rc)
+	if _, _, err := cc.GetProject(5); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if _, _, err := cc.GetProject(5); err != context.Canceled || calls != 1 {
+		t.Errorf("got error %v after %d calls, want %v after a single call", err, calls, context.Canceled)
+	}
+	//the client the context was bound to is not cancelled
+	if _, _, err := rc.GetProject(5); err != nil || calls != 2 {
+		t.Errorf("got error %v after %d calls, want no error after 2 calls", err, calls)
+	}
+}
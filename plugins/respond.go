@@ -21,6 +21,7 @@ import (
 	"strings"
 
 	"github.com/cosminilie/gitbot/gitlabhook"
+	gitlab "github.com/xanzy/go-gitlab"
 )
 
 const AboutThisBot = "Instructions for interacting with me using Merge Requests comments are available at https://github.com/cosminilie/gitbot"
@@ -45,3 +46,18 @@ In response to [this comment](%s):
 	}
 	return fmt.Sprintf(format, ic.User.Name, s, ic.ObjectAttributes.URL, strings.Join(quoted, "\n"), AboutThisBot)
 }
+
+//CreateNote comments on an issue or a merge request of a project. noteableType is the one of the webhook notes,
+//"Issue" or "MergeRequest".
+func CreateNote(cl GitLabClient, pid interface{}, noteableType string, iid int, body string) error {
+	var err error
+	switch noteableType {
+	case "Issue":
+		_, _, err = cl.CreateIssueNote(pid, iid, &gitlab.CreateIssueNoteOptions{Body: &body})
+	case "MergeRequest":
+		_, _, err = cl.CreateMergeRequestNote(pid, iid, &gitlab.CreateMergeRequestNoteOptions{Body: &body})
+	default:
+		err = fmt.Errorf("can't comment on a %q", noteableType)
+	}
+	return err
+}
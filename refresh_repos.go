@@ -0,0 +1,85 @@
+package gitbot
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/cosminilie/gitbot/plugins"
+	"github.com/go-kit/kit/log"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+//refreshRepos expands the configured groups and patterns again so that projects created after startup get their
+//plugins and hook, while deleted and archived projects are dropped. It runs with the timeout of "refresh_repos" and
+//stops when the bot does.
+func refreshRepos(s *basicService) error {
+	logger := log.NewContext(s.logger).With("Plugin", "refresh_repos")
+	return s.runPlugin(s.ctx, logger, "refresh_repos", func(ctx context.Context, pc *plugins.PluginClient) error {
+		return s.refresh(pc.GitLabClient)
+	})
+}
+
+//refresh expands the repos again through gc and updates the plugins and hooks
+func (s *basicService) refresh(gc plugins.GitLabClient) error {
+	projects, groups, err := expandRepos(s.logger, gc, s.repos, s.defaultApprovers)
+	if err != nil {
+		//keep the current repos, applying a partial expansion would drop the projects that were not listed
+		return fmt.Errorf("RefreshRepos Error: Failed to expand repos. Returned error: %s", err)
+	}
+	projects, err = dropGoneProjects(gc, s.repos, projects)
+	if err != nil {
+		return fmt.Errorf("RefreshRepos Error: Failed to check the configured projects. Returned error: %s", err)
+	}
+
+	added, removed := s.Plugins.SetRepos(projects)
+	s.Plugins.SetGroupRepos(groups)
+	if len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+	s.logger.Log(
+		"Func", "refreshRepos",
+		"Added", strings.Join(added, " "),
+		"Removed", strings.Join(removed, " "),
+	)
+
+	//projects that are no longer configured stop receiving events, new projects get their hook right away instead of
+	//waiting for the next addRepoEventHook run
+	s.removeStaleHooks(gc, removed)
+	for _, r := range added {
+		if err := s.ensureProjectHook(gc, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//dropGoneProjects removes the projects configured by their exact path that were deleted or archived since, expandRepos
+//only sees that for the projects of the groups it walks
+func dropGoneProjects(cl plugins.GitLabClient, repos []plugins.Repo, projects []plugins.Repo) ([]plugins.Repo, error) {
+	exact := make(map[string]bool)
+	for _, r := range repos {
+		if p := parseRepoPattern(r); p.exact() && !p.exclude {
+			exact[p.base] = true
+		}
+	}
+	var kept []plugins.Repo
+	for _, r := range projects {
+		if !exact[r.Name] {
+			kept = append(kept, r)
+			continue
+		}
+		p, _, err := cl.GetProject(r.Name)
+		if er, ok := err.(*gitlab.ErrorResponse); ok && er.Response != nil && er.Response.StatusCode == http.StatusNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !p.Archived {
+			kept = append(kept, r)
+		}
+	}
+	return kept, nil
+}
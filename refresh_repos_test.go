@@ -0,0 +1,64 @@
+package gitbot
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cosminilie/gitbot/gitlabfake"
+	"github.com/cosminilie/gitbot/plugins"
+	"github.com/go-kit/kit/log"
+)
+
+func TestRefreshRepos(t *testing.T) {
+	gl := gitlabfake.New()
+	gl.AddGroup("platform")
+	gl.AddGroup("platform/infra")
+	for _, p := range []string{"platform/api", "platform/old", "platform/infra/dns", "tools/cli", "tools/legacy", "tools/gone"} {
+		gl.AddProject(p)
+	}
+
+	svc := NewBasicService(context.Background(), log.NewNopLogger(), gl, nil, nil, nil, Instance{
+		Name: DefaultInstance,
+		Repos: []plugins.Repo{
+			{Name: "platform/**", Plugins: []string{"lgtm"}},
+			{Name: "tools/cli", Plugins: []string{"lgtm"}},
+			{Name: "tools/legacy", Plugins: []string{"lgtm"}},
+			{Name: "tools/gone", Plugins: []string{"lgtm"}},
+		},
+	})
+	deadline := time.Now().Add(5 * time.Second)
+	for len(svc.Plugins.RepoNames()) < 6 {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the repos to be loaded, got %v", svc.Plugins.RepoNames())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := addRepoEventHook(svc); err != nil {
+		t.Fatal(err)
+	}
+	gl.AddProject("platform/infra/terraform")
+	gl.ArchiveProject("platform/old")
+	gl.RemoveProject("platform/api")
+	//projects configured by their exact path are checked as well
+	gl.ArchiveProject("tools/legacy")
+	gl.RemoveProject("tools/gone")
+
+	if err := refreshRepos(svc); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := svc.Plugins.RepoNames(), []string{"platform/infra/dns", "platform/infra/terraform", "tools/cli"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got repos %v, want %v", got, want)
+	}
+	if len(svc.Plugins.Handlers(plugins.MergeCommentEvent, "platform/infra/terraform")) == 0 {
+		t.Error("the new project has no plugins")
+	}
+	if hooks := gl.Hooks("platform/old"); len(hooks) != 0 {
+		t.Errorf("got hooks %v on the archived project, want them removed", hooks)
+	}
+	if len(gl.Hooks("platform/infra/terraform")) != 1 {
+		t.Errorf("got hooks %v on the new project, want a single hook", gl.Hooks("platform/infra/terraform"))
+	}
+}
@@ -1,97 +1,399 @@
 package gitbot
 
 import (
+	"context"
+	"expvar"
 	"fmt"
 	"strings"
 
+	"github.com/cosminilie/gitbot/logging"
+	"github.com/cosminilie/gitbot/plugins"
+	"github.com/go-kit/kit/log"
 	gitlab "github.com/xanzy/go-gitlab"
 )
 
-//addRepoEventHook adds an event hook or updates an existing event hook to point at this service.
+//hookDrift counts the hooks found in_sync, missing, drifted or stale by the reconciliations, keyed by
+//<instance>.<project|group|system>.<state>. It is published with the other expvars on /debug/vars.
+var hookDrift = expvar.NewMap("hook_drift")
+
+//addRepoEventHook reconciles the hooks pointing at this service with the events the plugins of each repo need.
+//Depending on the hook strategy the hooks are added on each repo, on the configured groups or on the instance. It runs
+//with the timeout of "hooks" and stops when the bot does.
 func addRepoEventHook(s *basicService) error {
+	logger := log.NewContext(s.logger).With("Plugin", "hooks")
+	return s.runPlugin(s.ctx, logger, "hooks", func(ctx context.Context, pc *plugins.PluginClient) error {
+		return s.reconcileHooks(pc.GitLabClient)
+	})
+}
 
+//reconcileHooks reconciles the hooks of every repo through gc
+func (s *basicService) reconcileHooks(gc plugins.GitLabClient) error {
+	hr := s.hookReconciler()
+
+	switch s.hookStrategy {
+	case HookStrategyGroup:
+		groups := hookGroups(s.repos)
+		events := make(map[string]plugins.HookEvents)
+		for _, r := range s.Plugins.RepoNames() {
+			if g := hookGroupOf(groups, r); g != "" {
+				events[g] = events[g].Or(s.Plugins.HookEvents(r))
+			}
+		}
+		for _, g := range groups {
+			if _, err := hr.reconcile(groupHookTarget(gc, g), hr.options(events[g])); err != nil {
+				return err
+			}
+		}
+	case HookStrategySystem:
+		var events plugins.HookEvents
+		for _, r := range s.Plugins.RepoNames() {
+			e := s.Plugins.HookEvents(r)
+			events = events.Or(plugins.HookEvents{Push: e.Push, TagPush: e.TagPush, MergeRequests: e.MergeRequests})
+		}
+		if _, err := hr.reconcile(systemHookTarget(gc), hr.options(events)); err != nil {
+			return err
+		}
+	}
+
+	//Loop though each repo
+	for _, r := range s.Plugins.RepoNames() {
+		if err := s.ensureProjectHook(gc, r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//ensureProjectHook reconciles the project hook of a repo. Repos covered by a group or system hook get their project
+//hooks removed, the others get a hook receiving the events their plugins need.
+func (s *basicService) ensureProjectHook(gc plugins.GitLabClient, repo string) error {
+	events := s.Plugins.HookEvents(repo)
+	switch s.hookStrategy {
+	case HookStrategyGroup:
+		if hookGroupOf(hookGroups(s.repos), repo) != "" {
+			return s.removeRepoHooks(gc, repo)
+		}
+	case HookStrategySystem:
+		//system hooks do not deliver comments and pipelines, repos whose plugins need them keep a project hook
+		events = plugins.HookEvents{Note: events.Note, Pipeline: events.Pipeline}
+		if !events.Any() {
+			return s.removeRepoHooks(gc, repo)
+		}
+	}
+
+	t, err := projectHookTarget(gc, repo)
+	if err != nil {
+		return err
+	}
+	hr := s.hookReconciler()
+	_, err = hr.reconcile(t, hr.options(events))
+	return err
+}
+
+//removeRepoHooks deletes the project hooks created by the bot on a repo covered by a group or system hook, so events
+//are not delivered twice. Each repo is cleaned once per run of the service.
+func (s *basicService) removeRepoHooks(gc plugins.GitLabClient, repo string) error {
+	s.mut.Lock()
+	done := s.hookCleaned[repo]
+	s.mut.Unlock()
+	if done {
+		return nil
+	}
+
+	t, err := projectHookTarget(gc, repo)
+	if err != nil {
+		return err
+	}
+	if _, err := s.hookReconciler().reconcile(t, nil); err != nil {
+		return err
+	}
+
+	s.mut.Lock()
+	if s.hookCleaned == nil {
+		s.hookCleaned = make(map[string]bool)
+	}
+	s.hookCleaned[repo] = true
+	s.mut.Unlock()
+	return nil
+}
+
+//removeStaleHooks deletes the project hooks of repos that are no longer configured. Projects that were deleted
+//took their hooks with them.
+func (s *basicService) removeStaleHooks(gc plugins.GitLabClient, repos []string) {
+	hr := s.hookReconciler()
+	for _, r := range repos {
+		s.mut.Lock()
+		delete(s.hookCleaned, r)
+		s.mut.Unlock()
+
+		t, err := projectHookTarget(gc, r)
+		if err == nil {
+			_, err = hr.reconcile(t, nil)
+		}
+		if err != nil {
+			logging.Warn(s.logger).Log(
+				"Func", "removeStaleHooks",
+				"Project", r,
+				"Error", err,
+			)
+		}
+	}
+}
+
+//hookReconciler returns the reconciler of the hooks pointing at this service
+func (s *basicService) hookReconciler() hookReconciler {
+	return hookReconciler{
+		logger:    s.logger,
+		instance:  s.instance,
+		url:       hookURL(s.logger, s.hook, s.hookPath),
+		token:     s.hook.Token,
+		sslVerify: s.hook.SSLVerify,
+	}
+}
+
+//hookURL returns the URL GitLab delivers the events of an instance to. Unless configured the bot is reached on
+//port 9091 of its IP address.
+func hookURL(logger log.Logger, hook HookConfig, hookPath string) string {
+	if hook.URL != "" {
+		return hook.URL
+	}
 	//get server Ip
 	ip, err := externalIP()
 	if err != nil {
-		fmt.Println(err)
-	}
-	//init hook options
-	hookOpts := &gitlab.AddProjectHookOptions{
-		URL:                   gitlab.String(fmt.Sprintf("http://%s:9091/hook", ip)),
-		PushEvents:            gitlab.Bool(true),
-		IssuesEvents:          gitlab.Bool(false),
-		MergeRequestsEvents:   gitlab.Bool(true),
-		TagPushEvents:         gitlab.Bool(false),
-		NoteEvents:            gitlab.Bool(true),
-		BuildEvents:           gitlab.Bool(false),
-		PipelineEvents:        gitlab.Bool(false),
-		WikiPageEvents:        gitlab.Bool(false),
-		EnableSSLVerification: gitlab.Bool(false),
-	}
-	//init gitlab List HookOpts
-	listOptions := &gitlab.ListProjectHooksOptions{}
+		logging.Error(logger).Log(
+			"Func", "hookURL",
+			"Error", err,
+		)
+	}
+	return fmt.Sprintf("http://%s:9091%s", ip, hookPath)
+}
 
-	//Loop though each repo
-	for _, r := range s.Plugins.Repos {
+//hookGroups returns the groups a group hook is added on: the base group of each pattern, leaving out the groups
+//nested in another one
+func hookGroups(repos []plugins.Repo) []string {
+	var bases []string
+	for _, r := range repos {
+		p := parseRepoPattern(r)
+		if p.exclude || p.exact() || p.base == "" {
+			continue
+		}
+		bases = append(bases, p.base)
+	}
+	var groups []string
+	for _, b := range bases {
+		nested := false
+		for _, g := range bases {
+			nested = nested || strings.HasPrefix(strings.ToLower(b), strings.ToLower(g)+"/")
+		}
+		if !nested && hookGroupOf(groups, b) == "" {
+			groups = append(groups, b)
+		}
+	}
+	return groups
+}
 
-		//Get project details
-		proj, _, err := s.Plugins.GitLabClient.Projects.GetProject(r.Name)
-		if err != nil {
-			return fmt.Errorf("AddRepoEventHook Error: Failed to get Project %s. Returned error: %s", r.Name, err)
+//hookGroupOf returns the group containing path, or "" if none does
+func hookGroupOf(groups []string, path string) string {
+	for _, g := range groups {
+		if strings.EqualFold(g, path) || strings.HasPrefix(strings.ToLower(path), strings.ToLower(g)+"/") {
+			return g
 		}
+	}
+	return ""
+}
 
-		//Get project hooks
-		hooks, _, err := s.Plugins.GitLabClient.Projects.ListProjectHooks(proj.ID, listOptions)
-		if err != nil {
-			return fmt.Errorf("AddRepoEventHook Error: Failed to list hooks for Project %s. Returned error: %s", proj.NameWithNamespace, err)
-		}
-
-		//mark projects that don't have hooks
-		var repoHook = false
-		for _, h := range hooks {
-			if strings.Contains(h.URL, ip) {
-				s.logger.Log(
-					"Func", "addRepoEventHook",
-					"Action", "HookMatch",
-					"Project", proj.NameWithNamespace,
-					"Hook", h.URL,
-				)
-				repoHook = true
-				break
-			}
-			//check to see if it was created by us, and if it was, delete it to clean up (in case our IP address changed)
-			if botHook.MatchString(h.URL) {
-				s.logger.Log(
-					"Func", "addRepoEventHook",
-					"Action", "FoundOldHook",
-					"Project", proj.NameWithNamespace,
-					"Hook", h.URL,
-				)
-				//delete hook
-				_, err = s.Plugins.GitLabClient.Projects.DeleteProjectHook(proj.ID, h.ID)
-				if err != nil {
-					return fmt.Errorf("error Deleting hook:%s for project :%s. Returned errror is:%s", h.URL, proj.NameWithNamespace, err)
-				}
+//hookTarget is a project, a group or the instance whose hooks are reconciled
+type hookTarget struct {
+	kind string
+	name string
+	list func(fn func(*gitlab.ProjectHook) error) error
+	add  func(opt *plugins.HookOptions) error
+	edit func(hook int, opt *plugins.HookOptions) error //nil when the hooks have to be replaced
+	del  func(hook int) error
+}
+
+func projectHookTarget(gc plugins.GitLabClient, repo string) (hookTarget, error) {
+	//Get project details
+	proj, _, err := gc.GetProject(repo)
+	if err != nil {
+		return hookTarget{}, fmt.Errorf("AddRepoEventHook Error: Failed to get Project %s. Returned error: %s", repo, err)
+	}
+	return hookTarget{
+		kind: "project",
+		name: proj.PathWithNamespace,
+		list: func(fn func(*gitlab.ProjectHook) error) error { return plugins.ForEachProjectHook(gc, proj.ID, fn) },
+		add: func(opt *plugins.HookOptions) error {
+			_, _, err := gc.AddProjectHook(proj.ID, opt)
+			return err
+		},
+		edit: func(hook int, opt *plugins.HookOptions) error {
+			_, _, err := gc.EditProjectHook(proj.ID, hook, opt)
+			return err
+		},
+		del: func(hook int) error {
+			_, err := gc.DeleteProjectHook(proj.ID, hook)
+			return err
+		},
+	}, nil
+}
+
+func groupHookTarget(gc plugins.GitLabClient, group string) hookTarget {
+	return hookTarget{
+		kind: "group",
+		name: group,
+		list: func(fn func(*gitlab.ProjectHook) error) error { return plugins.ForEachGroupHook(gc, group, fn) },
+		add: func(opt *plugins.HookOptions) error {
+			_, _, err := gc.AddGroupHook(group, opt)
+			return err
+		},
+		edit: func(hook int, opt *plugins.HookOptions) error {
+			_, _, err := gc.EditGroupHook(group, hook, opt)
+			return err
+		},
+		del: func(hook int) error {
+			_, err := gc.DeleteGroupHook(group, hook)
+			return err
+		},
+	}
+}
+
+//systemHookTarget returns the system hooks of the instance, they cannot be edited
+func systemHookTarget(gc plugins.GitLabClient) hookTarget {
+	return hookTarget{
+		kind: "system",
+		name: "instance",
+		list: func(fn func(*gitlab.ProjectHook) error) error { return plugins.ForEachSystemHook(gc, fn) },
+		add: func(opt *plugins.HookOptions) error {
+			_, _, err := gc.AddSystemHook(opt)
+			return err
+		},
+		del: func(hook int) error {
+			_, err := gc.DeleteSystemHook(hook)
+			return err
+		},
+	}
+}
 
+//hookReconciler makes the hooks pointing at the bot match the hook it wants
+type hookReconciler struct {
+	logger    log.Logger
+	instance  string
+	url       string //where the bot receives the events of the instance
+	token     string
+	sslVerify bool
+	dryRun    bool //log the changes without making them
+}
+
+//options returns the hook receiving events, or nil when no event is needed
+func (hr hookReconciler) options(events plugins.HookEvents) *plugins.HookOptions {
+	if !events.Any() {
+		return nil
+	}
+	return &plugins.HookOptions{
+		URL:                   gitlab.String(hr.url),
+		Token:                 gitlab.String(hr.token),
+		PushEvents:            gitlab.Bool(events.Push),
+		TagPushEvents:         gitlab.Bool(events.TagPush),
+		MergeRequestsEvents:   gitlab.Bool(events.MergeRequests),
+		NoteEvents:            gitlab.Bool(events.Note),
+		PipelineEvents:        gitlab.Bool(events.Pipeline),
+		EnableSSLVerification: gitlab.Bool(hr.sslVerify),
+	}
+}
+
+//owns reports whether a hook points at the bot. Hooks on the IP address of an earlier run are ours as well.
+func (hr hookReconciler) owns(h *gitlab.ProjectHook) bool {
+	return h.URL == hr.url || botHook.MatchString(h.URL)
+}
+
+//reconcile keeps a single hook pointing at the bot on the target, matching want. When want is nil every hook
+//pointing at the bot is removed. All pages are read before any hook is changed so the listing does not shift.
+//It returns the number of hooks added, edited or deleted.
+func (hr hookReconciler) reconcile(t hookTarget, want *plugins.HookOptions) (int, error) {
+	var own []*gitlab.ProjectHook
+	err := t.list(func(h *gitlab.ProjectHook) error {
+		if hr.owns(h) {
+			own = append(own, h)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("AddRepoEventHook Error: Failed to list hooks for %s %s. Returned error: %s", t.kind, t.name, err)
+	}
+
+	//keep the hook on the current URL, or else the first one pointing at the bot which is edited to the current URL
+	var keep *gitlab.ProjectHook
+	if want != nil {
+		for _, h := range own {
+			if keep == nil || (h.URL == hr.url && keep.URL != hr.url) {
+				keep = h
 			}
 		}
+	}
 
-		if !repoHook {
-			s.logger.Log(
-				"Func", "addRepoEventHook",
-				"Action", "CreatingHook",
-				"Project", proj.NameWithNamespace,
-				"Hook", *hookOpts.URL,
-			)
-			//create hook
-			_, _, err := s.Plugins.GitLabClient.Projects.AddProjectHook(proj.ID, hookOpts)
-			if err != nil {
-				return fmt.Errorf("error Creating hook:%s for project :%s. Returned errror is:%s", *hookOpts.URL, proj.NameWithNamespace, err)
+	changes := 0
+	for _, h := range own {
+		if h == keep {
+			continue
+		}
+		id := h.ID
+		if err := hr.apply(t, "stale", h.URL, func() error { return t.del(id) }); err != nil {
+			return changes, fmt.Errorf("error Deleting hook:%s for %s :%s. Returned errror is:%s", h.URL, t.kind, t.name, err)
+		}
+		changes++
+	}
+	if want == nil {
+		return changes, nil
+	}
 
+	switch {
+	case keep == nil:
+		err = hr.apply(t, "missing", *want.URL, func() error { return t.add(want) })
+	case !hookDrifted(keep, want):
+		hookDrift.Add(hr.instance+"."+t.kind+".in_sync", 1)
+		return changes, nil
+	case t.edit != nil:
+		err = hr.apply(t, "drifted", keep.URL, func() error { return t.edit(keep.ID, want) })
+	default:
+		err = hr.apply(t, "drifted", keep.URL, func() error {
+			if err := t.del(keep.ID); err != nil {
+				return err
 			}
+			return t.add(want)
+		})
+	}
+	if err != nil {
+		return changes, fmt.Errorf("error Creating hook:%s for %s :%s. Returned errror is:%s", *want.URL, t.kind, t.name, err)
+	}
+	return changes + 1, nil
+}
 
-		}
+//apply counts and logs a change before making it, unless running dry
+func (hr hookReconciler) apply(t hookTarget, state, url string, change func() error) error {
+	hookDrift.Add(hr.instance+"."+t.kind+"."+state, 1)
+	hr.logger.Log(
+		"Func", "reconcileHooks",
+		"Kind", t.kind,
+		"Target", t.name,
+		"Hook", url,
+		"State", state,
+		"DryRun", hr.dryRun,
+	)
+	if hr.dryRun {
+		return nil
 	}
+	return change()
+}
 
-	return nil
+//hookDrifted reports whether a hook differs from the options it should have. GitLab never returns the secret token,
+//it is set again whenever the hook is edited.
+func hookDrifted(h *gitlab.ProjectHook, want *plugins.HookOptions) bool {
+	return h.URL != *want.URL ||
+		h.PushEvents != *want.PushEvents ||
+		h.TagPushEvents != *want.TagPushEvents ||
+		h.MergeRequestsEvents != *want.MergeRequestsEvents ||
+		h.NoteEvents != *want.NoteEvents ||
+		h.PipelineEvents != *want.PipelineEvents ||
+		h.EnableSSLVerification != *want.EnableSSLVerification
 }
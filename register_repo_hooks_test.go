@@ -0,0 +1,171 @@
+package gitbot
+
+import (
+	"context"
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/cosminilie/gitbot/gitlabfake"
+	"github.com/cosminilie/gitbot/plugins"
+	"github.com/go-kit/kit/log"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+//oldHook is a hook left over by a run on another IP address with the project strategy
+var oldHook = &plugins.HookOptions{
+	URL:                 gitlab.String("http://10.0.0.1:9091/hook"),
+	PushEvents:          gitlab.Bool(true),
+	MergeRequestsEvents: gitlab.Bool(true),
+	NoteEvents:          gitlab.Bool(true),
+}
+
+func newStrategyService(t *testing.T, inst Instance) (*gitlabfake.GitLab, *basicService) {
+	gl := gitlabfake.New()
+	for _, g := range []string{"platform", "platform/infra", "tools"} {
+		gl.AddGroup(g)
+	}
+	for _, p := range []string{"platform/api", "platform/infra/dns", "tools/cli", "tools/docs"} {
+		gl.AddProject(p)
+		gl.AddProjectHook(p, oldHook)
+	}
+
+	inst.Name = "strategy-" + inst.HookStrategy
+	inst.Repos = []plugins.Repo{
+		{Name: "platform/**", Plugins: []string{"lgtm"}},
+		{Name: "tools/cli", Plugins: []string{"lgtm"}},
+		{Name: "tools/docs"},
+	}
+	svc := NewBasicService(context.Background(), log.NewNopLogger(), gl, nil, nil, nil, inst)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(svc.Plugins.RepoNames()) < 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the repos to be loaded, got %v", svc.Plugins.RepoNames())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return gl, svc
+}
+
+func TestProjectHookReconcile(t *testing.T) {
+	gl, svc := newStrategyService(t, Instance{
+		HookStrategy: HookStrategyProject,
+		Hook:         HookConfig{URL: "https://bot.company.net/hook", Token: "secret", SSLVerify: true},
+	})
+	//a hook on the current URL that drifted, next to the old one
+	current := *oldHook
+	current.URL = gitlab.String("https://bot.company.net/hook")
+	drifted, _, _ := gl.AddProjectHook("platform/api", &current)
+
+	if err := addRepoEventHook(svc); err != nil {
+		t.Fatal(err)
+	}
+	hooks := gl.Hooks("platform/api")
+	if len(hooks) != 1 || hooks[0].ID != drifted.ID {
+		t.Fatalf("got hooks %v on platform/api, want the drifted hook %d edited in place", hooks, drifted.ID)
+	}
+	if h := hooks[0]; h.PushEvents || h.MergeRequestsEvents || !h.NoteEvents || !h.EnableSSLVerification || gl.HookToken(h.ID) != "secret" {
+		t.Errorf("got hook %+v with token %q, want note events only, SSL verification and the token", h, gl.HookToken(h.ID))
+	}
+	if hooks := gl.Hooks("tools/docs"); len(hooks) != 0 {
+		t.Errorf("got hooks %v on tools/docs, its plugins need no events", hooks)
+	}
+
+	if err := addRepoEventHook(svc); err != nil {
+		t.Fatal(err)
+	}
+	//hooks of an earlier run are edited to the current URL, the ones on tools/docs and the duplicate are stale
+	drift := expvar.Get("hook_drift").(*expvar.Map)
+	for state, want := range map[string]string{"drifted": "3", "stale": "2", "in_sync": "3"} {
+		if got := drift.Get(svc.instance + ".project." + state); got == nil || got.String() != want {
+			t.Errorf("got %v %s project hooks, want %s", got, state, want)
+		}
+	}
+	if got := drift.Get(svc.instance + ".project.missing"); got != nil {
+		t.Errorf("got %v missing project hooks, want none", got)
+	}
+}
+
+func TestGroupHookStrategy(t *testing.T) {
+	gl, svc := newStrategyService(t, Instance{HookStrategy: HookStrategyGroup})
+	for i := 0; i < 2; i++ {
+		if err := addRepoEventHook(svc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if hooks := gl.GroupHooks("platform"); len(hooks) != 1 || hooks[0].PushEvents || !hooks[0].NoteEvents {
+		t.Errorf("got group hooks %v on platform, want a single hook for comments", hooks)
+	}
+	if hooks := gl.GroupHooks("platform/infra"); len(hooks) != 0 {
+		t.Errorf("got group hooks %v on platform/infra, the hook of platform covers it", hooks)
+	}
+	for _, p := range []string{"platform/api", "platform/infra/dns"} {
+		if hooks := gl.Hooks(p); len(hooks) != 0 {
+			t.Errorf("got project hooks %v on %s, the group hook covers it", hooks, p)
+		}
+	}
+	if hooks := gl.Hooks("tools/cli"); len(hooks) != 1 || hooks[0].URL != svc.hookReconciler().url {
+		t.Errorf("got project hooks %v on tools/cli, want the fallback project hook", hooks)
+	}
+}
+
+func TestSystemHookStrategy(t *testing.T) {
+	gl, svc := newStrategyService(t, Instance{HookStrategy: HookStrategySystem})
+	gl.AddSystemHook(oldHook)
+	if err := addRepoEventHook(svc); err != nil {
+		t.Fatal(err)
+	}
+
+	//none of the plugins needs the push or merge request events a system hook delivers
+	if hooks := gl.SystemHooks(); len(hooks) != 0 {
+		t.Errorf("got system hooks %v, want none", hooks)
+	}
+	//lgtm handles comments which are not sent to system hooks
+	if hooks := gl.Hooks("platform/api"); len(hooks) != 1 || !hooks[0].NoteEvents || hooks[0].PushEvents || hooks[0].MergeRequestsEvents {
+		t.Errorf("got project hooks %v on platform/api, want a hook for comments only", hooks)
+	}
+	if hooks := gl.Hooks("tools/docs"); len(hooks) != 0 {
+		t.Errorf("got project hooks %v on tools/docs, want none", hooks)
+	}
+}
+
+func TestCleanupHooks(t *testing.T) {
+	gl, svc := newStrategyService(t, Instance{HookStrategy: HookStrategyProject})
+	if err := addRepoEventHook(svc); err != nil {
+		t.Fatal(err)
+	}
+	gl.AddProject("platform/unconfigured")
+	gl.AddProjectHook("platform/unconfigured", oldHook)
+	gl.AddProjectHook("tools/cli", &plugins.HookOptions{URL: gitlab.String("https://ci.company.net/hook")})
+
+	inst := Instance{Name: svc.instance, Repos: svc.repos}
+	if n, err := CleanupHooks(log.NewNopLogger(), gl, inst, true); err != nil || n != 4 {
+		t.Fatalf("dry run would remove %d hooks with error %v, want 4", n, err)
+	}
+	if n, err := CleanupHooks(log.NewNopLogger(), gl, inst, false); err != nil || n != 4 {
+		t.Fatalf("removed %d hooks with error %v, want 4", n, err)
+	}
+	for _, p := range []string{"platform/api", "platform/infra/dns", "platform/unconfigured", "tools/docs"} {
+		if hooks := gl.Hooks(p); len(hooks) != 0 {
+			t.Errorf("got hooks %v on %s after the cleanup", hooks, p)
+		}
+	}
+	if hooks := gl.Hooks("tools/cli"); len(hooks) != 1 {
+		t.Errorf("got hooks %v on tools/cli, want the hook of another service to be kept", hooks)
+	}
+}
+
+func TestHookGroups(t *testing.T) {
+	got := hookGroups([]plugins.Repo{
+		{Name: "platform/infra/*"},
+		{Name: "platform/**"},
+		{Name: "tools"},
+		{Name: "!tools/legacy-*"},
+		{Name: "docs/site"},
+		{Name: "*/website"},
+	})
+	if len(got) != 2 || got[0] != "platform" || got[1] != "tools" {
+		t.Errorf("got groups %v, want [platform tools]", got)
+	}
+}
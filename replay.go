@@ -0,0 +1,70 @@
+package gitbot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+//hookEvents maps the object_kind of a webhook payload to the X-Gitlab-Event header GitLab sends with it
+var hookEvents = map[string]string{
+	"note":          "Note Hook",
+	"merge_request": "Merge Request Hook",
+	"push":          "Push Hook",
+	"tag_push":      "Tag Push Hook",
+	"issue":         "Issue Hook",
+	"pipeline":      "Pipeline Hook",
+	"build":         "Build Hook",
+}
+
+//EventType returns the X-Gitlab-Event header value for a captured webhook payload based on its object_kind
+func EventType(payload []byte) (string, error) {
+	var kind struct {
+		ObjectKind string `json:"object_kind"`
+	}
+	if err := json.Unmarshal(payload, &kind); err != nil {
+		return "", fmt.Errorf("failed to Unmarshal payload with :%s", err)
+	}
+	e, ok := hookEvents[kind.ObjectKind]
+	if !ok {
+		return "", fmt.Errorf("unknown object_kind %q", kind.ObjectKind)
+	}
+	return e, nil
+}
+
+//Replay re-delivers a captured webhook payload to a running bot listening on hookURL.
+//If eventType is empty it is derived from the payload. token is sent as the secret token of the hook when set.
+func Replay(hookURL, eventType, token string, payload []byte) error {
+	if eventType == "" {
+		var err error
+		if eventType, err = EventType(payload); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, hookURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gitlab-Event", eventType)
+	if token != "" {
+		req.Header.Set("X-Gitlab-Token", token)
+	}
+
+	cl := &http.Client{Timeout: 10 * time.Second}
+	resp, err := cl.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("replay of %s to %s failed with %s: %s", eventType, hookURL, resp.Status, body)
+	}
+	return nil
+}
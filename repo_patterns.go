@@ -0,0 +1,152 @@
+package gitbot
+
+import (
+	"path"
+	"strings"
+
+	"github.com/cosminilie/gitbot/plugins"
+)
+
+//repoPattern is a repo block of the configuration. Its name is either a project path or a pattern:
+//
+//	group, group/ or group/*   the projects of a group
+//	group/**                   the projects of a group and of all its subgroups
+//	platform/*-service         glob matched against the path of the projects, * does not match /
+//	!platform/legacy-*         exclusion, matching projects are not handled by the bot unless listed by path
+//
+//When several blocks match a project the most specific one wins.
+type repoPattern struct {
+	repo     plugins.Repo
+	segments []string
+	exclude  bool
+	//base is the group listed to find the projects matching the pattern
+	base string
+	//recursive is set when the projects of the subgroups of base have to be listed
+	recursive bool
+	//group is set when the block applies to the whole base group and its group handlers have to run
+	group bool
+}
+
+func parseRepoPattern(r plugins.Repo) repoPattern {
+	p := repoPattern{repo: r}
+	name := r.Name
+	if strings.HasPrefix(name, "!") {
+		p.exclude = true
+		name = name[1:]
+	}
+	//legacy group notation: name, name/ or name/*
+	if fullRepo.MatchString(name) {
+		name = strings.TrimSuffix(strings.TrimSuffix(name, "/*"), "/") + "/*"
+	}
+	p.segments = strings.Split(strings.Trim(name, "/"), "/")
+
+	var literal []string
+	for _, s := range p.segments {
+		if isGlob(s) {
+			break
+		}
+		literal = append(literal, s)
+	}
+	p.base = strings.Join(literal, "/")
+	rest := p.segments[len(literal):]
+	p.recursive = len(rest) > 1 || (len(rest) == 1 && rest[0] == "**")
+	p.group = len(rest) == 1 && (rest[0] == "*" || rest[0] == "**")
+	return p
+}
+
+//isGlob reports whether a path segment contains glob meta characters
+func isGlob(segment string) bool {
+	return strings.ContainsAny(segment, "*?[")
+}
+
+//exact reports whether the pattern is the path of a single project
+func (p repoPattern) exact() bool {
+	return p.base == strings.Join(p.segments, "/")
+}
+
+//match reports whether the project path matches the pattern
+func (p repoPattern) match(project string) bool {
+	return matchSegments(p.segments, strings.Split(project, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, err := path.Match(strings.ToLower(pattern[0]), strings.ToLower(name[0])); err != nil || !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+//moreSpecific reports whether p is more specific than q. Exact paths come first, then patterns with more literal
+//segments, then patterns without ** and finally the pattern with more literal characters.
+func (p repoPattern) moreSpecific(q repoPattern) bool {
+	if p.exact() != q.exact() {
+		return p.exact()
+	}
+	pl, ql := p.literalSegments(), q.literalSegments()
+	if pl != ql {
+		return pl > ql
+	}
+	pr, qr := p.hasDoubleStar(), q.hasDoubleStar()
+	if pr != qr {
+		return !pr
+	}
+	return p.literalChars() > q.literalChars()
+}
+
+func (p repoPattern) literalSegments() int {
+	n := 0
+	for _, s := range p.segments {
+		if !isGlob(s) {
+			n++
+		}
+	}
+	return n
+}
+
+func (p repoPattern) hasDoubleStar() bool {
+	for _, s := range p.segments {
+		if s == "**" {
+			return true
+		}
+	}
+	return false
+}
+
+func (p repoPattern) literalChars() int {
+	n := 0
+	for _, s := range p.segments {
+		n += len(s) - strings.Count(s, "*") - strings.Count(s, "?")
+	}
+	return n
+}
+
+//resolve returns the most specific block matching the project, on a tie the block that comes first in the
+//configuration wins. Projects matched by an exclusion are skipped unless the project itself is listed.
+func resolve(patterns []repoPattern, project string) (repoPattern, bool) {
+	var best repoPattern
+	found, excluded := false, false
+	for _, p := range patterns {
+		switch {
+		case !p.match(project):
+		case p.exclude:
+			excluded = true
+		case !found || p.moreSpecific(best):
+			best, found = p, true
+		}
+	}
+	return best, found && (!excluded || best.exact())
+}
@@ -0,0 +1,92 @@
+package gitbot
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/cosminilie/gitbot/gitlabfake"
+	"github.com/cosminilie/gitbot/plugins"
+	"github.com/go-kit/kit/log"
+)
+
+func TestExpandRepos(t *testing.T) {
+	gl := gitlabfake.New()
+	for _, g := range []string{"platform", "platform/infra", "platform/infra/terraform", "tools"} {
+		gl.AddGroup(g)
+	}
+	for _, p := range []string{
+		"platform/api-service",
+		"platform/web-service",
+		"platform/legacy-service",
+		"platform/docs",
+		"platform/infra/dns",
+		"platform/infra/terraform/modules",
+		"tools/ci",
+		"other/app",
+	} {
+		gl.AddProject(p)
+	}
+
+	repos := []plugins.Repo{
+		{Name: "tools", Plugins: []string{"drop_rights"}},
+		{Name: "platform/**", Plugins: []string{"lgtm"}, Approvers: []string{"ops"}},
+		{Name: "platform/*-service", Plugins: []string{"lgtm", "policy"}, Approvers: []string{"dev"}},
+		{Name: "!platform/legacy-*"},
+		{Name: "platform/infra/terraform/**", Plugins: []string{"lgtm"}, Approvers: []string{"infra"}},
+		{Name: "other/app", Plugins: []string{"lgtm"}},
+	}
+
+	projects, groups, err := expandRepos(log.NewNopLogger(), gl, repos, []string{"admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string][]string)
+	for _, p := range projects {
+		got[p.Name] = p.Approvers
+	}
+	want := map[string][]string{
+		"platform/api-service":             {"dev", "admin"},
+		"platform/web-service":             {"dev", "admin"},
+		"platform/docs":                    {"ops", "admin"},
+		"platform/infra/dns":               {"ops", "admin"},
+		"platform/infra/terraform/modules": {"infra", "admin"},
+		"tools/ci":                         {"admin"},
+		"other/app":                        {"admin"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got projects %v, want %v", got, want)
+	}
+
+	var names []string
+	for _, g := range groups {
+		names = append(names, g.Name)
+	}
+	sort.Strings(names)
+	if want := []string{"platform", "platform/infra", "platform/infra/terraform", "tools"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got groups %v, want %v", names, want)
+	}
+}
+
+func TestRepoPatternMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		project string
+		match   bool
+	}{
+		{"monitoring_group/test1", "monitoring_group/test1", true},
+		{"tools", "tools/ci", true},
+		{"tools/", "tools/sub/ci", false},
+		{"platform/**", "platform/infra/terraform/x", true},
+		{"platform/**/terraform-*", "platform/terraform-aws", true},
+		{"platform/**/terraform-*", "platform/infra/terraform-aws", true},
+		{"platform/*-service", "platform/infra/api-service", false},
+		{"!platform/legacy-*", "Platform/Legacy-app", true},
+	}
+	for _, tt := range tests {
+		if got := parseRepoPattern(plugins.Repo{Name: tt.pattern}).match(tt.project); got != tt.match {
+			t.Errorf("%s matching %s: got %t, want %t", tt.pattern, tt.project, got, tt.match)
+		}
+	}
+}
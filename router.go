@@ -0,0 +1,123 @@
+package gitbot
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+)
+
+//Router implements http.Handler. It receives webhooks from every configured GitLab instance on a shared endpoint and
+//hands them to the Server of the instance whose host matches the project web_url of the payload.
+type Router struct {
+	Logger log.Logger
+	//Recorder is shared by the servers of all instances
+	Recorder *Recorder
+
+	mut     sync.RWMutex
+	byHost  map[string]*Server
+	byName  map[string]*Server
+	servers []*Server
+}
+
+//NewRouter creates an empty router
+func NewRouter(logger log.Logger, recorder *Recorder) *Router {
+	return &Router{
+		Logger:   logger,
+		Recorder: recorder,
+		byHost:   make(map[string]*Server),
+		byName:   make(map[string]*Server),
+	}
+}
+
+//Add registers the server of a GitLab instance reachable at host
+func (rt *Router) Add(host string, s *Server) {
+	rt.mut.Lock()
+	defer rt.mut.Unlock()
+
+	if host != "" {
+		rt.byHost[strings.ToLower(host)] = s
+	}
+	rt.byName[s.Instance] = s
+	rt.servers = append(rt.servers, s)
+}
+
+//ServeHTTP routes an incoming webhook to the server of its GitLab instance
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	payload, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "500 Internal Server Error: Failed to read request body", http.StatusInternalServerError)
+		return
+	}
+
+	host := payloadHost(payload)
+	s := rt.route(host)
+	if s == nil {
+		rt.Logger.Log(
+			"Caller", "Router",
+			"Host", host,
+			"Result", "No GitLab instance configured for host",
+		)
+		http.Error(w, "404 Not Found: No GitLab instance configured for "+host, http.StatusNotFound)
+		return
+	}
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(payload))
+	s.ServeHTTP(w, r)
+}
+
+//route returns the server for host. When a single instance is configured every webhook goes to it.
+func (rt *Router) route(host string) *Server {
+	rt.mut.RLock()
+	defer rt.mut.RUnlock()
+
+	if s, ok := rt.byHost[strings.ToLower(host)]; ok {
+		return s
+	}
+	if len(rt.servers) == 1 {
+		return rt.servers[0]
+	}
+	return nil
+}
+
+//server returns the server of a named instance
+func (rt *Router) server(instance string) *Server {
+	rt.mut.RLock()
+	defer rt.mut.RUnlock()
+
+	if s, ok := rt.byName[instance]; ok {
+		return s
+	}
+	if len(rt.servers) == 1 {
+		return rt.servers[0]
+	}
+	return nil
+}
+
+//payloadHost returns the host of the project the webhook payload belongs to
+func payloadHost(payload []byte) string {
+	var p struct {
+		Project struct {
+			WebURL string `json:"web_url"`
+		} `json:"project"`
+		Repository struct {
+			Homepage string `json:"homepage"`
+		} `json:"repository"`
+	}
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return ""
+	}
+	for _, s := range []string{p.Project.WebURL, p.Repository.Homepage} {
+		if u, err := url.Parse(s); err == nil && u.Host != "" {
+			return strings.ToLower(u.Host)
+		}
+	}
+	return ""
+}
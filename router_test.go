@@ -0,0 +1,111 @@
+package gitbot
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+//recordingService counts the events it receives
+type recordingService struct {
+	mut    sync.Mutex
+	events int
+}
+
+func (rs *recordingService) GitHook(ctx context.Context, logger log.Logger, data interface{}) []Outcome {
+	rs.mut.Lock()
+	defer rs.mut.Unlock()
+	rs.events++
+	return nil
+}
+
+func (rs *recordingService) GetErrors() chan error {
+	return nil
+}
+
+func (rs *recordingService) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+func (rs *recordingService) Events() int {
+	rs.mut.Lock()
+	defer rs.mut.Unlock()
+	return rs.events
+}
+
+func TestRouterRoutesByProjectHost(t *testing.T) {
+	logger := log.NewNopLogger()
+	company, public := &recordingService{}, &recordingService{}
+
+	rt := NewRouter(logger, nil)
+	rt.Add(Instance{Name: "company", GitURL: "https://gitlab.company.net/api/v4/"}.Host(), &Server{Service: company, Logger: logger, Instance: "company"})
+	rt.Add(Instance{Name: "com", GitURL: "https://gitlab.com/api/v4/"}.Host(), &Server{Service: public, Logger: logger, Instance: "com"})
+	hook := httptest.NewServer(rt)
+	defer hook.Close()
+
+	payload, err := ioutil.ReadFile(filepath.Join("testdata", "note_merge_request_comment.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Replay(hook.URL, "", "", payload); err != nil {
+		t.Fatal(err)
+	}
+
+	unknown := strings.Replace(string(payload), "gitlab.company.net", "gitlab.example.org", -1)
+	if err := Replay(hook.URL, "", "", []byte(unknown)); err == nil {
+		t.Error("webhook from an unknown host was accepted")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for company.Events() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if company.Events() != 1 || public.Events() != 0 {
+		t.Errorf("got %d events for gitlab.company.net and %d for gitlab.com, want 1 and 0", company.Events(), public.Events())
+	}
+}
+
+//filteringService is a recordingService handling a single repo
+type filteringService struct {
+	recordingService
+	repo string
+}
+
+func (fs *filteringService) HandlesRepo(repo string) bool {
+	return repo == fs.repo
+}
+
+func TestSystemHookDispatch(t *testing.T) {
+	logger := log.NewNopLogger()
+	svc := &filteringService{repo: "monitoring_group/test1"}
+	hook := httptest.NewServer(&Server{Service: svc, Logger: logger})
+	defer hook.Close()
+
+	payload, err := ioutil.ReadFile(filepath.Join("testdata", "merge_request.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := strings.Replace(string(payload), "monitoring_group/test1", "monitoring_group/other", -1)
+	created := `{"event_name":"project_create","path_with_namespace":"monitoring_group/test1","project_id":5}`
+	for _, p := range []string{string(payload), other, created} {
+		if err := Replay(hook.URL, "System Hook", "", []byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for svc.Events() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if svc.Events() != 1 {
+		t.Errorf("service received %d events, want only the merge request of its repo", svc.Events())
+	}
+}
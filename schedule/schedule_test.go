@@ -0,0 +1,87 @@
+package schedule
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestParseNext(t *testing.T) {
+	//a monday
+	from := time.Date(2017, 7, 3, 10, 7, 30, 0, time.UTC)
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"*/15 * * * *", time.Date(2017, 7, 3, 10, 15, 0, 0, time.UTC)},
+		{"0 2 * * *", time.Date(2017, 7, 4, 2, 0, 0, 0, time.UTC)},
+		{"30 8-18/2 * * 1-5", time.Date(2017, 7, 3, 10, 30, 0, 0, time.UTC)},
+		{"0 0 * * 0", time.Date(2017, 7, 9, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2017, 7, 9, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1,15 * *", time.Date(2017, 7, 15, 0, 0, 0, 0, time.UTC)},
+		//with both day fields restricted either one matches
+		{"0 0 1 * 3", time.Date(2017, 7, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2017, 7, 3, 11, 0, 0, 0, time.UTC)},
+		{"@every 90s", from.Add(90 * time.Second)},
+	}
+	for _, tt := range tests {
+		s, err := Parse(tt.spec)
+		if err != nil {
+			t.Errorf("%s: %s", tt.spec, err)
+			continue
+		}
+		if got := s.Next(from); !got.Equal(tt.want) {
+			t.Errorf("%s: got %s, want %s", tt.spec, got, tt.want)
+		}
+	}
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "0 0 0 * *", "*/0 * * * *", "5-1 * * * *", "@every -1m", "@sometimes"} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("%q was accepted", spec)
+		}
+	}
+}
+
+func TestSchedulerSkipsOverlapsAndIsolatesFailures(t *testing.T) {
+	s := New(log.NewNopLogger())
+
+	var mut sync.Mutex
+	slowRuns, failingRuns := 0, 0
+	s.Add("slow", Every(5*time.Millisecond), 0, func() error {
+		mut.Lock()
+		slowRuns++
+		mut.Unlock()
+		time.Sleep(30 * time.Millisecond)
+		return nil
+	})
+	s.Add("failing", Every(5*time.Millisecond), 0, func() error {
+		mut.Lock()
+		failingRuns++
+		mut.Unlock()
+		return errors.New("boom")
+	})
+	time.Sleep(100 * time.Millisecond)
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	st := s.Status()
+	if len(st) != 2 || st[0].Name != "failing" || st[1].Name != "slow" {
+		t.Fatalf("got status %+v, want the failing and slow jobs", st)
+	}
+	failing, slow := st[0], st[1]
+	if failing.Runs < 5 || failing.Failures != failing.Runs || failing.LastResult != "boom" || failing.Runs != failingRuns {
+		t.Errorf("got %+v after %d runs, want every run to fail", failing, failingRuns)
+	}
+	if slow.Runs != slowRuns || slow.Runs > 4 || slow.Skipped == 0 || slow.LastResult != "ok" || slow.Running {
+		t.Errorf("got %+v after %d runs, want the runs due while it ran to be skipped", slow, slowRuns)
+	}
+	if slow.LastRun == nil || slow.LastDuration == "" {
+		t.Errorf("got %+v, want the last run and its duration", slow)
+	}
+}
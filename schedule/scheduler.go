@@ -0,0 +1,232 @@
+package schedule
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cosminilie/gitbot/logging"
+	"github.com/go-kit/kit/log"
+)
+
+//Status of a job, served by the debug endpoint
+type Status struct {
+	Name     string `json:"name"`
+	Schedule string `json:"schedule"`
+	Jitter   string `json:"jitter,omitempty"`
+	Running  bool   `json:"running"`
+	//LastRun is when the last run started, LastDuration how long it took and LastResult is "ok" or its error
+	LastRun      *time.Time `json:"last_run,omitempty"`
+	LastDuration string     `json:"last_duration,omitempty"`
+	LastResult   string     `json:"last_result,omitempty"`
+	NextRun      *time.Time `json:"next_run,omitempty"`
+	Runs         int        `json:"runs"`
+	Failures     int        `json:"failures"`
+	//Skipped counts the runs that were due while the previous run was still running
+	Skipped int `json:"skipped"`
+}
+
+//job is a recurring handler with its status
+type job struct {
+	schedule Schedule
+	jitter   time.Duration
+	run      func() error
+	status   Status
+}
+
+//Scheduler runs each job on its own schedule. A job never overlaps with itself: the runs that are due while it is
+//still running are skipped. A failing job does not affect the others.
+type Scheduler struct {
+	logger log.Logger
+	mut    sync.Mutex
+	jobs   map[string]*job
+	stop   chan struct{}
+	once   sync.Once
+	wg     sync.WaitGroup
+}
+
+//New creates a scheduler without jobs
+func New(logger log.Logger) *Scheduler {
+	return &Scheduler{
+		logger: logger,
+		jobs:   make(map[string]*job),
+		stop:   make(chan struct{}),
+	}
+}
+
+//Add starts running fn on schedule, each run is delayed by a random duration up to jitter so that the jobs of
+//several bots or instances spread out. Jobs added after Stop never run.
+func (s *Scheduler) Add(name string, schedule Schedule, jitter time.Duration, fn func() error) {
+	j := &job{
+		schedule: schedule,
+		jitter:   jitter,
+		run:      fn,
+		status:   Status{Name: name, Schedule: fmt.Sprint(schedule)},
+	}
+	if jitter > 0 {
+		j.status.Jitter = jitter.String()
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	select {
+	case <-s.stop:
+		return
+	default:
+	}
+	s.jobs[name] = j
+	s.wg.Add(1)
+	go s.loop(j)
+}
+
+//Stop stops the jobs and waits for the running ones until ctx is done
+func (s *Scheduler) Stop(ctx context.Context) error {
+	s.once.Do(func() {
+		s.mut.Lock()
+		close(s.stop)
+		s.mut.Unlock()
+	})
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//Status returns the status of every job sorted by name
+func (s *Scheduler) Status() []Status {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	st := make([]Status, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		st = append(st, j.status)
+	}
+	sort.Slice(st, func(i, k int) bool {
+		return st[i].Name < st[k].Name
+	})
+	return st
+}
+
+//ServeHTTP serves the status of the jobs as JSON
+func (s *Scheduler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.Status())
+}
+
+//Handler serves the status of the jobs of several schedulers as JSON, keyed by the name of the scheduler
+func Handler(schedulers map[string]*Scheduler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st := make(map[string][]Status, len(schedulers))
+		for name, s := range schedulers {
+			st[name] = s.Status()
+		}
+		writeJSON(w, st)
+	})
+}
+
+//loop waits for the next run of j and runs it until the scheduler stops
+func (s *Scheduler) loop(j *job) {
+	defer s.wg.Done()
+	next := j.schedule.Next(time.Now())
+	for {
+		if next.IsZero() {
+			return
+		}
+		at := next
+		if j.jitter > 0 {
+			at = at.Add(time.Duration(rand.Int63n(int64(j.jitter))))
+		}
+		s.mut.Lock()
+		j.status.NextRun = &at
+		s.mut.Unlock()
+
+		timer := time.NewTimer(time.Until(at))
+		select {
+		case <-s.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		start := s.begin(j)
+		err := s.runJob(j)
+		end := time.Now()
+
+		//the runs that were due while this one ran are skipped
+		skipped := 0
+		for next = j.schedule.Next(next); !next.IsZero() && next.Before(end); next = j.schedule.Next(next) {
+			skipped++
+		}
+		s.finish(j, end.Sub(start), skipped, err)
+	}
+}
+
+//runJob runs j, a panic is reported as its error
+func (s *Scheduler) runJob(j *job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return j.run()
+}
+
+func (s *Scheduler) begin(j *job) time.Time {
+	start := time.Now()
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	j.status.Running = true
+	j.status.LastRun = &start
+	j.status.NextRun = nil
+	s.logger.Log(
+		"Action", "RecurringSchedule",
+		"handler", j.status.Name,
+	)
+	return start
+}
+
+func (s *Scheduler) finish(j *job, d time.Duration, skipped int, err error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	j.status.Running = false
+	j.status.LastDuration = d.String()
+	j.status.Runs++
+	j.status.Skipped += skipped
+	j.status.LastResult = "ok"
+	if err != nil {
+		j.status.Failures++
+		j.status.LastResult = err.Error()
+		logging.Error(s.logger).Log(
+			"Action", "RecurringSchedule",
+			"handler", j.status.Name,
+			"Duration", d,
+			"Error", err,
+		)
+	}
+	if skipped > 0 {
+		logging.Warn(s.logger).Log(
+			"Action", "RecurringSchedule",
+			"handler", j.status.Name,
+			"Duration", d,
+			"Skipped", skipped,
+		)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -1,52 +1,92 @@
 package gitbot
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"regexp"
 	"sync"
-	"time"
 
+	"github.com/cosminilie/gitbot/audit"
 	"github.com/cosminilie/gitbot/gitlabhook"
+	"github.com/cosminilie/gitbot/logging"
 	"github.com/cosminilie/gitbot/plugins"
+	"github.com/cosminilie/gitbot/schedule"
 
 	"github.com/go-kit/kit/log"
-	gitlab "github.com/xanzy/go-gitlab"
 )
 
 var (
 	fullRepo = regexp.MustCompile(`^[a-zA-Z0-9-]+(\/|\/\*)?$`)
-	//Right now we identify the boot hook URL by http://ip_addr:9091/hook
-	botHook        = regexp.MustCompile(`^http(s)?\:\/\/((25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)\.){3}(25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)\:9091\/hook$`)
+	//Right now we identify the boot hook URL by http://ip_addr:9091/hook or http://ip_addr:9091/hook/<instance>
+	botHook        = regexp.MustCompile(`^http(s)?\:\/\/((25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)\.){3}(25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)\:9091\/hook(\/[a-zA-Z0-9_.-]+)*$`)
 	errUnknownType = errors.New("can't decode gitlab event type")
 )
 
 // Service interface
 type Service interface {
-	GitHook(logger log.Logger, data interface{})
+	//GitHook handles a webhook event and returns the outcome of each plugin that ran. The plugins are cancelled when
+	//ctx is done.
+	GitHook(ctx context.Context, logger log.Logger, data interface{}) []Outcome
 	GetErrors() chan error
+	//Shutdown stops the scheduled handlers and waits for the running ones until ctx is done
+	Shutdown(ctx context.Context) error
 }
 
 //RecuringHandlers func
 type recuringHandlers func(s *basicService) error
 
-//NewBasicService creates a new basic service. It also performs the necesary steps to setup everything:
+//recurring are the handlers run on a schedule besides the group plugins, keyed by their name in the configuration
+var recurring = map[string]recuringHandlers{
+	"refresh_repos": refreshRepos,
+	"hooks":         addRepoEventHook,
+	"expire_grants": expireGrants,
+	"merge_queue":   advanceQueues,
+}
+
+//NewBasicService creates a new basic service for a GitLab instance. It also performs the necesary steps to setup everything:
 //* Expands groups repos to have a complete list of repos. Groups repos are then sent to grouphandlers while individual repos are handled by normal event or time based triggers.
-func NewBasicService(logger log.Logger, gcl *gitlab.Client, repos []plugins.Repo, defaultApprovers []string) *basicService {
+//The group handlers run on the schedule are cancelled when ctx is done. The access grants and the merge queues are kept in memory when grants
+//and queue are nil.
+func NewBasicService(ctx context.Context, logger log.Logger, gcl plugins.GitLabClient, al *audit.Log, grants *plugins.Grants, queue *plugins.MergeQueue, inst Instance) *basicService {
 
 	var pluginReposChan = make(chan plugins.Repo)
 	var groupReposChan = make(chan plugins.Repo)
 
 	logger = log.NewContext(logger).With("Context", "basic_service")
 
+	timeouts, err := inst.Timeouts()
+	if err != nil {
+		logging.Error(logger).Log(
+			"Action", "Timeouts",
+			"Error", err,
+		)
+	}
+	schedules, err := inst.JobSchedules()
+	if err != nil {
+		logging.Error(logger).Log(
+			"Action", "JobSchedules",
+			"Error", err,
+		)
+		schedules, _ = Instance{}.JobSchedules()
+	}
+
 	service := &basicService{
-		logger:  logger,
-		ErrorCh: make(chan error),
+		ctx:              ctx,
+		timeouts:         timeouts,
+		logger:           logger,
+		hookPath:         inst.Path(),
+		hookStrategy:     inst.Strategy(),
+		hook:             inst.Hook,
+		instance:         inst.Name,
+		repos:            inst.Repos,
+		defaultApprovers: inst.DefaultApprovers,
+		scheduler:        schedule.New(logger),
+		ErrorCh:          make(chan error, 1),
 	}
 
 	//Load repos and expand the groups. We also send groups to the groupReposChan while all repos(already completed ones) and the ones we expand from the group are sent to groupReposChan
 	go func() {
-		err := fanOutRepos(logger, gcl, repos, defaultApprovers, pluginReposChan, groupReposChan)
+		err := fanOutRepos(logger, gcl, inst.Repos, inst.DefaultApprovers, pluginReposChan, groupReposChan)
 		if err != nil {
 			service.sendError(err)
 			return
@@ -54,12 +94,15 @@ func NewBasicService(logger log.Logger, gcl *gitlab.Client, repos []plugins.Repo
 
 	}()
 
-	//load plugin agent
-	go func() {
-		plugin := plugins.NewPluginAgent(logger, gcl, pluginReposChan)
-		service.Plugins = plugin
-
-	}()
+	//load plugin agent. The agent loads repos from pluginReposChan in the background.
+	service.Plugins = plugins.NewPluginAgent(logger, gcl, pluginReposChan)
+	service.Plugins.Audit = al
+	if grants != nil {
+		service.Plugins.Grants = grants
+	}
+	if queue != nil {
+		service.Plugins.Queue = queue
+	}
 
 	//sets up group handlers
 	//This is a time intensive operation so we try to run this async and have the service return faster.
@@ -67,11 +110,16 @@ func NewBasicService(logger log.Logger, gcl *gitlab.Client, repos []plugins.Repo
 		setupGroupHandlers(service, groupReposChan)
 	}()
 
-	//start loop to periodic refresh.
-	go func() {
-		//TO DO: duration should be an global parameter from conf
-		service.scheduleHandlersEvery(1*time.Minute, groupHandlers, addRepoEventHook)
-	}()
+	//schedule the recurring handlers and the group plugins, each one on its own
+	for name, js := range schedules {
+		h, ok := recurring[name]
+		if !ok {
+			h = groupPluginHandler(name)
+		}
+		service.scheduler.Add(name, js.Schedule, js.Jitter, func() error {
+			return h(service)
+		})
+	}
 	return service
 }
 
@@ -79,8 +127,26 @@ func NewBasicService(logger log.Logger, gcl *gitlab.Client, repos []plugins.Repo
 type basicService struct {
 	Plugins *plugins.PluginAgent
 	logger  log.Logger
-	mut     sync.Mutex
-	ErrorCh chan error
+	//ctx is the parent of the contexts of the scheduled group handlers
+	ctx context.Context
+	//timeouts bound the time each plugin may take to handle an event or a group
+	timeouts PluginTimeouts
+	//hookPath is the path webhooks for this instance are received on
+	hookPath string
+	//hookStrategy is the kind of hooks registered to receive the events of the repos
+	hookStrategy string
+	hook         HookConfig
+	//instance is the name of the GitLab instance
+	instance string
+	//hookCleaned holds the repos covered by a group or system hook whose project hooks were already removed
+	hookCleaned map[string]bool
+	//repos and defaultApprovers are the configuration the groups are expanded from
+	repos            []plugins.Repo
+	defaultApprovers []string
+	mut              sync.Mutex
+	//scheduler runs the recurring handlers and the group plugins
+	scheduler *schedule.Scheduler
+	ErrorCh   chan error
 }
 
 //Runs an error channel that is used to fan out all the errors from basic service implementation
@@ -89,40 +155,50 @@ func (svc *basicService) GetErrors() chan error {
 }
 
 //GitHook is called on each git hook
-func (svc *basicService) GitHook(logger log.Logger, data interface{}) {
+func (svc *basicService) GitHook(ctx context.Context, logger log.Logger, data interface{}) []Outcome {
 	switch t := data.(type) {
 	case gitlabhook.MergeRequestCommentEvent:
-		err := svc.handleMergeRequestCommentEvent(logger, t)
-		svc.sendError(err)
+		logger = log.NewContext(logger).With("Repo", t.Project.PathWithNamespace, "MergeRequest", t.MergeRequest.IID)
+		outcomes, _ := svc.handleEvent(ctx, logger, plugins.MergeCommentEvent, t.Project.PathWithNamespace, t)
+		return outcomes
+	case gitlabhook.PushEvent:
+		logger = log.NewContext(logger).With("Repo", t.Project.PathWithNamespace, "Ref", t.Ref)
+		outcomes, _ := svc.handleEvent(ctx, logger, plugins.PushEvent, t.Project.PathWithNamespace, t)
+		return outcomes
+	case gitlabhook.PipelineEvent:
+		logger = log.NewContext(logger).With("Repo", t.Project.PathWithNamespace, "Pipeline", t.ObjectAttributes.ID)
+		outcomes, _ := svc.handleEvent(ctx, logger, plugins.PipelineEvent, t.Project.PathWithNamespace, t)
+		return outcomes
+	case gitlabhook.MergeRequestEvent:
+		logger = log.NewContext(logger).With("Repo", t.Project.PathWithNamespace, "MergeRequest", t.ObjectAttributes.IID)
+		outcomes, _ := svc.handleEvent(ctx, logger, plugins.MergeRequestEvent, t.Project.PathWithNamespace, t)
+		return outcomes
 	default:
-		logger.Log(
+		logging.Warn(logger).Log(
 			"Handler", "GitHook",
 			"Error", errUnknownType,
 		)
 	}
+	return nil
 }
 
-//utility functions to trigger periodic handlers.
-func (svc *basicService) scheduleHandlersEvery(d time.Duration, rh ...recuringHandlers) {
-	//https://golang.org/ref/spec#Passing_arguments_to_..._parameters
-	if rh == nil {
-		svc.sendError(errors.New("scheduleHandlersEvery, recurringHandlers is nil"))
-	}
-	for _ = range time.Tick(d) {
-		for _, h := range rh {
-			svc.logger.Log(
-				"Action", "RecurringSchedule",
-				"handler", fmt.Sprintf("%T", h),
-			)
-			if err := h(svc); err != nil {
-				svc.sendError(err)
-			}
-		}
+//HandlesRepo reports whether the repo is configured on this instance
+func (svc *basicService) HandlesRepo(repo string) bool {
+	return svc.Plugins.HasRepo(repo)
+}
 
-	}
+//Shutdown stops the scheduler. The running handlers complete, the following runs are skipped.
+func (svc *basicService) Shutdown(ctx context.Context) error {
+	return svc.scheduler.Stop(ctx)
+}
+
+//Scheduler returns the scheduler of the recurring handlers and the group plugins
+func (svc *basicService) Scheduler() *schedule.Scheduler {
+	return svc.scheduler
 }
 
-//sendError function used to send errors to the error channel
+//sendError sends a startup error to the error channel, they stop the bot. Only the first one is kept, the errors of
+//the plugins are logged and recorded in the outcomes of their event instead.
 func (svc *basicService) sendError(err error) {
 	select {
 	case svc.ErrorCh <- err:
@@ -130,21 +206,46 @@ func (svc *basicService) sendError(err error) {
 	}
 }
 
-//handleMergeRequestCommentEvent is called when new merge comment events happen
-func (svc *basicService) handleMergeRequestCommentEvent(logger log.Logger, se gitlabhook.MergeRequestCommentEvent) error {
-
-	for _, h := range svc.Plugins.MergeCommentEventHandlers(se.Project.PathWithNamespace) {
-		logger.Log(
-			"handler", "handleMergeRequestCommentEvent",
-			"ProjectName", se.Project.Name,
-			"Plugin", fmt.Sprintf("%T", h),
+//handleEvent runs the handlers the plugins of the repo registered for the event type, one after the other. It stops at
+//the first handler that fails.
+func (svc *basicService) handleEvent(ctx context.Context, logger log.Logger, t plugins.EventType, repo string, event interface{}) ([]Outcome, error) {
+	var outcomes []Outcome
+	for name, h := range svc.Plugins.Handlers(t, repo) {
+		plogger := log.NewContext(logger).With("Plugin", name)
+		logging.Debug(plogger).Log(
+			"handler", "handleEvent",
+			"Event", t,
 		)
-		pc := &svc.Plugins.PluginClient
-		//pc.Repos = s.Plugins.Repos
-		if err := h(pc, se); err != nil {
-			fmt.Println("Error handling handleMergeRequestCommentEvent.", err)
-			return err
+		if err := svc.runPlugin(ctx, plogger, name, func(ctx context.Context, pc *plugins.PluginClient) error {
+			return h(ctx, pc, event)
+		}); err != nil {
+			logging.Error(plogger).Log(
+				"handler", "handleEvent",
+				"Event", t,
+				"Error", err,
+			)
+			outcomes = append(outcomes, Outcome{Plugin: name, Error: err.Error()})
+			return outcomes, err
 		}
+		outcomes = append(outcomes, Outcome{Plugin: name})
 	}
-	return nil
+	return outcomes, nil
+}
+
+//runPlugin runs the handler of a plugin with the plugin timeout. The plugin client given to the handler logs to logger
+//and its GitLab calls stop once the handler context is done.
+func (svc *basicService) runPlugin(ctx context.Context, logger log.Logger, plugin string, h func(context.Context, *plugins.PluginClient) error) error {
+	ctx, cancel := context.WithTimeout(ctx, svc.timeouts.For(plugin))
+	defer cancel()
+
+	pc := svc.Plugins.PluginClient.WithLogger(logger).WithContext(ctx)
+	err := h(ctx, pc)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		logging.Warn(logger).Log(
+			"handler", "runPlugin",
+			"Timeout", svc.timeouts.For(plugin),
+			"Error", ctx.Err(),
+		)
+	}
+	return err
 }
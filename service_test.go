@@ -0,0 +1,165 @@
+package gitbot
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cosminilie/gitbot/gitlabfake"
+	"github.com/cosminilie/gitbot/gitlabhook"
+	"github.com/cosminilie/gitbot/logging"
+	"github.com/cosminilie/gitbot/plugins"
+	"github.com/cosminilie/gitbot/schedule"
+	"github.com/go-kit/kit/log"
+)
+
+func init() {
+	plugins.RegisterMergeCommentEventHandler("log-test", func(ctx context.Context, pc *plugins.PluginClient, e gitlabhook.MergeRequestCommentEvent) error {
+		logging.Info(pc.Logger).Log("msg", "handled")
+		return nil
+	})
+	plugins.RegisterMergeCommentEventHandler("slow-test", func(ctx context.Context, pc *plugins.PluginClient, e gitlabhook.MergeRequestCommentEvent) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+}
+
+//recordingLogger keeps the records logged with a msg
+type recordingLogger struct {
+	mut     sync.Mutex
+	records []map[string]string
+}
+
+func (rl *recordingLogger) Log(keyvals ...interface{}) error {
+	rec := make(map[string]string)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		rec[fmt.Sprint(keyvals[i])] = fmt.Sprint(keyvals[i+1])
+	}
+	rl.mut.Lock()
+	defer rl.mut.Unlock()
+	if _, ok := rec["msg"]; ok {
+		rl.records = append(rl.records, rec)
+	}
+	return nil
+}
+
+func TestPluginLoggerIsTagged(t *testing.T) {
+	gl := gitlabfake.New()
+	gl.AddProject("platform/api")
+	rl := &recordingLogger{}
+	svc := NewBasicService(context.Background(), rl, gl, nil, nil, nil, Instance{
+		Name:  DefaultInstance,
+		Repos: []plugins.Repo{{Name: "platform/api", Plugins: []string{"log-test"}}},
+	})
+	deadline := time.Now().Add(5 * time.Second)
+	for !svc.HandlesRepo("platform/api") {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the repos to be loaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var e gitlabhook.MergeRequestCommentEvent
+	e.Project.PathWithNamespace = "platform/api"
+	e.MergeRequest.IID = 3
+	svc.GitHook(context.Background(), log.NewContext(rl).With("Delivery", "d1"), e)
+
+	rl.mut.Lock()
+	defer rl.mut.Unlock()
+	want := map[string]string{"msg": "handled", "level": "info", "Delivery": "d1", "Repo": "platform/api", "MergeRequest": "3", "Plugin": "log-test"}
+	for _, rec := range rl.records {
+		if rec["msg"] != "handled" {
+			continue
+		}
+		for k, v := range want {
+			if rec[k] != v {
+				t.Errorf("got %s=%q in %v, want %q", k, rec[k], rec, v)
+			}
+		}
+		return
+	}
+	t.Errorf("the plugin record was not logged, got %v", rl.records)
+}
+
+func TestPluginTimeout(t *testing.T) {
+	gl := gitlabfake.New()
+	gl.AddProject("platform/api")
+	svc := NewBasicService(context.Background(), log.NewNopLogger(), gl, nil, nil, nil, Instance{
+		Name:           DefaultInstance,
+		PluginTimeouts: map[string]string{"slow-test": "20ms"},
+		Repos:          []plugins.Repo{{Name: "platform/api", Plugins: []string{"slow-test"}}},
+	})
+	deadline := time.Now().Add(5 * time.Second)
+	for !svc.HandlesRepo("platform/api") {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the repos to be loaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var e gitlabhook.MergeRequestCommentEvent
+	e.Project.PathWithNamespace = "platform/api"
+	outcomes := svc.GitHook(context.Background(), log.NewNopLogger(), e)
+	if len(outcomes) != 1 || outcomes[0].Error != context.DeadlineExceeded.Error() {
+		t.Errorf("got outcomes %+v, want the plugin to time out", outcomes)
+	}
+	//plugin errors do not stop the bot
+	select {
+	case err := <-svc.GetErrors():
+		t.Errorf("got %v on the error channel, want plugin errors only logged", err)
+	default:
+	}
+
+	//cancelling the event context stops the plugin before its timeout
+	svc.timeouts.Default, svc.timeouts.Plugins = time.Hour, nil
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	outcomes = svc.GitHook(ctx, log.NewNopLogger(), e)
+	if len(outcomes) != 1 || outcomes[0].Error != context.Canceled.Error() {
+		t.Errorf("got outcomes %+v, want the plugin to be cancelled", outcomes)
+	}
+}
+
+func TestStartupError(t *testing.T) {
+	svc := NewBasicService(context.Background(), log.NewNopLogger(), gitlabfake.New(), nil, nil, nil, Instance{
+		Name:  DefaultInstance,
+		Repos: []plugins.Repo{{Name: "missing/**", Plugins: []string{"lgtm"}}},
+	})
+	select {
+	case err := <-svc.GetErrors():
+		if err == nil {
+			t.Error("got a nil error for a group that does not exist")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("timed out waiting for the error expanding a group that does not exist")
+	}
+}
+
+func TestShutdownStopsScheduler(t *testing.T) {
+	svc := NewBasicService(context.Background(), log.NewNopLogger(), gitlabfake.New(), nil, nil, nil, Instance{Name: DefaultInstance})
+
+	runs := make(chan struct{}, 10)
+	release := make(chan struct{})
+	svc.Scheduler().Add("test", schedule.Every(time.Millisecond), 0, func() error {
+		runs <- struct{}{}
+		<-release
+		return nil
+	})
+	<-runs
+
+	//the running handler is waited for
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := svc.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("got %v while a handler runs, want %v", err, context.DeadlineExceeded)
+	}
+	close(release)
+	if err := svc.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 0 {
+		t.Errorf("the handler ran %d more times after Shutdown", len(runs))
+	}
+}
@@ -7,65 +7,120 @@ import (
 
 	"github.com/cosminilie/gitbot/plugins"
 	"github.com/go-kit/kit/log"
-
 	gitlab "github.com/xanzy/go-gitlab"
 )
 
-func fanOutRepos(logger log.Logger, cl *gitlab.Client, repos []plugins.Repo, defaultApprovers []string, reposChan chan plugins.Repo, groupReposChan chan plugins.Repo) error {
+//fanOutRepos expands the configured repos and sends the projects to reposChan and the groups to groupReposChan
+func fanOutRepos(logger log.Logger, cl plugins.GitLabClient, repos []plugins.Repo, defaultApprovers []string, reposChan chan plugins.Repo, groupReposChan chan plugins.Repo) error {
 	defer func() {
 		close(reposChan)
 		close(groupReposChan)
 	}()
-	for _, r := range repos {
 
-		if fullRepo.MatchString(r.Name) {
+	projects, groups, err := expandRepos(logger, cl, repos, defaultApprovers)
+	for _, g := range groups {
+		groupReposChan <- g
+	}
+	for _, p := range projects {
+		reposChan <- p
+	}
+	return err
+}
 
-			//cleanup namespace
-			s := r.Name
-			s = strings.TrimSuffix(s, "/*")
-			s = strings.TrimSuffix(s, "/")
-			//found a group, sent to global handlers
+//expandRepos resolves the repo patterns of the configuration to the projects they apply to. Each project gets the
+//plugins and approvers of the most specific block matching it. It also returns the groups whose group handlers have
+//to run. On error the projects and groups found so far are returned.
+func expandRepos(logger log.Logger, cl plugins.GitLabClient, repos []plugins.Repo, defaultApprovers []string) ([]plugins.Repo, []plugins.Repo, error) {
+	var (
+		patterns []repoPattern
+		paths    []string
+		groups   []plugins.Repo
+		seen     = make(map[string]bool)
+		seenGrp  = make(map[string]bool)
+		err      error
+	)
+	addPath := func(p string) {
+		if !seen[p] {
+			seen[p] = true
+			paths = append(paths, p)
+		}
+	}
 
+	for _, r := range repos {
+		p := parseRepoPattern(r)
+		patterns = append(patterns, p)
+		switch {
+		case p.exclude:
+		case p.exact():
+			addPath(p.base)
+		case err == nil:
 			logger.Log(
 				"FanOutRepos", "groupRepos",
-				"Repo", s,
+				"Repo", r.Name,
+				"Group", p.base,
+				"Recursive", p.recursive,
 			)
-			//send top level repos to groupReposChan
-			r.Name = s
-			groupReposChan <- r
-
-			//get members
-			pr, _, err := cl.Groups.ListGroupProjects(s)
-			if err != nil {
-				return err
-			}
-			if len(pr) > 0 {
-				for _, p := range pr {
-					//create new repo struct
-					rep := plugins.Repo{
-						Name:      strings.Replace(p.NameWithNamespace, " ", "", -1),
-						Plugins:   r.Plugins,
-						Approvers: append(r.Approvers, defaultApprovers...),
+			err = walkGroup(cl, p.base, p.recursive, func(group string, pr *gitlab.Project) {
+				if pr == nil {
+					//found a group, sent to global handlers
+					if p.group && !seenGrp[group] {
+						seenGrp[group] = true
+						groups = append(groups, plugins.Repo{Name: group, Plugins: r.Plugins, Approvers: r.Approvers, DropRights: r.DropRights, ProtectedBranches: r.ProtectedBranches})
 					}
-					logger.Log(
-						"Handler", "fan_out_repos",
-						"ProjectName", rep.Name,
-						"Aprovers", strings.Join(rep.Approvers, " "),
-						"Plugin", strings.Join(rep.Plugins, " "),
-					)
-
-					//append to existing list
-					reposChan <- rep
-
+					return
 				}
-			}
+				//archived projects are read only, nothing for the bot to do
+				if p.match(pr.PathWithNamespace) && !pr.Archived {
+					addPath(pr.PathWithNamespace)
+				}
+			})
+		}
+	}
+
+	var projects []plugins.Repo
+	for _, name := range paths {
+		p, ok := resolve(patterns, name)
+		if !ok {
+			logger.Log(
+				"Handler", "fan_out_repos",
+				"ProjectName", name,
+				"Action", "Excluded",
+			)
 			continue
 		}
-		//don't need to expand
-		r.Approvers = append(r.Approvers, defaultApprovers...)
-		reposChan <- r
+		rep := plugins.Repo{
+			Name:           name,
+			Plugins:        p.repo.Plugins,
+			Approvers:      append(append([]string(nil), p.repo.Approvers...), defaultApprovers...),
+			RequiredChecks: p.repo.RequiredChecks,
+			Policy:         p.repo.Policy,
+		}
+		logger.Log(
+			"Handler", "fan_out_repos",
+			"ProjectName", rep.Name,
+			"Pattern", p.repo.Name,
+			"Aprovers", strings.Join(rep.Approvers, " "),
+			"Plugin", strings.Join(rep.Plugins, " "),
+		)
+		projects = append(projects, rep)
+	}
+	return projects, groups, err
+}
+
+//walkGroup calls fn with a nil project for the group and then for each of its projects, following every page.
+//When recursive is set the subgroups are walked as well.
+func walkGroup(cl plugins.GitLabClient, group string, recursive bool, fn func(group string, p *gitlab.Project)) error {
+	fn(group, nil)
+	err := plugins.ForEachGroupProject(cl, group, func(p *gitlab.Project) error {
+		fn(group, p)
+		return nil
+	})
+	if err != nil || !recursive {
+		return err
 	}
-	return nil
+	return plugins.ForEachSubgroup(cl, group, func(g *plugins.Group) error {
+		return walkGroup(cl, g.FullPath, true, fn)
+	})
 }
 
 //taken from util/helper.go